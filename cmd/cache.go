@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/asherda/lightwalletd/common"
+	"github.com/asherda/lightwalletd/common/snapshot"
+	"github.com/asherda/lightwalletd/frontend"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// cacheCmd groups the commands that work on the block cache while
+// lightwalletd isn't running.
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the block cache offline",
+	Long: `Manage the block cache. These commands open the cache database
+directly, so lightwalletd must not be running. Like the server, they take
+their settings from the config file and environment as well as flags.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// These keys are bound to the server's flags otherwise.
+		for _, name := range cacheConfigFlags {
+			viper.BindPFlag(name, cmd.Flags().Lookup(name))
+		}
+	},
+}
+
+// cacheConfigFlags are the cache commands' flags that are also server
+// settings (see rootCmd).
+var cacheConfigFlags = []string{"data-dir", "verus-conf-path", "rpcuser", "rpcpassword", "rpchost", "rpcport"}
+
+// cacheVerifyCmd represents the cache verify command
+var cacheVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the block cache for damaged blocks",
+	Long: `Check every block in the cache: its checksum, that it's stored at its own
+height, that there are no missing heights, and that each block's prevHash is
+the hash of the block before it. With --repair, fetch the damaged blocks from
+zcashd and rewrite only those. Exits with status 1 if damage remains.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		repair, _ := cmd.Flags().GetBool("repair")
+		db := openCacheDB(&opt.Options{ReadOnly: !repair, ErrorIfMissing: true})
+		defer db.Close()
+
+		report, err := common.VerifyCacheDB(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		printCacheReport(report)
+		if repair && len(report.Problems) > 0 {
+			backend, err := connectRPC()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error: connecting to zcashd:", err)
+				os.Exit(1)
+			}
+			repaired, err := common.RepairCacheDB(context.Background(), backend, db, report)
+			fmt.Println("Repaired", len(repaired), "blocks")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			if report, err = common.VerifyCacheDB(db); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			fmt.Println("After repair:")
+			printCacheReport(report)
+		}
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// cacheExportCmd represents the cache export command
+var cacheExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write the block cache to a snapshot file",
+	Long: `Write a range of the block cache (by default, all of it) to a snapshot: a
+compressed, checksummed file that "cache import" can load into another
+lightwalletd's cache, so it doesn't have to download the blocks from zcashd.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		db := openCacheDB(&opt.Options{ReadOnly: true, ErrorIfMissing: true})
+		defer db.Close()
+		cache, err := common.OpenBlockCache(db, true)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		start, _ := cmd.Flags().GetInt("start")
+		end, _ := cmd.Flags().GetInt("end")
+		if start < 0 {
+			start = cache.GetFirstHeight()
+		}
+		if end < 0 {
+			end = cache.GetLatestHeight()
+		}
+		output, _ := cmd.Flags().GetString("output")
+		out := os.Stdout
+		if output != "-" {
+			if out, err = os.Create(output); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+		}
+		w := bufio.NewWriter(out)
+		err = cache.ExportSnapshot(w, start, end)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil && output != "-" {
+			err = out.Close()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			if output != "-" {
+				os.Remove(output)
+			}
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Exported blocks %d to %d\n", start, end)
+	},
+}
+
+// cacheImportCmd represents the cache import command
+var cacheImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Add the blocks in a snapshot file to the block cache",
+	Long: `Add the blocks in a snapshot written by "cache export" to the block cache.
+The snapshot must be for the same chain, and start at the height after the
+cache's latest block (or the cache must be empty). Nothing is added unless
+the whole snapshot is intact, its blocks link to each other and to the
+cache, and they agree with the --checkpoints given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		input, _ := cmd.Flags().GetString("input")
+		in := os.Stdin
+		if input != "-" {
+			var err error
+			if in, err = os.Open(input); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			defer in.Close()
+		}
+		sr, err := snapshot.NewReader(bufio.NewReader(in))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		header := sr.Header()
+
+		// The built-in checkpoints are by zcashd's chain name, which isn't
+		// known offline, so only those given here are checked.
+		specs, _ := cmd.Flags().GetStringSlice("checkpoints")
+		extraCheckpoints, err := common.ParseCheckpoints(specs)
+		if err == nil {
+			err = common.SetCheckpoints("", extraCheckpoints)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
+		dataDir, _ := cmd.Flags().GetString("data-dir")
+		if err := os.MkdirAll(filepath.Join(dataDir, "db"), 0755); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		db := openCacheDB(nil)
+		defer db.Close()
+		cache, err := common.OpenBlockCache(db, false)
+		if err == common.ErrNoCache {
+			cache = common.NewBlockCache(db, header.ChainID, int(header.StartHeight), false)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		count, err := cache.ImportSnapshot(sr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d blocks, %d to %d\n", count, header.StartHeight, header.EndHeight)
+	},
+}
+
+func printCacheReport(r *common.CacheReport) {
+	fmt.Printf("Chain %q: blocks %d to %d, %d checked\n",
+		r.ChainID, r.FirstHeight, r.NextHeight-1, r.Checked)
+	for _, p := range r.Problems {
+		fmt.Printf("  height %d: %s\n", p.Height, p.Reason)
+	}
+	if len(r.Problems) == 0 {
+		fmt.Println("No problems found")
+	} else {
+		fmt.Println(len(r.DamagedHeights()), "damaged blocks")
+	}
+}
+
+// openCacheDB opens the cache database in the data-dir directory.
+func openCacheDB(o *opt.Options) *leveldb.DB {
+	dbPath := filepath.Join(viper.GetString("data-dir"), "db")
+	db, err := leveldb.OpenFile(dbPath, o)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: can't open the block cache %s (lightwalletd must not be running): %v\n", dbPath, err)
+		os.Exit(1)
+	}
+	return db
+}
+
+// connectRPC returns a backend for zcashd, using the rpc* settings if
+// they're all given, else the verus-conf-path file.
+func connectRPC() (common.NodeBackend, error) {
+	opts := &common.Options{
+		RPCUser:       viper.GetString("rpcuser"),
+		RPCPassword:   viper.GetString("rpcpassword"),
+		RPCHost:       viper.GetString("rpchost"),
+		RPCPort:       viper.GetString("rpcport"),
+		VerusConfPath: viper.GetString("verus-conf-path"),
+	}
+	var rpcClient *rpcclient.Client
+	var err error
+	if opts.RPCUser != "" && opts.RPCPassword != "" && opts.RPCHost != "" && opts.RPCPort != "" {
+		rpcClient, err = frontend.NewZRPCFromFlags(opts)
+	} else {
+		rpcClient, err = frontend.NewZRPCFromConf(opts.VerusConfPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return common.NewRPCBackend(rpcClient.RawRequest), nil
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	cacheCmd.AddCommand(cacheExportCmd)
+	cacheCmd.AddCommand(cacheImportCmd)
+	cacheCmd.PersistentFlags().String("data-dir", "/var/lib/lightwalletd", "data directory (such as db)")
+	cacheCmd.PersistentFlags().String("verus-conf-path", "./VRSC.conf", "conf file to pull RPC creds from")
+	cacheCmd.PersistentFlags().String("rpcuser", "", "RPC user name")
+	cacheCmd.PersistentFlags().String("rpcpassword", "", "RPC password")
+	cacheCmd.PersistentFlags().String("rpchost", "", "RPC host")
+	cacheCmd.PersistentFlags().String("rpcport", "", "RPC host port")
+	cacheVerifyCmd.Flags().Bool("repair", false, "re-fetch damaged blocks from zcashd")
+	cacheExportCmd.Flags().StringP("output", "o", "-", "snapshot file to write (- for standard output)")
+	cacheExportCmd.Flags().Int("start", -1, "height of the first block to export (default the cache's first block)")
+	cacheExportCmd.Flags().Int("end", -1, "height of the last block to export (default the cache's latest block)")
+	cacheImportCmd.Flags().StringP("input", "i", "-", "snapshot file to read (- for standard input)")
+	cacheImportCmd.Flags().StringSlice("checkpoints", []string{}, "blocks that must be in the chain, as height:hash (big-endian)")
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,17 +17,23 @@ import (
 	"github.com/btcsuite/btcd/rpcclient"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 
 	"github.com/asherda/lightwalletd/common"
+	"github.com/asherda/lightwalletd/common/compression"
 	"github.com/asherda/lightwalletd/common/logging"
+	"github.com/asherda/lightwalletd/common/ratelimit"
+	"github.com/asherda/lightwalletd/common/tracing"
 	"github.com/asherda/lightwalletd/frontend"
 	"github.com/asherda/lightwalletd/walletrpc"
 )
@@ -52,6 +61,12 @@ var rootCmd = &cobra.Command{
 			RPCPassword:         viper.GetString("rpcpassword"),
 			RPCHost:             viper.GetString("rpchost"),
 			RPCPort:             viper.GetString("rpcport"),
+			RPCEndpoints:        viper.GetStringSlice("rpc-endpoints"),
+			RPCEndpointMaxLag:   viper.GetInt("rpc-endpoint-max-lag"),
+			RPCRecordFile:       viper.GetString("rpc-record"),
+			ValidateBlocks:      viper.GetBool("validate-blocks"),
+			ValidatePoW:         viper.GetBool("validate-pow"),
+			Checkpoints:         viper.GetStringSlice("checkpoints"),
 			NoTLSVeryInsecure:   viper.GetBool("no-tls-very-insecure"),
 			GenCertVeryInsecure: viper.GetBool("gen-cert-very-insecure"),
 			DataDir:             viper.GetString("data-dir"),
@@ -59,6 +74,37 @@ var rootCmd = &cobra.Command{
 			PingEnable:          viper.GetBool("ping-very-insecure"),
 			Darkside:            viper.GetBool("darkside-very-insecure"),
 			DarksideTimeout:     viper.GetUint64("darkside-timeout"),
+			RateLimit:           viper.GetFloat64("rate-limit"),
+			RateLimitBurst:      viper.GetFloat64("rate-limit-burst"),
+			RateLimitBlockCost:  viper.GetFloat64("rate-limit-block-cost"),
+			RateLimitCosts:      viper.GetString("rate-limit-costs"),
+			RateLimitAPIKeys:    viper.GetStringSlice("rate-limit-api-keys"),
+			RateLimitKeyRate:    viper.GetFloat64("rate-limit-api-key-rate"),
+			RateLimitKeyBurst:   viper.GetFloat64("rate-limit-api-key-burst"),
+			MaxClientStreams:    viper.GetInt("max-client-streams"),
+			MaxBlockRange:       viper.GetInt("max-block-range"),
+			Compression:         viper.GetStringSlice("grpc-compression"),
+			CompressionLevel:    viper.GetString("grpc-compression-level"),
+			TLSMinVersion:       viper.GetString("tls-min-version"),
+			TLSCipherSuites:     viper.GetStringSlice("tls-cipher-suites"),
+			TLSReloadInterval:   viper.GetInt("tls-reload-interval"),
+			ShutdownTimeout:     viper.GetInt("shutdown-timeout"),
+			ReadyMaxLag:         viper.GetInt("ready-max-lag"),
+			DaemonTimeout:       viper.GetInt("daemon-unreachable-timeout"),
+			TracingExporter:     viper.GetString("tracing-exporter"),
+			TracingEndpoint:     viper.GetString("tracing-otlp-endpoint"),
+			TracingInsecure:     viper.GetBool("tracing-otlp-insecure"),
+			TracingSampleRatio:  viper.GetFloat64("tracing-sample-ratio"),
+			LogAnonymization:    viper.GetString("log-peer-anonymization"),
+			LogAnonymizeKeyFile: viper.GetString("log-peer-key-file"),
+			AdminBindAddr:       viper.GetString("admin-bind-addr"),
+			AdminTokenFile:      viper.GetString("admin-token-file"),
+			Replica:             viper.GetBool("replica"),
+			ReplicaUpstream:     viper.GetString("replica-upstream"),
+			ReplicaInsecure:     viper.GetBool("replica-upstream-insecure"),
+			ReplicaReadOnly:     viper.GetBool("replica-read-only"),
+			UpstreamBackend:     viper.GetString("upstream-backend"),
+			UpstreamInsecure:    viper.GetBool("upstream-backend-insecure"),
 		}
 
 		common.Log.Debugf("Options: %#v\n", opts)
@@ -69,7 +115,7 @@ var rootCmd = &cobra.Command{
 		if !fileExists(opts.LogFile) {
 			os.OpenFile(opts.LogFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 		}
-		if !opts.Darkside && (opts.RPCUser == "" || opts.RPCPassword == "" || opts.RPCHost == "" || opts.RPCPort == "") {
+		if !opts.Darkside && !opts.Replica && opts.UpstreamBackend == "" && (opts.RPCUser == "" || opts.RPCPassword == "" || (len(opts.RPCEndpoints) == 0 && (opts.RPCHost == "" || opts.RPCPort == ""))) {
 			filesThatShouldExist = append(filesThatShouldExist, opts.VerusConfPath)
 		}
 		if !opts.NoTLSVeryInsecure && !opts.GenCertVeryInsecure {
@@ -125,32 +171,96 @@ func startServer(opts *common.Options) error {
 	}).Infof("Starting gRPC server version %s on %s", common.Version, opts.GRPCBindAddr)
 
 	logging.LogToStderr = opts.GRPCLogging
+	anonymizer, err := logging.NewAnonymizer(opts.LogAnonymization, opts.LogAnonymizeKeyFile)
+	if err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("couldn't configure peer address anonymization")
+	}
+	logging.SetAnonymizer(anonymizer)
 
 	// gRPC initialization
 	var server *grpc.Server
+	var transportCreds credentials.TransportCredentials // nil without TLS
+
+	// The compressors must be registered before any gRPC connection is made.
+	compressor, err := compression.New(compression.Config{
+		Algorithms: opts.Compression,
+		Level:      opts.CompressionLevel,
+	})
+	if err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("couldn't configure compression")
+	}
+	common.Compressors = compressor.Algorithms()
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		logging.LogInterceptor,
+		grpc_prometheus.UnaryServerInterceptor,
+		common.BytesServedUnaryInterceptor,
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		logging.LogStreamInterceptor,
+		grpc_prometheus.StreamServerInterceptor,
+		common.BytesServedStreamInterceptor,
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		Exporter:     opts.TracingExporter,
+		OTLPEndpoint: opts.TracingEndpoint,
+		OTLPInsecure: opts.TracingInsecure,
+		SampleRatio:  opts.TracingSampleRatio,
+		Version:      common.Version,
+	})
+	if err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("couldn't configure tracing")
+	}
+	if opts.TracingExporter != tracing.ExporterNone {
+		// Tracing comes first so the other interceptors' work is part of each call's span.
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{tracing.UnaryServerInterceptor()},
+			unaryInterceptors...)
+		streamInterceptors = append([]grpc.StreamServerInterceptor{tracing.StreamServerInterceptor()},
+			streamInterceptors...)
+	}
+	if opts.RateLimit > 0 || opts.MaxClientStreams > 0 {
+		limiter, err := newRateLimiter(opts)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("couldn't configure rate limiting")
+		}
+		unaryInterceptors = append(unaryInterceptors, limiter.UnaryInterceptor)
+		streamInterceptors = append(streamInterceptors, limiter.StreamInterceptor)
+	}
+	unaryInterceptors = append(unaryInterceptors, compressor.UnaryInterceptor)
+	streamInterceptors = append(streamInterceptors, compressor.StreamInterceptor)
+	serverOpts := []grpc.ServerOption{
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
+		grpc.StatsHandler(compressor.StatsHandler()),
+	}
 
 	if opts.NoTLSVeryInsecure {
 		common.Log.Warningln("Starting insecure no-TLS (plaintext) server")
 		fmt.Println("Starting insecure server")
-		server = grpc.NewServer(
-			grpc.StreamInterceptor(
-				grpc_middleware.ChainStreamServer(
-					grpc_prometheus.StreamServerInterceptor),
-			),
-			grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-				logging.LogInterceptor,
-				grpc_prometheus.UnaryServerInterceptor),
-			))
+		server = grpc.NewServer(serverOpts...)
 	} else {
-		var transportCreds credentials.TransportCredentials
+		tlsConfig, err := common.NewTLSConfig(opts.TLSMinVersion, opts.TLSCipherSuites)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("invalid TLS configuration")
+		}
 		if opts.GenCertVeryInsecure {
 			common.Log.Warning("Certificate and key not provided, generating self signed values")
 			fmt.Println("Starting insecure self-certificate server")
 			tlsCert := common.GenerateCerts()
-			transportCreds = credentials.NewServerTLSFromCert(tlsCert)
+			common.SetCertificateExpiry(tlsCert)
+			tlsConfig.Certificates = []tls.Certificate{*tlsCert}
 		} else {
-			var err error
-			transportCreds, err = credentials.NewServerTLSFromFile(opts.TLSCertPath, opts.TLSKeyPath)
+			reloader, err := common.NewCertReloader(opts.TLSCertPath, opts.TLSKeyPath)
 			if err != nil {
 				common.Log.WithFields(logrus.Fields{
 					"cert_file": opts.TLSCertPath,
@@ -158,20 +268,30 @@ func startServer(opts *common.Options) error {
 					"error":     err,
 				}).Fatal("couldn't load TLS credentials")
 			}
+			tlsConfig.GetCertificate = reloader.GetCertificate
+			if opts.TLSReloadInterval > 0 {
+				go reloader.Watch(context.Background(), time.Duration(opts.TLSReloadInterval)*time.Second)
+			}
+			// Reload the certificate on SIGHUP as well.
+			hangups := make(chan os.Signal, 1)
+			signal.Notify(hangups, syscall.SIGHUP)
+			go func() {
+				for range hangups {
+					if err := reloader.Reload(); err != nil {
+						common.Log.WithFields(logrus.Fields{
+							"cert_file": opts.TLSCertPath,
+							"key_path":  opts.TLSKeyPath,
+							"error":     err,
+						}).Warning("couldn't reload TLS credentials, keeping the previous ones")
+					}
+				}
+			}()
 		}
-		server = grpc.NewServer(
-			grpc.Creds(transportCreds),
-			grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-				grpc_prometheus.StreamServerInterceptor),
-			),
-			grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-				logging.LogInterceptor,
-				grpc_prometheus.UnaryServerInterceptor),
-			))
+		transportCreds = credentials.NewTLS(tlsConfig)
+		server = grpc.NewServer(append(serverOpts, grpc.Creds(transportCreds))...)
 	}
 	grpc_prometheus.EnableHandlingTimeHistogram()
 	grpc_prometheus.Register(server)
-	go startHTTPServer(opts)
 
 	// Enable reflection for debugging
 	if opts.LogLevel >= uint64(logrus.WarnLevel) {
@@ -186,9 +306,99 @@ func startServer(opts *common.Options) error {
 	var chainName string
 	var chainID string
 	var rpcClient *rpcclient.Client
-	var err error
+	var upstream walletrpc.CompactTxStreamerClient
+	var backend common.NodeBackend
+	var failover *common.FailoverBackend
+	if opts.Replica && opts.UpstreamBackend != "" {
+		common.Log.Fatal("--replica and --upstream-backend can't be used together")
+	}
+	common.BlockValidation = common.BlockChecks{
+		MerkleRoot:  opts.ValidateBlocks,
+		Time:        opts.ValidateBlocks,
+		ProofOfWork: opts.ValidatePoW,
+	}
+	common.MaxBlockRange = opts.MaxBlockRange
+	// instrument adds metrics, and with --rpc-record, recording, to a
+	// function that makes zcashd RPCs.
+	instrument := func(rawRequest func(method string, params []json.RawMessage) (json.RawMessage, error)) func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		return common.InstrumentRawRequest(rawRequest)
+	}
+	if opts.RPCRecordFile != "" {
+		recordFile, err := os.OpenFile(opts.RPCRecordFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("couldn't open the RPC recording file")
+		}
+		defer recordFile.Close()
+		instrument = func(rawRequest func(method string, params []json.RawMessage) (json.RawMessage, error)) func(method string, params []json.RawMessage) (json.RawMessage, error) {
+			return common.InstrumentRawRequest(common.RecordRawRequest(rawRequest, recordFile))
+		}
+	}
 	if opts.Darkside {
 		chainName = "darkside"
+		backend = common.DarksideBackend
+	} else if opts.Replica {
+		// A replica has no zcashd; it gets everything from its upstream.
+		if opts.ReplicaUpstream == "" {
+			common.Log.Fatal("--replica requires --replica-upstream")
+		}
+		conn, err := frontend.DialUpstream(opts.ReplicaUpstream, opts.ReplicaInsecure)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"upstream": opts.ReplicaUpstream,
+				"error":    err,
+			}).Fatal("setting up connection to upstream lightwalletd")
+		}
+		upstream = walletrpc.NewCompactTxStreamerClient(conn)
+		backend = common.NewRPCBackend(common.ReplicaRawRequest)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		getLightdInfo, err := upstream.GetLightdInfo(ctx, &walletrpc.Empty{})
+		cancel()
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"upstream": opts.ReplicaUpstream,
+				"error":    err,
+			}).Fatal("getting initial information from upstream lightwalletd")
+		}
+		common.Log.Info("Replica of ", opts.ReplicaUpstream,
+			": sapling height ", getLightdInfo.SaplingActivationHeight,
+			" block height ", getLightdInfo.BlockHeight,
+			" chain ", getLightdInfo.ChainName)
+		saplingHeight = int(getLightdInfo.SaplingActivationHeight)
+		chainName = getLightdInfo.ChainName
+		chainID = getLightdInfo.ChainID
+	} else if opts.UpstreamBackend != "" {
+		// Get what zcashd would provide from another lightwalletd.
+		conn, err := frontend.DialUpstream(opts.UpstreamBackend, opts.UpstreamInsecure)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"upstream": opts.UpstreamBackend,
+				"error":    err,
+			}).Fatal("setting up connection to upstream lightwalletd")
+		}
+		upstream = walletrpc.NewCompactTxStreamerClient(conn)
+		backend = common.NewUpstreamBackend(upstream)
+	} else if len(opts.RPCEndpoints) > 0 {
+		// Fail over between several zcashd nodes.
+		rpcClients, err := frontend.NewZRPCEndpoints(opts)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("setting up RPC connections to zcashd")
+		}
+		endpoints := make([]common.DaemonEndpoint, len(rpcClients))
+		for i, client := range rpcClients {
+			endpoints[i] = common.DaemonEndpoint{
+				Name:    opts.RPCEndpoints[i],
+				Backend: common.NewRPCBackend(instrument(client.RawRequest)),
+			}
+		}
+		failover = common.NewFailoverBackend(endpoints, opts.RPCEndpointMaxLag)
+		// Choose the primary by the endpoints' tips before it's first used.
+		failover.Check(context.Background())
+		backend = failover
 	} else {
 		if opts.RPCUser != "" && opts.RPCPassword != "" && opts.RPCHost != "" && opts.RPCPort != "" {
 			rpcClient, err = frontend.NewZRPCFromFlags(opts)
@@ -200,13 +410,37 @@ func startServer(opts *common.Options) error {
 				"error": err,
 			}).Fatal("setting up RPC connection to zcashd")
 		}
-		// Indirect function for test mocking (so unit tests can talk to stub functions).
-		common.RawRequest = rpcClient.RawRequest
+		backend = common.NewRPCBackend(instrument(rpcClient.RawRequest))
+	}
+
+	// The health service reports NOT_SERVING until the cache has synced.
+	// A read-only replica's cache doesn't grow, so it can't fall behind.
+	maxLag := opts.ReadyMaxLag
+	if opts.Replica && opts.ReplicaReadOnly {
+		maxLag = -1
+	}
+	healthMonitor := common.NewHealthMonitor(backend, maxLag,
+		time.Duration(opts.DaemonTimeout)*time.Second)
+	healthpb.RegisterHealthServer(server, healthMonitor.Server())
+	httpServer := startHTTPServer(opts, healthMonitor)
+
+	if opts.Replica {
+		healthMonitor.SetDaemonHeightFunc(func() (int, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			latest, err := upstream.GetLatestBlock(ctx, &walletrpc.ChainSpec{})
+			if err != nil {
+				return 0, err
+			}
+			return int(latest.Height), nil
+		})
+	}
 
+	if !opts.Darkside && !opts.Replica {
 		// Ensure that we can communicate with zcashd
-		common.FirstRPC()
+		common.FirstRPC(backend)
 
-		getLightdInfo, err := common.GetLightdInfo()
+		getLightdInfo, err := common.GetLightdInfo(context.Background(), backend)
 		if err != nil {
 			common.Log.WithFields(logrus.Fields{
 				"error": err,
@@ -221,6 +455,26 @@ func startServer(opts *common.Options) error {
 		chainID = getLightdInfo.ChainID
 	}
 
+	if !opts.Darkside {
+		extraCheckpoints, err := common.ParseCheckpoints(opts.Checkpoints)
+		if err == nil {
+			err = common.SetCheckpoints(chainName, extraCheckpoints)
+		}
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("invalid checkpoints")
+		}
+	}
+	if !opts.Darkside && !opts.Replica && opts.UpstreamBackend == "" {
+		// Refuse to serve a chain that contradicts a checkpoint.
+		if err := common.VerifyCheckpoints(context.Background(), backend); err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("zcashd's chain doesn't match the checkpoints")
+		}
+	}
+
 	dbPath := filepath.Join(opts.DataDir, "db")
 	if opts.Darkside {
 		os.RemoveAll(filepath.Join(dbPath, chainName))
@@ -235,21 +489,70 @@ func startServer(opts *common.Options) error {
 		os.Exit(1)
 	}
 
-	// leveldb instances are safe for concurrent use.
-	db, err := leveldb.OpenFile(dbPath, nil)
-	defer db.Close()
+	// leveldb instances are safe for concurrent use. A read-only replica
+	// shares the database with other replicas, so it must not change it.
+	readOnly := opts.Replica && opts.ReplicaReadOnly
+	db, err := leveldb.OpenFile(dbPath, &opt.Options{ReadOnly: readOnly, ErrorIfMissing: readOnly})
+	if err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"db_path": dbPath,
+			"error":   err,
+		}).Fatal("couldn't open block cache database")
+	}
 
-	cache := common.NewBlockCache(db, chainID, saplingHeight, opts.Redownload)
-	if !opts.Darkside {
-		go common.BlockIngestor(cache, 0 /*loop forever*/)
+	// Cancelling ctx stops the block ingestor at shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	ingestorDone := make(chan struct{})
+	var cache *common.BlockCache
+	if readOnly {
+		cache, err = common.OpenBlockCache(db, true)
+		if err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"db_path": dbPath,
+				"error":   err,
+			}).Fatal("couldn't open block cache")
+		}
+		if cache.GetChainID() != chainID {
+			common.Log.Fatal("the block cache is for chain ", cache.GetChainID(),
+				", the upstream is for ", chainID)
+		}
+	} else {
+		cache = common.NewBlockCache(db, chainID, saplingHeight, opts.Redownload)
+	}
+	prometheus.MustRegister(common.NewCacheCollector(cache))
+	if opts.Replica || opts.UpstreamBackend != "" {
+		// The upstream has only compact blocks, so BlockIngestor can't use it.
+		if readOnly {
+			close(ingestorDone)
+		} else {
+			go func() {
+				common.FollowUpstream(ctx, cache, upstream, 2*time.Second)
+				close(ingestorDone)
+			}()
+		}
+	} else if !opts.Darkside {
+		go func() {
+			common.BlockIngestor(ctx, backend, cache, 0 /*loop forever*/)
+			close(ingestorDone)
+		}()
 	} else {
 		// Darkside wants to control starting the block ingestor.
-		common.DarksideInit(cache, int(opts.DarksideTimeout))
+		common.DarksideInit(ctx, cache, int(opts.DarksideTimeout))
+		close(ingestorDone)
+	}
+	go healthMonitor.Run(ctx, cache, 5*time.Second)
+	if failover != nil {
+		go failover.Run(ctx, 5*time.Second)
 	}
 
 	// Compact transaction service initialization
 	{
-		service, err := frontend.NewLwdStreamer(cache, chainName, opts.PingEnable)
+		var service walletrpc.CompactTxStreamerServer
+		if opts.Replica {
+			service, err = frontend.NewReplicaStreamer(cache, chainName, opts.PingEnable, upstream)
+		} else {
+			service, err = frontend.NewLwdStreamer(cache, backend, chainName, opts.PingEnable)
+		}
 		if err != nil {
 			common.Log.WithFields(logrus.Fields{
 				"error": err,
@@ -267,6 +570,13 @@ func startServer(opts *common.Options) error {
 		walletrpc.RegisterDarksideStreamerServer(server, service)
 	}
 
+	// The admin service has its own listener, so it can be kept off the
+	// public network, and requires a token.
+	var adminServer *grpc.Server
+	if opts.AdminBindAddr != "" {
+		adminServer = startAdminServer(opts, cache, transportCreds)
+	}
+
 	// Start listening
 	listener, err := net.Listen("tcp", opts.GRPCBindAddr)
 	if err != nil {
@@ -276,16 +586,34 @@ func startServer(opts *common.Options) error {
 		}).Fatal("couldn't create listener")
 	}
 
-	// Signal handler for graceful stops
+	// Signal handler for graceful stops: stop accepting new connections
+	// and let the RPCs in progress (including block streams) finish, for
+	// up to the shutdown timeout, before cancelling them.
+	stopped := make(chan struct{})
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		s := <-signals
-		cache.Sync()
 		common.Log.WithFields(logrus.Fields{
-			"signal": s.String(),
+			"signal":  s.String(),
+			"timeout": opts.ShutdownTimeout,
 		}).Info("caught signal, stopping gRPC server")
-		os.Exit(1)
+		healthMonitor.Shutdown()
+		if adminServer != nil {
+			adminServer.Stop()
+		}
+		drained := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(time.Duration(opts.ShutdownTimeout) * time.Second):
+			common.Log.Warning("shutdown timeout expired, closing remaining connections")
+			server.Stop()
+		}
+		close(stopped)
 	}()
 
 	err = server.Serve(listener)
@@ -294,9 +622,117 @@ func startServer(opts *common.Options) error {
 			"error": err,
 		}).Fatal("gRPC server exited")
 	}
+	<-stopped
+
+	// Stop the block ingestor, then the metrics server, and close the
+	// cache last, so nothing writes to it after it's closed.
+	cancel()
+	<-ingestorDone
+	if opts.Darkside {
+		common.DarksideStop()
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warning("couldn't stop HTTP server cleanly")
+	}
+	cache.Close()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"error": err,
+		}).Warning("couldn't flush traces")
+	}
+	common.Log.Info("shutdown complete")
 	return nil
 }
 
+// startAdminServer starts serving the admin service on the admin bind address.
+func startAdminServer(opts *common.Options, cache *common.BlockCache, creds credentials.TransportCredentials) *grpc.Server {
+	if opts.AdminTokenFile == "" {
+		common.Log.Fatal("--admin-bind-addr requires --admin-token-file")
+	}
+	if creds == nil && !isLoopback(opts.AdminBindAddr) {
+		// The token and the calls would cross the network in the clear.
+		common.Log.WithFields(logrus.Fields{
+			"bind_addr": opts.AdminBindAddr,
+		}).Fatal("the admin server needs TLS unless --admin-bind-addr is a loopback address")
+	}
+	token, err := frontend.ReadAdminToken(opts.AdminTokenFile)
+	if err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"token_file": opts.AdminTokenFile,
+			"error":      err,
+		}).Fatal("couldn't read admin token")
+	}
+	serverOpts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+			logging.LogInterceptor,
+			frontend.AdminAuthInterceptor(token),
+		)),
+	}
+	if creds != nil {
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(serverOpts...)
+	walletrpc.RegisterAdminServer(server, frontend.NewAdminServer(cache))
+	listener, err := net.Listen("tcp", opts.AdminBindAddr)
+	if err != nil {
+		common.Log.WithFields(logrus.Fields{
+			"bind_addr": opts.AdminBindAddr,
+			"error":     err,
+		}).Fatal("couldn't create admin listener")
+	}
+	common.Log.Info("Starting admin server on ", opts.AdminBindAddr)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			common.Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Warning("admin server exited")
+		}
+	}()
+	return server
+}
+
+// isLoopback returns true if the listening address (host:port) is only
+// reachable from this machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newRateLimiter builds the per-client rate limiter from the command-line options.
+func newRateLimiter(opts *common.Options) (*ratelimit.Limiter, error) {
+	costs, err := ratelimit.ParseCosts(opts.RateLimitCosts)
+	if err != nil {
+		return nil, err
+	}
+	common.Log.WithFields(logrus.Fields{
+		"rate":        opts.RateLimit,
+		"burst":       opts.RateLimitBurst,
+		"max_streams": opts.MaxClientStreams,
+		"api_keys":    len(opts.RateLimitAPIKeys),
+	}).Info("Per-client rate limiting enabled")
+	return ratelimit.New(ratelimit.Config{
+		Rate:        opts.RateLimit,
+		Burst:       opts.RateLimitBurst,
+		APIKeyRate:  opts.RateLimitKeyRate,
+		APIKeyBurst: opts.RateLimitKeyBurst,
+		APIKeys:     opts.RateLimitAPIKeys,
+		MaxStreams:  opts.MaxClientStreams,
+		MethodCosts: costs,
+		BlockCost:   opts.RateLimitBlockCost,
+	}), nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -315,6 +751,9 @@ func init() {
 	rootCmd.Flags().Bool("grpc-logging-insecure", false, "enable grpc logging to stderr")
 	rootCmd.Flags().String("tls-cert", "./cert.pem", "the path to a TLS certificate")
 	rootCmd.Flags().String("tls-key", "./cert.key", "the path to a TLS key file")
+	rootCmd.Flags().String("tls-min-version", "1.2", "the minimum TLS version to accept (1.0, 1.1, 1.2, or 1.3)")
+	rootCmd.Flags().StringSlice("tls-cipher-suites", nil, "TLS 1.2 and earlier cipher suites to accept, by name (default Go's secure suites)")
+	rootCmd.Flags().Int("tls-reload-interval", 60, "how often, in seconds, to check the TLS certificate and key files for changes (0 disables)")
 	rootCmd.Flags().Int("log-level", int(logrus.InfoLevel), "log level (logrus 1-7)")
 	rootCmd.Flags().String("log-file", "./server.log", "log file to write to")
 	rootCmd.Flags().String("verus-conf-path", "./VRSC.conf", "conf file to pull RPC creds from")
@@ -322,6 +761,12 @@ func init() {
 	rootCmd.Flags().String("rpcpassword", "", "RPC password")
 	rootCmd.Flags().String("rpchost", "", "RPC host")
 	rootCmd.Flags().String("rpcport", "", "RPC host port")
+	rootCmd.Flags().StringSlice("rpc-endpoints", nil, "zcashd RPC endpoints (host:port) to fail over between, instead of rpchost and rpcport")
+	rootCmd.Flags().Int("rpc-endpoint-max-lag", 2, "skip RPC endpoints more than this many blocks behind the highest one")
+	rootCmd.Flags().String("rpc-record", "", "append every zcashd RPC and its reply to this file, for use as a test fixture")
+	rootCmd.Flags().Bool("validate-blocks", false, "check the merkle root and time of each block from zcashd")
+	rootCmd.Flags().Bool("validate-pow", false, "check that each proof-of-work block from zcashd meets its target (proof-of-stake blocks are skipped)")
+	rootCmd.Flags().StringSlice("checkpoints", []string{}, "blocks that must be in the chain, as height:hash (big-endian), in addition to the built-in ones")
 	rootCmd.Flags().Bool("no-tls-very-insecure", false, "run without the required TLS certificate, only for debugging, DO NOT use in production")
 	rootCmd.Flags().Bool("gen-cert-very-insecure", false, "run with self-signed TLS certificate, only for debugging, DO NOT use in production")
 	rootCmd.Flags().Bool("redownload", false, "re-fetch all blocks from zcashd; reinitialize local cache files")
@@ -329,6 +774,34 @@ func init() {
 	rootCmd.Flags().Bool("ping-very-insecure", false, "allow Ping GRPC for testing")
 	rootCmd.Flags().Bool("darkside-very-insecure", false, "run with GRPC-controllable mock zcashd for integration testing (shuts down after 30 minutes)")
 	rootCmd.Flags().Int("darkside-timeout", 30, "override 30 minute default darkside timeout")
+	rootCmd.Flags().Float64("rate-limit", 0, "per-client request rate limit, in tokens per second (0 disables)")
+	rootCmd.Flags().Float64("rate-limit-burst", 100, "per-client token bucket size (burst allowance)")
+	rootCmd.Flags().Float64("rate-limit-block-cost", 0.01, "tokens charged per block requested by GetBlockRange, GetBlockHeaders or GetHeaderRange")
+	rootCmd.Flags().String("rate-limit-costs", "", "per-method token costs, for example GetMempoolTx=5,GetBlock=1")
+	rootCmd.Flags().StringSlice("rate-limit-api-keys", nil, "API keys (sent by clients as x-api-key metadata) that get their own limits")
+	rootCmd.Flags().Float64("rate-limit-api-key-rate", 0, "rate limit for clients presenting an API key, in tokens per second (0 is unlimited)")
+	rootCmd.Flags().Float64("rate-limit-api-key-burst", 1000, "token bucket size for clients presenting an API key")
+	rootCmd.Flags().Int("max-client-streams", 0, "maximum concurrent streaming calls per client (0 is unlimited)")
+	rootCmd.Flags().Int("max-block-range", 10000, "maximum number of blocks a GetBlockRange, GetBlockHeaders or GetHeaderRange call may request (0 is unlimited)")
+	rootCmd.Flags().StringSlice("grpc-compression", []string{"gzip", "zstd"}, "gRPC compression algorithms to accept and respond with (gzip, zstd; empty disables compression)")
+	rootCmd.Flags().String("grpc-compression-level", "default", "gRPC compression level: fastest, default, better, or best")
+	rootCmd.Flags().Int("shutdown-timeout", 30, "seconds to let in-progress calls finish at shutdown before closing them")
+	rootCmd.Flags().Int("ready-max-lag", 10, "report not ready (health NOT_SERVING) when the cache is more than this many blocks behind zcashd")
+	rootCmd.Flags().Int("daemon-unreachable-timeout", 60, "report not ready when zcashd has been unreachable for this many seconds")
+	rootCmd.Flags().String("admin-bind-addr", "", "the address to listen for admin (cache management) gRPCs on (default disabled)")
+	rootCmd.Flags().String("admin-token-file", "", "file containing the bearer token admin gRPCs must present")
+	rootCmd.Flags().Bool("replica", false, "serve from the block cache without a zcashd, forwarding the calls that need one to --replica-upstream")
+	rootCmd.Flags().String("replica-upstream", "", "the address of the lightwalletd a replica follows and forwards to")
+	rootCmd.Flags().Bool("replica-upstream-insecure", false, "connect to the replica upstream without TLS")
+	rootCmd.Flags().Bool("replica-read-only", false, "open the block cache read-only (such as a shared snapshot) instead of following the upstream's blocks")
+	rootCmd.Flags().String("upstream-backend", "", "get blocks, tree states, transactions and the mempool from this lightwalletd instead of zcashd")
+	rootCmd.Flags().Bool("upstream-backend-insecure", false, "connect to the upstream backend without TLS")
+	rootCmd.Flags().String("log-peer-anonymization", "truncate", "how client addresses appear in the grpc log: \"truncate\" (to /24 or /48), \"cryptopan\", or \"none\"")
+	rootCmd.Flags().String("log-peer-key-file", "", "file containing the 32-byte (64 hex digit) cryptopan key (default: random each run)")
+	rootCmd.Flags().String("tracing-exporter", "", "export OpenTelemetry traces to \"otlp\" or \"stdout\" (default none)")
+	rootCmd.Flags().String("tracing-otlp-endpoint", "localhost:4317", "the OTLP (gRPC) collector address for traces")
+	rootCmd.Flags().Bool("tracing-otlp-insecure", false, "connect to the OTLP collector without TLS")
+	rootCmd.Flags().Float64("tracing-sample-ratio", 0.1, "fraction of calls to trace (unless the caller's trace context says otherwise)")
 
 	viper.BindPFlag("grpc-bind-addr", rootCmd.Flags().Lookup("grpc-bind-addr"))
 	viper.SetDefault("grpc-bind-addr", "127.0.0.1:9077")
@@ -340,6 +813,11 @@ func init() {
 	viper.SetDefault("tls-cert", "./cert.pem")
 	viper.BindPFlag("tls-key", rootCmd.Flags().Lookup("tls-key"))
 	viper.SetDefault("tls-key", "./cert.key")
+	viper.BindPFlag("tls-min-version", rootCmd.Flags().Lookup("tls-min-version"))
+	viper.SetDefault("tls-min-version", "1.2")
+	viper.BindPFlag("tls-cipher-suites", rootCmd.Flags().Lookup("tls-cipher-suites"))
+	viper.BindPFlag("tls-reload-interval", rootCmd.Flags().Lookup("tls-reload-interval"))
+	viper.SetDefault("tls-reload-interval", 60)
 	viper.BindPFlag("log-level", rootCmd.Flags().Lookup("log-level"))
 	viper.SetDefault("log-level", int(logrus.InfoLevel))
 	viper.BindPFlag("log-file", rootCmd.Flags().Lookup("log-file"))
@@ -350,6 +828,15 @@ func init() {
 	viper.BindPFlag("rpcpassword", rootCmd.Flags().Lookup("rpcpassword"))
 	viper.BindPFlag("rpchost", rootCmd.Flags().Lookup("rpchost"))
 	viper.BindPFlag("rpcport", rootCmd.Flags().Lookup("rpcport"))
+	viper.BindPFlag("rpc-endpoints", rootCmd.Flags().Lookup("rpc-endpoints"))
+	viper.BindPFlag("rpc-endpoint-max-lag", rootCmd.Flags().Lookup("rpc-endpoint-max-lag"))
+	viper.SetDefault("rpc-endpoint-max-lag", 2)
+	viper.BindPFlag("rpc-record", rootCmd.Flags().Lookup("rpc-record"))
+	viper.BindPFlag("validate-blocks", rootCmd.Flags().Lookup("validate-blocks"))
+	viper.SetDefault("validate-blocks", false)
+	viper.BindPFlag("validate-pow", rootCmd.Flags().Lookup("validate-pow"))
+	viper.SetDefault("validate-pow", false)
+	viper.BindPFlag("checkpoints", rootCmd.Flags().Lookup("checkpoints"))
 	viper.BindPFlag("no-tls-very-insecure", rootCmd.Flags().Lookup("no-tls-very-insecure"))
 	viper.SetDefault("no-tls-very-insecure", false)
 	viper.BindPFlag("gen-cert-very-insecure", rootCmd.Flags().Lookup("gen-cert-very-insecure"))
@@ -364,6 +851,54 @@ func init() {
 	viper.SetDefault("darkside-very-insecure", false)
 	viper.BindPFlag("darkside-timeout", rootCmd.Flags().Lookup("darkside-timeout"))
 	viper.SetDefault("darkside-timeout", 30)
+	viper.BindPFlag("rate-limit", rootCmd.Flags().Lookup("rate-limit"))
+	viper.SetDefault("rate-limit", 0)
+	viper.BindPFlag("rate-limit-burst", rootCmd.Flags().Lookup("rate-limit-burst"))
+	viper.SetDefault("rate-limit-burst", 100)
+	viper.BindPFlag("rate-limit-block-cost", rootCmd.Flags().Lookup("rate-limit-block-cost"))
+	viper.SetDefault("rate-limit-block-cost", 0.01)
+	viper.BindPFlag("rate-limit-costs", rootCmd.Flags().Lookup("rate-limit-costs"))
+	viper.BindPFlag("rate-limit-api-keys", rootCmd.Flags().Lookup("rate-limit-api-keys"))
+	viper.BindPFlag("rate-limit-api-key-rate", rootCmd.Flags().Lookup("rate-limit-api-key-rate"))
+	viper.SetDefault("rate-limit-api-key-rate", 0)
+	viper.BindPFlag("rate-limit-api-key-burst", rootCmd.Flags().Lookup("rate-limit-api-key-burst"))
+	viper.SetDefault("rate-limit-api-key-burst", 1000)
+	viper.BindPFlag("max-client-streams", rootCmd.Flags().Lookup("max-client-streams"))
+	viper.SetDefault("max-client-streams", 0)
+	viper.BindPFlag("max-block-range", rootCmd.Flags().Lookup("max-block-range"))
+	viper.SetDefault("max-block-range", 10000)
+	viper.BindPFlag("grpc-compression", rootCmd.Flags().Lookup("grpc-compression"))
+	viper.SetDefault("grpc-compression", []string{"gzip", "zstd"})
+	viper.BindPFlag("grpc-compression-level", rootCmd.Flags().Lookup("grpc-compression-level"))
+	viper.SetDefault("grpc-compression-level", "default")
+	viper.BindPFlag("shutdown-timeout", rootCmd.Flags().Lookup("shutdown-timeout"))
+	viper.SetDefault("shutdown-timeout", 30)
+	viper.BindPFlag("ready-max-lag", rootCmd.Flags().Lookup("ready-max-lag"))
+	viper.SetDefault("ready-max-lag", 10)
+	viper.BindPFlag("daemon-unreachable-timeout", rootCmd.Flags().Lookup("daemon-unreachable-timeout"))
+	viper.SetDefault("daemon-unreachable-timeout", 60)
+	viper.BindPFlag("admin-bind-addr", rootCmd.Flags().Lookup("admin-bind-addr"))
+	viper.BindPFlag("admin-token-file", rootCmd.Flags().Lookup("admin-token-file"))
+	viper.BindPFlag("replica", rootCmd.Flags().Lookup("replica"))
+	viper.SetDefault("replica", false)
+	viper.BindPFlag("replica-upstream", rootCmd.Flags().Lookup("replica-upstream"))
+	viper.BindPFlag("replica-upstream-insecure", rootCmd.Flags().Lookup("replica-upstream-insecure"))
+	viper.SetDefault("replica-upstream-insecure", false)
+	viper.BindPFlag("replica-read-only", rootCmd.Flags().Lookup("replica-read-only"))
+	viper.SetDefault("replica-read-only", false)
+	viper.BindPFlag("upstream-backend", rootCmd.Flags().Lookup("upstream-backend"))
+	viper.BindPFlag("upstream-backend-insecure", rootCmd.Flags().Lookup("upstream-backend-insecure"))
+	viper.SetDefault("upstream-backend-insecure", false)
+	viper.BindPFlag("log-peer-anonymization", rootCmd.Flags().Lookup("log-peer-anonymization"))
+	viper.SetDefault("log-peer-anonymization", "truncate")
+	viper.BindPFlag("log-peer-key-file", rootCmd.Flags().Lookup("log-peer-key-file"))
+	viper.BindPFlag("tracing-exporter", rootCmd.Flags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing-otlp-endpoint", rootCmd.Flags().Lookup("tracing-otlp-endpoint"))
+	viper.SetDefault("tracing-otlp-endpoint", "localhost:4317")
+	viper.BindPFlag("tracing-otlp-insecure", rootCmd.Flags().Lookup("tracing-otlp-insecure"))
+	viper.SetDefault("tracing-otlp-insecure", false)
+	viper.BindPFlag("tracing-sample-ratio", rootCmd.Flags().Lookup("tracing-sample-ratio"))
+	viper.SetDefault("tracing-sample-ratio", 0.1)
 
 	logger.SetFormatter(&logrus.TextFormatter{
 		//DisableColors:          true,
@@ -380,9 +915,6 @@ func init() {
 	})
 
 	logrus.RegisterExitHandler(onexit)
-
-	// Indirect function for test mocking (so unit tests can talk to stub functions)
-	common.Sleep = time.Sleep
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -410,7 +942,20 @@ func initConfig() {
 
 }
 
-func startHTTPServer(opts *common.Options) {
+// startHTTPServer starts serving metrics and health checks in the background;
+// the returned server's Shutdown stops it.
+func startHTTPServer(opts *common.Options, healthMonitor *common.HealthMonitor) *http.Server {
 	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(opts.HTTPBindAddr, nil)
+	http.HandleFunc("/healthz", healthMonitor.ServeHealthz)
+	http.HandleFunc("/readyz", healthMonitor.ServeReadyz)
+	server := &http.Server{Addr: opts.HTTPBindAddr}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			common.Log.WithFields(logrus.Fields{
+				"bind_addr": opts.HTTPBindAddr,
+				"error":     err,
+			}).Warning("HTTP server exited")
+		}
+	}()
+	return server
 }
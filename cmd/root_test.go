@@ -20,3 +20,21 @@ func TestFileExists(t *testing.T) {
 		t.Fatal("fileExists failed")
 	}
 }
+
+func TestIsLoopback(t *testing.T) {
+	for addr, loopback := range map[string]bool{
+		"127.0.0.1:9069":   true,
+		"127.0.0.2:9069":   true,
+		"[::1]:9069":       true,
+		"localhost:9069":   true,
+		":9069":            false,
+		"0.0.0.0:9069":     false,
+		"10.1.2.3:9069":    false,
+		"example.com:9069": false,
+		"127.0.0.1":        false,
+	} {
+		if isLoopback(addr) != loopback {
+			t.Error("unexpected isLoopback result for", addr)
+		}
+	}
+}
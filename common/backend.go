@@ -0,0 +1,324 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asherda/lightwalletd/common/tracing"
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NodeBackend is the full node (or whatever stands in for one) that
+// lightwalletd gets blocks, transactions and chain state from, and sends
+// transactions to. Errors from the node itself are returned as zcashd
+// reports them, "code: message".
+type NodeBackend interface {
+	// GetBlockchainInfo returns the chain's name, upgrades and height.
+	GetBlockchainInfo(ctx context.Context) (*ZcashdRpcReplyGetblockchaininfo, error)
+	// GetInfo returns the node's version.
+	GetInfo(ctx context.Context) (*ZcashdRpcReplyGetinfo, error)
+	// GetBlock returns the block at the given height in compact form, or
+	// nil (and no error) if the node doesn't have a block at that height yet.
+	// The compact block's header field holds the full serialized header, if
+	// the node provides it, for the block ingestor to store.
+	GetBlock(ctx context.Context, height int) (*walletrpc.CompactBlock, error)
+	// GetBlockHeader returns the serialized header of the block at the
+	// given height, or nil (and no error) if the node doesn't have a block
+	// at that height yet.
+	GetBlockHeader(ctx context.Context, height int) ([]byte, error)
+	// GetTreeState returns the Sapling note commitment tree state as of the
+	// given block, which can be specified by height or (big-endian) hash.
+	GetTreeState(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.TreeState, error)
+	// GetRawTransaction returns the transaction with the given txid (in
+	// big-endian display order), and the height of its block (0 if it's in
+	// the mempool).
+	GetRawTransaction(ctx context.Context, txid []byte) (*walletrpc.RawTransaction, error)
+	// SendRawTransaction submits a transaction, returning the node's reply
+	// (the txid).
+	SendRawTransaction(ctx context.Context, tx []byte) (string, error)
+	// GetMempool returns the txids (big-endian hex) of the transactions in
+	// the mempool.
+	GetMempool(ctx context.Context) ([]string, error)
+	// GetAddressTxids returns the txids (big-endian hex) of the transactions
+	// involving the transparent addresses, in the given block range.
+	GetAddressTxids(ctx context.Context, addresses []string, start, end uint64) ([]string, error)
+	// GetAddressBalance returns the total balance of the transparent addresses.
+	GetAddressBalance(ctx context.Context, addresses []string) (int64, error)
+	// GetAddressUtxos returns the unspent outputs of a transparent address.
+	GetAddressUtxos(ctx context.Context, address string) (ZcashdRpcReplyGetaddressutxos, error)
+}
+
+// rpcBackend is a NodeBackend that makes JSON-RPC calls to zcashd.
+type rpcBackend struct {
+	request func(method string, params []json.RawMessage) (json.RawMessage, error)
+}
+
+// NewRPCBackend returns a NodeBackend that makes zcashd JSON-RPC calls using
+// request; in production, that's btcsuite/btcd/rpcclient/rawrequest.go:RawRequest(),
+// in unit tests, a function that mocks zcashd.
+func NewRPCBackend(request func(method string, params []json.RawMessage) (json.RawMessage, error)) NodeBackend {
+	return &rpcBackend{request: request}
+}
+
+// call makes an RPC within a span (a child of any span in ctx) that records
+// the RPC method and any error.
+func (b *rpcBackend) call(ctx context.Context, method string, params ...json.RawMessage) (json.RawMessage, error) {
+	_, span := tracing.Tracer().Start(ctx, "zcashd."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rpc.method", method)))
+	defer span.End()
+	if params == nil {
+		params = []json.RawMessage{}
+	}
+	result, err := b.request(method, params)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+// callJSON makes an RPC and unmarshals its result into reply.
+func (b *rpcBackend) callJSON(ctx context.Context, reply interface{}, method string, params ...json.RawMessage) error {
+	result, err := b.call(ctx, method, params...)
+	// For some reason, the error responses are not JSON
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, reply)
+}
+
+func (b *rpcBackend) GetBlockchainInfo(ctx context.Context) (*ZcashdRpcReplyGetblockchaininfo, error) {
+	var reply ZcashdRpcReplyGetblockchaininfo
+	if err := b.callJSON(ctx, &reply, "getblockchaininfo"); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (b *rpcBackend) GetInfo(ctx context.Context) (*ZcashdRpcReplyGetinfo, error) {
+	var reply ZcashdRpcReplyGetinfo
+	if err := b.callJSON(ctx, &reply, "getinfo"); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (b *rpcBackend) GetBlock(ctx context.Context, height int) (*walletrpc.CompactBlock, error) {
+	blockData, err := b.getRawBlock(ctx, height)
+	if blockData == nil || err != nil {
+		return nil, err
+	}
+	return parseCompactBlock(blockData, height)
+}
+
+func (b *rpcBackend) GetBlockHeader(ctx context.Context, height int) ([]byte, error) {
+	blockData, err := b.getRawBlock(ctx, height)
+	if blockData == nil || err != nil {
+		return nil, err
+	}
+	return parseBlockHeader(blockData)
+}
+
+// getRawBlock returns the full block at the given height, or nil if zcashd
+// doesn't have it yet.
+func (b *rpcBackend) getRawBlock(ctx context.Context, height int) ([]byte, error) {
+	heightJSON, err := json.Marshal(strconv.Itoa(height))
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling height")
+	}
+	// non-verbose (raw hex)
+	result, rpcErr := b.call(ctx, "getblock", heightJSON, json.RawMessage("0"))
+
+	// For some reason, the error responses are not JSON
+	if rpcErr != nil {
+		// Check to see if we are requesting a height the zcashd doesn't have yet
+		if (strings.Split(rpcErr.Error(), ":"))[0] == "-8" {
+			return nil, nil
+		}
+		return nil, errors.Wrap(rpcErr, "error requesting block")
+	}
+
+	var blockDataHex string
+	err = json.Unmarshal(result, &blockDataHex)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading JSON response")
+	}
+
+	blockData, err := hex.DecodeString(blockDataHex)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding getblock output")
+	}
+	return blockData, nil
+}
+
+// parseBlockHeader returns the serialized header of a raw block.
+func parseBlockHeader(blockData []byte) ([]byte, error) {
+	hdr := parser.NewBlockHeader()
+	if _, err := hdr.ParseFromSlice(blockData); err != nil {
+		return nil, errors.Wrap(err, "error parsing block header")
+	}
+	return hdr.MarshalBinary()
+}
+
+// parseCompactBlock parses a raw block, which must be at the given height,
+// and returns it in compact form.
+func parseCompactBlock(blockData []byte, height int) (*walletrpc.CompactBlock, error) {
+	parseStart := time.Now()
+	// The cache keeps the JoinSplits; GetBlock and GetBlockRange remove them
+	// unless the client asks for them.
+	compact, rest, err := parser.ParseCompactBlock(blockData, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing block")
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("received overlong message")
+	}
+
+	if int(compact.Height) != height {
+		return nil, errors.New("received unexpected height block")
+	}
+	if BlockValidation.MerkleRoot || BlockValidation.ProofOfWork {
+		// These checks need the fully parsed block.
+		block := parser.NewBlock()
+		if _, err := block.ParseFromSlice(blockData); err != nil {
+			return nil, errors.Wrap(err, "error parsing block")
+		}
+		if err := checkBlock(block); err != nil {
+			return nil, &InvalidBlockError{Height: height, Err: err}
+		}
+	}
+	blockParseHistogram.Observe(time.Since(parseStart).Seconds())
+	return compact, nil
+}
+
+func (b *rpcBackend) GetTreeState(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.TreeState, error) {
+	// The Zcash z_gettreestate rpc accepts either a block height or block hash
+	var param json.RawMessage
+	var err error
+	if id.Height > 0 {
+		param, err = json.Marshal(strconv.Itoa(int(id.Height)))
+	} else {
+		// id.Hash is big-endian, keep in big-endian for the rpc
+		param, err = json.Marshal(hex.EncodeToString(id.Hash))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var reply ZcashdRpcReplyGettreestate
+	for {
+		if err := b.callJSON(ctx, &reply, "z_gettreestate", param); err != nil {
+			return nil, err
+		}
+		if reply.Sapling.Commitments.FinalState != "" {
+			break
+		}
+		if reply.Sapling.SkipHash == "" {
+			break
+		}
+		// The tree didn't change in this block; zcashd refers us to the
+		// block where it last did.
+		param, err = json.Marshal(reply.Sapling.SkipHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reply.Sapling.Commitments.FinalState == "" {
+		return nil, errors.New("zcashd did not return treestate")
+	}
+	return &walletrpc.TreeState{
+		Height: uint64(reply.Height),
+		Hash:   reply.Hash,
+		Time:   reply.Time,
+		Tree:   reply.Sapling.Commitments.FinalState,
+	}, nil
+}
+
+func (b *rpcBackend) GetRawTransaction(ctx context.Context, txid []byte) (*walletrpc.RawTransaction, error) {
+	txidJSON, err := json.Marshal(hex.EncodeToString(txid))
+	if err != nil {
+		return nil, err
+	}
+	// Many other fields are returned, but we need only these two.
+	var txinfo ZcashdRpcReplyGetrawtransaction
+	if err := b.callJSON(ctx, &txinfo, "getrawtransaction", txidJSON, json.RawMessage("1")); err != nil {
+		return nil, err
+	}
+	txBytes, err := hex.DecodeString(txinfo.Hex)
+	if err != nil {
+		return nil, err
+	}
+	return &walletrpc.RawTransaction{Data: txBytes, Height: uint64(txinfo.Height)}, nil
+}
+
+func (b *rpcBackend) SendRawTransaction(ctx context.Context, tx []byte) (string, error) {
+	txJSON, err := json.Marshal(hex.EncodeToString(tx))
+	if err != nil {
+		return "", err
+	}
+	result, err := b.call(ctx, "sendrawtransaction", txJSON)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+func (b *rpcBackend) GetMempool(ctx context.Context) ([]string, error) {
+	var txids []string
+	if err := b.callJSON(ctx, &txids, "getrawmempool"); err != nil {
+		return nil, err
+	}
+	return txids, nil
+}
+
+func (b *rpcBackend) GetAddressTxids(ctx context.Context, addresses []string, start, end uint64) ([]string, error) {
+	param, err := json.Marshal(&ZcashdRpcRequestGetaddresstxids{
+		Addresses: addresses,
+		Start:     start,
+		End:       end,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var txids []string
+	if err := b.callJSON(ctx, &txids, "getaddresstxids", param); err != nil {
+		return nil, err
+	}
+	return txids, nil
+}
+
+func (b *rpcBackend) GetAddressBalance(ctx context.Context, addresses []string) (int64, error) {
+	param, err := json.Marshal(&ZcashdRpcRequestGetaddressbalance{Addresses: addresses})
+	if err != nil {
+		return 0, err
+	}
+	var reply ZcashdRpcReplyGetaddressbalance
+	if err := b.callJSON(ctx, &reply, "getaddressbalance", param); err != nil {
+		return 0, err
+	}
+	return reply.Balance, nil
+}
+
+func (b *rpcBackend) GetAddressUtxos(ctx context.Context, address string) (ZcashdRpcReplyGetaddressutxos, error) {
+	param, err := json.Marshal(address)
+	if err != nil {
+		return nil, err
+	}
+	var reply ZcashdRpcReplyGetaddressutxos
+	if err := b.callJSON(ctx, &reply, "getaddressutxos", param); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
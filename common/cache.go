@@ -7,21 +7,29 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"hash/fnv"
 	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/asherda/lightwalletd/common/tracing"
 	"github.com/asherda/lightwalletd/walletrpc"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	blockHeightPrefix = "B" // key is "B" + block height, value is block; see also H, block by hash
 	blockHashPrefix   = "H" // key is "H" + block hash, value is block; see also B, block by height
 	idPrefix          = "I" // key is "I" + chain ID, value is height (more to come), see next (verusID)
+	headerPrefix      = "R" // key is "R" + block height, value is the block's serialized (raw) header
 )
 
 // BlockCache contains a consecutive set of recent compact blocks in marshalled form.
@@ -31,6 +39,7 @@ type BlockCache struct {
 	nextBlock  int         // height of the first block not in the cache
 	latestHash []byte      // hash of the most recent (highest height) block, for detecting reorgs.
 	ldb        *leveldb.DB // levelDB connection
+	readOnly   bool        // the database is opened read-only; don't try to repair it
 	mutex      sync.RWMutex
 }
 
@@ -48,6 +57,11 @@ func (c *BlockCache) GetFirstHeight() int {
 	return c.firstBlock
 }
 
+// GetChainID returns the ID of the chain whose blocks are cached.
+func (c *BlockCache) GetChainID() string {
+	return c.verusID
+}
+
 // GetLatestHash returns the hash (block ID) of the most recent (highest) known block.
 func (c *BlockCache) GetLatestHash() []byte {
 	c.mutex.RLock()
@@ -107,30 +121,32 @@ func (c *BlockCache) readBlock(height int) *walletrpc.CompactBlock {
 	if err != nil {
 		return nil
 	}
-	if len(cacheResult) < 72 {
-		Log.Warning("block read height: ", height, " failed, result too short. ")
+	block, err := decodeBlockRecord(height, cacheResult)
+	if err != nil {
+		// Could be file corruption.
+		Log.Warning("block read at height ", height, " failed: ", err)
 		return nil
 	}
+	return block
+}
 
-	cachecs := cacheResult[:8]
-	b := cacheResult[8:]
-	if !bytes.Equal(checksum(height, b), cachecs) {
-		Log.Warning("bad block checksum at height: ", height)
-		return nil
+// decodeBlockRecord checks and unmarshals a block record, the block's
+// checksum followed by the marshalled block, stored at the given height.
+func decodeBlockRecord(height int, record []byte) (*walletrpc.CompactBlock, error) {
+	if len(record) < 72 {
+		return nil, errors.New("record too short")
+	}
+	if !bytes.Equal(checksum(height, record[8:]), record[:8]) {
+		return nil, errors.New("bad checksum")
 	}
 	block := &walletrpc.CompactBlock{}
-	err = proto.Unmarshal(b, block)
-	if err != nil {
-		// Could be file corruption.
-		Log.Warning("blocks unmarshal at height: ", height, " failed: ", err)
-		return nil
+	if err := proto.Unmarshal(record[8:], block); err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
 	}
 	if int(block.Height) != height {
-		// Could be file corruption.
-		Log.Warning("block unexpected height at height ", height)
-		return nil
+		return nil, errors.Errorf("record is for height %d", block.Height)
 	}
-	return block
+	return block, nil
 }
 
 // Caller should hold c.mutex.Lock().
@@ -199,6 +215,74 @@ func NewBlockCache(db *leveldb.DB, chainID string, startHeight int, redownload b
 	return c
 }
 
+// OpenBlockCache returns the block cache already stored in db, for the
+// offline cache commands and read-only replicas. Unlike NewBlockCache, it
+// needs neither the chain ID nor the first height (both are found in the
+// database), and it doesn't check the blocks. If readOnly, db must have been
+// opened read-only, and damaged blocks are treated as missing rather than
+// removed.
+func OpenBlockCache(db *leveldb.DB, readOnly bool) (*BlockCache, error) {
+	chainID, first, next, err := readCacheBounds(db)
+	if err != nil {
+		return nil, err
+	}
+	c := &BlockCache{verusID: chainID, firstBlock: first, nextBlock: next, ldb: db, readOnly: readOnly}
+	if next > first {
+		block := c.readBlock(next - 1)
+		if block == nil {
+			return nil, errors.Errorf("latest block (%d) is damaged", next-1)
+		}
+		c.latestHash = block.Hash
+	}
+	return c, nil
+}
+
+// ErrNoCache is returned by OpenBlockCache for a database with no cache in it.
+var ErrNoCache = errors.New("no cache height record; the cache is empty")
+
+// readCacheBounds returns the chain ID and the height range of the cache in
+// db. The first height isn't recorded; it's the lowest stored block.
+func readCacheBounds(db *leveldb.DB) (chainID string, first, next int, err error) {
+	var chainIDs []string
+	iter := db.NewIterator(util.BytesPrefix([]byte(idPrefix)), nil)
+	for iter.Next() {
+		if len(iter.Value()) != 8 {
+			continue
+		}
+		chainIDs = append(chainIDs, string(iter.Key()[len(idPrefix):]))
+		next = int(binary.LittleEndian.Uint64(iter.Value()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return "", 0, 0, err
+	}
+	switch len(chainIDs) {
+	case 0:
+		return "", 0, 0, ErrNoCache
+	case 1:
+		chainID = chainIDs[0]
+	default:
+		return "", 0, 0, errors.New("more than one cache height record: " + strings.Join(chainIDs, ", "))
+	}
+
+	first = -1
+	iter = db.NewIterator(util.BytesPrefix([]byte(blockHeightPrefix)), nil)
+	for iter.Next() {
+		height, err := strconv.Atoi(string(iter.Key()[len(blockHeightPrefix):]))
+		if err == nil && (first < 0 || height < first) {
+			first = height
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return "", 0, 0, err
+	}
+	if first < 0 || first > next {
+		first = next
+	}
+	return chainID, first, next, nil
+}
+
 // Add adds the given block to the cache at the given height, returning true
 // if a reorg was detected.
 func (c *BlockCache) Add(height int, block *walletrpc.CompactBlock) error {
@@ -229,17 +313,23 @@ func (c *BlockCache) Add(height int, block *walletrpc.CompactBlock) error {
 		return nil
 	}
 
-	// Add the new block and its length to the db files.
-	data, err := proto.Marshal(block)
+	// Add the new block and its length to the db files. The full header,
+	// if the block has one, is stored separately, so that the blocks served
+	// from the cache don't carry it.
+	header := block.Header
+	block.Header = nil
+	checkSummed, err := encodeBlockRecord(height, block)
+	block.Header = header
 	if err != nil {
 		return err
 	}
-	checkSummed := checksum(height, data)
-	checkSummed = append(checkSummed, data...)
 	err = c.storeNewBlock(height, checkSummed)
 	if err != nil {
 		Log.Fatal("hash write at height", height, "failed: ", err)
 	}
+	if err := c.storeHeader(height, header); err != nil {
+		Log.Fatal("header write at height", height, "failed: ", err)
+	}
 	err = c.storeNewHeight(false)
 
 	if err != nil {
@@ -277,28 +367,231 @@ func (c *BlockCache) Reorg(height int) {
 	c.setLatestHash()
 }
 
+// Rollback removes the blocks above the given height from the cache, so
+// that height becomes the latest block; the ingestor then fetches the
+// following blocks again. Heights below the first block empty the cache.
+func (c *BlockCache) Rollback(height int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setDbHeight(height + 1)
+}
+
+// verifyBatchSize is the number of blocks Verify checks at a time, holding the
+// cache's lock; the ingestor can add blocks between batches.
+const verifyBatchSize = 2000
+
+// Verify re-reads the blocks in the given (inclusive) height range, limited
+// to the blocks in the cache, and returns the heights of those that are
+// missing, fail their checksum, or don't decode to a block of that height.
+func (c *BlockCache) Verify(start, end int) []int {
+	var bad []int
+	for height := start; height <= end; {
+		var done bool
+		bad, height, done = c.verifyBatch(bad, height, end)
+		if done {
+			break
+		}
+	}
+	return bad
+}
+
+// verifyBatch checks up to verifyBatchSize blocks from start (limited to the
+// blocks now in the cache) for Verify, and returns the next height to check,
+// or done if there are no more.
+func (c *BlockCache) verifyBatch(bad []int, start, end int) ([]int, int, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if start < c.firstBlock {
+		start = c.firstBlock
+	}
+	if end >= c.nextBlock {
+		end = c.nextBlock - 1
+	}
+	if end >= start+verifyBatchSize {
+		end = start + verifyBatchSize - 1
+	}
+	for height := start; height <= end; height++ {
+		if c.readBlock(height) == nil {
+			bad = append(bad, height)
+		}
+	}
+	return bad, end + 1, end+1 >= c.nextBlock
+}
+
+// ReadOnly returns true if the cache was opened read-only, so that it can't
+// be changed.
+func (c *BlockCache) ReadOnly() bool {
+	return c.readOnly
+}
+
+// Compact compacts the whole LevelDB database, reclaiming the space of
+// deleted blocks.
+func (c *BlockCache) Compact() error {
+	return c.ldb.CompactRange(util.Range{})
+}
+
+// CacheStats describes the contents of the cache.
+type CacheStats struct {
+	FirstHeight int    // height of the first block in the cache
+	NextHeight  int    // height of the first block not in the cache
+	LatestHash  []byte // hash of the most recent block, nil if the cache is empty
+	SizeBytes   int64  // total size of the LevelDB tables
+}
+
+// Stats returns the cache's height range and database size.
+func (c *BlockCache) Stats() (CacheStats, error) {
+	c.mutex.RLock()
+	stats := CacheStats{
+		FirstHeight: c.firstBlock,
+		NextHeight:  c.nextBlock,
+		LatestHash:  append([]byte(nil), c.latestHash...),
+	}
+	c.mutex.RUnlock()
+	var dbStats leveldb.DBStats
+	if err := c.ldb.Stats(&dbStats); err != nil {
+		return stats, err
+	}
+	stats.SizeBytes = leveldb.Sizes(dbStats.LevelSizes).Sum()
+	return stats, nil
+}
+
 // Get returns the compact block at the requested height if it's
 // in the cache, else nil.
-func (c *BlockCache) Get(height int) *walletrpc.CompactBlock {
+func (c *BlockCache) Get(ctx context.Context, height int) *walletrpc.CompactBlock {
+	_, span := tracing.Tracer().Start(ctx, "BlockCache.Get",
+		trace.WithAttributes(attribute.Int("height", height)))
+	defer span.End()
+
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
 	if height < c.firstBlock || height >= c.nextBlock {
+		span.SetAttributes(attribute.Bool("cache.hit", false))
 		return nil
 	}
 	block := c.readBlock(height)
-	if block == nil {
+	span.SetAttributes(attribute.Bool("cache.hit", block != nil))
+	if block == nil && !c.readOnly {
 		go func() {
 			// We hold only the read lock, need the exclusive lock.
 			c.mutex.Lock()
 			c.recoverFromCorruption(height - 10000)
 			c.mutex.Unlock()
 		}()
-		return nil
 	}
 	return block
 }
 
+// GetRange returns the cached blocks from height start to end inclusive
+// (start <= end), in order, with nil for each block the cache doesn't have.
+// It reads the blocks with LevelDB iterators rather than looking up each
+// one.
+func (c *BlockCache) GetRange(ctx context.Context, start, end int) []*walletrpc.CompactBlock {
+	_, span := tracing.Tracer().Start(ctx, "BlockCache.GetRange",
+		trace.WithAttributes(attribute.Int("start", start), attribute.Int("end", end)))
+	defer span.End()
+
+	blocks := make([]*walletrpc.CompactBlock, end-start+1)
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.ldb == nil {
+		return blocks
+	}
+	first, last := start, end
+	if first < c.firstBlock {
+		first = c.firstBlock
+	}
+	if last >= c.nextBlock {
+		last = c.nextBlock - 1
+	}
+
+	// Heights are keyed in decimal, so keys of the same length sort in
+	// height order, but shorter and longer keys sort among them. Read each
+	// run of heights with the same number of digits separately, skipping
+	// the other keys.
+	hits := 0
+	for runStart := first; runStart <= last; {
+		runEnd := last
+		if limit := lastWithDigits(runStart); limit < runEnd {
+			runEnd = limit
+		}
+		iter := c.ldb.NewIterator(&util.Range{
+			Start: []byte(blockHeightPrefix + strconv.Itoa(runStart)),
+			Limit: []byte(blockHeightPrefix + strconv.Itoa(runEnd) + "\x00"),
+		}, nil)
+		for iter.Next() {
+			height, err := strconv.Atoi(string(iter.Key()[len(blockHeightPrefix):]))
+			if err != nil || height < runStart || height > runEnd {
+				continue
+			}
+			block, err := decodeBlockRecord(height, iter.Value())
+			if err != nil {
+				// Could be file corruption.
+				Log.Warning("block read at height ", height, " failed: ", err)
+				continue
+			}
+			blocks[height-start] = block
+			hits++
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			Log.Warning("block range read at height ", runStart, " failed: ", err)
+		}
+		runStart = runEnd + 1
+	}
+	span.SetAttributes(attribute.Int("cache.hits", hits))
+
+	if hits < last-first+1 && !c.readOnly {
+		for height := first; height <= last; height++ {
+			if blocks[height-start] == nil {
+				go func() {
+					// We hold only the read lock, need the exclusive lock.
+					c.mutex.Lock()
+					c.recoverFromCorruption(height - 10000)
+					c.mutex.Unlock()
+				}()
+				break
+			}
+		}
+	}
+	return blocks
+}
+
+// lastWithDigits returns the largest height with as many (decimal) digits as
+// the given height.
+func lastWithDigits(height int) int {
+	limit := 10
+	for limit <= height {
+		limit *= 10
+	}
+	return limit - 1
+}
+
+// GetHeader returns the serialized header of the cached block at the given
+// height, or nil if the cache doesn't have it (the block isn't cached, or
+// was cached without its header).
+func (c *BlockCache) GetHeader(height int) []byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if height < c.firstBlock || height >= c.nextBlock {
+		return nil
+	}
+	return c.readHeader(height)
+}
+
+// readHeader is GetHeader without the lock or the range check.
+func (c *BlockCache) readHeader(height int) []byte {
+	if c.ldb == nil {
+		return nil
+	}
+	header, err := c.ldb.Get([]byte(headerPrefix+strconv.Itoa(height)), nil)
+	if err != nil {
+		return nil
+	}
+	return header
+}
+
 // GetLatestHeight returns the height of the most recent block, or -1
 // if the cache is empty.
 func (c *BlockCache) GetLatestHeight() int {
@@ -310,15 +603,30 @@ func (c *BlockCache) GetLatestHeight() int {
 	return c.nextBlock - 1
 }
 
+// GetLatestBlockID returns the height and a copy of the hash of the most
+// recent block, or -1 and nil if the cache is empty.
+func (c *BlockCache) GetLatestBlockID() (int, []byte) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.firstBlock == c.nextBlock {
+		return -1, nil
+	}
+	return c.nextBlock - 1, append([]byte(nil), c.latestHash...)
+}
+
 // Sync ensures that the db files are flushed to disk, can be called unnecessarily.
 func (c *BlockCache) Sync() {
 	c.storeNewHeight(true)
 }
 
-// Close is Currently used only for testing.
+// Close flushes the next-height record and closes the database; call it only
+// when nothing else is using the cache, at shutdown or in tests.
 func (c *BlockCache) Close() {
 	// Some operating system require you to close files before you can remove them.
 	if c.ldb != nil {
+		if !c.readOnly {
+			c.Sync()
+		}
 		c.ldb.Close()
 	}
 }
@@ -354,6 +662,16 @@ func (c *BlockCache) storeNewHeight(sync bool) error {
 	return c.ldb.Put([]byte(idPrefix+c.verusID), bytesHeight, &opt.WriteOptions{Sync: sync})
 }
 
+// storeHeader stores a block's header, or removes any stale header at that
+// height (from a block replaced by a reorg) if the block has none.
+func (c *BlockCache) storeHeader(height int, header []byte) error {
+	key := []byte(headerPrefix + strconv.Itoa(height))
+	if len(header) == 0 {
+		return c.ldb.Delete(key, &opt.WriteOptions{Sync: false})
+	}
+	return c.ldb.Put(key, header, &opt.WriteOptions{Sync: false})
+}
+
 func (c *BlockCache) storeNewBlock(height int, block []byte) error {
 	err := c.ldb.Put([]byte(blockHeightPrefix+strconv.Itoa(height)), block, &opt.WriteOptions{Sync: false})
 	if err != nil {
@@ -4,11 +4,14 @@
 package common
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/asherda/lightwalletd/parser"
@@ -120,7 +123,7 @@ func reorgCache(t *testing.T) {
 	if cache.GetLatestHeight() != 289461 {
 		t.Fatal("unexpected GetLatestHeight")
 	}
-	if int(cache.Get(289461).Height) != 289461 {
+	if int(cache.Get(context.Background(), 289461).Height) != 289461 {
 		t.Fatal("unexpected block contents")
 	}
 
@@ -139,7 +142,7 @@ func reorgCache(t *testing.T) {
 	if cache.GetLatestHeight() != 289462 {
 		t.Fatal("unexpected GetLatestHeight")
 	}
-	if int(cache.Get(289462).Height) != 289462 {
+	if int(cache.Get(context.Background(), 289462).Height) != 289462 {
 		t.Fatal("unexpected block contents")
 	}
 }
@@ -168,7 +171,7 @@ func fillCache(t *testing.T) {
 		if cache.GetLatestHeight() != 289460+i {
 			t.Fatal("unexpected GetLatestHeight")
 		}
-		b := cache.Get(289460 + i)
+		b := cache.Get(context.Background(), 289460+i)
 		if b == nil {
 			t.Fatal("unexpected Get failure")
 		}
@@ -177,3 +180,137 @@ func fillCache(t *testing.T) {
 		}
 	}
 }
+
+func TestCacheHeaders(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c := NewBlockCache(db, unitTestChain, 380640, true)
+	for height := 380640; height < 380643; height++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+			Header:   []byte(fmt.Sprintf("header %d", height)),
+		}
+		if err := c.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+		if len(block.Header) == 0 {
+			t.Fatal("cache.Add changed the block")
+		}
+	}
+	// The header is stored apart from the block.
+	if block := c.Get(context.Background(), 380641); block == nil || block.Header != nil {
+		t.Fatal("unexpected cached block", block)
+	}
+	if header := c.GetHeader(380641); string(header) != "header 380641" {
+		t.Fatal("unexpected cached header", string(header))
+	}
+	if header := c.GetHeader(380643); header != nil {
+		t.Fatal("header beyond the cache", string(header))
+	}
+
+	// A block replaced (by a reorg) with one without a header has none.
+	c.Reorg(380641)
+	if header := c.GetHeader(380642); header != nil {
+		t.Fatal("header of a removed block", string(header))
+	}
+	block := &walletrpc.CompactBlock{
+		Height:   380642,
+		Hash:     []byte(fmt.Sprintf("%031dx", 380642)),
+		PrevHash: []byte(fmt.Sprintf("%032d", 380641)),
+	}
+	if err := c.Add(380642, block); err != nil {
+		t.Fatal("cache.Add failed:", err)
+	}
+	if header := c.GetHeader(380642); header != nil {
+		t.Fatal("stale header after reorg", string(header))
+	}
+}
+
+func TestCacheGetRange(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Heights of two, three and four digits, whose keys sort among each
+	// other's.
+	c := NewBlockCache(db, unitTestChain, 90, true)
+	for height := 90; height <= 1010; height++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+		}
+		if err := c.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	check := func(start, end int) {
+		blocks := c.GetRange(context.Background(), start, end)
+		if len(blocks) != end-start+1 {
+			t.Fatal("unexpected number of blocks", len(blocks))
+		}
+		for i, block := range blocks {
+			height := start + i
+			if height < 90 || height > 1010 {
+				if block != nil {
+					t.Fatal("block outside the cache", height)
+				}
+				continue
+			}
+			if block == nil || block.Height != uint64(height) ||
+				string(block.Hash) != fmt.Sprintf("%032d", height) {
+				t.Fatal("unexpected block at height", height, block)
+			}
+		}
+	}
+	check(85, 1015)
+	check(95, 105)
+	check(999, 1000)
+	check(500, 500)
+	check(1011, 1020)
+}
+
+func TestCacheVerify(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, 380640, true)
+	// Enough blocks that Verify reads them in more than one batch.
+	last := 380640 + verifyBatchSize + 10
+	for height := 380640; height <= last; height++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+		}
+		if err := cache.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	bad := []int{380641, 380640 + verifyBatchSize, last}
+	for _, height := range bad {
+		if err := db.Put([]byte(blockHeightPrefix+strconv.Itoa(height)), []byte("damaged"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result := cache.Verify(0, last+1000); fmt.Sprint(result) != fmt.Sprint(bad) {
+		t.Fatal("unexpected Verify result", result)
+	}
+	if result := cache.Verify(380642, 380645); len(result) != 0 {
+		t.Fatal("unexpected Verify result", result)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/asherda/lightwalletd/common/snapshot"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// ExportSnapshot writes the cached blocks from start through end, with
+// their full headers, as a snapshot (see package snapshot).
+func (c *BlockCache) ExportSnapshot(w io.Writer, start, end int) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if start < c.firstBlock || end >= c.nextBlock || end < start {
+		return errors.Errorf("the cache has blocks %d to %d, can't export %d to %d",
+			c.firstBlock, c.nextBlock-1, start, end)
+	}
+	tip := c.readBlock(end)
+	if tip == nil {
+		return errors.Errorf("block %d is damaged", end)
+	}
+	sw, err := snapshot.NewWriter(w, snapshot.Header{
+		ChainID:     c.verusID,
+		StartHeight: uint64(start),
+		EndHeight:   uint64(end),
+		TipHash:     tip.Hash,
+	})
+	if err != nil {
+		return err
+	}
+	for height := start; height <= end; height++ {
+		block := c.readBlock(height)
+		if block == nil {
+			return errors.Errorf("block %d is damaged", height)
+		}
+		block.Header = c.readHeader(height)
+		if err := sw.Write(block); err != nil {
+			return err
+		}
+	}
+	return sw.Close()
+}
+
+// ImportSnapshot adds the blocks in a snapshot to the end of the cache; the
+// snapshot must be for the same chain and start at the cache's next height.
+// Each block's prevHash must match the hash of the block before it (and the
+// first block's, the cache's latest block), and each block must agree with
+// any checkpoint at its height. The blocks are stored as they're
+// read, but the cache's height is only advanced after the whole snapshot has
+// been read and checked, so a failed import leaves the cache as it was.
+// It returns the number of blocks added.
+func (c *BlockCache) ImportSnapshot(sr *snapshot.Reader) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	h := sr.Header()
+	if h.ChainID != c.verusID {
+		return 0, errors.Errorf("snapshot is for chain %q, the cache is for %q", h.ChainID, c.verusID)
+	}
+	if int(h.StartHeight) != c.nextBlock {
+		return 0, errors.Errorf("snapshot starts at height %d, the cache needs %d next",
+			h.StartHeight, c.nextBlock)
+	}
+	prevHash := c.latestHash
+	height := c.nextBlock
+	for {
+		block, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if prevHash != nil && !bytes.Equal(block.PrevHash, prevHash) {
+			return 0, errors.Errorf("snapshot block %d doesn't follow the block before it", height)
+		}
+		if err := checkCheckpoint(height, block); err != nil {
+			return 0, errors.Wrap(err, "snapshot")
+		}
+		// As in Add, the header is stored apart from the block.
+		header := block.Header
+		block.Header = nil
+		record, err := encodeBlockRecord(height, block)
+		if err != nil {
+			return 0, err
+		}
+		err = c.ldb.Put([]byte(blockHeightPrefix+strconv.Itoa(height)), record, &opt.WriteOptions{Sync: false})
+		if err != nil {
+			return 0, err
+		}
+		if err := c.storeHeader(height, header); err != nil {
+			return 0, err
+		}
+		prevHash = block.Hash
+		height++
+	}
+	if !bytes.Equal(prevHash, h.TipHash) {
+		return 0, errors.New("snapshot's last block doesn't match its tip hash")
+	}
+	count := height - c.nextBlock
+	c.nextBlock = height
+	c.latestHash = prevHash
+	if err := c.storeNewHeight(true); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asherda/lightwalletd/common/snapshot"
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath+"/from", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, 380640, true)
+	for height := 380640; height < 380650; height++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+		}
+		if height != 380642 {
+			block.Header = []byte(fmt.Sprintf("header %d", height))
+		}
+		if err := cache.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	var first, second bytes.Buffer
+	if err := cache.ExportSnapshot(&first, 380640, 380644); err != nil {
+		t.Fatal("ExportSnapshot failed:", err)
+	}
+	if err := cache.ExportSnapshot(&second, 380645, 380649); err != nil {
+		t.Fatal("ExportSnapshot failed:", err)
+	}
+	if err := cache.ExportSnapshot(&bytes.Buffer{}, 380645, 380650); err == nil {
+		t.Fatal("ExportSnapshot beyond the cache succeeded")
+	}
+
+	// The offline commands find the chain ID and heights in the database.
+	cache.Sync()
+	opened, err := OpenBlockCache(db, false)
+	if err != nil {
+		t.Fatal("OpenBlockCache failed:", err)
+	}
+	if opened.GetFirstHeight() != 380640 || opened.GetNextHeight() != 380650 ||
+		!bytes.Equal(opened.GetLatestHash(), cache.GetLatestHash()) {
+		t.Fatal("unexpected cache from OpenBlockCache")
+	}
+
+	db2, err := leveldb.OpenFile(unitTestPath+"/to", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if _, err := OpenBlockCache(db2, false); err != ErrNoCache {
+		t.Fatal("unexpected OpenBlockCache error", err)
+	}
+	cache2 := NewBlockCache(db2, unitTestChain, 380640, false)
+
+	// The second snapshot doesn't start where the (empty) cache ends.
+	sr, err := snapshot.NewReader(bytes.NewReader(second.Bytes()))
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	if _, err := cache2.ImportSnapshot(sr); err == nil {
+		t.Fatal("ImportSnapshot at the wrong height succeeded")
+	}
+	for _, data := range [][]byte{first.Bytes(), second.Bytes()} {
+		sr, err := snapshot.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal("NewReader failed:", err)
+		}
+		count, err := cache2.ImportSnapshot(sr)
+		if err != nil {
+			t.Fatal("ImportSnapshot failed:", err)
+		}
+		if count != 5 {
+			t.Fatal("unexpected import count", count)
+		}
+	}
+	report, err := VerifyCacheDB(db2)
+	if err != nil {
+		t.Fatal("VerifyCacheDB failed:", err)
+	}
+	if report.FirstHeight != 380640 || report.NextHeight != 380650 || len(report.Problems) != 0 {
+		t.Fatal("unexpected report after import", report)
+	}
+
+	// The headers come along, but are still kept apart from the blocks.
+	for height := 380640; height < 380650; height++ {
+		if !bytes.Equal(cache2.GetHeader(height), cache.GetHeader(height)) {
+			t.Fatal("unexpected header after import at height", height)
+		}
+		if cache2.Get(context.Background(), height).Header != nil {
+			t.Fatal("imported block has a header at height", height)
+		}
+	}
+	if cache2.GetHeader(380641) == nil || cache2.GetHeader(380642) != nil {
+		t.Fatal("unexpected headers after import")
+	}
+
+	// A snapshot whose blocks don't link to the cache changes nothing.
+	cache2.Rollback(380644)
+	block := cache.readBlock(380645)
+	block.PrevHash = make([]byte, 32)
+	var bad bytes.Buffer
+	sw, _ := snapshot.NewWriter(&bad, snapshot.Header{
+		ChainID: unitTestChain, StartHeight: 380645, EndHeight: 380645, TipHash: block.Hash,
+	})
+	sw.Write(block)
+	sw.Close()
+	sr, _ = snapshot.NewReader(&bad)
+	if _, err := cache2.ImportSnapshot(sr); err == nil {
+		t.Fatal("ImportSnapshot of an unlinked block succeeded")
+	}
+	if cache2.GetNextHeight() != 380645 {
+		t.Fatal("failed import changed the cache height", cache2.GetNextHeight())
+	}
+
+	// Nor does one with a block that contradicts a checkpoint.
+	if err := SetCheckpoints("", []Checkpoint{{Height: 380647, Hash: strings.Repeat("ab", 32)}}); err != nil {
+		t.Fatal("SetCheckpoints failed:", err)
+	}
+	defer SetCheckpoints("", nil)
+	sr, err = snapshot.NewReader(bytes.NewReader(second.Bytes()))
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	if _, err := cache2.ImportSnapshot(sr); err == nil {
+		t.Fatal("ImportSnapshot of a block contradicting a checkpoint succeeded")
+	}
+	if cache2.GetNextHeight() != 380645 {
+		t.Fatal("failed import changed the cache height", cache2.GetNextHeight())
+	}
+
+	// A checkpoint the snapshot agrees with doesn't get in the way.
+	hash := parser.Reverse(cache.readBlock(380647).Hash)
+	if err := SetCheckpoints("", []Checkpoint{{Height: 380647, Hash: hex.EncodeToString(hash)}}); err != nil {
+		t.Fatal("SetCheckpoints failed:", err)
+	}
+	sr, err = snapshot.NewReader(bytes.NewReader(second.Bytes()))
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	if _, err := cache2.ImportSnapshot(sr); err != nil {
+		t.Fatal("ImportSnapshot failed:", err)
+	}
+}
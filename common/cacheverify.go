@@ -0,0 +1,123 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// CacheProblem is a damaged block found by VerifyCacheDB.
+type CacheProblem struct {
+	Height int
+	Reason string
+}
+
+// CacheReport is the result of checking a block cache database offline.
+type CacheReport struct {
+	ChainID     string
+	FirstHeight int // lowest block height stored
+	NextHeight  int // height of the first block not in the cache
+	Checked     int // number of heights examined
+	Problems    []CacheProblem
+}
+
+// DamagedHeights returns the heights, in order, whose blocks must be
+// fetched again to repair the cache.
+func (r *CacheReport) DamagedHeights() []int {
+	seen := make(map[int]bool)
+	var heights []int
+	for _, p := range r.Problems {
+		if !seen[p.Height] {
+			seen[p.Height] = true
+			heights = append(heights, p.Height)
+		}
+	}
+	sort.Ints(heights)
+	return heights
+}
+
+// VerifyCacheDB checks a block cache database that isn't in use: every
+// height from the lowest stored block up to the cache's next height must
+// have a block record with a valid checksum, for that height, whose prevHash
+// is the hash of the block before it. A block that doesn't link to its
+// predecessor is reported along with the predecessor, since either may be
+// stale (left from before a reorg).
+func VerifyCacheDB(db *leveldb.DB) (*CacheReport, error) {
+	chainID, first, next, err := readCacheBounds(db)
+	if err != nil {
+		return nil, err
+	}
+	r := &CacheReport{ChainID: chainID, FirstHeight: first, NextHeight: next}
+
+	var prev *walletrpc.CompactBlock
+	for height := r.FirstHeight; height < r.NextHeight; height++ {
+		r.Checked++
+		record, err := db.Get([]byte(blockHeightPrefix+strconv.Itoa(height)), nil)
+		if err == leveldb.ErrNotFound {
+			r.Problems = append(r.Problems, CacheProblem{height, "missing"})
+			prev = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		block, err := decodeBlockRecord(height, record)
+		if err != nil {
+			r.Problems = append(r.Problems, CacheProblem{height, err.Error()})
+			prev = nil
+			continue
+		}
+		if prev != nil && !bytes.Equal(block.PrevHash, prev.Hash) {
+			r.Problems = append(r.Problems,
+				CacheProblem{height - 1, "not the parent of the next block"},
+				CacheProblem{height, "prevHash doesn't match the previous block"})
+		}
+		prev = block
+	}
+	return r, nil
+}
+
+// RepairCacheDB fetches the damaged blocks in the report from the backend
+// and rewrites them, leaving the rest of the cache as it is. It
+// returns the heights rewritten; check the database again afterward, since
+// the new blocks may not link to their neighbors if the chain has changed.
+func RepairCacheDB(ctx context.Context, backend NodeBackend, db *leveldb.DB, r *CacheReport) ([]int, error) {
+	var repaired []int
+	for _, height := range r.DamagedHeights() {
+		block, err := backend.GetBlock(ctx, height)
+		if err != nil {
+			return repaired, errors.Wrapf(err, "fetching block %d", height)
+		}
+		if block == nil {
+			return repaired, errors.Errorf("zcashd doesn't have block %d", height)
+		}
+		record, err := encodeBlockRecord(height, block)
+		if err != nil {
+			return repaired, err
+		}
+		if err := db.Put([]byte(blockHeightPrefix+strconv.Itoa(height)), record, nil); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, height)
+	}
+	return repaired, nil
+}
+
+// encodeBlockRecord returns the record stored for a block: its checksum
+// followed by the marshalled block.
+func encodeBlockRecord(height int, block *walletrpc.CompactBlock) ([]byte, error) {
+	data, err := proto.Marshal(block)
+	if err != nil {
+		return nil, err
+	}
+	return append(checksum(height, data), data...), nil
+}
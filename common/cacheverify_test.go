@@ -0,0 +1,93 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// getblockByHeightStub returns the test block at the requested height (380640-380643).
+func getblockByHeightStub(method string, params []json.RawMessage) (json.RawMessage, error) {
+	var heightStr string
+	json.Unmarshal(params[0], &heightStr)
+	height, _ := strconv.Atoi(heightStr)
+	return blocks[height-380640], nil
+}
+
+func TestVerifyCacheDB(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, 380640, true)
+	for height := 380640; height < 380644; height++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+		}
+		if err := cache.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	cache.Sync()
+
+	report, err := VerifyCacheDB(db)
+	if err != nil {
+		t.Fatal("VerifyCacheDB failed:", err)
+	}
+	if report.ChainID != unitTestChain || report.FirstHeight != 380640 || report.NextHeight != 380644 ||
+		report.Checked != 4 || len(report.Problems) != 0 {
+		t.Fatal("unexpected report", report)
+	}
+
+	// Damage one block, and replace another with one that doesn't link
+	// to its predecessor.
+	db.Put([]byte("B380641"), []byte("garbage"), nil)
+	block := cache.readBlock(380643)
+	block.PrevHash = make([]byte, 32)
+	record, _ := encodeBlockRecord(380643, block)
+	db.Put([]byte("B380643"), record, nil)
+	report, err = VerifyCacheDB(db)
+	if err != nil {
+		t.Fatal("VerifyCacheDB failed:", err)
+	}
+	if !reflect.DeepEqual(report.DamagedHeights(), []int{380641, 380642, 380643}) {
+		t.Fatal("unexpected problems", report.Problems)
+	}
+	db.Delete([]byte("B380640"), nil)
+	report, err = VerifyCacheDB(db)
+	if err != nil {
+		t.Fatal("VerifyCacheDB failed:", err)
+	}
+	if report.FirstHeight != 380641 {
+		t.Fatal("unexpected first height", report.FirstHeight)
+	}
+
+	// Only the damaged blocks are fetched and rewritten.
+	repaired, err := RepairCacheDB(context.Background(), NewRPCBackend(getblockByHeightStub), db, report)
+	if err != nil {
+		t.Fatal("RepairCacheDB failed:", err)
+	}
+	if !reflect.DeepEqual(repaired, []int{380641, 380642, 380643}) {
+		t.Fatal("unexpected repairs", repaired)
+	}
+	for _, height := range repaired {
+		if cache.readBlock(height) == nil {
+			t.Fatal("block not repaired at height", height)
+		}
+	}
+}
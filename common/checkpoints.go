@@ -0,0 +1,108 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint is a block that must be in the chain lightwalletd serves.
+type Checkpoint struct {
+	Height int
+	Hash   string // big-endian hex, as zcashd displays it
+}
+
+// builtinCheckpoints are the checkpoints built into lightwalletd, by chain
+// name (as getblockchaininfo reports it). Only add hashes that have been
+// confirmed against several independent nodes; until the VRSC and VRSCTEST
+// hashes have been, there are none, and --checkpoints supplies them.
+var builtinCheckpoints = map[string][]Checkpoint{}
+
+// checkpoints are the checkpoints of the chain being served, by height; the
+// hashes are little-endian, as in compact blocks. They're set at startup.
+var checkpoints = map[int][]byte{}
+
+// ParseCheckpoints parses checkpoints given as "height:hash".
+func ParseCheckpoints(specs []string) ([]Checkpoint, error) {
+	var result []Checkpoint
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 2 {
+			return nil, errors.Errorf("checkpoint %q isn't height:hash", spec)
+		}
+		height, err := strconv.Atoi(parts[0])
+		if err != nil || height < 0 {
+			return nil, errors.Errorf("checkpoint %q has an invalid height", spec)
+		}
+		if hash, err := hex.DecodeString(parts[1]); err != nil || len(hash) != 32 {
+			return nil, errors.Errorf("checkpoint %q has an invalid hash", spec)
+		}
+		result = append(result, Checkpoint{Height: height, Hash: strings.ToLower(parts[1])})
+	}
+	return result, nil
+}
+
+// SetCheckpoints sets the checkpoints of the chain being served: those built
+// in for the chain, and the extra ones given. Two checkpoints at the same
+// height must agree.
+func SetCheckpoints(chainName string, extra []Checkpoint) error {
+	checkpoints = map[int][]byte{}
+	for _, cp := range append(append([]Checkpoint{}, builtinCheckpoints[chainName]...), extra...) {
+		hash, err := hex.DecodeString(cp.Hash)
+		if err != nil || len(hash) != 32 {
+			return errors.Errorf("checkpoint at height %d has an invalid hash", cp.Height)
+		}
+		hash = parser.Reverse(hash)
+		if other, ok := checkpoints[cp.Height]; ok && !bytes.Equal(other, hash) {
+			return errors.Errorf("conflicting checkpoints at height %d", cp.Height)
+		}
+		checkpoints[cp.Height] = hash
+	}
+	return nil
+}
+
+// VerifyCheckpoints checks that the blocks zcashd has at the checkpoint
+// heights are the checkpointed ones.
+func VerifyCheckpoints(ctx context.Context, backend NodeBackend) error {
+	heights := make([]int, 0, len(checkpoints))
+	for height := range checkpoints {
+		heights = append(heights, height)
+	}
+	sort.Ints(heights)
+	for _, height := range heights {
+		block, err := backend.GetBlock(ctx, height)
+		if err != nil {
+			return errors.Wrapf(err, "getting checkpoint block %d", height)
+		}
+		if block == nil {
+			// zcashd hasn't got this far yet; the ingestor checks it.
+			break
+		}
+		if err := checkCheckpoint(height, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCheckpoint checks a block against the checkpoint at its height, if
+// there is one.
+func checkCheckpoint(height int, block *walletrpc.CompactBlock) error {
+	hash, ok := checkpoints[height]
+	if !ok || bytes.Equal(hash, block.Hash) {
+		return nil
+	}
+	blocksRejectedCounter.WithLabelValues("checkpoint").Inc()
+	return errors.Errorf("block %s at height %d contradicts the checkpoint %s",
+		displayHash(block.Hash), height, displayHash(hash))
+}
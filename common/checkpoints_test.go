@@ -0,0 +1,95 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseCheckpoints(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	cps, err := ParseCheckpoints([]string{"0:" + hash, "419200:" + strings.ToUpper(hash)})
+	if err != nil || len(cps) != 2 || cps[1].Height != 419200 || cps[1].Hash != hash {
+		t.Fatal("unexpected checkpoints", cps, err)
+	}
+	for _, spec := range []string{"419200", "x:" + hash, "-1:" + hash, "1:abcd", "1:" + hash + ":2"} {
+		if _, err := ParseCheckpoints([]string{spec}); err == nil {
+			t.Fatal("invalid checkpoint accepted:", spec)
+		}
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	defer SetCheckpoints("", nil)
+	testBlocks, err := os.Open("../testdata/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testBlocks.Close()
+	scan := bufio.NewScanner(testBlocks)
+	scan.Buffer(make([]byte, 64*1024), 8*1024*1024)
+	// Block hex by height.
+	blocks := make(map[string]string)
+	var hashes []string
+	for scan.Scan() {
+		blockData, err := hex.DecodeString(scan.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := parser.NewBlock()
+		if _, err := block.ParseFromSlice(blockData); err != nil {
+			t.Fatal(err)
+		}
+		blocks[strconv.Itoa(block.GetHeight())] = scan.Text()
+		hashes = append(hashes, hex.EncodeToString(block.GetDisplayHash()))
+	}
+	backend := NewRPCBackend(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		var height string
+		json.Unmarshal(params[0], &height)
+		if blockHex, ok := blocks[height]; ok {
+			return json.Marshal(blockHex)
+		}
+		return nil, errors.New("-8: Block height out of range")
+	})
+	ctx := context.Background()
+
+	// The built-in checkpoints are the chain's.
+	builtinCheckpoints["unittestnet"] = []Checkpoint{{Height: 380641, Hash: hashes[1]}}
+	defer delete(builtinCheckpoints, "unittestnet")
+	if err := SetCheckpoints("unittestnet", []Checkpoint{{Height: 380641, Hash: hashes[0]}}); err == nil {
+		t.Fatal("conflicting checkpoints accepted")
+	}
+	if err := SetCheckpoints("unittestnet", []Checkpoint{{Height: 380642, Hash: hashes[2]}, {Height: 500000, Hash: hashes[3]}}); err != nil {
+		t.Fatal("SetCheckpoints failed:", err)
+	}
+	// Checkpoints beyond zcashd's tip are left to the ingestor.
+	if err := VerifyCheckpoints(ctx, backend); err != nil {
+		t.Fatal("VerifyCheckpoints failed:", err)
+	}
+	if err := SetCheckpoints("other", []Checkpoint{{Height: 380642, Hash: hashes[1]}}); err != nil {
+		t.Fatal("SetCheckpoints failed:", err)
+	}
+	rejected0 := testutil.ToFloat64(blocksRejectedCounter.WithLabelValues("checkpoint"))
+	if err := VerifyCheckpoints(ctx, backend); err == nil {
+		t.Fatal("chain contradicting a checkpoint was accepted")
+	}
+	if testutil.ToFloat64(blocksRejectedCounter.WithLabelValues("checkpoint")) != rejected0+1 {
+		t.Fatal("rejected block wasn't counted")
+	}
+	if err := checkCheckpoint(380641, &walletrpc.CompactBlock{Hash: make([]byte, 32)}); err != nil {
+		t.Fatal("block without a checkpoint was rejected:", err)
+	}
+}
@@ -5,16 +5,20 @@
 package common
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
-	"encoding/json"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/asherda/lightwalletd/common/tracing"
 	"github.com/asherda/lightwalletd/parser"
 	"github.com/asherda/lightwalletd/walletrpc"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // 'make build' will overwrite this string with the output of git-describe (tag)
@@ -26,36 +30,76 @@ var (
 	BuildUser = ""
 )
 
+// Compressors lists the gRPC compression algorithms the server accepts (and
+// responds with), for GetLightdInfo.
+var Compressors []string
+
+// MaxBlockRange is the largest number of blocks a GetBlockRange,
+// GetBlockHeaders or GetHeaderRange call may request (0 is unlimited).
+var MaxBlockRange int
+
 type Options struct {
-	GRPCBindAddr        string `json:"grpc_bind_address,omitempty"`
-	GRPCLogging         bool   `json:"grpc_logging_insecure,omitempty"`
-	HTTPBindAddr        string `json:"http_bind_address,omitempty"`
-	TLSCertPath         string `json:"tls_cert_path,omitempty"`
-	TLSKeyPath          string `json:"tls_cert_key,omitempty"`
-	LogLevel            uint64 `json:"log_level,omitempty"`
-	LogFile             string `json:"log_file,omitempty"`
-	VerusConfPath       string `json:"zcash_conf,omitempty"`
-	RPCUser             string `json:"rpcuser"`
-	RPCPassword         string `json:"rpcpassword"`
-	RPCHost             string `json:"rpchost"`
-	RPCPort             string `json:"rpcport"`
-	NoTLSVeryInsecure   bool   `json:"no_tls_very_insecure,omitempty"`
-	GenCertVeryInsecure bool   `json:"gen_cert_very_insecure,omitempty"`
-	Redownload          bool   `json:"redownload"`
-	DataDir             string `json:"data_dir"`
-	PingEnable          bool   `json:"ping_enable"`
-	Darkside            bool   `json:"darkside"`
-	DarksideTimeout     uint64 `json:"darkside_timeout"`
+	GRPCBindAddr        string   `json:"grpc_bind_address,omitempty"`
+	GRPCLogging         bool     `json:"grpc_logging_insecure,omitempty"`
+	HTTPBindAddr        string   `json:"http_bind_address,omitempty"`
+	TLSCertPath         string   `json:"tls_cert_path,omitempty"`
+	TLSKeyPath          string   `json:"tls_cert_key,omitempty"`
+	LogLevel            uint64   `json:"log_level,omitempty"`
+	LogFile             string   `json:"log_file,omitempty"`
+	VerusConfPath       string   `json:"zcash_conf,omitempty"`
+	RPCUser             string   `json:"rpcuser"`
+	RPCPassword         string   `json:"rpcpassword"`
+	RPCHost             string   `json:"rpchost"`
+	RPCPort             string   `json:"rpcport"`
+	RPCEndpoints        []string `json:"rpc_endpoints,omitempty"`
+	RPCEndpointMaxLag   int      `json:"rpc_endpoint_max_lag,omitempty"`
+	RPCRecordFile       string   `json:"rpc_record_file,omitempty"`
+	ValidateBlocks      bool     `json:"validate_blocks,omitempty"`
+	ValidatePoW         bool     `json:"validate_pow,omitempty"`
+	Checkpoints         []string `json:"checkpoints,omitempty"`
+	NoTLSVeryInsecure   bool     `json:"no_tls_very_insecure,omitempty"`
+	GenCertVeryInsecure bool     `json:"gen_cert_very_insecure,omitempty"`
+	Redownload          bool     `json:"redownload"`
+	DataDir             string   `json:"data_dir"`
+	PingEnable          bool     `json:"ping_enable"`
+	Darkside            bool     `json:"darkside"`
+	DarksideTimeout     uint64   `json:"darkside_timeout"`
+	RateLimit           float64  `json:"rate_limit,omitempty"`
+	RateLimitBurst      float64  `json:"rate_limit_burst,omitempty"`
+	RateLimitBlockCost  float64  `json:"rate_limit_block_cost,omitempty"`
+	RateLimitCosts      string   `json:"rate_limit_costs,omitempty"`
+	RateLimitAPIKeys    []string `json:"rate_limit_api_keys,omitempty"`
+	RateLimitKeyRate    float64  `json:"rate_limit_api_key_rate,omitempty"`
+	RateLimitKeyBurst   float64  `json:"rate_limit_api_key_burst,omitempty"`
+	MaxClientStreams    int      `json:"max_client_streams,omitempty"`
+	MaxBlockRange       int      `json:"max_block_range,omitempty"`
+	Compression         []string `json:"grpc_compression,omitempty"`
+	CompressionLevel    string   `json:"grpc_compression_level,omitempty"`
+	TLSMinVersion       string   `json:"tls_min_version,omitempty"`
+	TLSCipherSuites     []string `json:"tls_cipher_suites,omitempty"`
+	TLSReloadInterval   int      `json:"tls_reload_interval,omitempty"`
+	ShutdownTimeout     int      `json:"shutdown_timeout,omitempty"`
+	ReadyMaxLag         int      `json:"ready_max_lag,omitempty"`
+	DaemonTimeout       int      `json:"daemon_unreachable_timeout,omitempty"`
+	TracingExporter     string   `json:"tracing_exporter,omitempty"`
+	TracingEndpoint     string   `json:"tracing_otlp_endpoint,omitempty"`
+	TracingInsecure     bool     `json:"tracing_otlp_insecure,omitempty"`
+	TracingSampleRatio  float64  `json:"tracing_sample_ratio,omitempty"`
+	LogAnonymization    string   `json:"log_peer_anonymization,omitempty"`
+	LogAnonymizeKeyFile string   `json:"log_peer_key_file,omitempty"`
+	AdminBindAddr       string   `json:"admin_bind_addr,omitempty"`
+	AdminTokenFile      string   `json:"admin_token_file,omitempty"`
+	Replica             bool     `json:"replica,omitempty"`
+	ReplicaUpstream     string   `json:"replica_upstream,omitempty"`
+	ReplicaInsecure     bool     `json:"replica_upstream_insecure,omitempty"`
+	ReplicaReadOnly     bool     `json:"replica_read_only,omitempty"`
+	UpstreamBackend     string   `json:"upstream_backend,omitempty"`
+	UpstreamInsecure    bool     `json:"upstream_backend_insecure,omitempty"`
 }
 
-// RawRequest points to the function to send a an RPC request to zcashd;
-// in production, it points to btcsuite/btcd/rpcclient/rawrequest.go:RawRequest();
-// in unit tests it points to a function to mock RPCs to zcashd.
-var RawRequest func(method string, params []json.RawMessage) (json.RawMessage, error)
-
-// Sleep allows a request to time.Sleep() to be mocked for testing;
-// in production, it points to the standard library time.Sleep();
-// in unit tests it points to a mock function.
+// Sleep allows the pauses between retries to be mocked for testing; in
+// production it's nil, and they're timed (see sleep); in unit tests it
+// points to a mock function.
 var Sleep func(d time.Duration)
 
 // Log as a global variable simplifies logging
@@ -133,21 +177,16 @@ type (
 	}
 )
 
-// FirstRPC tests that we can successfully reach zcashd through the RPC
-// interface. The specific RPC used here is not important.
-func FirstRPC() {
+// FirstRPC tests that we can successfully reach zcashd through the
+// backend. The specific RPC used here is not important.
+func FirstRPC(backend NodeBackend) {
 	retryCount := 0
 	for {
-		result, rpcErr := RawRequest("getblockchaininfo", []json.RawMessage{})
+		_, rpcErr := backend.GetBlockchainInfo(context.Background())
 		if rpcErr == nil {
 			if retryCount > 0 {
 				Log.Warn("getblockchaininfo RPC successful")
 			}
-			var getblockchaininfo ZcashdRpcReplyGetblockchaininfo
-			err := json.Unmarshal(result, &getblockchaininfo)
-			if err != nil {
-				Log.Fatalf("error parsing JSON getblockchaininfo response: %v", err)
-			}
 			break
 		}
 		retryCount++
@@ -160,29 +199,18 @@ func FirstRPC() {
 			"error": rpcErr.Error(),
 			"retry": retryCount,
 		}).Warn("error with getblockchaininfo rpc, retrying...")
-		Sleep(time.Duration(10+retryCount*5) * time.Second) // backoff
+		sleep(context.Background(), time.Duration(10+retryCount*5)*time.Second) // backoff
 	}
 }
 
-func GetLightdInfo() (*walletrpc.LightdInfo, error) {
-	result, rpcErr := RawRequest("getinfo", []json.RawMessage{})
-	if rpcErr != nil {
-		return nil, rpcErr
-	}
-	var getinfoReply ZcashdRpcReplyGetinfo
-	err := json.Unmarshal(result, &getinfoReply)
+func GetLightdInfo(ctx context.Context, backend NodeBackend) (*walletrpc.LightdInfo, error) {
+	getinfoReply, err := backend.GetInfo(ctx)
 	if err != nil {
-		return nil, rpcErr
-	}
-
-	result, rpcErr = RawRequest("getblockchaininfo", []json.RawMessage{})
-	if rpcErr != nil {
-		return nil, rpcErr
+		return nil, err
 	}
-	var getblockchaininfoReply ZcashdRpcReplyGetblockchaininfo
-	err = json.Unmarshal(result, &getblockchaininfoReply)
+	getblockchaininfoReply, err := backend.GetBlockchainInfo(ctx)
 	if err != nil {
-		return nil, rpcErr
+		return nil, err
 	}
 	// If the sapling consensus branch doesn't exist, it must be regtest
 	var saplingHeight int
@@ -209,93 +237,130 @@ func GetLightdInfo() (*walletrpc.LightdInfo, error) {
 		EstimatedHeight:         uint64(getblockchaininfoReply.EstimatedHeight),
 		ZcashdBuild:             getinfoReply.Build,
 		ZcashdSubversion:        getinfoReply.Subversion,
+		Compressors:             Compressors,
 	}, nil
 }
 
-func getBlockFromRPC(height int) (*walletrpc.CompactBlock, error) {
-	params := make([]json.RawMessage, 2)
-	heightJSON, err := json.Marshal(strconv.Itoa(height))
-	if err != nil {
-		return nil, errors.Wrap(err, "error marshaling height")
-	}
-	params[0] = heightJSON
-	params[1] = json.RawMessage("0") // non-verbose (raw hex)
-	result, rpcErr := RawRequest("getblock", params)
+var (
+	ingestorRunning bool
+	ingestorCancel  context.CancelFunc
+	ingestorDone    chan struct{}
+)
 
-	// For some reason, the error responses are not JSON
-	if rpcErr != nil {
-		// Check to see if we are requesting a height the zcashd doesn't have yet
-		if (strings.Split(rpcErr.Error(), ":"))[0] == "-8" {
-			return nil, nil
-		}
-		return nil, errors.Wrap(rpcErr, "error requesting block")
+func startIngestor(ctx context.Context, backend NodeBackend, c *BlockCache) {
+	if !ingestorRunning {
+		ingestorRunning = true
+		ctx, ingestorCancel = context.WithCancel(ctx)
+		ingestorDone = make(chan struct{})
+		go func(done chan struct{}) {
+			BlockIngestor(ctx, backend, c, 0)
+			close(done)
+		}(ingestorDone)
 	}
+}
 
-	var blockDataHex string
-	err = json.Unmarshal(result, &blockDataHex)
-	if err != nil {
-		return nil, errors.Wrap(err, "error reading JSON response")
+// stopIngestor stops the ingestor started by startIngestor and waits for it to exit.
+func stopIngestor() {
+	if ingestorRunning {
+		ingestorRunning = false
+		ingestorCancel()
+		<-ingestorDone
 	}
+}
 
-	blockData, err := hex.DecodeString(blockDataHex)
-	if err != nil {
-		return nil, errors.Wrap(err, "error decoding getblock output")
-	}
+// ingestorPaused is nonzero while the block ingestor is paused (by an admin).
+var ingestorPaused int32
 
-	block := parser.NewBlock()
-	rest, err := block.ParseFromSlice(blockData)
-	if err != nil {
-		return nil, errors.Wrap(err, "error parsing block")
-	}
-	if len(rest) != 0 {
-		return nil, errors.New("received overlong message")
+// PauseIngestor stops the block ingestor from fetching blocks until
+// ResumeIngestor is called; the cache continues to serve the blocks it has.
+func PauseIngestor() {
+	if atomic.SwapInt32(&ingestorPaused, 1) == 0 {
+		Log.Info("Block ingestor paused")
 	}
+}
 
-	if block.GetHeight() != height {
-		return nil, errors.New("received unexpected height block")
+// ResumeIngestor lets a paused block ingestor continue.
+func ResumeIngestor() {
+	if atomic.SwapInt32(&ingestorPaused, 0) == 1 {
+		Log.Info("Block ingestor resumed")
 	}
-
-	return block.ToCompact(), nil
 }
 
-var (
-	ingestorRunning  bool
-	stopIngestorChan = make(chan struct{})
-)
+// IngestorPaused returns true if the block ingestor is paused.
+func IngestorPaused() bool {
+	return atomic.LoadInt32(&ingestorPaused) != 0
+}
 
-func startIngestor(c *BlockCache) {
-	if !ingestorRunning {
-		ingestorRunning = true
-		go BlockIngestor(c, 0)
+// sleep pauses for the given duration (or calls Sleep, if it's mocked),
+// returning false early if ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if Sleep != nil {
+		Sleep(d)
+		return ctx.Err() == nil
 	}
-}
-func stopIngestor() {
-	if ingestorRunning {
-		ingestorRunning = false
-		stopIngestorChan <- struct{}{}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
 // BlockIngestor runs as a goroutine and polls zcashd for new blocks, adding them
-// to the cache. The repetition count, rep, is nonzero only for unit-testing.
-func BlockIngestor(c *BlockCache, rep int) {
+// to the cache, until ctx is cancelled. The repetition count, rep, is nonzero
+// only for unit-testing.
+func BlockIngestor(ctx context.Context, backend NodeBackend, c *BlockCache, rep int) {
 	lastLog := time.Now()
 	reorgCount := 0
 	lastHeightLogged := 0
 	retryCount := 0
+	rejectCount := 0
 	wait := true
+	// Hashes of the blocks removed while backing up to look for a reorg, by
+	// height, to tell whether the blocks that replace them are different.
+	orphaned := make(map[int][]byte)
+	times := make(blockTimes)
+	// reject waits to retry a block that failed a check, unless zcashd keeps
+	// sending invalid blocks; it returns false if ctx was cancelled.
+	reject := func(height int, err error) bool {
+		Log.WithFields(logrus.Fields{
+			"height": height,
+			"error":  err,
+		}).Warn("rejected block from zcashd")
+		rejectCount++
+		if rejectCount > 10 {
+			Log.Fatal("zcashd keeps sending invalid blocks")
+		}
+		return sleep(ctx, 10*time.Second)
+	}
 
 	// Start listening for new blocks
 	for i := 0; rep == 0 || i < rep; i++ {
 		// stop if requested
 		select {
-		case <-stopIngestorChan:
+		case <-ctx.Done():
+			Log.Info("Block ingestor stopping at height ", c.GetNextHeight())
 			return
 		default:
 		}
+		if IngestorPaused() {
+			if !sleep(ctx, time.Second) {
+				return
+			}
+			continue
+		}
 
 		height := c.GetNextHeight()
-		block, err := getBlockFromRPC(height)
+		block, err := backend.GetBlock(ctx, height)
+		if _, ok := err.(*InvalidBlockError); ok {
+			// zcashd was reached, so this isn't a failed RPC.
+			if !reject(height, err) {
+				return
+			}
+			continue
+		}
 		if err != nil {
 			Log.WithFields(logrus.Fields{
 				"height": height,
@@ -309,7 +374,9 @@ func BlockIngestor(c *BlockCache, rep int) {
 			}
 			// Delay then retry the same height.
 			c.Sync()
-			Sleep(10 * time.Second)
+			if !sleep(ctx, 10*time.Second) {
+				return
+			}
 			wait = true
 			continue
 		}
@@ -320,7 +387,9 @@ func BlockIngestor(c *BlockCache, rep int) {
 				Log.Info("Waiting for zcashd height to reach Sapling activation height ",
 					"(", c.GetFirstHeight(), ")...")
 				reorgCount = 0
-				Sleep(20 * time.Second)
+				if !sleep(ctx, 20*time.Second) {
+					return
+				}
 				continue
 			}
 			if wait {
@@ -330,7 +399,9 @@ func BlockIngestor(c *BlockCache, rep int) {
 					Log.Info("Ingestor waiting for block: ", height)
 					lastHeightLogged = height - 1
 				}
-				Sleep(2 * time.Second)
+				if !sleep(ctx, 2*time.Second) {
+					return
+				}
 				wait = false
 				continue
 			}
@@ -361,15 +432,48 @@ func BlockIngestor(c *BlockCache, rep int) {
 				}).Warn("REORG")
 			}
 			// Try backing up
+			if hash := c.GetLatestHash(); hash != nil {
+				orphaned[height-1] = hash
+			}
+			times.remove(height - 1)
 			c.Reorg(height - 1)
 			continue
 		}
+		// The block follows the cache's tip; check it against any
+		// checkpoint at its height, and its time against the blocks before it.
+		err = checkCheckpoint(height, block)
+		if err == nil && BlockValidation.Time {
+			err = times.checkTime(ctx, c, height, block)
+		}
+		if err != nil {
+			if !reject(height, err) {
+				return
+			}
+			continue
+		}
+		rejectCount = 0
 		// We have a valid block to add.
 		wait = true
 		reorgCount = 0
+		if hash, ok := orphaned[height]; ok {
+			delete(orphaned, height)
+			if !bytes.Equal(hash, block.Hash) {
+				// This is the fork point; every orphaned block from here
+				// up has been replaced.
+				depth := 1
+				for h := range orphaned {
+					if h-height+1 > depth {
+						depth = h - height + 1
+					}
+				}
+				observeReorg(depth)
+				orphaned = make(map[int][]byte)
+			}
+		}
 		if err := c.Add(height, block); err != nil {
 			Log.Fatal("Cache add failed:", err)
 		}
+		times.add(height, block)
 		// Don't log these too often.
 		if time.Now().Sub(lastLog).Seconds() >= 4 && c.GetNextHeight() == height+1 && height != lastHeightLogged {
 			lastLog = time.Now()
@@ -381,38 +485,278 @@ func BlockIngestor(c *BlockCache, rep int) {
 
 // GetBlock returns the compact block at the requested height, first by querying
 // the cache, then, if not found, will request the block from zcashd. It returns
-// nil if no block exists at this height.
-func GetBlock(cache *BlockCache, height int) (*walletrpc.CompactBlock, error) {
+// nil if no block exists at this height. The block doesn't include Sprout
+// JoinSplits (see GetBlockRange).
+func GetBlock(ctx context.Context, backend NodeBackend, cache *BlockCache, height int) (*walletrpc.CompactBlock, error) {
+	block, err := getBlock(ctx, backend, cache, height)
+	if err != nil {
+		return nil, err
+	}
+	StripJoinSplits(block)
+	return block, nil
+}
+
+// getBlock is GetBlock, but keeps the blocks' Sprout JoinSplits, which both the
+// cache and zcashd (via parseCompactBlock) include.
+func getBlock(ctx context.Context, backend NodeBackend, cache *BlockCache, height int) (*walletrpc.CompactBlock, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "GetBlock",
+		trace.WithAttributes(attribute.Int("height", height)))
+	defer span.End()
+
 	// First, check the cache to see if we have the block
-	block := cache.Get(height)
+	block := cache.Get(ctx, height)
 	if block != nil {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
 		return block, nil
 	}
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+	block, _, err := getBlockFromBackend(ctx, backend, height)
+	return block, err
+}
 
-	// Not in the cache, ask zcashd
-	block, err := getBlockFromRPC(height)
+// getBlockFromBackend returns the compact block at the given height from
+// zcashd, for blocks that aren't in the cache, and separately, its full
+// header if zcashd provided it.
+func getBlockFromBackend(ctx context.Context, backend NodeBackend, height int) (*walletrpc.CompactBlock, []byte, error) {
+	block, err := backend.GetBlock(ctx, height)
 	if err != nil {
-		return nil, err
+		trace.SpanFromContext(ctx).RecordError(err)
+		return nil, nil, err
 	}
 	if block == nil {
 		// Block height is too large
-		return nil, errors.New("block requested is newer than latest block")
+		return nil, nil, errors.New("block requested is newer than latest block")
 	}
-	return block, nil
+	// Compact blocks are served without the full header.
+	header := block.Header
+	block.Header = nil
+	return block, header, nil
+}
+
+// StripJoinSplits removes the Sprout JoinSplits from a compact block, and the
+// transactions that have nothing else shielded, leaving it as wallets that
+// don't ask for JoinSplits expect it.
+func StripJoinSplits(block *walletrpc.CompactBlock) {
+	vtx := block.Vtx[:0]
+	for _, tx := range block.Vtx {
+		tx.JoinSplits = nil
+		if len(tx.Spends)+len(tx.Outputs)+len(tx.Actions) > 0 {
+			vtx = append(vtx, tx)
+		}
+	}
+	block.Vtx = vtx
 }
 
-// GetBlockRange returns a sequence of consecutive blocks in the given range.
-func GetBlockRange(cache *BlockCache, blockOut chan<- *walletrpc.CompactBlock, errOut chan<- error, start, end int) {
-	// Go over [start, end] inclusive
-	for i := start; i <= end; i++ {
-		block, err := GetBlock(cache, i)
+// withHeader returns the block with its full header, from the cache's header
+// store (header) or else from zcashd, in place of its transactions. The header
+// must be that of the block the cache has (or zcashd returns) at that height,
+// so that the headers and compact blocks served are from the same chain.
+func withHeader(ctx context.Context, backend NodeBackend, block *walletrpc.CompactBlock, header []byte) (*walletrpc.CompactBlock, error) {
+	if header == nil {
+		// Blocks cached before the header store was added, or followed
+		// from an upstream lightwalletd, have no stored header.
+		var err error
+		header, err = backend.GetBlockHeader(ctx, int(block.Height))
 		if err != nil {
-			errOut <- err
+			return nil, err
+		}
+		if header == nil {
+			return nil, errors.New("block requested is newer than latest block")
+		}
+	}
+	hdr := parser.NewBlockHeader()
+	if _, err := hdr.ParseFromSlice(header); err != nil {
+		return nil, errors.Wrap(err, "error parsing block header")
+	}
+	if !bytes.Equal(hdr.GetEncodableHash(), block.Hash) {
+		return nil, errors.New("block header doesn't match the cached block (a reorg may be in progress)")
+	}
+	return &walletrpc.CompactBlock{
+		ProtoVersion: block.ProtoVersion,
+		Height:       block.Height,
+		Hash:         block.Hash,
+		PrevHash:     block.PrevHash,
+		Time:         block.Time,
+		Header:       header,
+	}, nil
+}
+
+// Blocks are read for GetBlockRange and GetBlockHeaderRange in batches, each
+// read while the previous one is being sent.
+const (
+	blockRangeBatch    = 100 // blocks per batch
+	blockRangeFetchers = 8   // concurrent zcashd requests for blocks not in the cache
+)
+
+// blockBatch is a batch of blocks in the order they're to be sent; if err is
+// set, getting the block after them failed.
+type blockBatch struct {
+	blocks []*walletrpc.CompactBlock
+	err    error
+}
+
+// GetBlockRange returns a sequence of consecutive blocks from start to end
+// inclusive, in descending order if end < start, with their Sprout JoinSplits
+// if joinSplits is set. It reads one batch of blocks ahead of those it sends,
+// so a client that doesn't keep up (blockOut isn't read while the stream's
+// flow control window is full) doesn't make it read further. It stops early,
+// and returns only once it has stopped reading, if ctx is cancelled (the
+// client has gone away).
+func GetBlockRange(ctx context.Context, backend NodeBackend, cache *BlockCache, blockOut chan<- *walletrpc.CompactBlock, errOut chan<- error, start, end int, joinSplits bool) {
+	ctx, span := tracing.Tracer().Start(ctx, "GetBlockRange",
+		trace.WithAttributes(attribute.Int("start", start), attribute.Int("end", end)))
+	defer span.End()
+	sendBlockRange(ctx, backend, cache, blockOut, errOut, start, end, joinSplits, false)
+}
+
+// GetBlockHeaderRange is GetBlockRange for GetBlockHeaders: each block has its
+// full serialized header, from the cache's header store or else from zcashd,
+// in place of its transactions.
+func GetBlockHeaderRange(ctx context.Context, backend NodeBackend, cache *BlockCache, blockOut chan<- *walletrpc.CompactBlock, errOut chan<- error, start, end int) {
+	ctx, span := tracing.Tracer().Start(ctx, "GetBlockHeaderRange",
+		trace.WithAttributes(attribute.Int("start", start), attribute.Int("end", end)))
+	defer span.End()
+	sendBlockRange(ctx, backend, cache, blockOut, errOut, start, end, false, true)
+}
+
+// sendBlockRange sends the blocks for GetBlockRange, or with headers set,
+// GetBlockHeaderRange.
+func sendBlockRange(ctx context.Context, backend NodeBackend, cache *BlockCache, blockOut chan<- *walletrpc.CompactBlock, errOut chan<- error, start, end int, joinSplits, headers bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	batches := make(chan blockBatch)
+	go readBlockRange(ctx, backend, cache, batches, start, end, headers)
+	defer func() {
+		cancel()
+		for range batches {
+		}
+	}()
+
+	for batch := range batches {
+		for _, block := range batch.blocks {
+			if !joinSplits {
+				StripJoinSplits(block)
+			}
+			select {
+			case blockOut <- block:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if batch.err != nil {
+			select {
+			case errOut <- batch.err:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	select {
+	case errOut <- nil:
+	case <-ctx.Done():
+	}
+}
+
+// readBlockRange reads the blocks from start to end (see GetBlockRange), with
+// their headers if headers is set, in batches, stopping after the first error.
+func readBlockRange(ctx context.Context, backend NodeBackend, cache *BlockCache, batches chan<- blockBatch, start, end int, headers bool) {
+	defer close(batches)
+	step := 1
+	if end < start {
+		step = -1
+	}
+	for first := start; ; {
+		last := first + step*(blockRangeBatch-1)
+		if (last-end)*step > 0 {
+			last = end
+		}
+		batch := readBlockBatch(ctx, backend, cache, first, last, headers)
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return
+		}
+		if batch.err != nil || last == end {
 			return
 		}
-		blockOut <- block
+		first = last + step
+	}
+}
+
+// readBlockBatch reads the blocks from first to last (either way round), and
+// with headers set, their headers, from the cache, and those it doesn't have
+// from zcashd, concurrently.
+func readBlockBatch(ctx context.Context, backend NodeBackend, cache *BlockCache, first, last int, headers bool) blockBatch {
+	low, high := first, last
+	if low > high {
+		low, high = high, low
+	}
+	cached := cache.GetRange(ctx, low, high)
+
+	step := 1
+	if last < first {
+		step = -1
+	}
+	blocks := make([]*walletrpc.CompactBlock, high-low+1)
+	errs := make([]error, len(blocks))
+	var wg sync.WaitGroup
+	var failed int32
+	fetchers := make(chan struct{}, blockRangeFetchers)
+	for i := range blocks {
+		height := first + i*step
+		block := cached[height-low]
+		var header []byte
+		if block != nil && headers {
+			header = cache.GetHeader(height)
+		}
+		if block != nil && (!headers || header != nil) {
+			// The cache has everything needed.
+			if headers {
+				block, errs[i] = withHeader(ctx, backend, block, header)
+			}
+			blocks[i] = block
+			if errs[i] != nil {
+				break
+			}
+			continue
+		}
+		fetchers <- struct{}{}
+		// Blocks are fetched in order, so once one has failed, the
+		// following ones won't be sent.
+		if atomic.LoadInt32(&failed) != 0 {
+			<-fetchers
+			break
+		}
+		wg.Add(1)
+		go func(i, height int, block *walletrpc.CompactBlock) {
+			defer func() {
+				<-fetchers
+				wg.Done()
+			}()
+			var header []byte
+			var err error
+			if block == nil {
+				block, header, err = getBlockFromBackend(ctx, backend, height)
+			}
+			if err == nil && headers {
+				block, err = withHeader(ctx, backend, block, header)
+			}
+			blocks[i], errs[i] = block, err
+			if err != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i, height, block)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return blockBatch{blocks: blocks[:i], err: err}
+		}
 	}
-	errOut <- nil
+	return blockBatch{blocks: blocks}
 }
 
 func displayHash(hash []byte) string {
@@ -5,6 +5,7 @@ package common
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -16,6 +17,12 @@ import (
 	"github.com/asherda/lightwalletd/walletrpc"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ------------------------------------------ Setup
@@ -78,6 +85,25 @@ func sleepStub(d time.Duration) {
 	sleepDuration += d
 }
 
+func TestSleep(t *testing.T) {
+	saved := Sleep
+	Sleep = nil
+	defer func() { Sleep = saved }()
+	if !sleep(context.Background(), time.Millisecond) {
+		t.Fatal("sleep failed")
+	}
+	// Cancelling the context ends a long sleep.
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	start := time.Now()
+	if sleep(ctx, time.Hour) {
+		t.Fatal("cancelled sleep succeeded")
+	}
+	if time.Since(start) > time.Minute {
+		t.Fatal("cancelled sleep took too long")
+	}
+}
+
 // ------------------------------------------ GetLightdInfo()
 
 func getLightdInfoStub(method string, params []json.RawMessage) (json.RawMessage, error) {
@@ -109,10 +135,10 @@ func getLightdInfoStub(method string, params []json.RawMessage) (json.RawMessage
 
 func TestGetLightdInfo(t *testing.T) {
 	testT = t
-	RawRequest = getLightdInfoStub
+	backend := NewRPCBackend(getLightdInfoStub)
 	Sleep = sleepStub
 	// This calls the getblockchaininfo rpc just to establish connectivity with zcashd
-	FirstRPC()
+	FirstRPC(backend)
 
 	// Ensure the retry happened as expected
 	logFile, err := ioutil.ReadFile("test-log")
@@ -128,7 +154,7 @@ func TestGetLightdInfo(t *testing.T) {
 	}
 
 	// Check the success case (second attempt)
-	getLightdInfo, err := GetLightdInfo()
+	getLightdInfo, err := GetLightdInfo(context.Background(), backend)
 	if err != nil {
 		t.Fatal("GetLightdInfo failed")
 	}
@@ -269,11 +295,15 @@ func getblockStub(method string, params []json.RawMessage) (json.RawMessage, err
 
 func TestBlockIngestor(t *testing.T) {
 	testT = t
-	RawRequest = getblockStub
 	Sleep = sleepStub
 	os.RemoveAll(unitTestPath)
-	testcache := NewBlockCache(unitTestPath, unitTestChain, 380640, false)
-	BlockIngestor(testcache, 11)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcache := NewBlockCache(db, unitTestChain, 380640, false)
+	BlockIngestor(context.Background(), NewRPCBackend(getblockStub), testcache, 11)
+	testcache.Close()
 	if step != 11 {
 		t.Error("unexpected final step", step)
 	}
@@ -283,55 +313,224 @@ func TestBlockIngestor(t *testing.T) {
 	os.RemoveAll(unitTestPath)
 }
 
+// getblockRangeStub returns the first two test blocks, at 380640 and 380641,
+// in any order (GetBlockRange fetches blocks concurrently).
+func getblockRangeStub(method string, params []json.RawMessage) (json.RawMessage, error) {
+	var height string
+	if err := json.Unmarshal(params[0], &height); err != nil {
+		return nil, err
+	}
+	switch height {
+	case "380640":
+		return blocks[0], nil
+	case "380641":
+		return blocks[1], nil
+	}
+	return nil, errors.New("-8: Block height out of range")
+}
+
+// receiveBlocks returns the heights of the blocks GetBlockRange sends, and
+// its final error.
+func receiveBlocks(blockChan <-chan *walletrpc.CompactBlock, errChan <-chan error) ([]uint64, error) {
+	var heights []uint64
+	for {
+		select {
+		case err := <-errChan:
+			return heights, err
+		case block := <-blockChan:
+			heights = append(heights, block.Height)
+		}
+	}
+}
+
 func TestGetBlockRange(t *testing.T) {
-	testT = t
-	RawRequest = getblockStub
+	backend := NewRPCBackend(getblockRangeStub)
 	os.RemoveAll(unitTestPath)
-	testcache := NewBlockCache(unitTestPath, unitTestChain, 380640, true)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcache := NewBlockCache(db, unitTestChain, 380640, true)
+	defer testcache.Close()
 	blockChan := make(chan *walletrpc.CompactBlock)
 	errChan := make(chan error)
-	go GetBlockRange(testcache, blockChan, errChan, 380640, 380642)
 
-	// read in block 380640
-	select {
-	case err := <-errChan:
-		// this will also catch context.DeadlineExceeded from the timeout
+	// Block 380642 isn't there (it's past the tip).
+	go GetBlockRange(context.Background(), backend, testcache, blockChan, errChan, 380640, 380642, false)
+	heights, err := receiveBlocks(blockChan, errChan)
+	if err == nil || err.Error() != "block requested is newer than latest block" {
 		t.Fatal("unexpected error:", err)
-	case cBlock := <-blockChan:
-		if cBlock.Height != 380640 {
-			t.Fatal("unexpected Height:", cBlock.Height)
-		}
+	}
+	if fmt.Sprint(heights) != "[380640 380641]" {
+		t.Fatal("unexpected heights:", heights)
 	}
 
-	// read in block 380641
-	select {
-	case err := <-errChan:
-		// this will also catch context.DeadlineExceeded from the timeout
+	go GetBlockRange(context.Background(), backend, testcache, blockChan, errChan, 380641, 380640, false)
+	heights, err = receiveBlocks(blockChan, errChan)
+	if err != nil {
 		t.Fatal("unexpected error:", err)
-	case cBlock := <-blockChan:
-		if cBlock.Height != 380641 {
-			t.Fatal("unexpected Height:", cBlock.Height)
-		}
 	}
+	if fmt.Sprint(heights) != "[380641 380640]" {
+		t.Fatal("unexpected descending heights:", heights)
+	}
+}
 
-	// try to read in block 380642, but this will fail (see case 3 above)
-	select {
-	case err := <-errChan:
-		// this will also catch context.DeadlineExceeded from the timeout
-		if err.Error() != "block requested is newer than latest block" {
+func TestGetBlockRangeBatches(t *testing.T) {
+	backend := NewRPCBackend(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("-8: Block height out of range")
+	})
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Several batches, with heights of four and five digits.
+	testcache := NewBlockCache(db, unitTestChain, 9900, true)
+	defer testcache.Close()
+	for height := 9900; height < 10150; height++ {
+		if err := testcache.Add(height, &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blockChan := make(chan *walletrpc.CompactBlock)
+	errChan := make(chan error)
+	check := func(start, end, count int, fails bool) {
+		go GetBlockRange(context.Background(), backend, testcache, blockChan, errChan, start, end, false)
+		heights, err := receiveBlocks(blockChan, errChan)
+		if (err != nil) != fails {
 			t.Fatal("unexpected error:", err)
 		}
-	case _ = <-blockChan:
-		t.Fatal("reading height 22 should have failed")
+		if len(heights) != count {
+			t.Fatal("unexpected number of blocks:", len(heights))
+		}
+		step := 1
+		if end < start {
+			step = -1
+		}
+		for i, height := range heights {
+			if height != uint64(start+i*step) {
+				t.Fatal("unexpected height:", height)
+			}
+		}
 	}
+	check(9900, 10149, 250, false)
+	check(10149, 9900, 250, false)
+	check(9990, 10200, 160, true)
+	check(9950, 9899, 51, true)
 
-	// check goroutine GetBlockRange() reaching the end of the range (and exiting)
-	go GetBlockRange(testcache, blockChan, errChan, 1, 0)
-	err := <-errChan
-	if err != nil {
-		t.Fatal("unexpected err return")
+	// Cancelling stops it, even while it's waiting to send.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		GetBlockRange(ctx, backend, testcache, blockChan, errChan, 9900, 10149, false)
+		close(done)
+	}()
+	if block := <-blockChan; block.Height != 9900 {
+		t.Fatal("unexpected height:", block.Height)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetBlockRange didn't stop when cancelled")
 	}
+}
+
+func TestGetBlockJoinSplits(t *testing.T) {
 	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcache := NewBlockCache(db, unitTestChain, 380640, true)
+	defer testcache.Close()
+	joinSplit := &walletrpc.CompactJoinSplit{
+		Nullifiers:   [][]byte{make([]byte, 32), make([]byte, 32)},
+		Commitments:  [][]byte{make([]byte, 32), make([]byte, 32)},
+		EphemeralKey: make([]byte, 32),
+	}
+	// The cache has a Sprout-only transaction, and one with a Sapling spend too.
+	if err := testcache.Add(380640, &walletrpc.CompactBlock{
+		Height:   380640,
+		Hash:     []byte(fmt.Sprintf("%032d", 380640)),
+		PrevHash: []byte(fmt.Sprintf("%032d", 380639)),
+		Vtx: []*walletrpc.CompactTx{
+			{Index: 1, JoinSplits: []*walletrpc.CompactJoinSplit{joinSplit}},
+			{Index: 2, Spends: []*walletrpc.CompactSpend{{Nf: make([]byte, 32)}},
+				JoinSplits: []*walletrpc.CompactJoinSplit{joinSplit}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	backend := NewRPCBackend(getblockStub)
+
+	block, err := GetBlock(context.Background(), backend, testcache, 380640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Vtx) != 1 || block.Vtx[0].Index != 2 || block.Vtx[0].JoinSplits != nil {
+		t.Fatal("GetBlock returned JoinSplits:", block.Vtx)
+	}
+
+	for _, joinSplits := range []bool{false, true} {
+		blockChan := make(chan *walletrpc.CompactBlock)
+		errChan := make(chan error)
+		go GetBlockRange(context.Background(), backend, testcache, blockChan, errChan, 380640, 380640, joinSplits)
+		block := <-blockChan
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+		if !joinSplits {
+			if len(block.Vtx) != 1 || block.Vtx[0].JoinSplits != nil {
+				t.Fatal("GetBlockRange returned unrequested JoinSplits:", block.Vtx)
+			}
+			continue
+		}
+		if len(block.Vtx) != 2 || len(block.Vtx[0].JoinSplits) != 1 || len(block.Vtx[1].JoinSplits) != 1 {
+			t.Fatal("GetBlockRange didn't return the JoinSplits:", block.Vtx)
+		}
+	}
+}
+
+func TestGetBlockTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	backend := NewRPCBackend(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("-8: Block height out of range")
+	})
+	// An empty cache, so GetBlock must ask zcashd.
+	cache := &BlockCache{firstBlock: 380640, nextBlock: 380640}
+	if _, err := GetBlock(context.Background(), backend, cache, 380640); err == nil {
+		t.Fatal("GetBlock unexpectedly succeeded")
+	}
+	spans := make(map[string]*sdktrace.SpanSnapshot)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	getBlock := spans["GetBlock"]
+	if getBlock == nil || spans["BlockCache.Get"] == nil || spans["zcashd.getblock"] == nil {
+		t.Fatal("missing spans", spans)
+	}
+	for _, child := range []string{"BlockCache.Get", "zcashd.getblock"} {
+		if spans[child].Parent.SpanID() != getBlock.SpanContext.SpanID() {
+			t.Fatal("span", child, "isn't a child of GetBlock")
+		}
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range getBlock.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["height"].AsInt64() != 380640 || attrs["cache.hit"].AsBool() {
+		t.Fatal("unexpected GetBlock attributes", getBlock.Attributes)
+	}
 }
 
 func TestGenerateCerts(t *testing.T) {
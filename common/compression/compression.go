@@ -0,0 +1,362 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+// Package compression provides the gzip and zstd gRPC compressors the
+// server offers, and reports how well each call's responses compress.
+//
+// A gRPC server compresses its responses with the algorithm the client
+// compressed its request with, so a client that wants compressed compact
+// blocks from GetBlockRange (for instance) sends its request with
+// grpc.UseCompressor("zstd"). GetLightdInfo lists the algorithms the server
+// accepts; the interceptors reject calls that use any other.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// Algorithms that Config.Algorithms may name.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Levels that Config.Level may name, from the fastest (and least
+// compression) to the slowest.
+const (
+	LevelFastest = "fastest"
+	LevelDefault = "default"
+	LevelBetter  = "better"
+	LevelBest    = "best"
+)
+
+var gzipLevels = map[string]int{
+	LevelFastest: gzip.BestSpeed,
+	LevelDefault: gzip.DefaultCompression,
+	LevelBetter:  7,
+	LevelBest:    gzip.BestCompression,
+}
+
+var zstdLevels = map[string]zstd.EncoderLevel{
+	LevelFastest: zstd.SpeedFastest,
+	LevelDefault: zstd.SpeedDefault,
+	LevelBetter:  zstd.SpeedBetterCompression,
+	LevelBest:    zstd.SpeedBestCompression,
+}
+
+// Limits on the memory each zstd stream may use. Every message is
+// compressed on its own, and gRPC messages are at most a few megabytes, so
+// a larger window wouldn't improve compression.
+const (
+	zstdWindowSize       = 1 << 20
+	zstdMaxDecoderMemory = 16 << 20
+)
+
+// Config specifies the compression the server offers.
+type Config struct {
+	Algorithms []string // Gzip and/or Zstd; empty disables compression
+	Level      string   // LevelFastest, LevelDefault (if empty), LevelBetter or LevelBest
+}
+
+// Server applies a Config; its interceptors and stats handler enforce the
+// configured algorithms and measure compression.
+type Server struct {
+	algorithms map[string]bool
+}
+
+// New registers the configured compressors with gRPC; it must be called
+// before any server or client connection is created.
+func New(cfg Config) (*Server, error) {
+	level := cfg.Level
+	if level == "" {
+		level = LevelDefault
+	}
+	if _, ok := gzipLevels[level]; !ok {
+		return nil, fmt.Errorf("unknown compression level %q (use %s, %s, %s or %s)",
+			cfg.Level, LevelFastest, LevelDefault, LevelBetter, LevelBest)
+	}
+	s := &Server{algorithms: make(map[string]bool)}
+	for _, name := range cfg.Algorithms {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "":
+			continue
+		case Gzip:
+			encoding.RegisterCompressor(newGzipCompressor(gzipLevels[level]))
+		case Zstd:
+			c, err := newZstdCompressor(zstdLevels[level])
+			if err != nil {
+				return nil, err
+			}
+			encoding.RegisterCompressor(c)
+		default:
+			return nil, fmt.Errorf("unknown compression algorithm %q (use %s or %s)", name, Gzip, Zstd)
+		}
+		s.algorithms[name] = true
+	}
+	return s, nil
+}
+
+// Algorithms returns the names of the enabled algorithms, for GetLightdInfo.
+func (s *Server) Algorithms() []string {
+	var names []string
+	for _, name := range []string{Gzip, Zstd} {
+		if s.algorithms[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// check returns an error if the call was compressed with an algorithm that
+// isn't enabled. (gRPC decompresses a call's request with any registered
+// compressor, and other packages may register gzip.)
+func (s *Server) check(ctx context.Context) error {
+	stream, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string })
+	if !ok {
+		return nil
+	}
+	name := stream.RecvCompress()
+	if name == "" || name == encoding.Identity || s.algorithms[name] {
+		return nil
+	}
+	return status.Errorf(codes.Unimplemented, "compression %q is not supported by this server", name)
+}
+
+// UnaryInterceptor rejects calls compressed with an algorithm that isn't enabled.
+func (s *Server) UnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if err := s.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor rejects calls compressed with an algorithm that isn't enabled.
+func (s *Server) StreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if err := s.check(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// gzipCompressor is like grpc's encoding/gzip, at a chosen level.
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+	level   int
+}
+
+func newGzipCompressor(level int) *gzipCompressor {
+	return &gzipCompressor{level: level}
+}
+
+func (c *gzipCompressor) Name() string {
+	return Gzip
+}
+
+func (c *gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if z, ok := c.writers.Get().(*gzip.Writer); ok {
+		z.Reset(w)
+		return &gzipWriter{Writer: z, pool: &c.writers}, nil
+	}
+	z, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{Writer: z, pool: &c.writers}, nil
+}
+
+type gzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *gzipWriter) Close() error {
+	defer w.pool.Put(w.Writer)
+	return w.Writer.Close()
+}
+
+func (c *gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	z, ok := c.readers.Get().(*gzip.Reader)
+	if !ok {
+		var err error
+		if z, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	} else if err := z.Reset(r); err != nil {
+		c.readers.Put(z)
+		return nil, err
+	}
+	return &pooledReader{Reader: z, release: func() { c.readers.Put(z) }}, nil
+}
+
+// zstdCompressor compresses with zstd. Its encoder compresses whole
+// messages at once, which needs no per-stream state, with at most
+// GOMAXPROCS messages being compressed at a time.
+type zstdCompressor struct {
+	encoder  *zstd.Encoder
+	decoders sync.Pool
+}
+
+func newZstdCompressor(level zstd.EncoderLevel) (*zstdCompressor, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(level),
+		zstd.WithWindowSize(zstdWindowSize))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{encoder: encoder}, nil
+}
+
+func (c *zstdCompressor) Name() string {
+	return Zstd
+}
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &zstdWriter{encoder: c.encoder, w: w}, nil
+}
+
+// zstdWriter collects a message and compresses it when closed.
+type zstdWriter struct {
+	encoder *zstd.Encoder
+	w       io.Writer
+	buf     bytes.Buffer
+}
+
+func (w *zstdWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *zstdWriter) Close() error {
+	_, err := w.w.Write(w.encoder.EncodeAll(w.buf.Bytes(), nil))
+	return err
+}
+
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	d, ok := c.decoders.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		d, err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdWindowSize),
+			zstd.WithDecoderMaxMemory(zstdMaxDecoderMemory))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := d.Reset(r); err != nil {
+		c.decoders.Put(d)
+		return nil, err
+	}
+	return &pooledReader{Reader: d, release: func() { c.decoders.Put(d) }}, nil
+}
+
+// pooledReader returns its decompressor to the pool once it has been read
+// to the end; gRPC reads each message to the end (or to its size limit).
+type pooledReader struct {
+	io.Reader
+	release func()
+}
+
+func (r *pooledReader) Read(p []byte) (int, error) {
+	if r.Reader == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.Reader = nil
+		r.release()
+	}
+	return n, err
+}
+
+var compressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "lightwalletd_grpc_compression_ratio",
+	Help:    "Ratio of the uncompressed to the compressed size of each compressed call's responses, by gRPC method and algorithm.",
+	Buckets: []float64{1, 1.25, 1.5, 2, 2.5, 3, 4, 6, 8},
+}, []string{"grpc_method", "algorithm"})
+
+func init() {
+	prometheus.MustRegister(compressionRatio)
+}
+
+// gRPC frames every message with a 5-byte header, which is included in
+// its wire length.
+const messageHeaderLen = 5
+
+type callSizesKey struct{}
+
+// callSizes accumulates the sizes of a call's responses.
+type callSizes struct {
+	method       string
+	algorithm    string
+	uncompressed int
+	compressed   int
+	mutex        sync.Mutex
+}
+
+// StatsHandler returns a gRPC stats handler that records the compression
+// ratio of each call.
+func (s *Server) StatsHandler() stats.Handler {
+	return statsHandler{}
+}
+
+type statsHandler struct{}
+
+func (statsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, callSizesKey{}, &callSizes{method: info.FullMethodName})
+}
+
+func (statsHandler) HandleRPC(ctx context.Context, rs stats.RPCStats) {
+	sizes, ok := ctx.Value(callSizesKey{}).(*callSizes)
+	if !ok || rs.IsClient() {
+		return
+	}
+	sizes.mutex.Lock()
+	defer sizes.mutex.Unlock()
+	switch rs := rs.(type) {
+	case *stats.OutHeader:
+		sizes.algorithm = rs.Compression
+	case *stats.OutPayload:
+		sizes.uncompressed += rs.Length
+		sizes.compressed += rs.WireLength - messageHeaderLen
+	case *stats.End:
+		if sizes.algorithm == "" || sizes.algorithm == encoding.Identity || sizes.compressed <= 0 {
+			return
+		}
+		compressionRatio.WithLabelValues(sizes.method, sizes.algorithm).
+			Observe(float64(sizes.uncompressed) / float64(sizes.compressed))
+	}
+}
+
+func (statsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (statsHandler) HandleConn(ctx context.Context, cs stats.ConnStats) {}
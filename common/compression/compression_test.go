@@ -0,0 +1,233 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package compression
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+func roundTrip(t *testing.T, c encoding.Compressor, data []byte) []byte {
+	var compressed bytes.Buffer
+	w, err := c.Compress(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Decompress(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatalf("%s: data changed by compression", c.Name())
+	}
+	return compressed.Bytes()
+}
+
+func TestCompressors(t *testing.T) {
+	zstdCompressor, err := newZstdCompressor(zstdLevels[LevelDefault])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("compact block "), 1000)
+	for _, c := range []encoding.Compressor{newGzipCompressor(gzipLevels[LevelDefault]), zstdCompressor} {
+		// Again, with pooled (de)compressors.
+		for i := 0; i < 3; i++ {
+			if compressed := roundTrip(t, c, data); len(compressed) > len(data)/10 {
+				t.Fatalf("%s: compressed %d bytes to %d", c.Name(), len(data), len(compressed))
+			}
+			roundTrip(t, c, nil)
+		}
+		if _, err := ioutil.ReadAll(mustDecompress(t, c, []byte("not compressed"))); err == nil {
+			t.Fatalf("%s: invalid data was decompressed", c.Name())
+		}
+	}
+
+	// zstd frames needing a larger window than the limit are rejected.
+	encoder, err := zstd.NewWriter(nil, zstd.WithWindowSize(8<<20), zstd.WithSingleSegment(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := make([]byte, 4<<20)
+	compressed := encoder.EncodeAll(large, nil)
+	if _, err := ioutil.ReadAll(mustDecompress(t, zstdCompressor, compressed)); err == nil {
+		t.Fatal("zstd frame with a large window was decompressed")
+	}
+}
+
+// mustDecompress returns a reader of the decompressed data, which fails if
+// Decompress does.
+func mustDecompress(t *testing.T, c encoding.Compressor, data []byte) io.Reader {
+	r, err := c.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return &errReader{err}
+	}
+	return r
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(Config{Algorithms: []string{" ZSTD", "", Gzip}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithms := s.Algorithms(); len(algorithms) != 2 || algorithms[0] != Gzip || algorithms[1] != Zstd {
+		t.Fatal("unexpected algorithms", algorithms)
+	}
+	if encoding.GetCompressor(Zstd) == nil {
+		t.Fatal("zstd compressor not registered")
+	}
+	if _, err := New(Config{Algorithms: []string{"brotli"}}); err == nil {
+		t.Fatal("unknown algorithm accepted")
+	}
+	if _, err := New(Config{Level: "fast"}); err == nil {
+		t.Fatal("unknown level accepted")
+	}
+	if s, err := New(Config{}); err != nil || len(s.Algorithms()) != 0 {
+		t.Fatal("unexpected result with no algorithms", err)
+	}
+}
+
+// blockServer streams compressible compact blocks.
+type blockServer struct {
+	walletrpc.UnimplementedCompactTxStreamerServer
+}
+
+func (blockServer) GetBlockRange(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetBlockRangeServer) error {
+	for height := span.Start.Height; height <= span.End.Height; height++ {
+		block := &walletrpc.CompactBlock{
+			Height: height,
+			Hash:   make([]byte, 32),
+			Header: make([]byte, 1487),
+		}
+		if err := resp.Send(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func histogram(t *testing.T, method, algorithm string) *dto.Histogram {
+	var m dto.Metric
+	if err := compressionRatio.WithLabelValues(method, algorithm).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Histogram
+}
+
+func TestServer(t *testing.T) {
+	s, err := New(Config{Algorithms: []string{Gzip, Zstd}, Level: LevelFastest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Accept only zstd, though both are registered.
+	s.algorithms = map[string]bool{Zstd: true}
+
+	server := grpc.NewServer(
+		grpc.StreamInterceptor(s.StreamInterceptor),
+		grpc.StatsHandler(s.StatsHandler()))
+	walletrpc.RegisterCompactTxStreamerServer(server, blockServer{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := walletrpc.NewCompactTxStreamerClient(conn)
+
+	const method = "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetBlockRange"
+	span := &walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 1000},
+		End:   &walletrpc.BlockID{Height: 1009},
+	}
+	getBlocks := func(opts ...grpc.CallOption) (int, error) {
+		stream, err := client.GetBlockRange(context.Background(), span, opts...)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for {
+			block, err := stream.Recv()
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+			if block.Height != span.Start.Height+uint64(n) || len(block.Header) != 1487 {
+				t.Fatal("unexpected block", block.Height)
+			}
+			n++
+		}
+	}
+
+	before := histogram(t, method, Zstd).GetSampleCount()
+	if n, err := getBlocks(grpc.UseCompressor(Zstd)); err != nil || n != 10 {
+		t.Fatal("zstd stream failed", n, err)
+	}
+	// The server records the call when it ends, which may be just after
+	// the client has received everything.
+	h := histogram(t, method, Zstd)
+	for i := 0; i < 100 && h.GetSampleCount() == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		h = histogram(t, method, Zstd)
+	}
+	if h.GetSampleCount() != before+1 {
+		t.Fatal("compression ratio not recorded")
+	}
+
+	// Uncompressed calls work, and aren't recorded.
+	if n, err := getBlocks(); err != nil || n != 10 {
+		t.Fatal("uncompressed stream failed", n, err)
+	}
+	if histogram(t, method, Zstd).GetSampleCount() != before+1 {
+		t.Fatal("uncompressed call recorded")
+	}
+
+	if _, err := getBlocks(grpc.UseCompressor(Gzip)); status.Code(err) != codes.Unimplemented {
+		t.Fatal("gzip call wasn't rejected", err)
+	}
+	if histogram(t, method, Gzip).GetSampleCount() != 0 {
+		t.Fatal("rejected call recorded")
+	}
+	if h.GetSampleSum() < 5 {
+		t.Fatal("compact blocks compressed poorly", h.GetSampleSum())
+	}
+}
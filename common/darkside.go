@@ -3,18 +3,16 @@ package common
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
 )
 
 type darksideState struct {
@@ -59,18 +57,32 @@ type stagedTx struct {
 // the command line.
 var DarksideEnabled bool
 
+// darksideCtx is cancelled when darksidewalletd shuts down; it stops the
+// block ingestor, which is otherwise started and stopped by ApplyStaged().
+var darksideCtx context.Context
+
 // DarksideInit should be called once at startup in darksidewalletd mode.
-func DarksideInit(c *BlockCache, timeout int) {
+func DarksideInit(ctx context.Context, c *BlockCache, timeout int) {
 	Log.Info("Darkside mode running")
 	DarksideEnabled = true
+	darksideCtx = ctx
 	state.cache = c
-	RawRequest = darksideRawRequest
 	go func() {
-		time.Sleep(time.Duration(timeout) * time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(timeout) * time.Minute):
+		}
 		Log.Fatal("Shutting down darksidewalletd to prevent accidental deployment in production.")
 	}()
 }
 
+// DarksideStop waits for the block ingestor, if it's running, to exit; call
+// it at shutdown after cancelling the context passed to DarksideInit.
+func DarksideStop() {
+	stopIngestor()
+}
+
 // DarksideReset allows the wallet test code to specify values
 // that are returned by GetLightdInfo().
 func DarksideReset(sa int, bi, cn string) error {
@@ -179,35 +191,21 @@ func DarksideApplyStaged(height int) error {
 		if tx.height >= state.startHeight+len(state.activeBlocks) {
 			return errors.New("transaction height too high")
 		}
-		block := state.activeBlocks[tx.height-state.startHeight]
-		// The next one or 3 bytes encode the number of transactions to follow,
-		// little endian.
-		nTxFirstByte := block[1487]
-		switch {
-		case nTxFirstByte < 252:
-			block[1487]++
-		case nTxFirstByte == 252:
-			// incrementing to 253, requires "253" followed by 2-byte length,
-			// extend the block by two bytes, shift existing transaction bytes
-			block = append(block, 0, 0)
-			copy(block[1490:], block[1488:len(block)-2])
-			block[1487] = 253
-			block[1488] = 253
-			block[1489] = 0
-		case nTxFirstByte == 253:
-			block[1488]++
-			if block[1488] == 0 {
-				// wrapped around
-				block[1489]++
-			}
-		default:
-			// no need to worry about more than 64k transactions
-			Log.Fatal("unexpected compact transaction count ", nTxFirstByte,
-				", can't support more than 64k transactions in a block")
+		// Rebuilding the block gives it a new merkle root, and so a new
+		// hash, as adding a transaction to a real block would.
+		block := parser.NewBlock()
+		if _, err := block.ParseFromSlice(state.activeBlocks[tx.height-state.startHeight]); err != nil {
+			return err
+		}
+		builder := parser.NewBlockBuilderFromBlock(block)
+		if err := builder.AddRawTransaction(tx.bytes); err != nil {
+			return err
 		}
-		block[68]++ // hack HashFinalSaplingRoot to mod the block hash
-		block = append(block, tx.bytes...)
-		state.activeBlocks[tx.height-state.startHeight] = block
+		blockBytes, err := builder.BuildBinary()
+		if err != nil {
+			return err
+		}
+		state.activeBlocks[tx.height-state.startHeight] = blockBytes
 	}
 	setPrevhash()
 	state.latestHeight = height
@@ -217,7 +215,7 @@ func DarksideApplyStaged(height int) error {
 
 	// The block ingestor can only run if there are blocks
 	if len(state.activeBlocks) > 0 {
-		startIngestor(state.cache)
+		startIngestor(darksideCtx, DarksideBackend, state.cache)
 	} else {
 		stopIngestor()
 	}
@@ -308,47 +306,13 @@ func DarksideStageBlocksCreate(height int32, nonce int32, count int32) error {
 	Log.Info("StageBlocksCreate(height=", height, ", nonce=", nonce, ", count=", count, ")")
 	for i := 0; i < int(count); i++ {
 
-		fakeCoinbase := "0400008085202f890100000000000000000000000000000000000000000000000000" +
-			"00000000000000ffffffff2a03d12c0c00043855975e464b8896790758f824ceac97836" +
-			"22c17ed38f1669b8a45ce1da857dbbe7950e2ffffffff02a0ebce1d000000001976a914" +
-			"7ed15946ec14ae0cd8fa8991eb6084452eb3f77c88ac405973070000000017a914e445cf" +
-			"a944b6f2bdacefbda904a81d5fdd26d77f8700000000000000000000000000000000000000"
-
-		// This coinbase transaction was pulled from block 797905, whose
-		// little-endian encoding is 0xD12C0C00. Replace it with the block
-		// number we want.
-		fakeCoinbase = strings.Replace(fakeCoinbase, "d12c0c00",
-			fmt.Sprintf("%02x", height&0xFF)+
-				fmt.Sprintf("%02x", (height>>8)&0xFF)+
-				fmt.Sprintf("%02x", (height>>16)&0xFF)+
-				fmt.Sprintf("%02x", (height>>24)&0xFF), 1)
-		fakeCoinbaseBytes, err := hex.DecodeString(fakeCoinbase)
-		if err != nil {
-			Log.Fatal(err)
-		}
-
-		hashOfTxnsAndHeight := sha256.Sum256([]byte(string(nonce) + "#" + string(height)))
-		blockHeader := &parser.BlockHeader{
-			RawBlockHeader: &parser.RawBlockHeader{
-				Version:              4,                      // start: 0
-				HashPrevBlock:        make([]byte, 32),       // start: 4
-				HashMerkleRoot:       hashOfTxnsAndHeight[:], // start: 36
-				HashFinalSaplingRoot: make([]byte, 32),       // start: 68
-				Time:                 1,                      // start: 100
-				NBitsBytes:           make([]byte, 4),        // start: 104
-				Nonce:                make([]byte, 32),       // start: 108
-				Solution:             make([]byte, 1344),     // starts: 140, 143
-			}, // length: 1487
-		}
-
-		headerBytes, err := blockHeader.MarshalBinary()
+		// The nonce gives blocks at the same height different hashes.
+		builder := parser.NewBlockBuilder(int(height), nil)
+		builder.SetNonce(uint64(uint32(nonce)))
+		blockBytes, err := builder.BuildBinary()
 		if err != nil {
-			Log.Fatal(err)
+			return err
 		}
-		blockBytes := make([]byte, 0)
-		blockBytes = append(blockBytes, headerBytes...)
-		blockBytes = append(blockBytes, byte(1))
-		blockBytes = append(blockBytes, fakeCoinbaseBytes...)
 		if err = darksideStageBlock("DarksideStageBlockCreate", blockBytes); err != nil {
 			// This should never fail since we created the block ourselves.
 			return err
@@ -363,148 +327,131 @@ func DarksideClearIncomingTransactions() {
 	state.incomingTransactions = make([][]byte, 0)
 }
 
-func darksideRawRequest(method string, params []json.RawMessage) (json.RawMessage, error) {
-	switch method {
-	case "getblockchaininfo":
-		blockchaininfo := &ZcashdRpcReplyGetblockchaininfo{
-			Chain: state.chainName,
-			Upgrades: map[string]Upgradeinfo{
-				"76b809bb": {ActivationHeight: state.startHeight},
-			},
-			Blocks:    state.latestHeight,
-			Consensus: ConsensusInfo{state.branchID, state.branchID},
-		}
-		return json.Marshal(blockchaininfo)
+// DarksideBackend is the NodeBackend in darksidewalletd mode; it presents
+// the blocks and transactions staged by the test code as a mock zcashd.
+var DarksideBackend NodeBackend = darksideBackend{}
+
+type darksideBackend struct{}
+
+func (darksideBackend) GetBlockchainInfo(ctx context.Context) (*ZcashdRpcReplyGetblockchaininfo, error) {
+	return &ZcashdRpcReplyGetblockchaininfo{
+		Chain: state.chainName,
+		Upgrades: map[string]Upgradeinfo{
+			"76b809bb": {ActivationHeight: state.startHeight},
+		},
+		Blocks:    state.latestHeight,
+		Consensus: ConsensusInfo{state.branchID, state.branchID},
+	}, nil
+}
 
-	case "getinfo":
-		info := &ZcashdRpcReplyGetinfo{}
-		return json.Marshal(info)
+func (darksideBackend) GetInfo(ctx context.Context) (*ZcashdRpcReplyGetinfo, error) {
+	return &ZcashdRpcReplyGetinfo{}, nil
+}
 
-	case "getblock":
-		var heightStr string
-		err := json.Unmarshal(params[0], &heightStr)
-		if err != nil {
-			return nil, errors.New("failed to parse getblock request")
-		}
+func (darksideBackend) GetBlock(ctx context.Context, height int) (*walletrpc.CompactBlock, error) {
+	blockData, err := darksideRawBlock(height)
+	if blockData == nil || err != nil {
+		return nil, err
+	}
+	return parseCompactBlock(blockData, height)
+}
 
-		height, err := strconv.Atoi(heightStr)
-		if err != nil {
-			return nil, errors.New("error parsing height as integer")
-		}
-		state.mutex.RLock()
-		defer state.mutex.RUnlock()
-		const notFoundErr = "-8:"
-		if len(state.activeBlocks) == 0 {
-			return nil, errors.New(notFoundErr)
-		}
-		if height > state.latestHeight {
-			return nil, errors.New(notFoundErr)
-		}
-		if height < state.startHeight {
-			return nil, errors.New(fmt.Sprint("getblock: requesting height ", height,
-				" is less than sapling activation height"))
-		}
-		index := height - state.startHeight
-		if index >= len(state.activeBlocks) {
-			return nil, errors.New(notFoundErr)
-		}
-		return json.Marshal(hex.EncodeToString(state.activeBlocks[index]))
+func (darksideBackend) GetBlockHeader(ctx context.Context, height int) ([]byte, error) {
+	blockData, err := darksideRawBlock(height)
+	if blockData == nil || err != nil {
+		return nil, err
+	}
+	return parseBlockHeader(blockData)
+}
 
-	case "getaddresstxids":
-		// Not required for minimal reorg testing.
-		return nil, errors.New("not implemented yet")
+// darksideRawBlock returns the active block at the given height, or nil if
+// there isn't one (yet).
+func darksideRawBlock(height int) ([]byte, error) {
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	if len(state.activeBlocks) == 0 {
+		return nil, nil
+	}
+	if height > state.latestHeight {
+		return nil, nil
+	}
+	if height < state.startHeight {
+		return nil, errors.New(fmt.Sprint("getblock: requesting height ", height,
+			" is less than sapling activation height"))
+	}
+	index := height - state.startHeight
+	if index >= len(state.activeBlocks) {
+		return nil, nil
+	}
+	return state.activeBlocks[index], nil
+}
 
-	case "getrawtransaction":
-		return darksideGetRawTransaction(params)
+func (darksideBackend) GetTreeState(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.TreeState, error) {
+	return nil, errors.New("there was an attempt to call an unsupported RPC")
+}
 
-	case "sendrawtransaction":
-		var rawtx string
-		err := json.Unmarshal(params[0], &rawtx)
-		if err != nil {
-			return nil, errors.New("failed to parse sendrawtransaction JSON")
-		}
-		txBytes, err := hex.DecodeString(rawtx)
-		if err != nil {
-			return nil, errors.New("failed to parse sendrawtransaction value as a hex string")
-		}
-		// Parse the transaction to get its hash (txid).
-		tx := parser.NewTransaction()
-		rest, err := tx.ParseFromSlice(txBytes)
-		if err != nil {
-			return nil, err
-		}
-		if len(rest) != 0 {
-			return nil, errors.New("transaction serialization is too long")
-		}
-		state.incomingTransactions = append(state.incomingTransactions, txBytes)
+func (darksideBackend) GetAddressTxids(ctx context.Context, addresses []string, start, end uint64) ([]string, error) {
+	// Not required for minimal reorg testing.
+	return nil, errors.New("not implemented yet")
+}
 
-		return []byte(hex.EncodeToString(tx.GetDisplayHash())), nil
+func (darksideBackend) GetAddressBalance(ctx context.Context, addresses []string) (int64, error) {
+	return 0, errors.New("there was an attempt to call an unsupported RPC")
+}
 
-	case "getrawmempool":
-		reply := make([]string, 0)
-		addTxToReply := func(txBytes []byte) {
-			ctx := parser.NewTransaction()
-			ctx.ParseFromSlice(txBytes)
-			reply = append(reply, hex.EncodeToString(ctx.GetDisplayHash()))
-		}
-		for _, blockBytes := range state.stagedBlocks {
-			block := parser.NewBlock()
-			block.ParseFromSlice(blockBytes)
-			for _, tx := range block.Transactions() {
-				addTxToReply(tx.Bytes())
-			}
-		}
-		for _, tx := range state.stagedTransactions {
-			addTxToReply(tx.bytes)
-		}
-		return json.Marshal(reply)
+func (darksideBackend) GetAddressUtxos(ctx context.Context, address string) (ZcashdRpcReplyGetaddressutxos, error) {
+	return nil, errors.New("there was an attempt to call an unsupported RPC")
+}
 
-	default:
-		return nil, errors.New("there was an attempt to call an unsupported RPC")
+func (darksideBackend) SendRawTransaction(ctx context.Context, txBytes []byte) (string, error) {
+	// Parse the transaction to get its hash (txid).
+	tx := parser.NewTransaction()
+	rest, err := tx.ParseFromSlice(txBytes)
+	if err != nil {
+		return "", err
 	}
+	if len(rest) != 0 {
+		return "", errors.New("transaction serialization is too long")
+	}
+	state.incomingTransactions = append(state.incomingTransactions, txBytes)
+
+	return hex.EncodeToString(tx.GetDisplayHash()), nil
 }
 
-func darksideGetRawTransaction(params []json.RawMessage) (json.RawMessage, error) {
-	if !state.resetted {
-		return nil, errors.New("please call Reset first")
+func (darksideBackend) GetMempool(ctx context.Context) ([]string, error) {
+	reply := make([]string, 0)
+	addTxToReply := func(txBytes []byte) {
+		ctx := parser.NewTransaction()
+		ctx.ParseFromSlice(txBytes)
+		reply = append(reply, hex.EncodeToString(ctx.GetDisplayHash()))
 	}
-	var rawtx string
-	err := json.Unmarshal(params[0], &rawtx)
-	if err != nil {
-		return nil, errors.New("failed to parse getrawtransaction JSON")
+	for _, blockBytes := range state.stagedBlocks {
+		block := parser.NewBlock()
+		block.ParseFromSlice(blockBytes)
+		for _, tx := range block.Transactions() {
+			addTxToReply(tx.Bytes())
+		}
 	}
-	txid, err := hex.DecodeString(rawtx)
-	if err != nil {
-		return nil, errors.New("-9: " + err.Error())
-	}
-	marshalReply := func(tx *parser.Transaction, height int) []byte {
-		switch string(params[1]) {
-		case "0":
-			txJSON, _ := json.Marshal(hex.EncodeToString(tx.Bytes()))
-			return txJSON
-		case "1":
-			reply := struct {
-				Hex    string
-				Height int
-			}{hex.EncodeToString(tx.Bytes()), height}
-			txVerboseJSON, _ := json.Marshal(reply)
-			return txVerboseJSON
-		default:
-			Log.Fatal("darkside only recognizes verbose 0 or 1")
-			return nil
+	for _, tx := range state.stagedTransactions {
+		addTxToReply(tx.bytes)
+	}
+	return reply, nil
+}
 
-		}
+func (darksideBackend) GetRawTransaction(ctx context.Context, txid []byte) (*walletrpc.RawTransaction, error) {
+	if !state.resetted {
+		return nil, errors.New("please call Reset first")
 	}
 	// Linear search for the tx, somewhat inefficient but this is test code
 	// and there aren't many blocks. If this becomes a performance problem,
 	// we can maintain a map of transactions indexed by txid.
-	findTxInBlocks := func(blocks [][]byte) json.RawMessage {
+	findTxInBlocks := func(blocks [][]byte) *walletrpc.RawTransaction {
 		for _, b := range blocks {
 			block := parser.NewBlock()
 			_, _ = block.ParseFromSlice(b)
 			for _, tx := range block.Transactions() {
 				if bytes.Equal(tx.GetDisplayHash(), txid) {
-					return marshalReply(tx, block.GetHeight())
+					return &walletrpc.RawTransaction{Data: tx.Bytes(), Height: uint64(block.GetHeight())}
 				}
 			}
 		}
@@ -523,7 +470,7 @@ func darksideGetRawTransaction(params []json.RawMessage) (json.RawMessage, error
 		tx := parser.NewTransaction()
 		_, _ = tx.ParseFromSlice(stx.bytes)
 		if bytes.Equal(tx.GetDisplayHash(), txid) {
-			return marshalReply(tx, 0), nil
+			return &walletrpc.RawTransaction{Data: tx.Bytes()}, nil
 		}
 	}
 	return nil, errors.New("-5: No information available about transaction")
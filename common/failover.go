@@ -0,0 +1,312 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/sirupsen/logrus"
+)
+
+// endpointCheckTimeout limits each health check of a daemon endpoint.
+const endpointCheckTimeout = 10 * time.Second
+
+// DaemonEndpoint is one of the nodes a FailoverBackend uses.
+type DaemonEndpoint struct {
+	Name    string // for logs and metrics, such as host:port
+	Backend NodeBackend
+}
+
+// endpointState is what the FailoverBackend knows about an endpoint.
+type endpointState struct {
+	DaemonEndpoint
+	healthy bool
+	height  int // -1 until the first health check
+}
+
+// FailoverBackend is a NodeBackend that uses several nodes. Calls go to the
+// nodes that are up and within maxLag blocks of the highest tip; if a node
+// can't be reached, the call is retried on the next one. The calls that the
+// block ingestor makes, and those that depend on the chain it has followed
+// (such as tree states), stick to one node (the primary) until it goes down
+// or falls behind, so that reorgs are resolved against a single view of the
+// chain. Other reads are spread over the nodes in turn.
+type FailoverBackend struct {
+	maxLag int
+
+	mutex     sync.Mutex
+	endpoints []*endpointState
+	primary   int // index into endpoints
+	next      int // next endpoint for load-balanced reads
+}
+
+// NewFailoverBackend returns a FailoverBackend using the endpoints, which
+// are preferred (as the primary) in the order given. Until the first health
+// check, all endpoints are assumed to be up.
+func NewFailoverBackend(endpoints []DaemonEndpoint, maxLag int) *FailoverBackend {
+	b := &FailoverBackend{maxLag: maxLag}
+	for _, e := range endpoints {
+		b.endpoints = append(b.endpoints, &endpointState{DaemonEndpoint: e, healthy: true, height: -1})
+		daemonEndpointUpGauge.WithLabelValues(e.Name).Set(1)
+	}
+	return b
+}
+
+// Run checks the endpoints at the given interval until ctx is cancelled.
+func (b *FailoverBackend) Run(ctx context.Context, interval time.Duration) {
+	for {
+		b.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Check gets each endpoint's tip height, and chooses a new primary if the
+// current one is down or lagging.
+func (b *FailoverBackend) Check(ctx context.Context) {
+	heights := make([]int, len(b.endpoints))
+	errs := make([]error, len(b.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range b.endpoints {
+		wg.Add(1)
+		go func(i int, e *endpointState) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, endpointCheckTimeout)
+			defer cancel()
+			info, err := e.Backend.GetBlockchainInfo(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			heights[i] = info.Blocks
+		}(i, e)
+	}
+	wg.Wait()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, e := range b.endpoints {
+		if errs[i] != nil {
+			b.markDown(e, errs[i])
+			continue
+		}
+		if !e.healthy {
+			Log.WithFields(logrus.Fields{
+				"endpoint": e.Name,
+				"height":   heights[i],
+			}).Info("daemon endpoint is back up")
+		}
+		e.healthy = true
+		e.height = heights[i]
+		daemonEndpointUpGauge.WithLabelValues(e.Name).Set(1)
+		daemonEndpointHeightGauge.WithLabelValues(e.Name).Set(float64(e.height))
+	}
+	if !b.usable(b.endpoints[b.primary]) {
+		for i, e := range b.endpoints {
+			if b.usable(e) {
+				Log.WithFields(logrus.Fields{
+					"from": b.endpoints[b.primary].Name,
+					"to":   e.Name,
+				}).Warn("switching primary daemon endpoint")
+				b.primary = i
+				break
+			}
+		}
+	}
+}
+
+// markDown records that an endpoint couldn't be reached; the caller must
+// hold the mutex.
+func (b *FailoverBackend) markDown(e *endpointState, err error) {
+	if e.healthy {
+		Log.WithFields(logrus.Fields{
+			"endpoint": e.Name,
+			"error":    err,
+		}).Warn("daemon endpoint is down")
+	}
+	e.healthy = false
+	daemonEndpointUpGauge.WithLabelValues(e.Name).Set(0)
+}
+
+// usable returns whether an endpoint is up and not lagging behind the
+// highest tip; the caller must hold the mutex.
+func (b *FailoverBackend) usable(e *endpointState) bool {
+	if !e.healthy {
+		return false
+	}
+	if e.height < 0 {
+		return true
+	}
+	for _, other := range b.endpoints {
+		if other.healthy && other.height-e.height > b.maxLag {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the endpoints to try, in order: the primary first if
+// sticky, else starting from the next in turn. The usable endpoints come
+// first; the others are a last resort, since they may have recovered.
+func (b *FailoverBackend) candidates(sticky bool) []int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	start := b.primary
+	if !sticky {
+		start = b.next
+		b.next = (b.next + 1) % len(b.endpoints)
+	}
+	var usable, others []int
+	for n := 0; n < len(b.endpoints); n++ {
+		i := (start + n) % len(b.endpoints)
+		if b.usable(b.endpoints[i]) {
+			usable = append(usable, i)
+		} else {
+			others = append(others, i)
+		}
+	}
+	return append(usable, others...)
+}
+
+// do makes a call, failing over to the next endpoint if one can't be
+// reached or sends an invalid block. Errors from the node itself are
+// returned as they are.
+func (b *FailoverBackend) do(ctx context.Context, sticky bool, call func(NodeBackend) error) error {
+	var err error
+	for _, i := range b.candidates(sticky) {
+		e := b.endpoints[i]
+		err = call(e.Backend)
+		if err == nil || isNodeError(err) || ctx.Err() != nil {
+			if err == nil && sticky {
+				b.mutex.Lock()
+				b.primary = i
+				b.mutex.Unlock()
+			}
+			return err
+		}
+		if _, ok := err.(*InvalidBlockError); ok {
+			// The node is up, but sent a bad block; try the next one
+			// without marking this one down.
+			continue
+		}
+		b.mutex.Lock()
+		b.markDown(e, err)
+		b.mutex.Unlock()
+	}
+	return err
+}
+
+// isNodeError returns whether an error is one the node returned ("code:
+// message"), rather than a failure to reach it.
+func isNodeError(err error) bool {
+	_, convErr := strconv.Atoi(strings.Split(err.Error(), ":")[0])
+	return convErr == nil
+}
+
+func (b *FailoverBackend) GetBlockchainInfo(ctx context.Context) (*ZcashdRpcReplyGetblockchaininfo, error) {
+	var reply *ZcashdRpcReplyGetblockchaininfo
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		reply, err = n.GetBlockchainInfo(ctx)
+		return
+	})
+	return reply, err
+}
+
+func (b *FailoverBackend) GetInfo(ctx context.Context) (*ZcashdRpcReplyGetinfo, error) {
+	var reply *ZcashdRpcReplyGetinfo
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		reply, err = n.GetInfo(ctx)
+		return
+	})
+	return reply, err
+}
+
+func (b *FailoverBackend) GetBlock(ctx context.Context, height int) (*walletrpc.CompactBlock, error) {
+	var block *walletrpc.CompactBlock
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		block, err = n.GetBlock(ctx, height)
+		return
+	})
+	return block, err
+}
+
+func (b *FailoverBackend) GetBlockHeader(ctx context.Context, height int) ([]byte, error) {
+	var header []byte
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		header, err = n.GetBlockHeader(ctx, height)
+		return
+	})
+	return header, err
+}
+
+func (b *FailoverBackend) GetTreeState(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.TreeState, error) {
+	var treeState *walletrpc.TreeState
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		treeState, err = n.GetTreeState(ctx, id)
+		return
+	})
+	return treeState, err
+}
+
+func (b *FailoverBackend) GetRawTransaction(ctx context.Context, txid []byte) (*walletrpc.RawTransaction, error) {
+	var tx *walletrpc.RawTransaction
+	err := b.do(ctx, false, func(n NodeBackend) (err error) {
+		tx, err = n.GetRawTransaction(ctx, txid)
+		return
+	})
+	return tx, err
+}
+
+func (b *FailoverBackend) SendRawTransaction(ctx context.Context, tx []byte) (string, error) {
+	var reply string
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		reply, err = n.SendRawTransaction(ctx, tx)
+		return
+	})
+	return reply, err
+}
+
+func (b *FailoverBackend) GetMempool(ctx context.Context) ([]string, error) {
+	var txids []string
+	err := b.do(ctx, true, func(n NodeBackend) (err error) {
+		txids, err = n.GetMempool(ctx)
+		return
+	})
+	return txids, err
+}
+
+func (b *FailoverBackend) GetAddressTxids(ctx context.Context, addresses []string, start, end uint64) ([]string, error) {
+	var txids []string
+	err := b.do(ctx, false, func(n NodeBackend) (err error) {
+		txids, err = n.GetAddressTxids(ctx, addresses, start, end)
+		return
+	})
+	return txids, err
+}
+
+func (b *FailoverBackend) GetAddressBalance(ctx context.Context, addresses []string) (int64, error) {
+	var balance int64
+	err := b.do(ctx, false, func(n NodeBackend) (err error) {
+		balance, err = n.GetAddressBalance(ctx, addresses)
+		return
+	})
+	return balance, err
+}
+
+func (b *FailoverBackend) GetAddressUtxos(ctx context.Context, address string) (ZcashdRpcReplyGetaddressutxos, error) {
+	var utxos ZcashdRpcReplyGetaddressutxos
+	err := b.do(ctx, false, func(n NodeBackend) (err error) {
+		utxos, err = n.GetAddressUtxos(ctx, address)
+		return
+	})
+	return utxos, err
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+)
+
+// failoverNode is a zcashd that can be down, and counts the calls it answers.
+type failoverNode struct {
+	height int
+	down   bool
+	calls  map[string]int
+}
+
+func (n *failoverNode) backend() NodeBackend {
+	n.calls = make(map[string]int)
+	return NewRPCBackend(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		if n.down {
+			return nil, errors.New("Post \"http://127.0.0.1:8232\": dial tcp: connection refused")
+		}
+		n.calls[method]++
+		switch method {
+		case "getblockchaininfo":
+			return json.Marshal(&ZcashdRpcReplyGetblockchaininfo{Blocks: n.height})
+		case "getaddressbalance":
+			return json.Marshal(&ZcashdRpcReplyGetaddressbalance{Balance: 100})
+		case "getblock":
+			return nil, errors.New("-8: Block height out of range")
+		}
+		return nil, errors.New("-32601: Method not found")
+	})
+}
+
+func TestFailoverBackend(t *testing.T) {
+	ctx := context.Background()
+	nodes := []*failoverNode{{height: 1000}, {height: 1000}, {height: 1000}}
+	var endpoints []DaemonEndpoint
+	for i, n := range nodes {
+		endpoints = append(endpoints, DaemonEndpoint{Name: string('a' + rune(i)), Backend: n.backend()})
+	}
+	b := NewFailoverBackend(endpoints, 2)
+	b.Check(ctx)
+
+	// The ingestor's calls stick to the first endpoint.
+	for i := 0; i < 3; i++ {
+		if _, err := b.GetBlockchainInfo(ctx); err != nil {
+			t.Fatal("GetBlockchainInfo failed:", err)
+		}
+	}
+	if nodes[0].calls["getblockchaininfo"] != 4 || nodes[1].calls["getblockchaininfo"] != 1 {
+		t.Fatal("getblockchaininfo wasn't sticky", nodes[0].calls, nodes[1].calls)
+	}
+	// Other reads are spread over the endpoints.
+	for i := 0; i < 3; i++ {
+		if balance, err := b.GetAddressBalance(ctx, []string{"t1"}); err != nil || balance != 100 {
+			t.Fatal("unexpected GetAddressBalance result", balance, err)
+		}
+	}
+	for i, n := range nodes {
+		if n.calls["getaddressbalance"] != 1 {
+			t.Fatal("getaddressbalance wasn't load-balanced, endpoint", i, n.calls)
+		}
+	}
+
+	// Errors from the node aren't retried elsewhere.
+	if _, err := b.GetInfo(ctx); err == nil || err.Error() != "-32601: Method not found" {
+		t.Fatal("unexpected GetInfo error", err)
+	}
+	if nodes[0].calls["getinfo"] != 1 || nodes[1].calls["getinfo"] != 0 || !b.endpoints[0].healthy {
+		t.Fatal("node error was retried")
+	}
+
+	// The primary goes down; calls fail over to the next endpoint, which
+	// becomes the primary.
+	nodes[0].down = true
+	if _, err := b.GetBlockchainInfo(ctx); err != nil {
+		t.Fatal("GetBlockchainInfo didn't fail over:", err)
+	}
+	if b.primary != 1 || b.endpoints[0].healthy {
+		t.Fatal("unexpected state after failover", b.primary, b.endpoints[0].healthy)
+	}
+	// It comes back, but the primary doesn't change until it's needed to.
+	nodes[0].down = false
+	b.Check(ctx)
+	if b.primary != 1 || !b.endpoints[0].healthy {
+		t.Fatal("unexpected state after recovery", b.primary, b.endpoints[0].healthy)
+	}
+
+	// The primary falls behind, so it's replaced; the lagging endpoint is
+	// skipped for reads too.
+	nodes[0].height = 1010
+	nodes[2].height = 1009
+	b.Check(ctx)
+	if b.primary != 0 {
+		t.Fatal("lagging primary wasn't replaced", b.primary)
+	}
+	nodes[1].calls = make(map[string]int)
+	for i := 0; i < 6; i++ {
+		b.GetAddressBalance(ctx, []string{"t1"})
+	}
+	if nodes[1].calls["getaddressbalance"] != 0 {
+		t.Fatal("lagging endpoint was used", nodes[1].calls)
+	}
+
+	// With every endpoint down, calls fail with the last error.
+	for _, n := range nodes {
+		n.down = true
+	}
+	if _, err := b.GetBlockchainInfo(ctx); err == nil || isNodeError(err) {
+		t.Fatal("unexpected error with every endpoint down", err)
+	}
+}
+
+// invalidBlockNode is a zcashd whose blocks fail validation.
+type invalidBlockNode struct {
+	NodeBackend
+	calls int
+}
+
+func (n *invalidBlockNode) GetBlock(ctx context.Context, height int) (*walletrpc.CompactBlock, error) {
+	n.calls++
+	return nil, &InvalidBlockError{Height: height, Err: errors.New("merkle root doesn't match the transactions")}
+}
+
+func TestFailoverInvalidBlock(t *testing.T) {
+	ctx := context.Background()
+	bad := &invalidBlockNode{NodeBackend: (&failoverNode{height: 1000}).backend()}
+	good := &failoverNode{height: 1000}
+	b := NewFailoverBackend([]DaemonEndpoint{
+		{Name: "bad", Backend: bad},
+		{Name: "good", Backend: good.backend()},
+	}, 2)
+	b.Check(ctx)
+
+	// The block is fetched from the next endpoint, but the first isn't
+	// marked down, since it could be reached.
+	if block, err := b.GetBlock(ctx, 1001); block != nil || err != nil {
+		t.Fatal("GetBlock didn't fail over:", block, err)
+	}
+	if bad.calls != 1 || good.calls["getblock"] != 1 {
+		t.Fatal("unexpected calls", bad.calls, good.calls)
+	}
+	if !b.endpoints[0].healthy {
+		t.Fatal("endpoint with an invalid block was marked down")
+	}
+}
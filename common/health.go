@@ -0,0 +1,209 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthServiceName is the service whose status the health monitor reports,
+// along with the server as a whole ("").
+const HealthServiceName = "cash.z.wallet.sdk.rpc.CompactTxStreamer"
+
+// HealthStatus describes the block cache's sync progress and the daemon's
+// reachability; it is the JSON body of the /healthz and /readyz responses.
+type HealthStatus struct {
+	Ready           bool      `json:"ready"`
+	CacheHeight     int       `json:"cache_height"`
+	DaemonHeight    int       `json:"daemon_height"`
+	Lag             int       `json:"lag"`
+	MaxLag          int       `json:"max_lag"`
+	DaemonReachable bool      `json:"daemon_reachable"`
+	LastContact     time.Time `json:"last_contact,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// HealthMonitor polls the daemon for its block height and reports the server
+// as serving (ready) only when the cache is within maxLag blocks of it and the
+// daemon has been reachable within the last unreachableTimeout.
+type HealthMonitor struct {
+	maxLag             int
+	unreachableTimeout time.Duration
+	server             *health.Server
+	daemonHeightFunc   func() (int, error)
+
+	mutex        sync.RWMutex
+	cache        *BlockCache // nil until Run starts
+	daemonHeight int
+	lastContact  time.Time
+	lastError    error
+	ready        bool
+	shutdown     bool
+}
+
+// NewHealthMonitor returns a health monitor that gets the daemon's height
+// from the backend; it reports NOT_SERVING until Run has found the block
+// cache to be in sync. A negative maxLag means the cache is never too far
+// behind.
+func NewHealthMonitor(backend NodeBackend, maxLag int, unreachableTimeout time.Duration) *HealthMonitor {
+	h := &HealthMonitor{
+		maxLag:             maxLag,
+		unreachableTimeout: unreachableTimeout,
+		server:             health.NewServer(),
+		daemonHeightFunc: func() (int, error) {
+			return getDaemonHeight(backend)
+		},
+	}
+	h.setServing(false)
+	return h
+}
+
+// SetDaemonHeightFunc replaces the function that gets the daemon's height
+// (by default, from the backend); a replica uses its upstream's height instead.
+func (h *HealthMonitor) SetDaemonHeightFunc(f func() (int, error)) {
+	h.mutex.Lock()
+	h.daemonHeightFunc = f
+	h.mutex.Unlock()
+}
+
+// Server returns the grpc.health.v1 service implementation to register
+// with the gRPC server.
+func (h *HealthMonitor) Server() *health.Server {
+	return h.server
+}
+
+// Shutdown reports NOT_SERVING from now on, so that load balancers stop
+// sending new requests while the server drains.
+func (h *HealthMonitor) Shutdown() {
+	h.mutex.Lock()
+	h.shutdown = true
+	h.mutex.Unlock()
+	h.server.Shutdown()
+}
+
+func (h *HealthMonitor) setServing(ready bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if ready {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	h.server.SetServingStatus("", status)
+	h.server.SetServingStatus(HealthServiceName, status)
+}
+
+// Run checks the daemon's height, and compares the cache's height with it, at
+// the given interval until ctx is cancelled.
+func (h *HealthMonitor) Run(ctx context.Context, cache *BlockCache, interval time.Duration) {
+	h.mutex.Lock()
+	h.cache = cache
+	h.mutex.Unlock()
+	for {
+		h.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// check queries the daemon's height once and updates the serving status.
+func (h *HealthMonitor) check() {
+	h.mutex.RLock()
+	daemonHeight := h.daemonHeightFunc
+	h.mutex.RUnlock()
+	height, err := daemonHeight()
+	h.mutex.Lock()
+	if err == nil {
+		h.daemonHeight = height
+		h.lastContact = time.Now()
+	}
+	h.lastError = err
+	h.mutex.Unlock()
+
+	status := h.Status()
+	h.mutex.Lock()
+	wasReady := h.ready
+	h.ready = status.Ready
+	h.mutex.Unlock()
+	if status.Ready != wasReady {
+		Log.WithFields(logrus.Fields{
+			"ready":         status.Ready,
+			"cache_height":  status.CacheHeight,
+			"daemon_height": status.DaemonHeight,
+			"error":         status.Error,
+		}).Info("Health status changed")
+	}
+	h.setServing(status.Ready)
+	if err == nil {
+		setDaemonHeight(status.DaemonHeight, status.CacheHeight)
+	}
+}
+
+// getDaemonHeight returns the daemon's latest block height.
+func getDaemonHeight(backend NodeBackend) (int, error) {
+	getblockchaininfoReply, err := backend.GetBlockchainInfo(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	return getblockchaininfoReply.Blocks, nil
+}
+
+// Status returns the current sync and daemon status.
+func (h *HealthMonitor) Status() HealthStatus {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	status := HealthStatus{
+		CacheHeight:  -1,
+		DaemonHeight: h.daemonHeight,
+		MaxLag:       h.maxLag,
+		LastContact:  h.lastContact,
+		DaemonReachable: !h.lastContact.IsZero() &&
+			time.Since(h.lastContact) <= h.unreachableTimeout,
+	}
+	if h.cache != nil {
+		status.CacheHeight = h.cache.GetLatestHeight()
+	}
+	if h.lastError != nil {
+		status.Error = h.lastError.Error()
+	}
+	status.Lag = status.DaemonHeight - status.CacheHeight
+	if status.Lag < 0 {
+		// The daemon may be behind us briefly after a restart or reorg.
+		status.Lag = 0
+	}
+	status.Ready = !h.shutdown && status.DaemonReachable &&
+		status.CacheHeight >= 0 && (h.maxLag < 0 || status.Lag <= h.maxLag)
+	return status
+}
+
+// ServeHealthz is the HTTP liveness handler: it always succeeds (the process
+// is up), with the sync status as its body.
+func (h *HealthMonitor) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	h.writeStatus(w, h.Status(), http.StatusOK)
+}
+
+// ServeReadyz is the HTTP readiness handler: it fails with 503 Service
+// Unavailable unless the cache is in sync and the daemon is reachable.
+func (h *HealthMonitor) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	status := h.Status()
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	h.writeStatus(w, status, code)
+}
+
+func (h *HealthMonitor) writeStatus(w http.ResponseWriter, status HealthStatus, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var daemonHeight int
+var daemonDown bool
+
+func getblockchaininfoStub(method string, params []json.RawMessage) (json.RawMessage, error) {
+	if daemonDown {
+		return nil, errors.New("connection refused")
+	}
+	return json.Marshal(&ZcashdRpcReplyGetblockchaininfo{Blocks: daemonHeight})
+}
+
+func TestHealthMonitor(t *testing.T) {
+	h := NewHealthMonitor(NewRPCBackend(getblockchaininfoStub), 5, time.Minute)
+	if status := h.Status(); status.Ready || status.CacheHeight != -1 {
+		t.Fatal("unexpected status before Run", status)
+	}
+	// The cache holds blocks 100 through 119.
+	h.cache = &BlockCache{firstBlock: 100, nextBlock: 120}
+
+	servingStatus := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := h.Server().Check(context.Background(),
+			&healthpb.HealthCheckRequest{Service: HealthServiceName})
+		if err != nil {
+			t.Fatal("Check failed:", err)
+		}
+		return resp.Status
+	}
+	if servingStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatal("unexpected initial status")
+	}
+
+	// Too far behind.
+	daemonHeight = 125
+	h.check()
+	if status := h.Status(); status.Ready || status.Lag != 6 || !status.DaemonReachable {
+		t.Fatal("unexpected status", status)
+	}
+	if servingStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatal("unexpected status when behind")
+	}
+
+	// Close enough.
+	daemonHeight = 124
+	h.check()
+	if status := h.Status(); !status.Ready || status.Lag != 5 {
+		t.Fatal("unexpected status", status)
+	}
+	if servingStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Fatal("unexpected status when in sync")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("unexpected /readyz code", rec.Code)
+	}
+
+	// A brief daemon outage doesn't matter, a long one does.
+	daemonDown = true
+	h.check()
+	if status := h.Status(); !status.Ready || status.Error == "" {
+		t.Fatal("unexpected status", status)
+	}
+	h.lastContact = time.Now().Add(-2 * time.Minute)
+	h.check()
+	if status := h.Status(); status.Ready || status.DaemonReachable {
+		t.Fatal("unexpected status", status)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("unexpected /readyz code", rec.Code)
+	}
+	var status HealthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal("bad /readyz body:", err)
+	}
+	if status.CacheHeight != 119 || status.DaemonHeight != 124 {
+		t.Fatal("unexpected /readyz body", status)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("unexpected /healthz code", rec.Code)
+	}
+	daemonDown = false
+
+	// Once shutdown starts, the server is never ready again.
+	h.check()
+	if !h.Status().Ready {
+		t.Fatal("unexpected status", h.Status())
+	}
+	h.Shutdown()
+	h.check()
+	if h.Status().Ready || servingStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatal("unexpected status after shutdown", h.Status())
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package logging
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Ways of anonymizing the peer addresses in the access log.
+const (
+	AnonymizeNone      = "none"      // log the address and port as they are
+	AnonymizeTruncate  = "truncate"  // zero the host part: IPv4 to /24, IPv6 to /48
+	AnonymizeCryptoPAn = "cryptopan" // keyed, prefix-preserving encryption
+)
+
+// An Anonymizer maps an IP address to an anonymized one. Addresses that
+// share a prefix should map to addresses that share a prefix, so that
+// traffic from a network can still be recognized as such.
+type Anonymizer interface {
+	Anonymize(ip net.IP) net.IP
+}
+
+var anonymizer Anonymizer = truncator{}
+
+// SetAnonymizer sets how peer addresses are anonymized in the log; nil
+// leaves them as they are.
+func SetAnonymizer(a Anonymizer) {
+	anonymizer = a
+}
+
+// NewAnonymizer returns the Anonymizer for the given mode. For
+// AnonymizeCryptoPAn, keyFile holds a 32-byte key, as 64 hex digits; if it's
+// empty, a random key is used, so addresses can only be correlated within
+// one run of the server.
+func NewAnonymizer(mode, keyFile string) (Anonymizer, error) {
+	switch mode {
+	case AnonymizeNone:
+		return nil, nil
+	case AnonymizeTruncate:
+		return truncator{}, nil
+	case AnonymizeCryptoPAn:
+		key := make([]byte, 32)
+		if keyFile == "" {
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+		} else {
+			contents, err := ioutil.ReadFile(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			if key, err = hex.DecodeString(strings.TrimSpace(string(contents))); err != nil {
+				return nil, fmt.Errorf("%s: %v", keyFile, err)
+			}
+		}
+		return NewCryptoPAn(key)
+	}
+	return nil, fmt.Errorf("unknown address anonymization %q (use %s, %s, or %s)",
+		mode, AnonymizeNone, AnonymizeTruncate, AnonymizeCryptoPAn)
+}
+
+// anonymizeAddr returns the (anonymized) IP address, without the port, of a
+// peer, for logging.
+func anonymizeAddr(addr net.Addr) string {
+	if anonymizer == nil {
+		return addr.String()
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		// Such as a unix socket; there's nothing identifying to hide.
+		return addr.String()
+	}
+	return anonymizer.Anonymize(ip).String()
+}
+
+type truncator struct{}
+
+func (truncator) Anonymize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// CryptoPAn is the prefix-preserving address anonymization scheme of Xu, Fan,
+// Ammar and Moon, "Prefix-Preserving IP Address Anonymization" (2002): two
+// addresses that share an n-bit prefix are mapped to addresses that share an
+// n-bit prefix, and without the key the mapping can't be reversed.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// NewCryptoPAn returns a CryptoPAn anonymizer using the given 32-byte key;
+// the first half is the AES key, the second half determines the padding.
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != 32 {
+		return nil, errors.New("CryptoPAn key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+// Anonymize maps an IPv4 or IPv6 address.
+func (c *CryptoPAn) Anonymize(ip net.IP) net.IP {
+	orig := ip.To4()
+	if orig == nil {
+		orig = ip.To16()
+	}
+	nbits := len(orig) * 8
+	result := make(net.IP, len(orig))
+	var input, output [aes.BlockSize]byte
+	for pos := 0; pos < nbits; pos++ {
+		// The first pos bits of the address followed by the
+		// remaining bits of the pad.
+		copy(input[:], c.pad[:])
+		for i := 0; i < pos/8; i++ {
+			input[i] = orig[i]
+		}
+		if partial := pos % 8; partial > 0 {
+			mask := byte(0xff) << (8 - uint(partial))
+			input[pos/8] = orig[pos/8]&mask | c.pad[pos/8]&^mask
+		}
+		c.block.Encrypt(output[:], input[:])
+		// The first bit of the result is the one-time pad bit for this position.
+		result[pos/8] |= (output[0] >> 7) << (7 - uint(pos%8))
+	}
+	for i := range result {
+		result[i] ^= orig[i]
+	}
+	return result
+}
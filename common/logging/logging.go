@@ -2,8 +2,11 @@ package logging
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -17,13 +20,43 @@ func LoggingInterceptor() grpc.ServerOption {
 }
 
 func loggerFromContext(ctx context.Context) *logrus.Entry {
-	// TODO: anonymize the addresses. cryptopan?
-	if peerInfo, ok := peer.FromContext(ctx); ok {
-		return log.WithFields(logrus.Fields{"peer_addr": peerInfo.Addr})
+	if peerInfo, ok := peer.FromContext(ctx); ok && peerInfo.Addr != nil {
+		return log.WithFields(logrus.Fields{"peer_addr": anonymizeAddr(peerInfo.Addr)})
 	}
 	return log.WithFields(logrus.Fields{"peer_addr": "unknown"})
 }
 
+// requestFields returns the parts of a request that are safe to log: heights,
+// ranges, and counts, but never addresses, transaction IDs, or transaction data.
+func requestFields(req interface{}) logrus.Fields {
+	switch r := req.(type) {
+	case *walletrpc.BlockID:
+		return logrus.Fields{"height": r.GetHeight()}
+	case *walletrpc.BlockRange:
+		return logrus.Fields{"start": r.GetStart().GetHeight(), "end": r.GetEnd().GetHeight()}
+	case *walletrpc.TxFilter:
+		if r.GetBlock() != nil {
+			return logrus.Fields{"height": r.GetBlock().GetHeight(), "index": r.GetIndex()}
+		}
+	case *walletrpc.RawTransaction:
+		return logrus.Fields{"tx_size": len(r.GetData())}
+	case *walletrpc.TransparentAddressBlockFilter:
+		return logrus.Fields{
+			"start": r.GetRange().GetStart().GetHeight(),
+			"end":   r.GetRange().GetEnd().GetHeight(),
+		}
+	case *walletrpc.AddressList:
+		return logrus.Fields{"addresses": len(r.GetAddresses())}
+	case *walletrpc.GetAddressUtxosArg:
+		return logrus.Fields{"start": r.GetStartHeight(), "max_entries": r.GetMaxEntries()}
+	case *walletrpc.Exclude:
+		return logrus.Fields{"exclude": len(r.GetTxid())}
+	case *walletrpc.Duration:
+		return logrus.Fields{"interval_us": r.GetIntervalUs()}
+	}
+	return nil
+}
+
 func LogInterceptor(
 	ctx context.Context,
 	req interface{},
@@ -36,7 +69,7 @@ func LogInterceptor(
 	resp, err := handler(ctx, req)
 
 	if LogToStderr {
-		entry := reqLog.WithFields(logrus.Fields{
+		entry := reqLog.WithFields(requestFields(req)).WithFields(logrus.Fields{
 			"method":   info.FullMethod,
 			"duration": time.Since(start),
 			"error":    err,
@@ -51,3 +84,67 @@ func LogInterceptor(
 
 	return resp, err
 }
+
+// LogStreamInterceptor logs each streaming call when it ends, with the
+// number of messages and bytes sent to the client.
+func LogStreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if !LogToStderr {
+		return handler(srv, ss)
+	}
+	reqLog := loggerFromContext(ss.Context())
+	start := time.Now()
+	ls := &loggingStream{ServerStream: ss}
+
+	err := handler(srv, ls)
+
+	entry := reqLog.WithFields(ls.fields).WithFields(logrus.Fields{
+		"method":        info.FullMethod,
+		"duration":      time.Since(start),
+		"msgs_received": atomic.LoadInt64(&ls.received),
+		"msgs_sent":     atomic.LoadInt64(&ls.sent),
+		"bytes_sent":    atomic.LoadInt64(&ls.bytes),
+		"error":         err,
+	})
+	if err != nil {
+		entry.Error("stream failed")
+	} else {
+		entry.Info("stream completed")
+	}
+	return err
+}
+
+// loggingStream counts the messages going through a stream, and keeps the
+// loggable fields of the first request.
+type loggingStream struct {
+	grpc.ServerStream
+	fields   logrus.Fields
+	received int64
+	sent     int64
+	bytes    int64
+}
+
+func (s *loggingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		if atomic.AddInt64(&s.received, 1) == 1 {
+			s.fields = requestFields(m)
+		}
+	}
+	return err
+}
+
+func (s *loggingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddInt64(&s.sent, 1)
+		if msg, ok := m.(proto.Message); ok {
+			atomic.AddInt64(&s.bytes, int64(proto.Size(msg)))
+		}
+	}
+	return err
+}
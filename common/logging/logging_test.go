@@ -6,12 +6,17 @@ package logging
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
 
 	"errors"
 	"github.com/asherda/lightwalletd/common"
+	"github.com/asherda/lightwalletd/walletrpc"
 	"github.com/sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/peer"
 )
@@ -59,3 +64,142 @@ func TestLogInterceptor(t *testing.T) {
 	os.Remove("test-log")
 	step = 0
 }
+
+type testStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []interface{}
+}
+
+func (s *testStream) Context() context.Context { return s.ctx }
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	*m.(*walletrpc.BlockRange) = walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380640},
+		End:   &walletrpc.BlockID{Height: 380642},
+	}
+	return nil
+}
+
+func (s *testStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+func TestLogStreamInterceptor(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	log.StandardLogger().ReplaceHooks(logger.Hooks)
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	LogToStderr = true
+	defer func() { LogToStderr = false }()
+
+	ss := &testStream{ctx: peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.77"), Port: 9067},
+	})}
+	err := LogStreamInterceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: "/test/GetBlockRange"},
+		func(srv interface{}, stream grpc.ServerStream) error {
+			var req walletrpc.BlockRange
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			for h := req.Start.Height; h <= req.End.Height; h++ {
+				if err := stream.SendMsg(&walletrpc.CompactBlock{Height: h}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(ss.sent) != 3 {
+		t.Fatal("unexpected number of messages sent", len(ss.sent))
+	}
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("nothing logged")
+	}
+	expected := map[string]interface{}{
+		"method":     "/test/GetBlockRange",
+		"peer_addr":  "192.0.2.0",
+		"start":      uint64(380640),
+		"end":        uint64(380642),
+		"msgs_sent":  int64(3),
+		"bytes_sent": int64(3 * 4),
+	}
+	for k, v := range expected {
+		if entry.Data[k] != v {
+			t.Fatal("unexpected", k, entry.Data[k])
+		}
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	fields := requestFields(&walletrpc.TransparentAddressBlockFilter{
+		Address: "t1VmmGiyjVNeCjxDZzg7vZmd99WyzVby9yC",
+		Range: &walletrpc.BlockRange{
+			Start: &walletrpc.BlockID{Height: 1},
+			End:   &walletrpc.BlockID{Height: 2},
+		},
+	})
+	if fields["start"] != uint64(1) || fields["end"] != uint64(2) {
+		t.Fatal("unexpected fields", fields)
+	}
+	if strings.Contains(fmt.Sprint(fields), "t1Vmm") {
+		t.Fatal("address logged", fields)
+	}
+	fields = requestFields(&walletrpc.GetAddressUtxosArg{
+		Address:     "t1VmmGiyjVNeCjxDZzg7vZmd99WyzVby9yC",
+		StartHeight: 5,
+	})
+	if strings.Contains(fmt.Sprint(fields), "t1Vmm") {
+		t.Fatal("address logged", fields)
+	}
+	if requestFields(&walletrpc.Address{Address: "t1VmmGiyjVNeCjxDZzg7vZmd99WyzVby9yC"}) != nil {
+		t.Fatal("address logged")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tt := range []struct{ in, out string }{
+		{"192.0.2.77", "192.0.2.0"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::"},
+	} {
+		if got := (truncator{}).Anonymize(net.ParseIP(tt.in)).String(); got != tt.out {
+			t.Fatal("truncate", tt.in, "got", got, "expected", tt.out)
+		}
+	}
+}
+
+func TestCryptoPAn(t *testing.T) {
+	// The key and expected results are from the reference implementation.
+	key := []byte{21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+		216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2}
+	c, err := NewCryptoPAn(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ in, out string }{
+		{"128.11.68.132", "135.242.180.132"},
+		{"129.118.74.4", "134.136.186.123"},
+		{"130.132.252.244", "133.68.164.234"},
+		{"141.223.7.43", "141.167.8.160"},
+		{"141.233.145.108", "141.129.237.235"},
+	} {
+		if got := c.Anonymize(net.ParseIP(tt.in)).String(); got != tt.out {
+			t.Fatal("cryptopan", tt.in, "got", got, "expected", tt.out)
+		}
+	}
+	// Prefixes are preserved for IPv6 as well.
+	a := c.Anonymize(net.ParseIP("2001:db8:1234::1"))
+	b := c.Anonymize(net.ParseIP("2001:db8:1234::2"))
+	if !a.Mask(net.CIDRMask(126, 128)).Equal(b.Mask(net.CIDRMask(126, 128))) || a.Equal(b) {
+		t.Fatal("IPv6 prefix not preserved", a, b)
+	}
+	if _, err := NewCryptoPAn(key[:16]); err == nil {
+		t.Fatal("short key accepted")
+	}
+	if _, err := NewAnonymizer("scramble", ""); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+}
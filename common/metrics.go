@@ -0,0 +1,240 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/grpc"
+)
+
+// Chain, ingestion, and daemon RPC metrics, in addition to the generic
+// per-method gRPC metrics from grpc_prometheus.
+var (
+	daemonHeightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lightwalletd_daemon_height",
+		Help: "Latest block height reported by zcashd.",
+	})
+	syncLagGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lightwalletd_sync_lag_blocks",
+		Help: "Number of blocks the cache is behind zcashd.",
+	})
+	reorgCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lightwalletd_reorgs_total",
+		Help: "Chain reorganizations detected by the block ingestor.",
+	})
+	reorgDepthHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lightwalletd_reorg_depth_blocks",
+		Help:    "Number of cached blocks replaced by each chain reorganization.",
+		Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100},
+	})
+	rpcDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lightwalletd_daemon_rpc_duration_seconds",
+		Help:    "Latency of RPCs to zcashd, by RPC method.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"method"})
+	rpcErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightwalletd_daemon_rpc_errors_total",
+		Help: "RPCs to zcashd that failed, by RPC method.",
+	}, []string{"method"})
+	blockParseHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lightwalletd_block_parse_duration_seconds",
+		Help:    "Time to parse a full block from zcashd into a compact block.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+	mempoolSizeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "lightwalletd_mempool_size",
+		Help: "Number of transactions in zcashd's mempool, as of the last refresh.",
+	})
+	daemonEndpointUpGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lightwalletd_daemon_endpoint_up",
+		Help: "Whether each zcashd endpoint answered its last health check (1) or not (0).",
+	}, []string{"endpoint"})
+	daemonEndpointHeightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lightwalletd_daemon_endpoint_height",
+		Help: "Latest block height reported by each zcashd endpoint.",
+	}, []string{"endpoint"})
+	blocksRejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightwalletd_blocks_rejected_total",
+		Help: "Blocks from zcashd that failed validation, by the check that failed.",
+	}, []string{"reason"})
+	bytesServedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lightwalletd_bytes_served_total",
+		Help: "Bytes of (uncompressed) response messages sent to clients, by gRPC method.",
+	}, []string{"grpc_method"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		daemonHeightGauge,
+		syncLagGauge,
+		reorgCounter,
+		reorgDepthHistogram,
+		rpcDurationHistogram,
+		rpcErrorCounter,
+		blockParseHistogram,
+		mempoolSizeGauge,
+		bytesServedCounter,
+		daemonEndpointUpGauge,
+		daemonEndpointHeightGauge,
+		blocksRejectedCounter,
+	)
+}
+
+// InstrumentRawRequest wraps a RawRequest function so that the latency and
+// errors of each call are recorded, by RPC method.
+func InstrumentRawRequest(
+	rawRequest func(method string, params []json.RawMessage) (json.RawMessage, error),
+) func(method string, params []json.RawMessage) (json.RawMessage, error) {
+	return func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		start := time.Now()
+		result, err := rawRequest(method, params)
+		rpcDurationHistogram.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			rpcErrorCounter.WithLabelValues(method).Inc()
+		}
+		return result, err
+	}
+}
+
+// SetMempoolSize records the number of transactions in the mempool.
+func SetMempoolSize(n int) {
+	mempoolSizeGauge.Set(float64(n))
+}
+
+func observeReorg(depth int) {
+	reorgCounter.Inc()
+	reorgDepthHistogram.Observe(float64(depth))
+}
+
+func setDaemonHeight(daemonHeight, cacheHeight int) {
+	daemonHeightGauge.Set(float64(daemonHeight))
+	lag := daemonHeight - cacheHeight
+	if lag < 0 {
+		lag = 0
+	}
+	syncLagGauge.Set(float64(lag))
+}
+
+func addBytesServed(fullMethod string, m interface{}) {
+	if msg, ok := m.(proto.Message); ok {
+		bytesServedCounter.WithLabelValues(fullMethod).Add(float64(proto.Size(msg)))
+	}
+}
+
+// BytesServedUnaryInterceptor counts the bytes of each unary response.
+func BytesServedUnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err == nil {
+		addBytesServed(info.FullMethod, resp)
+	}
+	return resp, err
+}
+
+// BytesServedStreamInterceptor counts the bytes of each streamed response message.
+func BytesServedStreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &countingStream{ServerStream: ss, fullMethod: info.FullMethod})
+}
+
+type countingStream struct {
+	grpc.ServerStream
+	fullMethod string
+}
+
+func (s *countingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		addBytesServed(s.fullMethod, m)
+	}
+	return err
+}
+
+// cacheCollector reports the block cache's height and LevelDB statistics
+// when metrics are scraped.
+type cacheCollector struct {
+	cache *BlockCache
+}
+
+var (
+	cacheHeightDesc = prometheus.NewDesc("lightwalletd_cache_height",
+		"Height of the most recent block in the cache.", nil, nil)
+	levelSizeDesc = prometheus.NewDesc("lightwalletd_leveldb_size_bytes",
+		"Size of the LevelDB tables at each level.", []string{"level"}, nil)
+	levelTablesDesc = prometheus.NewDesc("lightwalletd_leveldb_tables",
+		"Number of LevelDB tables at each level.", []string{"level"}, nil)
+	compactionReadDesc = prometheus.NewDesc("lightwalletd_leveldb_compaction_read_bytes_total",
+		"Bytes read by LevelDB compactions, by level.", []string{"level"}, nil)
+	compactionWriteDesc = prometheus.NewDesc("lightwalletd_leveldb_compaction_write_bytes_total",
+		"Bytes written by LevelDB compactions, by level.", []string{"level"}, nil)
+	compactionTimeDesc = prometheus.NewDesc("lightwalletd_leveldb_compaction_seconds_total",
+		"Time spent in LevelDB compactions, by level.", []string{"level"}, nil)
+	writeDelayDesc = prometheus.NewDesc("lightwalletd_leveldb_write_delay_seconds_total",
+		"Time LevelDB writes were delayed waiting for compaction.", nil, nil)
+	ioReadDesc = prometheus.NewDesc("lightwalletd_leveldb_io_read_bytes_total",
+		"Bytes read from LevelDB files.", nil, nil)
+	ioWriteDesc = prometheus.NewDesc("lightwalletd_leveldb_io_write_bytes_total",
+		"Bytes written to LevelDB files.", nil, nil)
+)
+
+// NewCacheCollector returns a Prometheus collector for the cache's height
+// and storage statistics; register it once, for the server's cache.
+func NewCacheCollector(cache *BlockCache) prometheus.Collector {
+	return &cacheCollector{cache: cache}
+}
+
+func (cc *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHeightDesc
+	ch <- levelSizeDesc
+	ch <- levelTablesDesc
+	ch <- compactionReadDesc
+	ch <- compactionWriteDesc
+	ch <- compactionTimeDesc
+	ch <- writeDelayDesc
+	ch <- ioReadDesc
+	ch <- ioWriteDesc
+}
+
+func (cc *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(cacheHeightDesc, prometheus.GaugeValue,
+		float64(cc.cache.GetLatestHeight()))
+
+	var stats leveldb.DBStats
+	if err := cc.cache.ldb.Stats(&stats); err != nil {
+		// The database is closed (shutting down).
+		return
+	}
+	for i := range stats.LevelSizes {
+		level := strconv.Itoa(i)
+		ch <- prometheus.MustNewConstMetric(levelSizeDesc, prometheus.GaugeValue,
+			float64(stats.LevelSizes[i]), level)
+		ch <- prometheus.MustNewConstMetric(levelTablesDesc, prometheus.GaugeValue,
+			float64(stats.LevelTablesCounts[i]), level)
+		ch <- prometheus.MustNewConstMetric(compactionReadDesc, prometheus.CounterValue,
+			float64(stats.LevelRead[i]), level)
+		ch <- prometheus.MustNewConstMetric(compactionWriteDesc, prometheus.CounterValue,
+			float64(stats.LevelWrite[i]), level)
+		ch <- prometheus.MustNewConstMetric(compactionTimeDesc, prometheus.CounterValue,
+			stats.LevelDurations[i].Seconds(), level)
+	}
+	ch <- prometheus.MustNewConstMetric(writeDelayDesc, prometheus.CounterValue,
+		stats.WriteDelayDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(ioReadDesc, prometheus.CounterValue, float64(stats.IORead))
+	ch <- prometheus.MustNewConstMetric(ioWriteDesc, prometheus.CounterValue, float64(stats.IOWrite))
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestInstrumentRawRequest(t *testing.T) {
+	rawRequest := InstrumentRawRequest(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		if method == "getbestblockhash" {
+			return nil, errors.New("-1: no")
+		}
+		return json.RawMessage("{}"), nil
+	})
+	errors0 := testutil.ToFloat64(rpcErrorCounter.WithLabelValues("getbestblockhash"))
+	if _, err := rawRequest("getinfo", nil); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := rawRequest("getbestblockhash", nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+	if testutil.ToFloat64(rpcErrorCounter.WithLabelValues("getbestblockhash")) != errors0+1 {
+		t.Fatal("error not counted")
+	}
+	if testutil.ToFloat64(rpcErrorCounter.WithLabelValues("getinfo")) != 0 {
+		t.Fatal("unexpected getinfo error count")
+	}
+}
+
+func TestBytesServed(t *testing.T) {
+	block := &walletrpc.CompactBlock{Height: 380640, Hash: make([]byte, 32)}
+	before := testutil.ToFloat64(bytesServedCounter.WithLabelValues("/test/GetBlock"))
+	addBytesServed("/test/GetBlock", block)
+	addBytesServed("/test/GetBlock", "not a message")
+	served := testutil.ToFloat64(bytesServedCounter.WithLabelValues("/test/GetBlock")) - before
+	if served != 38 {
+		t.Fatal("unexpected bytes served", served)
+	}
+}
+
+func TestCacheCollector(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(unitTestPath)
+	cache := NewBlockCache(db, unitTestChain, 380640, true)
+	collector := NewCacheCollector(cache)
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal("Register failed:", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal("Gather failed:", err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() == "lightwalletd_cache_height" {
+			found = true
+			if family.Metric[0].GetGauge().GetValue() != -1 {
+				t.Fatal("unexpected cache height", family.Metric[0])
+			}
+		}
+	}
+	if !found {
+		t.Fatal("lightwalletd_cache_height not collected")
+	}
+
+	// Nothing is reported from a closed database, but it's not an error.
+	cache.Close()
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal("Gather failed after Close:", err)
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+// Package ratelimit implements per-client token-bucket rate limiting and
+// concurrent stream quotas as gRPC server interceptors.
+//
+// Each client (identified by a recognized API key, else by peer IP address)
+// has a bucket that refills at a fixed rate up to a burst size. Every call
+// takes tokens according to its method's cost; the calls that take a block
+// range (GetBlockRange, GetBlockHeaders and GetHeaderRange) additionally cost
+// a (usually fractional) amount per requested block. A call that finds too
+// few tokens fails with codes.ResourceExhausted and a "retry-after" trailer
+// giving the number of seconds until it would succeed; one that costs more
+// than the burst size fails without it, since it never would.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// APIKeyHeader is the gRPC metadata key clients use to present an API key.
+	APIKeyHeader = "x-api-key"
+
+	// RetryAfterTrailer is the gRPC trailer that tells a throttled client
+	// how many seconds to wait before retrying.
+	RetryAfterTrailer = "retry-after"
+
+	// Clients whose buckets have refilled are forgotten this often.
+	sweepInterval = 10 * time.Minute
+
+	// tooCostly is the wait take returns for a request that costs more than
+	// the caller's bucket holds, which can never succeed.
+	tooCostly = time.Duration(-1)
+)
+
+// DefaultCosts are the per-call costs of methods not given in Config.MethodCosts;
+// methods not listed here cost 1.
+var DefaultCosts = map[string]float64{
+	"GetMempoolTx":          5,
+	"GetTaddressTxids":      5,
+	"GetAddressUtxos":       2,
+	"GetAddressUtxosStream": 2,
+	"SendTransaction":       2,
+}
+
+// Config specifies the limits applied to each client.
+type Config struct {
+	Rate        float64            // tokens added to each client's bucket per second, 0 disables rate limiting
+	Burst       float64            // bucket capacity
+	APIKeyRate  float64            // refill rate for clients presenting a recognized API key
+	APIKeyBurst float64            // bucket capacity for clients presenting a recognized API key
+	APIKeys     []string           // recognized API keys
+	MaxStreams  int                // concurrent streaming calls per client, 0 is unlimited
+	MethodCosts map[string]float64 // cost per call, by method name (such as "GetBlock")
+	BlockCost   float64            // additional cost per block of a block range request
+}
+
+// Limiter tracks the token buckets and open streams of each client.
+type Limiter struct {
+	cfg       Config
+	apiKeys   map[string]bool
+	clients   map[string]*client
+	lastSweep time.Time
+	mutex     sync.Mutex
+
+	// now allows the clock to be mocked for testing.
+	now func() time.Time
+}
+
+type client struct {
+	tokens  float64
+	burst   float64
+	rate    float64
+	last    time.Time // when tokens was last brought up to date
+	streams int
+}
+
+var throttled = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lightwalletd_ratelimit_throttled_total",
+		Help: "Calls rejected by the rate limiter, by method and reason (rate, cost or streams).",
+	},
+	[]string{"method", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(throttled)
+}
+
+// New returns a Limiter that enforces the given configuration.
+func New(cfg Config) *Limiter {
+	l := &Limiter{
+		cfg:     cfg,
+		apiKeys: make(map[string]bool),
+		clients: make(map[string]*client),
+		now:     time.Now,
+	}
+	for _, k := range cfg.APIKeys {
+		if k != "" {
+			l.apiKeys[k] = true
+		}
+	}
+	return l
+}
+
+// ParseCosts parses a list of method costs of the form
+// "GetMempoolTx=5,GetBlock=1" into a map.
+func ParseCosts(s string) (map[string]float64, error) {
+	costs := make(map[string]float64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("method cost %q is not of the form Method=cost", item)
+		}
+		cost, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || cost < 0 {
+			return nil, fmt.Errorf("invalid cost for method %s: %q", kv[0], kv[1])
+		}
+		costs[strings.TrimSpace(kv[0])] = cost
+	}
+	return costs, nil
+}
+
+// methodName returns the short name ("GetBlock") of a full gRPC
+// method name ("/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetBlock").
+func methodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// cost returns the number of tokens the given request consumes.
+func (l *Limiter) cost(method string, req interface{}) float64 {
+	cost, ok := l.cfg.MethodCosts[method]
+	if !ok {
+		if cost, ok = DefaultCosts[method]; !ok {
+			cost = 1
+		}
+	}
+	if span, ok := req.(*walletrpc.BlockRange); ok && span.Start != nil && span.End != nil {
+		start, end := float64(span.Start.Height), float64(span.End.Height)
+		cost += (math.Abs(end-start) + 1) * l.cfg.BlockCost
+	}
+	return cost
+}
+
+// clientKey identifies the caller: by API key if it presents a recognized
+// one, else by the IP address (without port) it connects from.
+func (l *Limiter) clientKey(ctx context.Context) (key string, hasAPIKey bool) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, k := range md.Get(APIKeyHeader) {
+			if l.apiKeys[k] {
+				return "key:" + k, true
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr := p.Addr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		return "ip:" + addr, false
+	}
+	return "ip:unknown", false
+}
+
+// Caller should hold l.mutex.
+func (l *Limiter) getClient(ctx context.Context) *client {
+	now := l.now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	key, hasAPIKey := l.clientKey(ctx)
+	c := l.clients[key]
+	if c == nil {
+		c = &client{rate: l.cfg.Rate, burst: l.cfg.Burst, last: now}
+		if hasAPIKey {
+			c.rate, c.burst = l.cfg.APIKeyRate, l.cfg.APIKeyBurst
+		}
+		c.tokens = c.burst
+		l.clients[key] = c
+	}
+	return c
+}
+
+// Forget clients without open streams whose buckets have refilled; a new
+// client starts with a full bucket, so forgetting them changes nothing.
+// Caller should hold l.mutex.
+func (l *Limiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, c := range l.clients {
+		if c.streams == 0 && (c.rate <= 0 || c.tokens+now.Sub(c.last).Seconds()*c.rate >= c.burst) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// take removes cost tokens from the caller's bucket. If there are too few,
+// it takes nothing and returns how long the caller should wait, or tooCostly
+// if the bucket can never hold enough.
+func (l *Limiter) take(ctx context.Context, cost float64) (ok bool, retryAfter time.Duration) {
+	if l.cfg.Rate <= 0 {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	c := l.getClient(ctx)
+	if c.rate <= 0 {
+		// Recognized API keys without a rate of their own are unlimited.
+		return true, 0
+	}
+	now := l.now()
+	c.tokens = math.Min(c.burst, c.tokens+now.Sub(c.last).Seconds()*c.rate)
+	c.last = now
+	if cost > c.burst {
+		// Waiting won't help; the client must ask for less, such as a
+		// shorter block range.
+		return false, tooCostly
+	}
+	if c.tokens < cost {
+		return false, time.Duration((cost - c.tokens) / c.rate * float64(time.Second))
+	}
+	c.tokens -= cost
+	return true, 0
+}
+
+// openStream reserves one of the caller's concurrent stream slots; the
+// returned function releases it.
+func (l *Limiter) openStream(ctx context.Context) (release func(), ok bool) {
+	if l.cfg.MaxStreams <= 0 {
+		return func() {}, true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	c := l.getClient(ctx)
+	if c.streams >= l.cfg.MaxStreams {
+		return nil, false
+	}
+	c.streams++
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		c.streams--
+		c.last = l.now()
+	}, true
+}
+
+func exhausted(method, reason string, retryAfter time.Duration) error {
+	throttled.WithLabelValues(method, reason).Inc()
+	if retryAfter == tooCostly {
+		return status.Errorf(codes.ResourceExhausted,
+			"%s: request costs more than the rate limit allows, request fewer blocks", method)
+	}
+	return status.Errorf(codes.ResourceExhausted,
+		"%s: rate limit exceeded (%s), retry after %.1f seconds", method, reason, retryAfter.Seconds())
+}
+
+// reason labels a rejection by take in the throttled metric.
+func reason(retryAfter time.Duration) string {
+	if retryAfter == tooCostly {
+		return "cost"
+	}
+	return "rate"
+}
+
+// setRetryAfter sets the retry-after trailer with the given function, unless
+// retrying won't help.
+func setRetryAfter(setTrailer func(metadata.MD), retryAfter time.Duration) {
+	if retryAfter != tooCostly {
+		setTrailer(retryAfterMD(retryAfter))
+	}
+}
+
+func retryAfterMD(retryAfter time.Duration) metadata.MD {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	return metadata.Pairs(RetryAfterTrailer, strconv.FormatInt(seconds, 10))
+}
+
+// UnaryInterceptor charges each unary call against the caller's bucket.
+func (l *Limiter) UnaryInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	method := methodName(info.FullMethod)
+	if ok, retryAfter := l.take(ctx, l.cost(method, req)); !ok {
+		setRetryAfter(func(md metadata.MD) { grpc.SetTrailer(ctx, md) }, retryAfter)
+		return nil, exhausted(method, reason(retryAfter), retryAfter)
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor limits the number of concurrent streams per caller and
+// charges each stream against the caller's bucket when its (first) request
+// message arrives, so that the cost can depend on the request.
+func (l *Limiter) StreamInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	method := methodName(info.FullMethod)
+	release, ok := l.openStream(ss.Context())
+	if !ok {
+		// There's no way to know when a stream will finish, so suggest a
+		// short wait.
+		retryAfter := time.Second
+		ss.SetTrailer(retryAfterMD(retryAfter))
+		return exhausted(method, "streams", retryAfter)
+	}
+	defer release()
+	return handler(srv, &limitedStream{ServerStream: ss, limiter: l, method: method})
+}
+
+// limitedStream charges the first message received on a stream.
+type limitedStream struct {
+	grpc.ServerStream
+	limiter *Limiter
+	method  string
+	charged bool
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.charged {
+		return nil
+	}
+	s.charged = true
+	if ok, retryAfter := s.limiter.take(s.Context(), s.limiter.cost(s.method, m)); !ok {
+		setRetryAfter(s.SetTrailer, retryAfter)
+		return exhausted(s.method, reason(retryAfter), retryAfter)
+	}
+	return nil
+}
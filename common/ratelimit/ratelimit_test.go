@@ -0,0 +1,233 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var clock time.Time
+
+func mockNow() time.Time {
+	return clock
+}
+
+func peerContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000},
+	})
+}
+
+func okHandler(ctx context.Context, req interface{}) (interface{}, error) {
+	return "ok", nil
+}
+
+func TestParseCosts(t *testing.T) {
+	costs, err := ParseCosts("GetMempoolTx=10, GetBlock=0.5,")
+	if err != nil {
+		t.Fatal("ParseCosts failed:", err)
+	}
+	if len(costs) != 2 || costs["GetMempoolTx"] != 10 || costs["GetBlock"] != 0.5 {
+		t.Fatal("unexpected costs", costs)
+	}
+	if _, err := ParseCosts("GetBlock"); err == nil {
+		t.Fatal("ParseCosts unexpected success")
+	}
+	if _, err := ParseCosts("GetBlock=-1"); err == nil {
+		t.Fatal("ParseCosts unexpected success")
+	}
+}
+
+func TestCost(t *testing.T) {
+	l := New(Config{BlockCost: 0.01, MethodCosts: map[string]float64{"GetBlock": 3}})
+	if c := l.cost("GetBlock", nil); c != 3 {
+		t.Fatal("unexpected GetBlock cost", c)
+	}
+	if c := l.cost("GetMempoolTx", nil); c != DefaultCosts["GetMempoolTx"] {
+		t.Fatal("unexpected GetMempoolTx cost", c)
+	}
+	span := &walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 1000},
+		End:   &walletrpc.BlockID{Height: 1099},
+	}
+	if c := l.cost("GetBlockRange", span); c != 2 {
+		t.Fatal("unexpected GetBlockRange cost", c)
+	}
+	// Descending ranges cost the same.
+	span.Start, span.End = span.End, span.Start
+	if c := l.cost("GetBlockRange", span); c != 2 {
+		t.Fatal("unexpected descending GetBlockRange cost", c)
+	}
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	l := New(Config{Rate: 1, Burst: 2, APIKeys: []string{"secret"}})
+	l.now = mockNow
+	clock = time.Unix(1600000000, 0)
+	info := &grpc.UnaryServerInfo{FullMethod: "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetBlock"}
+	ctx := peerContext("10.1.2.3")
+
+	// The burst allows two calls in quick succession.
+	for i := 0; i < 2; i++ {
+		if _, err := l.UnaryInterceptor(ctx, nil, info, okHandler); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	_, err := l.UnaryInterceptor(ctx, nil, info, okHandler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("expected ResourceExhausted, got", err)
+	}
+
+	// Other clients have their own buckets.
+	if _, err := l.UnaryInterceptor(peerContext("10.1.2.4"), nil, info, okHandler); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	// A recognized API key without its own rate is unlimited.
+	keyCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(APIKeyHeader, "secret"))
+	for i := 0; i < 10; i++ {
+		if _, err := l.UnaryInterceptor(keyCtx, nil, info, okHandler); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	// An unrecognized one falls back to the peer address.
+	badKeyCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(APIKeyHeader, "guess"))
+	if _, err := l.UnaryInterceptor(badKeyCtx, nil, info, okHandler); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	// The bucket refills with time.
+	clock = clock.Add(time.Second)
+	if _, err := l.UnaryInterceptor(ctx, nil, info, okHandler); err != nil {
+		t.Fatal("unexpected error after refill", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	l := New(Config{Rate: 2, Burst: 4, BlockCost: 1})
+	l.now = mockNow
+	clock = time.Unix(1600000000, 0)
+	ctx := peerContext("10.1.2.3")
+	if ok, _ := l.take(ctx, 3); !ok {
+		t.Fatal("unexpected failure")
+	}
+	ok, retryAfter := l.take(ctx, 3)
+	if ok {
+		t.Fatal("unexpected success")
+	}
+	// One token left, two more needed at two per second.
+	if retryAfter != time.Second {
+		t.Fatal("unexpected retryAfter", retryAfter)
+	}
+	if md := retryAfterMD(1500 * time.Millisecond); md.Get(RetryAfterTrailer)[0] != "2" {
+		t.Fatal("unexpected retry-after metadata", md)
+	}
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	trailer metadata.MD
+	end     uint64 // of the requested block range, from 1
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	span := m.(*walletrpc.BlockRange)
+	span.Start = &walletrpc.BlockID{Height: 1}
+	span.End = &walletrpc.BlockID{Height: s.end}
+	return nil
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	l := New(Config{Rate: 1, Burst: 10, MaxStreams: 1, BlockCost: 0.1})
+	l.now = mockNow
+	clock = time.Unix(1600000000, 0)
+	info := &grpc.StreamServerInfo{FullMethod: "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetBlockRange"}
+	stream := &testStream{ctx: peerContext("10.1.2.3"), end: 90}
+
+	inner := func(srv interface{}, ss grpc.ServerStream) error {
+		// While this stream is open, another is refused.
+		err := l.StreamInterceptor(nil, stream, info, func(interface{}, grpc.ServerStream) error {
+			return nil
+		})
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatal("expected ResourceExhausted, got", err)
+		}
+		return ss.RecvMsg(&walletrpc.BlockRange{})
+	}
+	// The 90-block range costs 10 tokens, the whole burst.
+	if err := l.StreamInterceptor(nil, stream, info, inner); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	// The refused concurrent stream was told to retry after a second.
+	if r := stream.trailer.Get(RetryAfterTrailer); len(r) != 1 || r[0] != "1" {
+		t.Fatal("unexpected retry-after trailer", r)
+	}
+	stream.trailer = nil
+	err := l.StreamInterceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+		return ss.RecvMsg(&walletrpc.BlockRange{})
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("expected ResourceExhausted, got", err)
+	}
+	if stream.trailer.Get(RetryAfterTrailer)[0] != "10" {
+		t.Fatal("unexpected retry-after", stream.trailer)
+	}
+
+	// A 100-block range costs 11 tokens, more than the burst, so it fails
+	// however long the client waits.
+	clock = clock.Add(time.Hour)
+	stream = &testStream{ctx: peerContext("10.1.2.3"), end: 100}
+	err = l.StreamInterceptor(nil, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+		return ss.RecvMsg(&walletrpc.BlockRange{})
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatal("expected ResourceExhausted, got", err)
+	}
+	if r := stream.trailer.Get(RetryAfterTrailer); len(r) != 0 {
+		t.Fatal("unexpected retry-after", r)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New(Config{Rate: 1, Burst: 10})
+	l.now = mockNow
+	clock = time.Unix(1600000000, 0)
+	ctx := peerContext("10.1.2.3")
+	if ok, _ := l.take(ctx, 10); !ok {
+		t.Fatal("unexpected failure")
+	}
+	// The client is remembered until its bucket has refilled.
+	clock = clock.Add(5 * time.Second)
+	l.sweep(clock)
+	if len(l.clients) != 1 {
+		t.Fatal("client with an empty bucket forgotten")
+	}
+	if ok, _ := l.take(ctx, 10); ok {
+		t.Fatal("bucket refilled early")
+	}
+	clock = clock.Add(10 * time.Second)
+	l.sweep(clock)
+	if len(l.clients) != 0 {
+		t.Fatal("client with a full bucket remembered")
+	}
+}
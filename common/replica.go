@@ -0,0 +1,155 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrReplica is returned by the backend in replica mode, where there's no
+// zcashd; the requests that need it are forwarded to the upstream instead.
+var ErrReplica = errors.New("no zcashd connection in replica mode")
+
+// ReplicaRawRequest is the request function of the (RPC) backend in replica
+// mode.
+func ReplicaRawRequest(method string, params []json.RawMessage) (json.RawMessage, error) {
+	return nil, ErrReplica
+}
+
+// FollowUpstream runs as a goroutine in replica mode, in place of
+// BlockIngestor: it adds the blocks of an upstream lightwalletd to the cache,
+// as they appear there, until ctx is cancelled. If the upstream's chain no
+// longer includes the cache's latest block (a reorg), it backs up, one block
+// at a time, until it does. Like BlockIngestor, it waits while the ingestor
+// is paused.
+func FollowUpstream(ctx context.Context, c *BlockCache, upstream walletrpc.CompactTxStreamerClient, interval time.Duration) {
+	reorgCount := 0
+	for {
+		if IngestorPaused() {
+			if !sleep(ctx, interval) {
+				Log.Info("Upstream follower stopping at height ", c.GetNextHeight())
+				return
+			}
+			continue
+		}
+		added, reorg, err := followOnce(ctx, c, upstream)
+		if ctx.Err() != nil {
+			Log.Info("Upstream follower stopping at height ", c.GetNextHeight())
+			return
+		}
+		if err != nil {
+			Log.WithFields(logrus.Fields{
+				"height": c.GetNextHeight(),
+				"error":  err,
+			}).Warn("error getting blocks from upstream")
+		}
+		if reorg {
+			reorgCount++
+			if reorgCount > 100 {
+				Log.Fatal("Reorg exceeded max of 100 blocks! Help!")
+			}
+			Log.Info("Reorg in upstream, backing up to height ", c.GetLatestHeight()-1)
+			c.Reorg(c.GetLatestHeight())
+			continue
+		}
+		if reorgCount > 0 {
+			observeReorg(reorgCount)
+			reorgCount = 0
+		}
+		if added == 0 || err != nil {
+			c.Sync()
+			select {
+			case <-ctx.Done():
+				Log.Info("Upstream follower stopping at height ", c.GetNextHeight())
+				return
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+// upstreamBatchSize is the most blocks the follower asks the upstream for in
+// one GetBlockRange, well under the upstream's --max-block-range default.
+const upstreamBatchSize = 1000
+
+// followOnce adds the upstream's blocks above the cache's latest block to the
+// cache, upstreamBatchSize at a time. It returns the number added, or reorg
+// true if the upstream's chain doesn't include the cache's latest block.
+func followOnce(ctx context.Context, c *BlockCache, upstream walletrpc.CompactTxStreamerClient) (int, bool, error) {
+	latest, err := upstream.GetLatestBlock(ctx, &walletrpc.ChainSpec{})
+	if err != nil {
+		return 0, false, err
+	}
+	latestHeight, latestHash := c.GetLatestBlockID()
+	next := c.GetNextHeight()
+	if int(latest.Height) < next {
+		// Nothing new; but the upstream's tip may have been replaced.
+		if int(latest.Height) == latestHeight && latest.Hash != nil &&
+			!bytes.Equal(latest.Hash, latestHash) {
+			return 0, true, nil
+		}
+		return 0, false, nil
+	}
+	added := 0
+	for start := next; start <= int(latest.Height); start += upstreamBatchSize {
+		end := start + upstreamBatchSize - 1
+		if end > int(latest.Height) {
+			end = int(latest.Height)
+		}
+		n, reorg, err := followRange(ctx, c, upstream, start, end)
+		added += n
+		if err != nil || reorg || n < end-start+1 {
+			// A short range means the upstream's chain got shorter.
+			return added, reorg, err
+		}
+	}
+	return added, false, nil
+}
+
+// followRange adds the upstream's blocks from start to end to the cache,
+// which must end just below start.
+func followRange(ctx context.Context, c *BlockCache, upstream walletrpc.CompactTxStreamerClient, start, end int) (int, bool, error) {
+	// Cancelling the context ends the stream if we stop reading early.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := upstream.GetBlockRange(ctx, &walletrpc.BlockRange{
+		Start:      &walletrpc.BlockID{Height: uint64(start)},
+		End:        &walletrpc.BlockID{Height: uint64(end)},
+		JoinSplits: true, // the cache keeps them
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	added := 0
+	for {
+		block, err := stream.Recv()
+		if err == io.EOF {
+			return added, false, nil
+		}
+		if err != nil {
+			return added, false, err
+		}
+		if int(block.Height) != start+added {
+			return added, false, errors.Errorf("upstream sent block %d, expected %d", block.Height, start+added)
+		}
+		if c.HashMismatch(block.PrevHash) {
+			return added, true, nil
+		}
+		if err := checkCheckpoint(int(block.Height), block); err != nil {
+			return added, false, err
+		}
+		if err := c.Add(int(block.Height), block); err != nil {
+			return added, false, err
+		}
+		added++
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeUpstream is an upstream lightwalletd serving the blocks in its chain.
+type fakeUpstream struct {
+	walletrpc.CompactTxStreamerClient
+	mutex sync.Mutex
+	chain []*walletrpc.CompactBlock // chain[0] is at replicaTestStart
+	// maxBlockRange, if set, is the upstream's --max-block-range.
+	maxBlockRange int
+}
+
+const replicaTestStart = 380640
+
+// replicaTestBlock returns a block whose hash depends on its fork.
+func replicaTestBlock(height int, fork, prevFork byte) *walletrpc.CompactBlock {
+	return &walletrpc.CompactBlock{
+		Height:   uint64(height),
+		Hash:     []byte(fmt.Sprintf("%c%031d", fork, height)),
+		PrevHash: []byte(fmt.Sprintf("%c%031d", prevFork, height-1)),
+	}
+}
+
+// setChain makes the upstream's chain fork a up to (not including) height
+// forkAt, then fork b up to end.
+func (u *fakeUpstream) setChain(forkAt, end int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.chain = nil
+	prevFork := byte('a')
+	for height := replicaTestStart; height <= end; height++ {
+		fork := byte('a')
+		if height >= forkAt {
+			fork = 'b'
+		}
+		u.chain = append(u.chain, replicaTestBlock(height, fork, prevFork))
+		prevFork = fork
+	}
+}
+
+func (u *fakeUpstream) GetLatestBlock(ctx context.Context, in *walletrpc.ChainSpec, opts ...grpc.CallOption) (*walletrpc.BlockID, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	tip := u.chain[len(u.chain)-1]
+	return &walletrpc.BlockID{Height: tip.Height, Hash: tip.Hash}, nil
+}
+
+func (u *fakeUpstream) GetBlockRange(ctx context.Context, in *walletrpc.BlockRange, opts ...grpc.CallOption) (walletrpc.CompactTxStreamer_GetBlockRangeClient, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	start := int(in.Start.Height) - replicaTestStart
+	end := int(in.End.Height) - replicaTestStart
+	if u.maxBlockRange > 0 && end-start >= u.maxBlockRange {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"block range of %d blocks exceeds the maximum of %d", end-start+1, u.maxBlockRange)
+	}
+	if end >= len(u.chain) {
+		end = len(u.chain) - 1
+	}
+	stream := &fakeBlockStream{}
+	if start <= end {
+		stream.blocks = append(stream.blocks, u.chain[start:end+1]...)
+	}
+	return stream, nil
+}
+
+type fakeBlockStream struct {
+	grpc.ClientStream
+	blocks []*walletrpc.CompactBlock
+}
+
+func (s *fakeBlockStream) Recv() (*walletrpc.CompactBlock, error) {
+	if len(s.blocks) == 0 {
+		return nil, io.EOF
+	}
+	block := s.blocks[0]
+	s.blocks = s.blocks[1:]
+	return block, nil
+}
+
+func TestFollowUpstream(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, replicaTestStart, true)
+	upstream := &fakeUpstream{}
+
+	upstream.setChain(replicaTestStart+100, replicaTestStart+4)
+	added, reorg, err := followOnce(context.Background(), cache, upstream)
+	if err != nil || reorg || added != 5 {
+		t.Fatal("unexpected followOnce result", added, reorg, err)
+	}
+	added, reorg, err = followOnce(context.Background(), cache, upstream)
+	if err != nil || reorg || added != 0 {
+		t.Fatal("unexpected followOnce result with no new blocks", added, reorg, err)
+	}
+
+	// The upstream's tip is replaced by a block at the same height.
+	upstream.setChain(replicaTestStart+4, replicaTestStart+4)
+	added, reorg, err = followOnce(context.Background(), cache, upstream)
+	if err != nil || !reorg || added != 0 {
+		t.Fatal("replaced tip not detected", added, reorg, err)
+	}
+
+	// A longer fork replaces the last two blocks; the follower backs up
+	// and adds the new fork.
+	upstream.setChain(replicaTestStart+3, replicaTestStart+6)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		FollowUpstream(ctx, cache, upstream, 10*time.Millisecond)
+		close(done)
+	}()
+	want := replicaTestBlock(replicaTestStart+6, 'b', 'b').Hash
+	for i := 0; ; i++ {
+		if _, hash := cache.GetLatestBlockID(); bytes.Equal(hash, want) {
+			break
+		}
+		if i > 500 {
+			t.Fatal("follower didn't reach the upstream's tip, at ", cache.GetLatestHeight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	for height := replicaTestStart; height <= replicaTestStart+6; height++ {
+		block := cache.Get(context.Background(), height)
+		if block == nil {
+			t.Fatal("missing block", height)
+		}
+		fork := byte('a')
+		if height >= replicaTestStart+3 {
+			fork = 'b'
+		}
+		if block.Hash[0] != fork {
+			t.Fatal("block", height, "is from the wrong fork")
+		}
+	}
+}
+
+func TestFollowUpstreamMaxBlockRange(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, replicaTestStart, true)
+
+	// The upstream refuses ranges longer than one batch, and has more than
+	// two batches to send a fresh replica.
+	upstream := &fakeUpstream{maxBlockRange: upstreamBatchSize}
+	count := 2*upstreamBatchSize + 500
+	upstream.setChain(replicaTestStart+count, replicaTestStart+count-1)
+	added, reorg, err := followOnce(context.Background(), cache, upstream)
+	if err != nil || reorg || added != count {
+		t.Fatal("unexpected followOnce result", added, reorg, err)
+	}
+	if cache.GetNextHeight() != replicaTestStart+count {
+		t.Fatal("follower didn't reach the upstream's tip, at ", cache.GetNextHeight())
+	}
+}
+
+func TestFollowUpstreamCheckpoint(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, replicaTestStart, true)
+	upstream := &fakeUpstream{}
+
+	// The upstream's chain forks below a checkpoint on fork a.
+	checkpoint := replicaTestBlock(replicaTestStart+2, 'a', 'a')
+	defer SetCheckpoints("", nil)
+	if err := SetCheckpoints("", []Checkpoint{{Height: replicaTestStart + 2, Hash: displayHash(checkpoint.Hash)}}); err != nil {
+		t.Fatal("SetCheckpoints failed:", err)
+	}
+	upstream.setChain(replicaTestStart+2, replicaTestStart+4)
+	added, reorg, err := followOnce(context.Background(), cache, upstream)
+	if err == nil || reorg || added != 2 {
+		t.Fatal("block contradicting a checkpoint was accepted", added, reorg, err)
+	}
+	if cache.GetNextHeight() != replicaTestStart+2 {
+		t.Fatal("unexpected cache height", cache.GetNextHeight())
+	}
+}
+
+func TestFollowUpstreamPaused(t *testing.T) {
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, replicaTestStart, true)
+	upstream := &fakeUpstream{}
+	upstream.setChain(replicaTestStart+100, replicaTestStart+4)
+
+	PauseIngestor()
+	defer ResumeIngestor()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		FollowUpstream(ctx, cache, upstream, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if cache.GetNextHeight() != replicaTestStart {
+		t.Fatal("paused follower added blocks, at ", cache.GetNextHeight())
+	}
+	ResumeIngestor()
+	for i := 0; cache.GetNextHeight() != replicaTestStart+5; i++ {
+		if i > 500 {
+			t.Fatal("resumed follower didn't reach the upstream's tip, at ", cache.GetNextHeight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
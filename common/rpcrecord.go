@@ -0,0 +1,109 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// rpcExchange is one line of an RPC recording: a zcashd JSON-RPC request
+// and its reply.
+type rpcExchange struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// key identifies the request an exchange answers.
+func (e *rpcExchange) key() string {
+	if len(e.Params) == 0 {
+		return e.Method + "[]"
+	}
+	params, _ := json.Marshal(e.Params)
+	return e.Method + string(params)
+}
+
+// RecordRawRequest wraps a request function (such as rpcClient.RawRequest)
+// so that each request and its reply are written to out as a line of JSON.
+// These recordings are the fixtures NewReplayRawRequest plays back.
+func RecordRawRequest(
+	rawRequest func(method string, params []json.RawMessage) (json.RawMessage, error),
+	out io.Writer,
+) func(method string, params []json.RawMessage) (json.RawMessage, error) {
+	var mutex sync.Mutex
+	return func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		result, err := rawRequest(method, params)
+		exchange := rpcExchange{Method: method, Params: params, Result: result}
+		if err != nil {
+			exchange.Result = nil
+			exchange.Error = err.Error()
+		}
+		line, merr := json.Marshal(&exchange)
+		if merr != nil {
+			Log.Warning("recording ", method, ": ", merr)
+			return result, err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if _, werr := out.Write(append(line, '\n')); werr != nil {
+			Log.Warning("recording ", method, ": ", werr)
+		}
+		return result, err
+	}
+}
+
+// NewReplayRawRequest returns a request function that answers zcashd
+// JSON-RPC requests from a recording made by RecordRawRequest. A request
+// gets the recorded replies to the same request (same method and params) in
+// order; once those run out, it keeps getting the last one. A request that
+// wasn't recorded fails. Blank lines, and lines starting with #, are ignored.
+func NewReplayRawRequest(in io.Reader) (func(method string, params []json.RawMessage) (json.RawMessage, error), error) {
+	replies := make(map[string][]rpcExchange)
+	scanner := bufio.NewScanner(in)
+	// Recorded blocks can be large.
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		var exchange rpcExchange
+		if err := json.Unmarshal(text, &exchange); err != nil {
+			return nil, errors.Wrapf(err, "recording line %d", line)
+		}
+		key := exchange.key()
+		replies[key] = append(replies[key], exchange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading recording")
+	}
+
+	var mutex sync.Mutex
+	return func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		request := rpcExchange{Method: method, Params: params}
+		key := request.key()
+		mutex.Lock()
+		exchanges := replies[key]
+		if len(exchanges) == 0 {
+			mutex.Unlock()
+			return nil, errors.New("no recorded reply to " + key)
+		}
+		exchange := exchanges[0]
+		if len(exchanges) > 1 {
+			replies[key] = exchanges[1:]
+		}
+		mutex.Unlock()
+		if exchange.Error != "" {
+			return nil, errors.New(exchange.Error)
+		}
+		return exchange.Result, nil
+	}, nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// backendStub is a zcashd with a chain 1000 blocks long and a mempool.
+func backendStub(method string, params []json.RawMessage) (json.RawMessage, error) {
+	switch method {
+	case "getblockchaininfo":
+		return json.Marshal(&ZcashdRpcReplyGetblockchaininfo{Chain: "main", Blocks: 1000})
+	case "getblock":
+		return nil, errors.New("-8: Block height out of range")
+	case "getrawtransaction":
+		var txid string
+		json.Unmarshal(params[0], &txid)
+		if txid != "0102" {
+			return nil, errors.New("-5: No information available about transaction")
+		}
+		return json.Marshal(&ZcashdRpcReplyGetrawtransaction{Hex: "dead", Height: 900})
+	case "getrawmempool":
+		return json.Marshal([]string{"0102", "0304"})
+	}
+	return nil, errors.New("unexpected call to " + method)
+}
+
+func TestRecordReplayRawRequest(t *testing.T) {
+	var recording bytes.Buffer
+	record := RecordRawRequest(backendStub, &recording)
+	record("getblockchaininfo", []json.RawMessage{})
+	record("getrawtransaction", []json.RawMessage{json.RawMessage(`"0102"`), json.RawMessage("1")})
+	record("getrawtransaction", []json.RawMessage{json.RawMessage(`"0506"`), json.RawMessage("1")})
+
+	// Comments can be added to recordings.
+	fixture := "# a comment\n\n" + recording.String()
+	replay, err := NewReplayRawRequest(strings.NewReader(fixture))
+	if err != nil {
+		t.Fatal("NewReplayRawRequest failed:", err)
+	}
+	// Params are matched by value, not formatting.
+	result, err := replay("getrawtransaction", []json.RawMessage{json.RawMessage(` "0102"`), json.RawMessage("1")})
+	if err != nil {
+		t.Fatal("replayed getrawtransaction failed:", err)
+	}
+	var tx ZcashdRpcReplyGetrawtransaction
+	if err := json.Unmarshal(result, &tx); err != nil || tx.Hex != "dead" || tx.Height != 900 {
+		t.Fatal("unexpected replayed transaction", string(result), err)
+	}
+	_, err = replay("getrawtransaction", []json.RawMessage{json.RawMessage(`"0506"`), json.RawMessage("1")})
+	if err == nil || err.Error() != "-5: No information available about transaction" {
+		t.Fatal("unexpected replayed error", err)
+	}
+	// No params is the same as empty params.
+	if _, err := replay("getblockchaininfo", nil); err != nil {
+		t.Fatal("replayed getblockchaininfo failed:", err)
+	}
+	if _, err := replay("getrawmempool", nil); err == nil {
+		t.Fatal("unrecorded getrawmempool succeeded")
+	}
+	if _, err := NewReplayRawRequest(strings.NewReader("{bad json\n")); err == nil {
+		t.Fatal("NewReplayRawRequest accepted a bad recording")
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+// Package snapshot reads and writes block cache snapshots, a portable form of
+// a range of the cache used to seed new lightwalletd instances.
+//
+// A snapshot is the 8-byte magic "LWDSNAP\x00" and a 4-byte big-endian format
+// version, followed by a gzip stream containing:
+//
+//   - the header: chain ID, start and end heights (inclusive), and the hash
+//     of the block at the end height
+//   - one record per block, in height order: the length of the marshalled
+//     CompactBlock, then the block; from version 2 the block's header field
+//     carries its full raw header, if the cache has it
+//   - a zero length, marking the end of the records, and the record count
+//   - the SHA-256 of everything in the stream before it
+//
+// Strings, byte slices and records are prefixed with their length; lengths,
+// heights and counts are unsigned varints.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/golang/protobuf/proto"
+)
+
+// Version is the snapshot format version written by this package; it also
+// reads the earlier versions.
+const Version = 2
+
+const (
+	magic = "LWDSNAP\x00"
+
+	// Limits, to fail cleanly on damaged snapshots.
+	maxRecordSize = 16 << 20
+	maxFieldSize  = 1 << 10
+)
+
+// Errors returned when reading a snapshot.
+var (
+	ErrNotSnapshot = errors.New("not a block cache snapshot")
+	ErrChecksum    = errors.New("snapshot checksum mismatch")
+)
+
+// Header describes the blocks in a snapshot.
+type Header struct {
+	ChainID     string
+	StartHeight uint64 // height of the first block
+	EndHeight   uint64 // height of the last block
+	TipHash     []byte // hash of the last block
+}
+
+// Writer writes a snapshot.
+type Writer struct {
+	header Header
+	gz     *gzip.Writer
+	body   io.Writer // the gzip stream, and the checksum
+	sum    hash.Hash
+	next   uint64 // height of the next block to write
+}
+
+// NewWriter writes the snapshot preamble and header to w; the blocks from
+// the header's start height through its end height must then be written,
+// in order, followed by Close.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.EndHeight < h.StartHeight {
+		return nil, errors.New("snapshot end height is less than start height")
+	}
+	if len(h.ChainID) > maxFieldSize || len(h.TipHash) > maxFieldSize {
+		return nil, errors.New("snapshot header field too long")
+	}
+	preamble := make([]byte, len(magic)+4)
+	copy(preamble, magic)
+	binary.BigEndian.PutUint32(preamble[len(magic):], Version)
+	if _, err := w.Write(preamble); err != nil {
+		return nil, err
+	}
+	sw := &Writer{header: h, gz: gzip.NewWriter(w), sum: sha256.New(), next: h.StartHeight}
+	sw.body = io.MultiWriter(sw.gz, sw.sum)
+
+	var buf bytes.Buffer
+	putBytes(&buf, []byte(h.ChainID))
+	putUvarint(&buf, h.StartHeight)
+	putUvarint(&buf, h.EndHeight)
+	putBytes(&buf, h.TipHash)
+	if _, err := sw.body.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Write adds the next block to the snapshot.
+func (sw *Writer) Write(block *walletrpc.CompactBlock) error {
+	if block.Height != sw.next || sw.next > sw.header.EndHeight {
+		return fmt.Errorf("snapshot block at height %d, expected %d", block.Height, sw.next)
+	}
+	data, err := proto.Marshal(block)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	putBytes(&buf, data)
+	if _, err := sw.body.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	sw.next++
+	return nil
+}
+
+// Close ends the snapshot, after all its blocks have been written; it
+// doesn't close the underlying writer.
+func (sw *Writer) Close() error {
+	if sw.next != sw.header.EndHeight+1 {
+		return fmt.Errorf("snapshot is missing blocks %d to %d", sw.next, sw.header.EndHeight)
+	}
+	var buf bytes.Buffer
+	putUvarint(&buf, 0)
+	putUvarint(&buf, sw.next-sw.header.StartHeight)
+	if _, err := sw.body.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if _, err := sw.gz.Write(sw.sum.Sum(nil)); err != nil {
+		return err
+	}
+	return sw.gz.Close()
+}
+
+// Reader reads a snapshot.
+type Reader struct {
+	header Header
+	body   *hashingReader
+	next   uint64 // height of the next block to read
+	done   bool
+}
+
+// NewReader reads the snapshot preamble and header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	preamble := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotSnapshot
+		}
+		return nil, err
+	}
+	if string(preamble[:len(magic)]) != magic {
+		return nil, ErrNotSnapshot
+	}
+	if v := binary.BigEndian.Uint32(preamble[len(magic):]); v < 1 || v > Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d (this lightwalletd reads versions 1 to %d)", v, Version)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	sr := &Reader{body: &hashingReader{r: bufio.NewReader(gz), sum: sha256.New()}}
+	chainID, err := sr.body.readBytes(maxFieldSize)
+	if err != nil {
+		return nil, err
+	}
+	sr.header.ChainID = string(chainID)
+	if sr.header.StartHeight, err = binary.ReadUvarint(sr.body); err != nil {
+		return nil, unexpected(err)
+	}
+	if sr.header.EndHeight, err = binary.ReadUvarint(sr.body); err != nil {
+		return nil, unexpected(err)
+	}
+	if sr.header.TipHash, err = sr.body.readBytes(maxFieldSize); err != nil {
+		return nil, err
+	}
+	if sr.header.EndHeight < sr.header.StartHeight {
+		return nil, errors.New("snapshot end height is less than start height")
+	}
+	sr.next = sr.header.StartHeight
+	return sr, nil
+}
+
+// Header returns the snapshot's header.
+func (sr *Reader) Header() Header {
+	return sr.header
+}
+
+// Next returns the next block in the snapshot. After the last block it
+// returns io.EOF, but only if the whole snapshot is intact; any other error
+// means the snapshot is damaged or doesn't match its header.
+func (sr *Reader) Next() (*walletrpc.CompactBlock, error) {
+	if sr.done {
+		return nil, io.EOF
+	}
+	data, err := sr.body.readBytes(maxRecordSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		if err := sr.finish(); err != nil {
+			return nil, err
+		}
+		sr.done = true
+		return nil, io.EOF
+	}
+	if sr.next > sr.header.EndHeight {
+		return nil, errors.New("snapshot has blocks beyond its end height")
+	}
+	block := &walletrpc.CompactBlock{}
+	if err := proto.Unmarshal(data, block); err != nil {
+		return nil, fmt.Errorf("snapshot block %d: %v", sr.next, err)
+	}
+	if block.Height != sr.next {
+		return nil, fmt.Errorf("snapshot block at height %d, expected %d", block.Height, sr.next)
+	}
+	sr.next++
+	return block, nil
+}
+
+// finish checks the record count and checksum at the end of the snapshot.
+func (sr *Reader) finish() error {
+	count, err := binary.ReadUvarint(sr.body)
+	if err != nil {
+		return unexpected(err)
+	}
+	if count != sr.next-sr.header.StartHeight || sr.next != sr.header.EndHeight+1 {
+		return fmt.Errorf("snapshot ends at height %d, expected %d", sr.next-1, sr.header.EndHeight)
+	}
+	expected := sr.body.sum.Sum(nil)
+	actual := make([]byte, len(expected))
+	if _, err := io.ReadFull(sr.body.r, actual); err != nil {
+		return unexpected(err)
+	}
+	if !bytes.Equal(expected, actual) {
+		return ErrChecksum
+	}
+	if _, err := sr.body.r.ReadByte(); err != io.EOF {
+		return errors.New("snapshot has data after its checksum")
+	}
+	return nil
+}
+
+// hashingReader adds the bytes read to a checksum.
+type hashingReader struct {
+	r   *bufio.Reader
+	sum hash.Hash
+}
+
+func (hr *hashingReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.sum.Write([]byte{b})
+	}
+	return b, err
+}
+
+// readBytes reads a length-prefixed byte slice.
+func (hr *hashingReader) readBytes(max int) ([]byte, error) {
+	n, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if n > uint64(max) {
+		return nil, errors.New("snapshot field too long")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(hr.r, b); err != nil {
+		return nil, unexpected(err)
+	}
+	hr.sum.Write(b)
+	return b, nil
+}
+
+// unexpected reports the end of the stream inside a snapshot as an error,
+// so only a complete snapshot ends with io.EOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func putBytes(buf *bytes.Buffer, b []byte) {
+	putUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
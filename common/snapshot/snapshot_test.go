@@ -0,0 +1,141 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+)
+
+var testHeader = Header{
+	ChainID:     "main",
+	StartHeight: 380640,
+	EndHeight:   380642,
+	TipHash:     []byte{3},
+}
+
+func writeTestSnapshot(t *testing.T) []byte {
+	var buf bytes.Buffer
+	sw, err := NewWriter(&buf, testHeader)
+	if err != nil {
+		t.Fatal("NewWriter failed:", err)
+	}
+	for i := uint64(0); i < 3; i++ {
+		block := &walletrpc.CompactBlock{Height: 380640 + i, Hash: []byte{byte(i + 1)}, PrevHash: []byte{byte(i)}}
+		if err := sw.Write(block); err != nil {
+			t.Fatal("Write failed:", err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal("Close failed:", err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(data []byte) ([]*walletrpc.CompactBlock, error) {
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var blocks []*walletrpc.CompactBlock
+	for {
+		block, err := sr.Next()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := writeTestSnapshot(t)
+	sr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("NewReader failed:", err)
+	}
+	h := sr.Header()
+	if h.ChainID != "main" || h.StartHeight != 380640 || h.EndHeight != 380642 || !bytes.Equal(h.TipHash, []byte{3}) {
+		t.Fatal("unexpected header", h)
+	}
+	blocks, err := readAll(data)
+	if err != nil {
+		t.Fatal("reading failed:", err)
+	}
+	if len(blocks) != 3 || blocks[2].Height != 380642 || !bytes.Equal(blocks[2].Hash, []byte{3}) {
+		t.Fatal("unexpected blocks", blocks)
+	}
+}
+
+func TestWriterChecks(t *testing.T) {
+	sw, err := NewWriter(ioutil.Discard, testHeader)
+	if err != nil {
+		t.Fatal("NewWriter failed:", err)
+	}
+	if err := sw.Write(&walletrpc.CompactBlock{Height: 380641}); err == nil {
+		t.Fatal("out of order block accepted")
+	}
+	if err := sw.Write(&walletrpc.CompactBlock{Height: 380640}); err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	if err := sw.Close(); err == nil {
+		t.Fatal("Close of an incomplete snapshot succeeded")
+	}
+	if _, err := NewWriter(ioutil.Discard, Header{StartHeight: 2, EndHeight: 1}); err == nil {
+		t.Fatal("inverted range accepted")
+	}
+}
+
+func TestDamagedSnapshots(t *testing.T) {
+	data := writeTestSnapshot(t)
+
+	if _, err := NewReader(bytes.NewReader([]byte("not a snapshot"))); err != ErrNotSnapshot {
+		t.Fatal("unexpected error", err)
+	}
+	future := append([]byte(nil), data...)
+	future[len(magic)+3] = 99
+	if _, err := NewReader(bytes.NewReader(future)); err == nil {
+		t.Fatal("unsupported version accepted")
+	}
+	// Version 1 differs only in that its blocks have no headers.
+	old := append([]byte(nil), data...)
+	old[len(magic)+3] = 1
+	if blocks, err := readAll(old); err != nil || len(blocks) != 3 {
+		t.Fatal("version 1 snapshot not accepted", err)
+	}
+
+	// Every truncation must fail, never end cleanly.
+	for n := len(magic) + 4; n < len(data); n++ {
+		if _, err := readAll(data[:n]); err == nil {
+			t.Fatal("snapshot truncated to", n, "bytes was accepted")
+		}
+	}
+
+	// Recompress the contents with one byte changed, so only the
+	// snapshot's own checksum can catch it.
+	gz, err := gzip.NewReader(bytes.NewReader(data[len(magic)+4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body[len(body)-40] ^= 1
+	var buf bytes.Buffer
+	buf.Write(data[:len(magic)+4])
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+	if _, err := readAll(buf.Bytes()); err == nil {
+		t.Fatal("corrupt snapshot accepted")
+	}
+}
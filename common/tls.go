@@ -0,0 +1,178 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var certExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "lightwalletd_tls_certificate_expiry_timestamp_seconds",
+	Help: "Unix time at which the TLS certificate being served expires.",
+})
+
+func init() {
+	prometheus.MustRegister(certExpiry)
+}
+
+// CertReloader holds the server's TLS certificate and key pair, which it
+// reloads from their files when they change (for example, after a Let's
+// Encrypt renewal) so that the server doesn't need to restart.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	certMod  time.Time // modification times of the loaded files
+	keyMod   time.Time
+	mutex    sync.RWMutex
+}
+
+// NewCertReloader loads the certificate and key from the given files.
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	r := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key files again. If they can't be loaded,
+// the previous certificate remains in use.
+func (r *CertReloader) Reload() error {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	r.mutex.Unlock()
+
+	SetCertificateExpiry(&cert)
+	Log.WithFields(logrus.Fields{
+		"cert_file": r.certPath,
+		"subject":   cert.Leaf.Subject.String(),
+		"not_after": cert.Leaf.NotAfter,
+	}).Info("Loaded TLS certificate")
+	return nil
+}
+
+// changed reports whether either file has been modified since it was loaded.
+func (r *CertReloader) changed() bool {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return !certInfo.ModTime().Equal(r.certMod) || !keyInfo.ModTime().Equal(r.keyMod)
+}
+
+// Watch checks the certificate and key files for changes at the given
+// interval, reloading them when they change, until ctx is cancelled.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		// The files may be replaced one at a time; a failure here
+		// is retried at the next interval.
+		if err := r.Reload(); err != nil {
+			Log.WithFields(logrus.Fields{
+				"cert_file": r.certPath,
+				"key_file":  r.keyPath,
+				"error":     err,
+			}).Warning("couldn't reload TLS certificate, keeping the previous one")
+		}
+	}
+}
+
+// GetCertificate returns the current certificate; it is suitable for
+// use as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// SetCertificateExpiry records the expiration time of the served certificate
+// in the lightwalletd_tls_certificate_expiry_timestamp_seconds gauge.
+func SetCertificateExpiry(cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	certExpiry.Set(float64(leaf.NotAfter.Unix()))
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig returns the server TLS configuration with the given minimum
+// protocol version ("1.2", for example) and cipher suites (by their standard
+// names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). An empty list of
+// cipher suites selects Go's defaults. Cipher suites don't apply to TLS 1.3.
+func NewTLSConfig(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported minimum TLS version %q (use 1.0, 1.1, 1.2, or 1.3)", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+	if len(cipherSuites) == 0 {
+		return config, nil
+	}
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+	for _, name := range cipherSuites {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unknown or insecure TLS cipher suite: " + name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for the given organization,
+// and its key, to the given files.
+func writeTestCert(t *testing.T, certPath, keyPath, org string, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{org}},
+		NotBefore:    time.Unix(1600000000, 0),
+		NotAfter:     time.Unix(1700000000, 0),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes, however coarse the filesystem's.
+	os.Chtimes(certPath, mtime, mtime)
+	os.Chtimes(keyPath, mtime, mtime)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lwd-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "cert.key")
+
+	writeTestCert(t, certPath, keyPath, "first", time.Unix(1600000000, 0))
+	r, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal("NewCertReloader failed:", err)
+	}
+	org := func() string {
+		cert, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+		return cert.Leaf.Subject.Organization[0]
+	}
+	if org() != "first" {
+		t.Fatal("unexpected certificate", org())
+	}
+	if r.changed() {
+		t.Fatal("unexpected change")
+	}
+
+	writeTestCert(t, certPath, keyPath, "second", time.Unix(1600000100, 0))
+	if !r.changed() {
+		t.Fatal("change not detected")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal("Reload failed:", err)
+	}
+	if org() != "second" {
+		t.Fatal("unexpected certificate after reload", org())
+	}
+
+	// A bad key file leaves the previous certificate in place.
+	if err := ioutil.WriteFile(keyPath, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload unexpectedly succeeded")
+	}
+	if org() != "second" {
+		t.Fatal("certificate replaced after failed reload", org())
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	config, err := NewTLSConfig("1.3", nil)
+	if err != nil {
+		t.Fatal("NewTLSConfig failed:", err)
+	}
+	if config.MinVersion != tls.VersionTLS13 || config.CipherSuites != nil {
+		t.Fatal("unexpected config", config)
+	}
+	config, err = NewTLSConfig("1.2", []string{
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		" TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	})
+	if err != nil {
+		t.Fatal("NewTLSConfig failed:", err)
+	}
+	if len(config.CipherSuites) != 2 ||
+		config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ||
+		config.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Fatal("unexpected cipher suites", config.CipherSuites)
+	}
+	if _, err := NewTLSConfig("1.4", nil); err == nil {
+		t.Fatal("NewTLSConfig unexpected success")
+	}
+	// Insecure suites aren't allowed.
+	if _, err := NewTLSConfig("1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Fatal("NewTLSConfig unexpected success")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+// Package tracing configures OpenTelemetry tracing. Until Init is called
+// (or if tracing is disabled), spans are no-ops and cost almost nothing.
+//
+// Spans start in the gRPC server interceptors (one per call) and continue
+// through the block cache and every RPC to zcashd, so the time taken by a
+// slow call can be attributed to the cache, LevelDB, or zcashd.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+const instrumentationName = "github.com/asherda/lightwalletd"
+
+// Exporters that Config.Exporter may name.
+const (
+	ExporterNone   = ""
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config specifies where spans are sent and how many are kept.
+type Config struct {
+	Exporter     string  // ExporterNone, ExporterStdout, or ExporterOTLP
+	OTLPEndpoint string  // collector host:port, for ExporterOTLP
+	OTLPInsecure bool    // connect to the collector without TLS
+	SampleRatio  float64 // fraction of traces (that don't have a sampled parent) to keep
+	Version      string  // lightwalletd version, recorded in the service resource
+}
+
+// Tracer returns the tracer for lightwalletd's own spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Init installs the global tracer provider described by cfg; the returned
+// function flushes any spans not yet exported and stops the exporter.
+func Init(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdout.NewExporter(stdout.WithWriter(os.Stdout), stdout.WithoutMetricExport())
+	case ExporterOTLP:
+		opts := []otlpgrpc.Option{otlpgrpc.WithEndpoint(cfg.OTLPEndpoint)}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlpgrpc.WithInsecure())
+		}
+		exporter, err = otlp.NewExporter(ctx, otlpgrpc.NewDriver(opts...))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q (use %s or %s)",
+			cfg.Exporter, ExporterStdout, ExporterOTLP)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(sdkresource.NewWithAttributes(
+			semconv.ServiceNameKey.String("lightwalletd"),
+			semconv.ServiceVersionKey.String(cfg.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	// Continue traces started by clients that send W3C trace context.
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// UnaryServerInterceptor starts a span for each unary call.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return otelgrpc.UnaryServerInterceptor()
+}
+
+// StreamServerInterceptor starts a span for each streaming call.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return otelgrpc.StreamServerInterceptor()
+}
+
+// UnaryClientInterceptor starts a span for each unary call made to another
+// server, and passes the trace context along with it.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return otelgrpc.UnaryClientInterceptor()
+}
+
+// StreamClientInterceptor starts a span for each streaming call made to
+// another server, and passes the trace context along with it.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return otelgrpc.StreamClientInterceptor()
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInit(t *testing.T) {
+	if _, err := Init(context.Background(), Config{Exporter: "jaeger"}); err == nil {
+		t.Fatal("Init unexpectedly accepted an unknown exporter")
+	}
+
+	shutdown, err := Init(context.Background(), Config{Exporter: ExporterNone})
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	if _, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); ok {
+		t.Fatal("tracer provider installed with no exporter")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal("shutdown failed:", err)
+	}
+
+	shutdown, err = Init(context.Background(), Config{Exporter: ExporterStdout, SampleRatio: 1})
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	_, span := Tracer().Start(context.Background(), "test")
+	if !span.SpanContext().IsSampled() {
+		t.Fatal("span not sampled with SampleRatio 1")
+	}
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal("shutdown failed:", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/status"
+)
+
+// upstreamTimeout limits each call an upstream backend makes.
+const upstreamTimeout = 30 * time.Second
+
+// errNoUpstreamBlocks is returned for blocks, which can't be had from an
+// upstream lightwalletd (it only has compact blocks); FollowUpstream adds them
+// to the cache instead of BlockIngestor.
+var errNoUpstreamBlocks = errors.New("blocks are not available from an upstream lightwalletd")
+
+// upstreamBackend is a NodeBackend that uses another lightwalletd's
+// CompactTxStreamer service, so that lightwalletd can run without a full node.
+type upstreamBackend struct {
+	upstream walletrpc.CompactTxStreamerClient
+}
+
+// NewUpstreamBackend returns a NodeBackend that gets tree states,
+// transactions, address information and the mempool from upstream, and
+// sends transactions to it.
+func NewUpstreamBackend(upstream walletrpc.CompactTxStreamerClient) NodeBackend {
+	return &upstreamBackend{upstream: upstream}
+}
+
+// upstreamError returns an error from the upstream as zcashd would: the
+// upstream passes on zcashd's "code: message" errors as the gRPC status
+// message.
+func upstreamError(err error) error {
+	if s, ok := status.FromError(err); ok && err != nil {
+		return errors.New(s.Message())
+	}
+	return err
+}
+
+func (b *upstreamBackend) GetBlockchainInfo(ctx context.Context) (*ZcashdRpcReplyGetblockchaininfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	info, err := b.upstream.GetLightdInfo(ctx, &walletrpc.Empty{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	// Report the upstream's latest block, rather than its zcashd's, since
+	// that's the block we can get from it.
+	latest, err := b.upstream.GetLatestBlock(ctx, &walletrpc.ChainSpec{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	return &ZcashdRpcReplyGetblockchaininfo{
+		Name:    info.ChainName,
+		Chain:   info.ChainName,
+		ChainID: info.ChainID,
+		Upgrades: map[string]Upgradeinfo{
+			"76b809bb": {ActivationHeight: int(info.SaplingActivationHeight), Status: "active"},
+		},
+		Blocks:          int(latest.Height),
+		Consensus:       ConsensusInfo{info.ConsensusBranchId, info.ConsensusBranchId},
+		EstimatedHeight: int(info.EstimatedHeight),
+	}, nil
+}
+
+func (b *upstreamBackend) GetInfo(ctx context.Context) (*ZcashdRpcReplyGetinfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	info, err := b.upstream.GetLightdInfo(ctx, &walletrpc.Empty{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	return &ZcashdRpcReplyGetinfo{
+		Build:      info.ZcashdBuild,
+		Subversion: info.ZcashdSubversion,
+	}, nil
+}
+
+func (b *upstreamBackend) GetBlock(ctx context.Context, height int) (*walletrpc.CompactBlock, error) {
+	return nil, errNoUpstreamBlocks
+}
+
+// GetBlockHeader gets the header from the upstream's header store, since
+// FollowUpstream adds only the compact blocks to the cache.
+func (b *upstreamBackend) GetBlockHeader(ctx context.Context, height int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	stream, err := b.upstream.GetHeaderRange(ctx, &walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: uint64(height)},
+		End:   &walletrpc.BlockID{Height: uint64(height)},
+	})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	header, err := stream.Recv()
+	if err == io.EOF {
+		// The upstream doesn't have the block yet.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	if int(header.Height) != height {
+		return nil, errors.Errorf("upstream sent header %d, expected %d", header.Height, height)
+	}
+	return header.Header, nil
+}
+
+func (b *upstreamBackend) GetTreeState(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.TreeState, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	treeState, err := b.upstream.GetTreeState(ctx, id)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	return treeState, nil
+}
+
+func (b *upstreamBackend) GetRawTransaction(ctx context.Context, txid []byte) (*walletrpc.RawTransaction, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	// The txid is big-endian; the upstream's request is little-endian.
+	tx, err := b.upstream.GetTransaction(ctx, &walletrpc.TxFilter{Hash: parser.Reverse(txid)})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	return tx, nil
+}
+
+func (b *upstreamBackend) SendRawTransaction(ctx context.Context, tx []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	resp, err := b.upstream.SendTransaction(ctx, &walletrpc.RawTransaction{Data: tx})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+	if resp.ErrorCode != 0 {
+		return "", fmt.Errorf("%d: %s", resp.ErrorCode, resp.ErrorMessage)
+	}
+	// On success, the message is zcashd's reply (the txid).
+	return resp.ErrorMessage, nil
+}
+
+func (b *upstreamBackend) GetMempool(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	// The upstream only sends the (shielded) transactions it can make
+	// compact, which are the only ones GetMempoolTx returns anyway.
+	stream, err := b.upstream.GetMempoolTx(ctx, &walletrpc.Exclude{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	txids := make([]string, 0)
+	for {
+		tx, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, upstreamError(err)
+		}
+		txids = append(txids, hex.EncodeToString(parser.Reverse(tx.Hash)))
+	}
+	return txids, nil
+}
+
+func (b *upstreamBackend) GetAddressTxids(ctx context.Context, addresses []string, start, end uint64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	// The upstream returns the transactions themselves; hash them to get
+	// their txids.
+	txids := make([]string, 0)
+	for _, addr := range addresses {
+		stream, err := b.upstream.GetTaddressTxids(ctx, &walletrpc.TransparentAddressBlockFilter{
+			Address: addr,
+			Range: &walletrpc.BlockRange{
+				Start: &walletrpc.BlockID{Height: start},
+				End:   &walletrpc.BlockID{Height: end},
+			},
+		})
+		if err != nil {
+			return nil, upstreamError(err)
+		}
+		for {
+			rawtx, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, upstreamError(err)
+			}
+			tx := parser.NewTransaction()
+			if _, err := tx.ParseFromSlice(rawtx.Data); err != nil {
+				return nil, errors.Wrap(err, "parsing transaction from upstream")
+			}
+			txids = append(txids, hex.EncodeToString(tx.GetDisplayHash()))
+		}
+	}
+	return txids, nil
+}
+
+func (b *upstreamBackend) GetAddressBalance(ctx context.Context, addresses []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	balance, err := b.upstream.GetTaddressBalance(ctx, &walletrpc.AddressList{Addresses: addresses})
+	if err != nil {
+		return 0, upstreamError(err)
+	}
+	return balance.ValueZat, nil
+}
+
+func (b *upstreamBackend) GetAddressUtxos(ctx context.Context, address string) (ZcashdRpcReplyGetaddressutxos, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	utxos, err := b.upstream.GetAddressUtxos(ctx, &walletrpc.GetAddressUtxosArg{Address: address})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	reply := make(ZcashdRpcReplyGetaddressutxos, len(utxos.AddressUtxos))
+	for i, utxo := range utxos.AddressUtxos {
+		reply[i].Txid = hex.EncodeToString(parser.Reverse(utxo.Txid))
+		reply[i].OutputIndex = int64(utxo.Index)
+		reply[i].Script = hex.EncodeToString(utxo.Script)
+		reply[i].Satoshis = uint64(utxo.ValueZat)
+		reply[i].Height = int(utxo.Height)
+	}
+	return reply, nil
+}
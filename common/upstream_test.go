@@ -0,0 +1,140 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/asherda/lightwalletd/walletrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// upstreamStub is an upstream lightwalletd with fixed replies.
+type upstreamStub struct {
+	walletrpc.CompactTxStreamerClient
+}
+
+func (u *upstreamStub) GetLightdInfo(ctx context.Context, in *walletrpc.Empty, opts ...grpc.CallOption) (*walletrpc.LightdInfo, error) {
+	return &walletrpc.LightdInfo{
+		ChainName:               "main",
+		SaplingActivationHeight: 419200,
+		ConsensusBranchId:       "e9ff75a6",
+		BlockHeight:             1000010,
+		ZcashdBuild:             "v4.1.0",
+	}, nil
+}
+
+func (u *upstreamStub) GetLatestBlock(ctx context.Context, in *walletrpc.ChainSpec, opts ...grpc.CallOption) (*walletrpc.BlockID, error) {
+	return &walletrpc.BlockID{Height: 1000000}, nil
+}
+
+func (u *upstreamStub) GetTreeState(ctx context.Context, id *walletrpc.BlockID, opts ...grpc.CallOption) (*walletrpc.TreeState, error) {
+	return &walletrpc.TreeState{Height: id.Height, Hash: "00ab", Time: 1234, Tree: "01ff"}, nil
+}
+
+func (u *upstreamStub) GetTransaction(ctx context.Context, txf *walletrpc.TxFilter, opts ...grpc.CallOption) (*walletrpc.RawTransaction, error) {
+	if txf.Hash[0] != 0x22 {
+		return nil, status.Error(codes.Unknown, "-5: No information available about transaction")
+	}
+	return &walletrpc.RawTransaction{Data: []byte{0xde, 0xad}, Height: 1000}, nil
+}
+
+func (u *upstreamStub) SendTransaction(ctx context.Context, rawtx *walletrpc.RawTransaction, opts ...grpc.CallOption) (*walletrpc.SendResponse, error) {
+	if rawtx.Data[0] == 0 {
+		return &walletrpc.SendResponse{ErrorCode: -26, ErrorMessage: "bad-txns"}, nil
+	}
+	return &walletrpc.SendResponse{ErrorMessage: `"0123"`}, nil
+}
+
+func (u *upstreamStub) GetHeaderRange(ctx context.Context, in *walletrpc.BlockRange, opts ...grpc.CallOption) (walletrpc.CompactTxStreamer_GetHeaderRangeClient, error) {
+	stream := &headerStream{}
+	for height := in.Start.Height; height <= in.End.Height && height <= 1000000; height++ {
+		stream.headers = append(stream.headers, &walletrpc.BlockHeader{
+			Height: height,
+			Header: []byte(fmt.Sprintf("header %d", height)),
+		})
+	}
+	return stream, nil
+}
+
+type headerStream struct {
+	grpc.ClientStream
+	headers []*walletrpc.BlockHeader
+}
+
+func (s *headerStream) Recv() (*walletrpc.BlockHeader, error) {
+	if len(s.headers) == 0 {
+		return nil, io.EOF
+	}
+	header := s.headers[0]
+	s.headers = s.headers[1:]
+	return header, nil
+}
+
+func TestUpstreamBackend(t *testing.T) {
+	backend := NewUpstreamBackend(&upstreamStub{})
+	ctx := context.Background()
+
+	info, err := GetLightdInfo(ctx, backend)
+	if err != nil {
+		t.Fatal("GetLightdInfo failed:", err)
+	}
+	if info.ChainName != "main" || info.SaplingActivationHeight != 419200 ||
+		info.BlockHeight != 1000000 || info.ConsensusBranchId != "e9ff75a6" || info.ZcashdBuild != "v4.1.0" {
+		t.Fatal("unexpected LightdInfo", info)
+	}
+
+	treeState, err := backend.GetTreeState(ctx, &walletrpc.BlockID{Height: 1000})
+	if err != nil {
+		t.Fatal("GetTreeState failed:", err)
+	}
+	if treeState.Height != 1000 || treeState.Hash != "00ab" || treeState.Tree != "01ff" {
+		t.Fatal("unexpected tree state", treeState)
+	}
+
+	// The txid is big-endian; the upstream's request is little-endian.
+	txid := make([]byte, 32)
+	txid[0], txid[31] = 0x11, 0x22
+	tx, err := backend.GetRawTransaction(ctx, txid)
+	if err != nil {
+		t.Fatal("GetRawTransaction failed:", err)
+	}
+	if !bytes.Equal(tx.Data, []byte{0xde, 0xad}) || tx.Height != 1000 {
+		t.Fatal("unexpected transaction", tx)
+	}
+	txid[0], txid[31] = 0x22, 0x11
+	_, err = backend.GetRawTransaction(ctx, txid)
+	if err == nil || err.Error() != "-5: No information available about transaction" {
+		t.Fatal("unexpected GetRawTransaction error", err)
+	}
+
+	result, err := backend.SendRawTransaction(ctx, []byte{1, 2})
+	if err != nil || result != `"0123"` {
+		t.Fatal("unexpected SendRawTransaction result", result, err)
+	}
+	_, err = backend.SendRawTransaction(ctx, []byte{0, 2})
+	if err == nil || err.Error() != "-26: bad-txns" {
+		t.Fatal("unexpected SendRawTransaction error", err)
+	}
+
+	// Headers come from the upstream's header store.
+	header, err := backend.GetBlockHeader(ctx, 1000)
+	if err != nil || string(header) != "header 1000" {
+		t.Fatal("unexpected GetBlockHeader result", header, err)
+	}
+	header, err = backend.GetBlockHeader(ctx, 1000001)
+	if err != nil || header != nil {
+		t.Fatal("unexpected GetBlockHeader result beyond the tip", header, err)
+	}
+
+	if _, err := backend.GetBlock(ctx, 1000); err == nil {
+		t.Fatal("GetBlock should fail")
+	}
+}
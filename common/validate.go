@@ -0,0 +1,122 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+)
+
+// BlockChecks selects the checks made on the blocks zcashd sends, so that a
+// compromised or buggy daemon can't feed wallets malformed blocks. Each
+// block's link to its parent (prevHash) is always checked by the ingestor,
+// which treats a mismatch as a reorg.
+type BlockChecks struct {
+	MerkleRoot  bool // the header's merkle root matches the transactions
+	ProofOfWork bool // the header hash meets its nBits target, unless it's a proof-of-stake block
+	Time        bool // the block time is after the median of the previous 11, and not too far in the future
+}
+
+// BlockValidation is the set of checks made on blocks from zcashd; it's set
+// at startup.
+var BlockValidation BlockChecks
+
+// InvalidBlockError is returned for a block that zcashd sent but that fails
+// one of the checks; zcashd was reached, so this isn't retried as a failed
+// RPC (see BlockIngestor).
+type InvalidBlockError struct {
+	Height int
+	Err    error
+}
+
+func (e *InvalidBlockError) Error() string {
+	return fmt.Sprintf("invalid block at height %d: %v", e.Height, e.Err)
+}
+
+// medianTimeSpan is the number of blocks whose median time a new block's
+// time must exceed.
+const medianTimeSpan = 11
+
+// maxFutureBlockTime is how far a block's time may be ahead of ours.
+const maxFutureBlockTime = 2 * time.Hour
+
+// checkBlock makes the checks on a parsed full block that BlockValidation
+// enables.
+func checkBlock(block *parser.Block) error {
+	if BlockValidation.MerkleRoot {
+		if err := block.CheckMerkleRoot(); err != nil {
+			blocksRejectedCounter.WithLabelValues("merkle_root").Inc()
+			return err
+		}
+	}
+	if BlockValidation.ProofOfWork && !block.IsProofOfStake() {
+		if err := block.CheckProofOfWork(); err != nil {
+			blocksRejectedCounter.WithLabelValues("proof_of_work").Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// blockTimes remembers the times of the blocks the ingestor has added, by
+// height, to check each new block's time against the median of the previous
+// ones. Times it doesn't have are read from the cache.
+type blockTimes map[int]uint32
+
+// add records the time of a block added to the cache, and forgets the times
+// that are no longer needed.
+func (t blockTimes) add(height int, block *walletrpc.CompactBlock) {
+	t[height] = block.Time
+	delete(t, height-medianTimeSpan)
+}
+
+// remove forgets the time of a block removed from the cache by a reorg.
+func (t blockTimes) remove(height int) {
+	delete(t, height)
+}
+
+// medianTimePast returns the median time of the (up to 11) cached blocks
+// before height, or zero if there are none.
+func (t blockTimes) medianTimePast(ctx context.Context, c *BlockCache, height int) uint32 {
+	var times []int
+	for h := height - medianTimeSpan; h < height; h++ {
+		if h < c.GetFirstHeight() {
+			continue
+		}
+		if _, ok := t[h]; !ok {
+			block := c.Get(ctx, h)
+			if block == nil {
+				continue
+			}
+			t[h] = block.Time
+		}
+		times = append(times, int(t[h]))
+	}
+	if len(times) == 0 {
+		return 0
+	}
+	sort.Ints(times)
+	return uint32(times[len(times)/2])
+}
+
+// checkTime checks that a block at the given height is later than the
+// median time of the blocks before it, and not more than two hours ahead of
+// the current time.
+func (t blockTimes) checkTime(ctx context.Context, c *BlockCache, height int, block *walletrpc.CompactBlock) error {
+	if mtp := t.medianTimePast(ctx, c, height); block.Time <= mtp {
+		blocksRejectedCounter.WithLabelValues("time").Inc()
+		return errors.Errorf("block time %d is not after the median time of the previous blocks (%d)", block.Time, mtp)
+	}
+	if limit := time.Now().Add(maxFutureBlockTime).Unix(); int64(block.Time) > limit {
+		blocksRejectedCounter.WithLabelValues("time").Inc()
+		return errors.Errorf("block time %d is too far in the future", block.Time)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestCheckBlockMerkleRoot(t *testing.T) {
+	defer func() { BlockValidation = BlockChecks{} }()
+	testBlocks, err := os.Open("../testdata/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testBlocks.Close()
+	scan := bufio.NewScanner(testBlocks)
+	scan.Buffer(make([]byte, 64*1024), 8*1024*1024)
+	if !scan.Scan() {
+		t.Fatal("no test blocks")
+	}
+	blockData, err := hex.DecodeString(scan.Text())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := parser.NewBlock()
+	if _, err := block.ParseFromSlice(blockData); err != nil {
+		t.Fatal(err)
+	}
+	height := block.GetHeight()
+	// Change the header's merkle root (after the version and prevHash).
+	blockData[4+32] ^= 1
+
+	rejected0 := testutil.ToFloat64(blocksRejectedCounter.WithLabelValues("merkle_root"))
+	if _, err := parseCompactBlock(blockData, height); err != nil {
+		t.Fatal("block was checked with validation off:", err)
+	}
+	BlockValidation.MerkleRoot = true
+	if _, err := parseCompactBlock(blockData, height); err == nil {
+		t.Fatal("block with the wrong merkle root was accepted")
+	} else if _, ok := err.(*InvalidBlockError); !ok {
+		t.Fatal("unexpected error type", err)
+	}
+	if testutil.ToFloat64(blocksRejectedCounter.WithLabelValues("merkle_root")) != rejected0+1 {
+		t.Fatal("rejected block wasn't counted")
+	}
+	blockData[4+32] ^= 1
+	if _, err := parseCompactBlock(blockData, height); err != nil {
+		t.Fatal("valid block was rejected:", err)
+	}
+}
+
+func TestCheckBlockProofOfWork(t *testing.T) {
+	defer func() { BlockValidation = BlockChecks{} }()
+	testBlocks, err := os.Open("../testdata/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testBlocks.Close()
+	scan := bufio.NewScanner(testBlocks)
+	scan.Buffer(make([]byte, 64*1024), 8*1024*1024)
+	if !scan.Scan() {
+		t.Fatal("no test blocks")
+	}
+	blockData, err := hex.DecodeString(scan.Text())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := parser.NewBlock()
+	if _, err := block.ParseFromSlice(blockData); err != nil {
+		t.Fatal(err)
+	}
+	height := block.GetHeight()
+	// The test blocks are Zcash blocks, so their Verus hashes don't meet
+	// their targets; this one's nonce doesn't mark it as proof of stake.
+	if block.IsProofOfStake() {
+		t.Fatal("unexpected proof-of-stake test block")
+	}
+
+	rejected0 := testutil.ToFloat64(blocksRejectedCounter.WithLabelValues("proof_of_work"))
+	BlockValidation.ProofOfWork = true
+	if _, err := parseCompactBlock(blockData, height); err == nil {
+		t.Fatal("block above its target was accepted")
+	} else if _, ok := err.(*InvalidBlockError); !ok {
+		t.Fatal("unexpected error type", err)
+	}
+	if testutil.ToFloat64(blocksRejectedCounter.WithLabelValues("proof_of_work")) != rejected0+1 {
+		t.Fatal("rejected block wasn't counted")
+	}
+
+	// Proof-of-stake blocks aren't checked. (The nonce isn't covered by
+	// the merkle root, which isn't checked here anyway.)
+	nonce := 4 + 32 + 32 + 32 + 4 + 4
+	blockData[nonce] = 0xff
+	if _, err := parseCompactBlock(blockData, height); err != nil {
+		t.Fatal("proof-of-stake block was rejected:", err)
+	}
+}
+
+func TestCheckBlockTime(t *testing.T) {
+	ctx := context.Background()
+	os.RemoveAll(unitTestPath)
+	defer os.RemoveAll(unitTestPath)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := NewBlockCache(db, unitTestChain, 380640, true)
+	// Block times go up by 100 seconds, but the earlier ones are out of order.
+	blockTime := func(height int) uint32 {
+		if height < 380645 && height%2 == 1 {
+			return uint32(1600000000 + (height-380640)*100 + 250)
+		}
+		return uint32(1600000000 + (height-380640)*100)
+	}
+	for height := 380640; height < 380652; height++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(height),
+			Hash:     []byte(fmt.Sprintf("%032d", height)),
+			PrevHash: []byte(fmt.Sprintf("%032d", height-1)),
+			Time:     blockTime(height),
+		}
+		if err := cache.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+
+	// The median of the previous 11 blocks' times (380641-380651) is 380646's.
+	times := make(blockTimes)
+	if mtp := times.medianTimePast(ctx, cache, 380652); mtp != blockTime(380646) {
+		t.Fatal("unexpected median time", mtp, blockTime(380646))
+	}
+	block := &walletrpc.CompactBlock{Height: 380652, Time: blockTime(380646)}
+	if err := times.checkTime(ctx, cache, 380652, block); err == nil {
+		t.Fatal("block time at the median was accepted")
+	}
+	block.Time++
+	if err := times.checkTime(ctx, cache, 380652, block); err != nil {
+		t.Fatal("block time after the median was rejected:", err)
+	}
+	block.Time = uint32(time.Now().Add(3 * time.Hour).Unix())
+	if err := times.checkTime(ctx, cache, 380652, block); err == nil {
+		t.Fatal("block time in the future was accepted")
+	}
+
+	// A reorg replaces a block with an earlier time.
+	times.remove(380651)
+	cache.Reorg(380651)
+	replacement := &walletrpc.CompactBlock{
+		Height:   380651,
+		Hash:     []byte(fmt.Sprintf("%031dx", 380651)),
+		PrevHash: []byte(fmt.Sprintf("%032d", 380650)),
+		Time:     blockTime(380641),
+	}
+	if err := cache.Add(380651, replacement); err != nil {
+		t.Fatal("cache.Add failed:", err)
+	}
+	times.add(380651, replacement)
+	if mtp := times.medianTimePast(ctx, cache, 380652); mtp != blockTime(380643) {
+		t.Fatal("unexpected median time after reorg", mtp, blockTime(380643))
+	}
+	// The first block has nothing to compare with.
+	if mtp := times.medianTimePast(ctx, cache, 380640); mtp != 0 {
+		t.Fatal("unexpected median time before the first block", mtp)
+	}
+}
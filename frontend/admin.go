@@ -0,0 +1,161 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package frontend
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/asherda/lightwalletd/common"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type adminServer struct {
+	cache *common.BlockCache
+	walletrpc.UnimplementedAdminServer
+}
+
+// NewAdminServer constructs the gRPC service for cache administration.
+func NewAdminServer(cache *common.BlockCache) walletrpc.AdminServer {
+	return &adminServer{cache: cache}
+}
+
+// ReadAdminToken reads the admin bearer token from a file; surrounding
+// white space is ignored.
+func ReadAdminToken(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", errors.New(path + " is empty")
+	}
+	return token, nil
+}
+
+// AdminAuthInterceptor rejects calls that don't carry the given token as
+// "authorization: Bearer <token>" metadata.
+func AdminAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, auth := range md.Get("authorization") {
+			if !strings.HasPrefix(auth, "Bearer ") {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid admin token")
+	}
+}
+
+func (s *adminServer) stats() (*walletrpc.AdminCacheStats, error) {
+	stats, err := s.cache.Stats()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &walletrpc.AdminCacheStats{
+		FirstHeight:    uint64(stats.FirstHeight),
+		NextHeight:     uint64(stats.NextHeight),
+		LatestHash:     stats.LatestHash,
+		DbSizeBytes:    stats.SizeBytes,
+		IngestorPaused: common.IngestorPaused(),
+	}, nil
+}
+
+// checkWritable returns an error for the calls that change the cache, or the
+// ingestor, if the cache was opened read-only (a read-only replica, which has
+// no ingestor).
+func (s *adminServer) checkWritable() error {
+	if s.cache.ReadOnly() {
+		return status.Error(codes.FailedPrecondition, "the cache is read-only")
+	}
+	return nil
+}
+
+// Rollback removes the blocks above the given height from the cache.
+func (s *adminServer) Rollback(ctx context.Context, h *walletrpc.AdminHeight) (*walletrpc.AdminCacheStats, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	common.Log.Warning("admin: rolling the cache back to height ", h.Height)
+	s.cache.Rollback(int(h.Height))
+	return s.stats()
+}
+
+// Verify re-checks the cached blocks in the given range.
+func (s *adminServer) Verify(ctx context.Context, r *walletrpc.AdminHeightRange) (*walletrpc.AdminVerifyResult, error) {
+	if r.End < r.Start {
+		return nil, status.Error(codes.InvalidArgument, "end height is less than start height")
+	}
+	start, end := int(r.Start), int(r.End)
+	if first := s.cache.GetFirstHeight(); start < first {
+		start = first
+	}
+	if next := s.cache.GetNextHeight(); end >= next {
+		end = next - 1
+	}
+	result := &walletrpc.AdminVerifyResult{}
+	if end >= start {
+		result.Checked = uint64(end - start + 1)
+	}
+	for _, height := range s.cache.Verify(start, end) {
+		result.BadHeights = append(result.BadHeights, uint64(height))
+	}
+	if len(result.BadHeights) > 0 {
+		common.Log.Warning("admin: verify found ", len(result.BadHeights), " bad blocks, the first at height ",
+			result.BadHeights[0])
+	}
+	return result, nil
+}
+
+// Compact runs a full LevelDB compaction.
+func (s *adminServer) Compact(ctx context.Context, e *walletrpc.Empty) (*walletrpc.AdminCacheStats, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	common.Log.Info("admin: compacting the cache database")
+	if err := s.cache.Compact(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return s.stats()
+}
+
+// PauseIngestor stops the block ingestor (or upstream follower) from adding
+// blocks.
+func (s *adminServer) PauseIngestor(ctx context.Context, e *walletrpc.Empty) (*walletrpc.AdminCacheStats, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	common.PauseIngestor()
+	return s.stats()
+}
+
+// ResumeIngestor restarts a paused block ingestor.
+func (s *adminServer) ResumeIngestor(ctx context.Context, e *walletrpc.Empty) (*walletrpc.AdminCacheStats, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	common.ResumeIngestor()
+	return s.stats()
+}
+
+// GetCacheStats returns the cache's height range, latest hash, and size.
+func (s *adminServer) GetCacheStats(ctx context.Context, e *walletrpc.Empty) (*walletrpc.AdminCacheStats, error) {
+	return s.stats()
+}
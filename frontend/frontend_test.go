@@ -18,6 +18,11 @@ import (
 	"github.com/asherda/lightwalletd/common"
 	"github.com/asherda/lightwalletd/walletrpc"
 	"github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -34,10 +39,28 @@ const (
 	unitTestChain = "unittestnet"
 )
 
+// The cache from the previous testsetup(), closed by the next.
+var lastCache *common.BlockCache
+
+// rawRequest mocks zcashd for the streamer testsetup() returns.
+var rawRequest func(method string, params []json.RawMessage) (json.RawMessage, error)
+
 func testsetup() (walletrpc.CompactTxStreamerServer, *common.BlockCache) {
+	if lastCache != nil {
+		lastCache.Close()
+	}
 	os.RemoveAll(unitTestPath)
-	cache := common.NewBlockCache(unitTestPath, unitTestChain, 380640, true)
-	lwd, err := NewLwdStreamer(cache, "main", false /* enablePing */)
+	db, err := leveldb.OpenFile(unitTestPath, nil)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprint("leveldb.OpenFile failed:", err))
+		os.Exit(1)
+	}
+	cache := common.NewBlockCache(db, unitTestChain, 380640, true)
+	lastCache = cache
+	backend := common.NewRPCBackend(func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		return rawRequest(method, params)
+	})
+	lwd, err := NewLwdStreamer(cache, backend, "main", false /* enablePing */)
 	if err != nil {
 		os.Stderr.WriteString(fmt.Sprint("NewLwdStreamer failed:", err))
 		os.Exit(1)
@@ -159,7 +182,7 @@ func getblockStub(method string, params []json.RawMessage) (json.RawMessage, err
 
 func TestGetLatestBlock(t *testing.T) {
 	testT = t
-	common.RawRequest = getblockStub
+	rawRequest = getblockStub
 	lwd, cache := testsetup()
 
 	// This argument is not used (it may be in the future)
@@ -177,7 +200,7 @@ func TestGetLatestBlock(t *testing.T) {
 	}
 
 	// This does zcashd rpc "getblock", calls getblockStub() above
-	block, err := common.GetBlock(cache, 380640)
+	block, err := common.GetBlock(context.Background(), common.NewRPCBackend(getblockStub), cache, 380640)
 	if err != nil {
 		t.Fatal("getBlockFromRPC failed", err)
 	}
@@ -268,7 +291,7 @@ func (tg *testgettx) Send(tx *walletrpc.RawTransaction) error {
 
 func TestGetTaddressTxids(t *testing.T) {
 	testT = t
-	common.RawRequest = zcashdrpcStub
+	rawRequest = zcashdrpcStub
 	lwd, _ := testsetup()
 
 	addressBlockFilter := &walletrpc.TransparentAddressBlockFilter{
@@ -345,7 +368,7 @@ func TestGetTaddressTxidsNilArgs(t *testing.T) {
 
 func TestGetBlock(t *testing.T) {
 	testT = t
-	common.RawRequest = getblockStub
+	rawRequest = getblockStub
 	lwd, _ := testsetup()
 
 	_, err := lwd.GetBlock(context.Background(), &walletrpc.BlockID{})
@@ -397,8 +420,7 @@ func (tg *testgetbrange) Send(cb *walletrpc.CompactBlock) error {
 
 func TestGetBlockRange(t *testing.T) {
 	testT = t
-	common.RawRequest = getblockStub
-	common.RawRequest = getblockStub
+	rawRequest = getblockStub
 	lwd, _ := testsetup()
 
 	blockrange := &walletrpc.BlockRange{
@@ -443,6 +465,37 @@ func TestGetBlockRangeNilArgs(t *testing.T) {
 	}
 }
 
+func TestGetBlockRangeMax(t *testing.T) {
+	lwd, _ := testsetup()
+	common.MaxBlockRange = 100
+	defer func() { common.MaxBlockRange = 0 }()
+
+	for _, heights := range [][2]uint64{{380640, 380740}, {380740, 380640}} {
+		blockrange := &walletrpc.BlockRange{
+			Start: &walletrpc.BlockID{Height: heights[0]},
+			End:   &walletrpc.BlockID{Height: heights[1]},
+		}
+		err := lwd.GetBlockRange(blockrange, &testgetbrange{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatal("GetBlockRange of 101 blocks should have failed", err)
+		}
+		err = lwd.GetBlockHeaders(blockrange, &headerCollector{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatal("GetBlockHeaders of 101 blocks should have failed", err)
+		}
+		err = lwd.GetHeaderRange(blockrange, &headerRangeCollector{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatal("GetHeaderRange of 101 blocks should have failed", err)
+		}
+	}
+	if err := checkBlockRange(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380739},
+		End:   &walletrpc.BlockID{Height: 380640},
+	}); err != nil {
+		t.Fatal("range of 100 blocks rejected", err)
+	}
+}
+
 func sendrawtransactionStub(method string, params []json.RawMessage) (json.RawMessage, error) {
 	step++
 	if method != "sendrawtransaction" {
@@ -464,7 +517,7 @@ func sendrawtransactionStub(method string, params []json.RawMessage) (json.RawMe
 func TestSendTransaction(t *testing.T) {
 	testT = t
 	lwd, _ := testsetup()
-	common.RawRequest = sendrawtransactionStub
+	rawRequest = sendrawtransactionStub
 	rawtx := walletrpc.RawTransaction{Data: []byte{7}}
 	sendresult, err := lwd.SendTransaction(context.Background(), &rawtx)
 	if err != nil {
@@ -592,3 +645,199 @@ func TestMempoolFilter(t *testing.T) {
 	}
 
 }
+
+func TestAdmin(t *testing.T) {
+	_, cache := testsetup()
+	for h := 380640; h < 380644; h++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(h),
+			Hash:     []byte(fmt.Sprintf("%032d", h)),
+			PrevHash: []byte(fmt.Sprintf("%032d", h-1)),
+		}
+		if err := cache.Add(h, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	admin := NewAdminServer(cache)
+	stats, err := admin.GetCacheStats(context.Background(), &walletrpc.Empty{})
+	if err != nil {
+		t.Fatal("GetCacheStats failed:", err)
+	}
+	if stats.FirstHeight != 380640 || stats.NextHeight != 380644 || !bytes.Equal(stats.LatestHash, []byte(fmt.Sprintf("%032d", 380643))) {
+		t.Fatal("unexpected stats", stats)
+	}
+	result, err := admin.Verify(context.Background(), &walletrpc.AdminHeightRange{Start: 0, End: 999999})
+	if err != nil {
+		t.Fatal("Verify failed:", err)
+	}
+	if result.Checked != 4 || len(result.BadHeights) != 0 {
+		t.Fatal("unexpected verify result", result)
+	}
+	if _, err := admin.Verify(context.Background(), &walletrpc.AdminHeightRange{Start: 2, End: 1}); err == nil {
+		t.Fatal("Verify of an inverted range should fail")
+	}
+	stats, err = admin.Rollback(context.Background(), &walletrpc.AdminHeight{Height: 380641})
+	if err != nil {
+		t.Fatal("Rollback failed:", err)
+	}
+	if stats.NextHeight != 380642 || !bytes.Equal(stats.LatestHash, []byte(fmt.Sprintf("%032d", 380641))) {
+		t.Fatal("unexpected stats after rollback", stats)
+	}
+	if _, err := admin.Compact(context.Background(), &walletrpc.Empty{}); err != nil {
+		t.Fatal("Compact failed:", err)
+	}
+	stats, _ = admin.PauseIngestor(context.Background(), &walletrpc.Empty{})
+	if !stats.IngestorPaused || !common.IngestorPaused() {
+		t.Fatal("ingestor not paused")
+	}
+	stats, _ = admin.ResumeIngestor(context.Background(), &walletrpc.Empty{})
+	if stats.IngestorPaused || common.IngestorPaused() {
+		t.Fatal("ingestor still paused")
+	}
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	path := unitTestPath + "-readonly"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cache := common.NewBlockCache(db, unitTestChain, 380640, true)
+	for h := 380640; h < 380644; h++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(h),
+			Hash:     []byte(fmt.Sprintf("%032d", h)),
+			PrevHash: []byte(fmt.Sprintf("%032d", h-1)),
+		}
+		if err := cache.Add(h, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	cache.Sync()
+	readOnly, err := common.OpenBlockCache(db, true)
+	if err != nil {
+		t.Fatal("OpenBlockCache failed:", err)
+	}
+
+	// The calls that would change the cache, or its (missing) ingestor, fail.
+	admin := NewAdminServer(readOnly)
+	if _, err := admin.Rollback(context.Background(), &walletrpc.AdminHeight{Height: 380641}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatal("Rollback of a read-only cache should have failed", err)
+	}
+	if _, err := admin.Compact(context.Background(), &walletrpc.Empty{}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatal("Compact of a read-only cache should have failed", err)
+	}
+	if _, err := admin.PauseIngestor(context.Background(), &walletrpc.Empty{}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatal("PauseIngestor with a read-only cache should have failed", err)
+	}
+	if common.IngestorPaused() {
+		t.Fatal("ingestor paused")
+	}
+	stats, err := admin.GetCacheStats(context.Background(), &walletrpc.Empty{})
+	if err != nil || stats.NextHeight != 380644 {
+		t.Fatal("unexpected stats", stats, err)
+	}
+	result, err := admin.Verify(context.Background(), &walletrpc.AdminHeightRange{Start: 0, End: 999999})
+	if err != nil || result.Checked != 4 || len(result.BadHeights) != 0 {
+		t.Fatal("unexpected verify result", result, err)
+	}
+}
+
+func TestAdminAuthInterceptor(t *testing.T) {
+	interceptor := AdminAuthInterceptor("s3cret")
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	for _, tt := range []struct {
+		auth []string
+		ok   bool
+	}{
+		{nil, false},
+		{[]string{"authorization", "s3cret"}, false},
+		{[]string{"authorization", "Bearer wrong"}, false},
+		{[]string{"authorization", "Bearer s3cret"}, true},
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tt.auth...))
+		resp, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+		if tt.ok && (err != nil || resp != "ok") {
+			t.Fatal("call with", tt.auth, "failed:", err)
+		}
+		if !tt.ok && status.Code(err) != codes.Unauthenticated {
+			t.Fatal("call with", tt.auth, "unexpected result:", resp, err)
+		}
+	}
+}
+
+// replicaUpstream is an upstream lightwalletd that has every block, and
+// records the calls forwarded to it.
+type replicaUpstream struct {
+	walletrpc.CompactTxStreamerClient
+	calls []string
+}
+
+func (u *replicaUpstream) GetBlock(ctx context.Context, id *walletrpc.BlockID, opts ...grpc.CallOption) (*walletrpc.CompactBlock, error) {
+	u.calls = append(u.calls, "GetBlock")
+	return &walletrpc.CompactBlock{Height: id.Height}, nil
+}
+
+func (u *replicaUpstream) SendTransaction(ctx context.Context, rawtx *walletrpc.RawTransaction, opts ...grpc.CallOption) (*walletrpc.SendResponse, error) {
+	u.calls = append(u.calls, "SendTransaction")
+	return &walletrpc.SendResponse{ErrorMessage: "sent"}, nil
+}
+
+func TestReplicaStreamer(t *testing.T) {
+	_, cache := testsetup()
+	for h := 380640; h < 380642; h++ {
+		block := &walletrpc.CompactBlock{
+			Height:   uint64(h),
+			Hash:     []byte(fmt.Sprintf("%032d", h)),
+			PrevHash: []byte(fmt.Sprintf("%032d", h-1)),
+		}
+		if err := cache.Add(h, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	upstream := &replicaUpstream{}
+	replica, err := NewReplicaStreamer(cache, "main", false, upstream)
+	if err != nil {
+		t.Fatal("NewReplicaStreamer failed:", err)
+	}
+
+	// Cached blocks are served locally, others by the upstream.
+	block, err := replica.GetBlock(context.Background(), &walletrpc.BlockID{Height: 380641})
+	if err != nil || !bytes.Equal(block.Hash, []byte(fmt.Sprintf("%032d", 380641))) {
+		t.Fatal("cached GetBlock failed", block, err)
+	}
+	block, err = replica.GetBlock(context.Background(), &walletrpc.BlockID{Height: 380642})
+	if err != nil || block.Height != 380642 {
+		t.Fatal("forwarded GetBlock failed", block, err)
+	}
+	latest, err := replica.GetLatestBlock(context.Background(), &walletrpc.ChainSpec{})
+	if err != nil || latest.Height != 380641 {
+		t.Fatal("GetLatestBlock failed", latest, err)
+	}
+	resp, err := replica.SendTransaction(context.Background(), &walletrpc.RawTransaction{Data: []byte{1}})
+	if err != nil || resp.ErrorMessage != "sent" {
+		t.Fatal("forwarded SendTransaction failed", resp, err)
+	}
+
+	// Ranges that are too long are rejected before they're forwarded.
+	common.MaxBlockRange = 100
+	defer func() { common.MaxBlockRange = 0 }()
+	blockrange := &walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380740},
+		End:   &walletrpc.BlockID{Height: 380640},
+	}
+	if err := replica.GetBlockHeaders(blockrange, &headerCollector{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("GetBlockHeaders of 101 blocks should have failed", err)
+	}
+	if err := replica.GetHeaderRange(blockrange, &headerRangeCollector{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatal("GetHeaderRange of 101 blocks should have failed", err)
+	}
+	if strings.Join(upstream.calls, ",") != "GetBlock,SendTransaction" {
+		t.Fatal("unexpected upstream calls", upstream.calls)
+	}
+}
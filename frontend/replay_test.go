@@ -0,0 +1,619 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package frontend
+
+// These tests run the streamer against the zcashd replies in
+// testdata/*.jsonl, in the format --rpc-record writes.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asherda/lightwalletd/common"
+	"github.com/asherda/lightwalletd/parser"
+	"github.com/asherda/lightwalletd/walletrpc"
+)
+
+const (
+	replayAddress = "t1NjjYgsqP1i2iqXQXQoDeHNKmPGP8ayrmu"
+	replayTxid0   = "5fc4867a1b8bd5ab709799adf322a85d10607e053726d5f5ab4b1c9ab897e6bc"
+	replayTxid1   = "6732cf8d67aac5b82a2a0f0217a7d4aa245b2adb0b97fd2d923dfc674415e221"
+	replayTxid2   = "f0b22277ac851b5f4df590fe6a128aad9d0ce8063235eb2b328c2dc6a23c1ec5"
+)
+
+// replaySetup returns a streamer whose zcashd replies come from the
+// recording in testdata.
+func replaySetup(t *testing.T, fixture string) (walletrpc.CompactTxStreamerServer, *common.BlockCache) {
+	f, err := os.Open(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rawRequest, err = common.NewReplayRawRequest(f)
+	if err != nil {
+		t.Fatal("NewReplayRawRequest failed:", err)
+	}
+	return testsetup()
+}
+
+// txidBytes returns a txid, given in big-endian hex, in the little-endian
+// order the gRPC interface uses.
+func txidBytes(txid string) []byte {
+	b, _ := hex.DecodeString(txid)
+	return parser.Reverse(b)
+}
+
+type blockCollector struct {
+	walletrpc.CompactTxStreamer_GetBlockRangeServer
+	blocks []*walletrpc.CompactBlock
+}
+
+func (c *blockCollector) Context() context.Context {
+	return context.Background()
+}
+
+func (c *blockCollector) Send(block *walletrpc.CompactBlock) error {
+	c.blocks = append(c.blocks, block)
+	return nil
+}
+
+func TestReplayGetBlock(t *testing.T) {
+	lwd, _ := replaySetup(t, "blocks.jsonl")
+	for height := uint64(380640); height <= 380643; height++ {
+		block, err := lwd.GetBlock(context.Background(), &walletrpc.BlockID{Height: height})
+		if err != nil {
+			t.Fatal("GetBlock failed:", err)
+		}
+		if block.Height != height || len(block.Hash) != 32 {
+			t.Fatal("unexpected block", block.Height, block.Hash)
+		}
+	}
+	_, err := lwd.GetBlock(context.Background(), &walletrpc.BlockID{Height: 380644})
+	if err == nil || err.Error() != "block requested is newer than latest block" {
+		t.Fatal("unexpected error getting a block past the tip", err)
+	}
+}
+
+func TestReplayGetBlockRange(t *testing.T) {
+	lwd, _ := replaySetup(t, "blocks.jsonl")
+	out := &blockCollector{}
+	err := lwd.GetBlockRange(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380640},
+		End:   &walletrpc.BlockID{Height: 380643},
+	}, out)
+	if err != nil {
+		t.Fatal("GetBlockRange failed:", err)
+	}
+	if len(out.blocks) != 4 {
+		t.Fatal("unexpected number of blocks", len(out.blocks))
+	}
+	for i, block := range out.blocks {
+		if block.Height != uint64(380640+i) {
+			t.Fatal("unexpected block height", block.Height)
+		}
+		if i > 0 && len(block.PrevHash) != 32 {
+			t.Fatal("block", block.Height, "has no prevHash")
+		}
+	}
+
+	// The range runs past the tip; the blocks before it are sent.
+	out = &blockCollector{}
+	err = lwd.GetBlockRange(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380642},
+		End:   &walletrpc.BlockID{Height: 380645},
+	}, out)
+	if err == nil || err.Error() != "block requested is newer than latest block" {
+		t.Fatal("unexpected GetBlockRange error", err)
+	}
+	if len(out.blocks) != 2 {
+		t.Fatal("unexpected number of blocks", len(out.blocks))
+	}
+}
+
+// relinkBlocks returns the recording in testdata with each recorded block's
+// prevHash replaced by the hash lightwalletd computes for its parent. The
+// blocks are from Zcash mainnet, so they link by their (SHA256d) Zcash
+// hashes, which aren't the Verus hashes lightwalletd checks.
+func relinkBlocks(t *testing.T, fixture string) []byte {
+	f, err := os.Open(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	hashes := make(map[[32]byte][]byte) // Zcash hash to relinked Verus hash
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var exchange struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+			Result json.RawMessage   `json:"result,omitempty"`
+			Error  string            `json:"error,omitempty"`
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' || json.Unmarshal(line, &exchange) != nil ||
+			exchange.Method != "getblock" || exchange.Result == nil {
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+		var blockHex string
+		if err := json.Unmarshal(exchange.Result, &blockHex); err != nil {
+			t.Fatal(err)
+		}
+		block, err := hex.DecodeString(blockHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := parser.NewBlockHeader()
+		rest, err := hdr.ParseFromSlice(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(block[:len(block)-len(rest)])
+		zcashHash := sha256.Sum256(digest[:])
+		var prevHash [32]byte
+		copy(prevHash[:], block[4:36])
+		if hash, ok := hashes[prevHash]; ok {
+			copy(block[4:36], hash)
+		}
+		hdr = parser.NewBlockHeader()
+		if _, err := hdr.ParseFromSlice(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes[zcashHash] = hdr.GetEncodableHash()
+		exchange.Result, _ = json.Marshal(hex.EncodeToString(block))
+		line, _ = json.Marshal(exchange)
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestReplayReorg(t *testing.T) {
+	_, cache := testsetup()
+	var err error
+	rawRequest, err = common.NewReplayRawRequest(bytes.NewReader(relinkBlocks(t, "reorg.jsonl")))
+	if err != nil {
+		t.Fatal("NewReplayRawRequest failed:", err)
+	}
+	common.Sleep = func(d time.Duration) {}
+	defer func() { common.Sleep = nil }()
+
+	// The ingestor adds 380640-380642, finds that 380643 doesn't follow
+	// the cached 380642, backs up, and replaces 380642 with the new block;
+	// then it adds 380643, and waits for 380644.
+	backend := common.NewRPCBackend(rawRequest)
+	common.BlockIngestor(context.Background(), backend, cache, 7)
+	if cache.GetNextHeight() != 380644 {
+		t.Fatal("unexpected cache height", cache.GetNextHeight())
+	}
+	replaced := cache.Get(context.Background(), 380642)
+	next := cache.Get(context.Background(), 380643)
+	if replaced == nil || next == nil || !bytes.Equal(next.PrevHash, replaced.Hash) {
+		t.Fatal("the orphaned block wasn't replaced")
+	}
+	header := parser.NewBlockHeader()
+	if _, err := header.ParseFromSlice(cache.GetHeader(380642)); err != nil {
+		t.Fatal("header doesn't parse:", err)
+	}
+	if !bytes.Equal(header.GetEncodableHash(), replaced.Hash) {
+		t.Fatal("the orphaned block's header is still stored")
+	}
+}
+
+func TestReplayGetLightdInfo(t *testing.T) {
+	lwd, _ := replaySetup(t, "lightdinfo.jsonl")
+	info, err := lwd.GetLightdInfo(context.Background(), &walletrpc.Empty{})
+	if err != nil {
+		t.Fatal("GetLightdInfo failed:", err)
+	}
+	if info.ChainName != "VRSC" || info.BlockHeight != 1510123 || info.SaplingActivationHeight != 1 ||
+		info.ConsensusBranchId != "76b809bb" || info.ZcashdBuild != "v0.9.4-1" ||
+		info.ZcashdSubversion != "/MagicBean:v0.9.4-1/" || !info.TaddrSupport {
+		t.Fatal("unexpected LightdInfo", info)
+	}
+}
+
+func TestReplayGetTreeState(t *testing.T) {
+	lwd, _ := replaySetup(t, "treestate.jsonl")
+	// The tree didn't change in 380642; zcashd refers to the block where it
+	// last did.
+	treeState, err := lwd.GetTreeState(context.Background(), &walletrpc.BlockID{Height: 380642})
+	if err != nil {
+		t.Fatal("GetTreeState failed:", err)
+	}
+	if treeState.Height != 380640 || treeState.Tree != "000000" || treeState.Network != "main" ||
+		treeState.Hash != "000000000422b926dd2f656d31d62a6fae8f0d16b587d10d8ea27262ffa7be15" {
+		t.Fatal("unexpected tree state", treeState)
+	}
+	treeState, err = lwd.GetTreeState(context.Background(), &walletrpc.BlockID{Height: 380643})
+	if err != nil {
+		t.Fatal("GetTreeState failed:", err)
+	}
+	if treeState.Height != 380643 || treeState.Time != 1534970836 ||
+		treeState.Hash != "0000000006a93e42eda987907498568acd44fa4878c5b7dfe6ed900c57ea0b07" {
+		t.Fatal("unexpected tree state", treeState)
+	}
+	_, err = lwd.GetTreeState(context.Background(), &walletrpc.BlockID{Height: 9999999})
+	if err == nil || err.Error() != "-8: Invalid block height parameter" {
+		t.Fatal("unexpected GetTreeState error", err)
+	}
+}
+
+func TestReplayGetTransaction(t *testing.T) {
+	lwd, _ := replaySetup(t, "transactions.jsonl")
+	tx, err := lwd.GetTransaction(context.Background(), &walletrpc.TxFilter{Hash: txidBytes(replayTxid1)})
+	if err != nil {
+		t.Fatal("GetTransaction failed:", err)
+	}
+	if !bytes.Equal(tx.Data, rawTxData[1]) || tx.Height != 380642 {
+		t.Fatal("unexpected transaction", tx.Height)
+	}
+	_, err = lwd.GetTransaction(context.Background(), &walletrpc.TxFilter{Hash: txidBytes(replayTxid2)})
+	if err == nil || err.Error() != "-5: No such mempool or blockchain transaction. Use gettransaction for wallet transactions." {
+		t.Fatal("unexpected GetTransaction error", err)
+	}
+}
+
+type txCollector struct {
+	walletrpc.CompactTxStreamer_GetTaddressTxidsServer
+	txs []*walletrpc.RawTransaction
+}
+
+func (c *txCollector) Context() context.Context {
+	return context.Background()
+}
+
+func (c *txCollector) Send(tx *walletrpc.RawTransaction) error {
+	c.txs = append(c.txs, tx)
+	return nil
+}
+
+func TestReplayGetTaddressTxids(t *testing.T) {
+	lwd, _ := replaySetup(t, "transactions.jsonl")
+	out := &txCollector{}
+	err := lwd.GetTaddressTxids(&walletrpc.TransparentAddressBlockFilter{
+		Address: replayAddress,
+		Range: &walletrpc.BlockRange{
+			Start: &walletrpc.BlockID{Height: 380640},
+			End:   &walletrpc.BlockID{Height: 380643},
+		},
+	}, out)
+	if err != nil {
+		t.Fatal("GetTaddressTxids failed:", err)
+	}
+	if len(out.txs) != 2 || !bytes.Equal(out.txs[0].Data, rawTxData[0]) || out.txs[1].Height != 380642 {
+		t.Fatal("unexpected transactions", out.txs)
+	}
+	err = lwd.GetTaddressTxids(&walletrpc.TransparentAddressBlockFilter{
+		Address: replayAddress,
+		Range: &walletrpc.BlockRange{
+			Start: &walletrpc.BlockID{Height: 380643},
+			End:   &walletrpc.BlockID{Height: 380640},
+		},
+	}, &txCollector{})
+	if err == nil || err.Error() != "-8: Start height cannot be after end height" {
+		t.Fatal("unexpected GetTaddressTxids error", err)
+	}
+}
+
+type mempoolCollector struct {
+	walletrpc.CompactTxStreamer_GetMempoolTxServer
+	txs []*walletrpc.CompactTx
+}
+
+func (c *mempoolCollector) Context() context.Context {
+	return context.Background()
+}
+
+func (c *mempoolCollector) Send(tx *walletrpc.CompactTx) error {
+	c.txs = append(c.txs, tx)
+	return nil
+}
+
+func TestReplayGetMempoolTx(t *testing.T) {
+	lwd, _ := replaySetup(t, "transactions.jsonl")
+	// Start with no copy of the mempool.
+	mempoolMap = nil
+	lastMempool = time.Time{}
+
+	// The third transaction left the mempool before it could be fetched.
+	out := &mempoolCollector{}
+	if err := lwd.GetMempoolTx(&walletrpc.Exclude{}, out); err != nil {
+		t.Fatal("GetMempoolTx failed:", err)
+	}
+	if len(out.txs) != 2 || !bytes.Equal(out.txs[0].Hash, txidBytes(replayTxid0)) ||
+		!bytes.Equal(out.txs[1].Hash, txidBytes(replayTxid1)) {
+		t.Fatal("unexpected mempool transactions", out.txs)
+	}
+	// Exclude the first by a prefix of its (little-endian) txid.
+	out = &mempoolCollector{}
+	exclude := &walletrpc.Exclude{Txid: [][]byte{txidBytes(replayTxid0)[28:]}}
+	if err := lwd.GetMempoolTx(exclude, out); err != nil {
+		t.Fatal("GetMempoolTx failed:", err)
+	}
+	if len(out.txs) != 1 || !bytes.Equal(out.txs[0].Hash, txidBytes(replayTxid1)) {
+		t.Fatal("unexpected mempool transactions with exclude", out.txs)
+	}
+
+	// A failed refresh keeps the previous copy of the mempool.
+	rawRequest = func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("-28: Loading block index...")
+	}
+	lastMempool = time.Time{}
+	if err := lwd.GetMempoolTx(&walletrpc.Exclude{}, &mempoolCollector{}); err == nil {
+		t.Fatal("GetMempoolTx should have failed")
+	}
+	out = &mempoolCollector{}
+	if err := lwd.GetMempoolTx(&walletrpc.Exclude{}, out); err != nil {
+		t.Fatal("GetMempoolTx failed:", err)
+	}
+	if len(out.txs) != 2 {
+		t.Fatal("unexpected mempool transactions after a failed refresh", out.txs)
+	}
+}
+
+func TestReplayGetTaddressBalance(t *testing.T) {
+	lwd, _ := replaySetup(t, "addresses.jsonl")
+	balance, err := lwd.GetTaddressBalance(context.Background(),
+		&walletrpc.AddressList{Addresses: []string{replayAddress}})
+	if err != nil {
+		t.Fatal("GetTaddressBalance failed:", err)
+	}
+	if balance.ValueZat != 1250000000 {
+		t.Fatal("unexpected balance", balance.ValueZat)
+	}
+	// A request that wasn't recorded fails (this address is valid).
+	_, err = lwd.GetTaddressBalance(context.Background(),
+		&walletrpc.AddressList{Addresses: []string{"t1234567890123456789012345678901234"}})
+	if err == nil {
+		t.Fatal("GetTaddressBalance of an unrecorded address succeeded")
+	}
+}
+
+func TestReplayGetAddressUtxos(t *testing.T) {
+	lwd, _ := replaySetup(t, "addresses.jsonl")
+	utxos, err := lwd.GetAddressUtxos(context.Background(),
+		&walletrpc.GetAddressUtxosArg{Address: replayAddress})
+	if err != nil {
+		t.Fatal("GetAddressUtxos failed:", err)
+	}
+	if len(utxos.AddressUtxos) != 2 {
+		t.Fatal("unexpected number of utxos", len(utxos.AddressUtxos))
+	}
+	utxo := utxos.AddressUtxos[1]
+	if !bytes.Equal(utxo.Txid, txidBytes(replayTxid1)) || utxo.Index != 1 ||
+		utxo.ValueZat != 250000000 || utxo.Height != 380642 || len(utxo.Script) != 25 {
+		t.Fatal("unexpected utxo", utxo)
+	}
+	// Only the utxos at or above the start height, up to the limit.
+	utxos, err = lwd.GetAddressUtxos(context.Background(),
+		&walletrpc.GetAddressUtxosArg{Address: replayAddress, StartHeight: 380642})
+	if err != nil || len(utxos.AddressUtxos) != 1 {
+		t.Fatal("unexpected utxos with a start height", utxos, err)
+	}
+	utxos, err = lwd.GetAddressUtxos(context.Background(),
+		&walletrpc.GetAddressUtxosArg{Address: replayAddress, MaxEntries: 1})
+	if err != nil || len(utxos.AddressUtxos) != 1 || utxos.AddressUtxos[0].Height != 380641 {
+		t.Fatal("unexpected utxos with a limit", utxos, err)
+	}
+}
+
+func TestReplaySendTransaction(t *testing.T) {
+	lwd, _ := replaySetup(t, "sendtransaction.jsonl")
+	resp, err := lwd.SendTransaction(context.Background(), &walletrpc.RawTransaction{Data: rawTxData[0]})
+	if err != nil {
+		t.Fatal("SendTransaction failed:", err)
+	}
+	if resp.ErrorCode != 0 || resp.ErrorMessage != `"`+replayTxid0+`"` {
+		t.Fatal("unexpected SendTransaction response", resp)
+	}
+	// zcashd's error is returned in the response.
+	resp, err = lwd.SendTransaction(context.Background(), &walletrpc.RawTransaction{Data: rawTxData[1]})
+	if err != nil {
+		t.Fatal("SendTransaction failed:", err)
+	}
+	if resp.ErrorCode != -26 || resp.ErrorMessage != "16: bad-txns-inputs-spent" {
+		t.Fatal("unexpected SendTransaction error response", resp)
+	}
+}
+
+func TestReplayGetBlockHeaders(t *testing.T) {
+	lwd, _ := replaySetup(t, "blocks.jsonl")
+	testBlocks, err := os.Open("../testdata/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testBlocks.Close()
+	scan := bufio.NewScanner(testBlocks)
+	scan.Buffer(make([]byte, 64*1024), 8*1024*1024)
+	var rawBlocks [][]byte
+	for scan.Scan() {
+		blockData, err := hex.DecodeString(scan.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawBlocks = append(rawBlocks, blockData)
+	}
+
+	out := &headerCollector{}
+	err = lwd.GetBlockHeaders(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380640},
+		End:   &walletrpc.BlockID{Height: 380643},
+	}, out)
+	if err != nil {
+		t.Fatal("GetBlockHeaders failed:", err)
+	}
+	if len(out.blocks) != 4 {
+		t.Fatal("unexpected number of blocks", len(out.blocks))
+	}
+	for i, block := range out.blocks {
+		compact, err := lwd.GetBlock(context.Background(), &walletrpc.BlockID{Height: block.Height})
+		if err != nil {
+			t.Fatal("GetBlock failed:", err)
+		}
+		if block.Height != uint64(380640+i) || !bytes.Equal(block.Hash, compact.Hash) ||
+			!bytes.Equal(block.PrevHash, compact.PrevHash) || block.Time != compact.Time {
+			t.Fatal("unexpected block", block.Height)
+		}
+		if len(block.Vtx) != 0 {
+			t.Fatal("block", block.Height, "has transactions")
+		}
+		// The header is the start of the full block.
+		if len(block.Header) == 0 || !bytes.HasPrefix(rawBlocks[i], block.Header) {
+			t.Fatal("block", block.Height, "has the wrong header")
+		}
+	}
+
+	err = lwd.GetBlockHeaders(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380643},
+		End:   &walletrpc.BlockID{Height: 380644},
+	}, &headerCollector{})
+	if err == nil || err.Error() != "block requested is newer than latest block" {
+		t.Fatal("unexpected GetBlockHeaders error", err)
+	}
+}
+
+func TestReplayGetBlockHeadersCached(t *testing.T) {
+	lwd, cache := replaySetup(t, "blocks.jsonl")
+	backend := common.NewRPCBackend(rawRequest)
+	for height := 380640; height <= 380643; height++ {
+		block, err := backend.GetBlock(context.Background(), height)
+		if err != nil {
+			t.Fatal("GetBlock failed:", err)
+		}
+		if err := cache.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	// The blocks and headers are all in the cache, so zcashd isn't asked.
+	rawRequest = func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		t.Error("unexpected zcashd call", method)
+		return nil, errors.New("unexpected zcashd call")
+	}
+
+	out := &headerCollector{}
+	err := lwd.GetBlockHeaders(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380643},
+		End:   &walletrpc.BlockID{Height: 380640},
+	}, out)
+	if err != nil {
+		t.Fatal("GetBlockHeaders failed:", err)
+	}
+	if len(out.blocks) != 4 {
+		t.Fatal("unexpected number of blocks", len(out.blocks))
+	}
+	for i, block := range out.blocks {
+		if block.Height != uint64(380643-i) || !bytes.Equal(block.Header, cache.GetHeader(int(block.Height))) {
+			t.Fatal("unexpected block", block.Height)
+		}
+	}
+
+	headers := &headerRangeCollector{}
+	err = lwd.GetHeaderRange(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380643},
+		End:   &walletrpc.BlockID{Height: 380640},
+	}, headers)
+	if err != nil {
+		t.Fatal("GetHeaderRange failed:", err)
+	}
+	if len(headers.headers) != 4 {
+		t.Fatal("unexpected number of headers", len(headers.headers))
+	}
+	for i, header := range headers.headers {
+		if header.Height != uint64(380643-i) || !bytes.Equal(header.Header, cache.GetHeader(int(header.Height))) {
+			t.Fatal("unexpected header", header.Height)
+		}
+	}
+}
+
+type headerCollector struct {
+	walletrpc.CompactTxStreamer_GetBlockHeadersServer
+	blocks []*walletrpc.CompactBlock
+}
+
+func (c *headerCollector) Context() context.Context {
+	return context.Background()
+}
+
+func (c *headerCollector) Send(block *walletrpc.CompactBlock) error {
+	c.blocks = append(c.blocks, block)
+	return nil
+}
+
+func TestReplayGetHeaderRange(t *testing.T) {
+	lwd, cache := replaySetup(t, "blocks.jsonl")
+	// The ingestor stores the headers of the first two blocks; the others
+	// come from zcashd.
+	backend := common.NewRPCBackend(rawRequest)
+	for height := 380640; height < 380642; height++ {
+		block, err := backend.GetBlock(context.Background(), height)
+		if err != nil {
+			t.Fatal("GetBlock failed:", err)
+		}
+		if err := cache.Add(height, block); err != nil {
+			t.Fatal("cache.Add failed:", err)
+		}
+	}
+	if cache.GetHeader(380641) == nil {
+		t.Fatal("header wasn't stored")
+	}
+	compact, err := lwd.GetBlock(context.Background(), &walletrpc.BlockID{Height: 380641})
+	if err != nil || compact.Header != nil {
+		t.Fatal("unexpected cached block", compact, err)
+	}
+	compact, err = lwd.GetBlock(context.Background(), &walletrpc.BlockID{Height: 380642})
+	if err != nil || compact.Header != nil {
+		t.Fatal("unexpected block from zcashd", compact, err)
+	}
+
+	out := &headerRangeCollector{}
+	err = lwd.GetHeaderRange(&walletrpc.BlockRange{
+		Start: &walletrpc.BlockID{Height: 380640},
+		End:   &walletrpc.BlockID{Height: 380643},
+	}, out)
+	if err != nil {
+		t.Fatal("GetHeaderRange failed:", err)
+	}
+	if len(out.headers) != 4 {
+		t.Fatal("unexpected number of headers", len(out.headers))
+	}
+	for i, header := range out.headers {
+		hdr := parser.NewBlockHeader()
+		if _, err := hdr.ParseFromSlice(header.Header); err != nil {
+			t.Fatal("header", header.Height, "doesn't parse:", err)
+		}
+		if header.Height != uint64(380640+i) || !bytes.Equal(hdr.GetEncodableHash(), header.Hash) {
+			t.Fatal("unexpected header", header.Height)
+		}
+	}
+}
+
+type headerRangeCollector struct {
+	walletrpc.CompactTxStreamer_GetHeaderRangeServer
+	headers []*walletrpc.BlockHeader
+}
+
+func (c *headerRangeCollector) Context() context.Context {
+	return context.Background()
+}
+
+func (c *headerRangeCollector) Send(header *walletrpc.BlockHeader) error {
+	c.headers = append(c.headers, header)
+	return nil
+}
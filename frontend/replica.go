@@ -0,0 +1,250 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package frontend
+
+import (
+	"context"
+	"io"
+
+	"github.com/asherda/lightwalletd/common"
+	"github.com/asherda/lightwalletd/common/tracing"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// replicaStreamer serves the blocks in its cache itself, and forwards the
+// requests that need zcashd (and requests for blocks it doesn't have) to an
+// upstream lightwalletd.
+type replicaStreamer struct {
+	walletrpc.CompactTxStreamerServer // the local streamer
+	cache                             *common.BlockCache
+	upstream                          walletrpc.CompactTxStreamerClient
+}
+
+// NewReplicaStreamer constructs a gRPC context for a replica.
+func NewReplicaStreamer(cache *common.BlockCache, chainName string, enablePing bool, upstream walletrpc.CompactTxStreamerClient) (walletrpc.CompactTxStreamerServer, error) {
+	// There's no zcashd; everything that would need it is forwarded.
+	local, err := NewLwdStreamer(cache, common.NewRPCBackend(common.ReplicaRawRequest), chainName, enablePing)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaStreamer{CompactTxStreamerServer: local, cache: cache, upstream: upstream}, nil
+}
+
+// DialUpstream connects to the upstream lightwalletd of a replica, using TLS
+// (verified against the system's roots) unless insecure is set.
+func DialUpstream(addr string, insecure bool) (*grpc.ClientConn, error) {
+	creds := grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))
+	if insecure {
+		creds = grpc.WithInsecure()
+	}
+	return grpc.Dial(addr, creds,
+		grpc.WithUnaryInterceptor(tracing.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(tracing.StreamClientInterceptor()))
+}
+
+// inCache returns whether the cache has the block at the given height.
+func (s *replicaStreamer) inCache(height int) bool {
+	return height >= s.cache.GetFirstHeight() && height <= s.cache.GetLatestHeight()
+}
+
+// GetBlock returns the compact block at the requested height, from the
+// cache if it's there, else from the upstream.
+func (s *replicaStreamer) GetBlock(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.CompactBlock, error) {
+	if id.Hash == nil && id.Height != 0 && s.inCache(int(id.Height)) {
+		return s.CompactTxStreamerServer.GetBlock(ctx, id)
+	}
+	return s.upstream.GetBlock(ctx, id)
+}
+
+// GetBlockRange streams the blocks in the range from the cache if it has
+// all of them, else from the upstream.
+func (s *replicaStreamer) GetBlockRange(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetBlockRangeServer) error {
+	if span.Start != nil && span.End != nil &&
+		s.inCache(int(span.Start.Height)) && s.inCache(int(span.End.Height)) {
+		return s.CompactTxStreamerServer.GetBlockRange(span, resp)
+	}
+	if err := checkBlockRange(span); err != nil {
+		return err
+	}
+	stream, err := s.upstream.GetBlockRange(resp.Context(), span)
+	if err != nil {
+		return err
+	}
+	for {
+		block, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Send(block); err != nil {
+			return err
+		}
+	}
+}
+
+// GetBlockHeaders is forwarded to the upstream, since the headers aren't in
+// the cache.
+func (s *replicaStreamer) GetBlockHeaders(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetBlockHeadersServer) error {
+	if err := checkBlockRange(span); err != nil {
+		return err
+	}
+	stream, err := s.upstream.GetBlockHeaders(resp.Context(), span)
+	if err != nil {
+		return err
+	}
+	for {
+		block, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Send(block); err != nil {
+			return err
+		}
+	}
+}
+
+// GetHeaderRange is forwarded to the upstream, like GetBlockHeaders.
+func (s *replicaStreamer) GetHeaderRange(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetHeaderRangeServer) error {
+	if err := checkBlockRange(span); err != nil {
+		return err
+	}
+	stream, err := s.upstream.GetHeaderRange(resp.Context(), span)
+	if err != nil {
+		return err
+	}
+	for {
+		header, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Send(header); err != nil {
+			return err
+		}
+	}
+}
+
+// GetTaddressTxids is forwarded to the upstream.
+func (s *replicaStreamer) GetTaddressTxids(filter *walletrpc.TransparentAddressBlockFilter, resp walletrpc.CompactTxStreamer_GetTaddressTxidsServer) error {
+	stream, err := s.upstream.GetTaddressTxids(resp.Context(), filter)
+	if err != nil {
+		return err
+	}
+	for {
+		tx, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Send(tx); err != nil {
+			return err
+		}
+	}
+}
+
+// GetTreeState is forwarded to the upstream.
+func (s *replicaStreamer) GetTreeState(ctx context.Context, id *walletrpc.BlockID) (*walletrpc.TreeState, error) {
+	return s.upstream.GetTreeState(ctx, id)
+}
+
+// GetTransaction is forwarded to the upstream.
+func (s *replicaStreamer) GetTransaction(ctx context.Context, txf *walletrpc.TxFilter) (*walletrpc.RawTransaction, error) {
+	return s.upstream.GetTransaction(ctx, txf)
+}
+
+// GetLightdInfo is forwarded to the upstream, which has the zcashd.
+func (s *replicaStreamer) GetLightdInfo(ctx context.Context, in *walletrpc.Empty) (*walletrpc.LightdInfo, error) {
+	return s.upstream.GetLightdInfo(ctx, in)
+}
+
+// SendTransaction is forwarded to the upstream.
+func (s *replicaStreamer) SendTransaction(ctx context.Context, rawtx *walletrpc.RawTransaction) (*walletrpc.SendResponse, error) {
+	return s.upstream.SendTransaction(ctx, rawtx)
+}
+
+// GetTaddressBalance is forwarded to the upstream.
+func (s *replicaStreamer) GetTaddressBalance(ctx context.Context, addresses *walletrpc.AddressList) (*walletrpc.Balance, error) {
+	return s.upstream.GetTaddressBalance(ctx, addresses)
+}
+
+// GetTaddressBalanceStream is forwarded to the upstream.
+func (s *replicaStreamer) GetTaddressBalanceStream(addresses walletrpc.CompactTxStreamer_GetTaddressBalanceStreamServer) error {
+	stream, err := s.upstream.GetTaddressBalanceStream(addresses.Context())
+	if err != nil {
+		return err
+	}
+	for {
+		addr, err := addresses.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(addr); err != nil {
+			return err
+		}
+	}
+	balance, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	return addresses.SendAndClose(balance)
+}
+
+// GetMempoolTx is forwarded to the upstream.
+func (s *replicaStreamer) GetMempoolTx(exclude *walletrpc.Exclude, resp walletrpc.CompactTxStreamer_GetMempoolTxServer) error {
+	stream, err := s.upstream.GetMempoolTx(resp.Context(), exclude)
+	if err != nil {
+		return err
+	}
+	for {
+		tx, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Send(tx); err != nil {
+			return err
+		}
+	}
+}
+
+// GetAddressUtxos is forwarded to the upstream.
+func (s *replicaStreamer) GetAddressUtxos(ctx context.Context, arg *walletrpc.GetAddressUtxosArg) (*walletrpc.GetAddressUtxosReplyList, error) {
+	return s.upstream.GetAddressUtxos(ctx, arg)
+}
+
+// GetAddressUtxosStream is forwarded to the upstream.
+func (s *replicaStreamer) GetAddressUtxosStream(arg *walletrpc.GetAddressUtxosArg, resp walletrpc.CompactTxStreamer_GetAddressUtxosStreamServer) error {
+	stream, err := s.upstream.GetAddressUtxosStream(resp.Context(), arg)
+	if err != nil {
+		return err
+	}
+	for {
+		utxo, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := resp.Send(utxo); err != nil {
+			return err
+		}
+	}
+}
@@ -35,6 +35,38 @@ func NewZRPCFromFlags(opts *common.Options) (*rpcclient.Client, error) {
 	return rpcclient.New(connCfg, nil)
 }
 
+// NewZRPCEndpoints connects to each of the zcashd endpoints (host:port) in
+// opts.RPCEndpoints, with the rpcuser and rpcpassword from the flags if
+// they're given, else from the configuration file.
+func NewZRPCEndpoints(opts *common.Options) ([]*rpcclient.Client, error) {
+	user, pass := opts.RPCUser, opts.RPCPassword
+	if user == "" || pass == "" {
+		connCfg, err := connFromConf(opts.VerusConfPath)
+		if err != nil {
+			return nil, err
+		}
+		user, pass = connCfg.User, connCfg.Pass
+	}
+	clients := make([]*rpcclient.Client, 0, len(opts.RPCEndpoints))
+	for _, endpoint := range opts.RPCEndpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, errors.Wrapf(err, "bad RPC endpoint %q", endpoint)
+		}
+		client, err := rpcclient.New(&rpcclient.ConnConfig{
+			Host:         endpoint,
+			User:         user,
+			Pass:         pass,
+			HTTPPostMode: true, // Zcash only supports HTTP POST mode
+			DisableTLS:   true, // Zcash does not provide TLS by default
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
 // If passed a string, interpret as a path, open and read; if passed
 // a byte slice, interpret as the config file content (used in testing).
 func connFromConf(confPath interface{}) (*rpcclient.ConnConfig, error) {
@@ -8,7 +8,6 @@ package frontend
 import (
 	"context"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"io"
 	"regexp"
@@ -21,18 +20,22 @@ import (
 	"github.com/asherda/lightwalletd/common"
 	"github.com/asherda/lightwalletd/parser"
 	"github.com/asherda/lightwalletd/walletrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type lwdStreamer struct {
 	cache      *common.BlockCache
+	backend    common.NodeBackend
 	chainName  string
 	pingEnable bool
 	walletrpc.UnimplementedCompactTxStreamerServer
 }
 
-// NewLwdStreamer constructs a gRPC context.
-func NewLwdStreamer(cache *common.BlockCache, chainName string, enablePing bool) (walletrpc.CompactTxStreamerServer, error) {
-	return &lwdStreamer{cache: cache, chainName: chainName, pingEnable: enablePing}, nil
+// NewLwdStreamer constructs a gRPC context that serves blocks from the cache
+// and everything else from the backend.
+func NewLwdStreamer(cache *common.BlockCache, backend common.NodeBackend, chainName string, enablePing bool) (walletrpc.CompactTxStreamerServer, error) {
+	return &lwdStreamer{cache: cache, backend: backend, chainName: chainName, pingEnable: enablePing}, nil
 }
 
 // DarksideStreamer holds the gRPC state for darksidewalletd.
@@ -57,14 +60,13 @@ func checkTaddress(taddr string) error {
 
 // GetLatestBlock returns the height of the best chain, according to zcashd.
 func (s *lwdStreamer) GetLatestBlock(ctx context.Context, placeholder *walletrpc.ChainSpec) (*walletrpc.BlockID, error) {
-	latestBlock := s.cache.GetLatestHeight()
+	latestBlock, latestHash := s.cache.GetLatestBlockID()
 
 	if latestBlock == -1 {
 		return nil, errors.New("Cache is empty. Server is probably not yet ready")
 	}
 
-	// TODO: also return block hashes here
-	return &walletrpc.BlockID{Height: uint64(latestBlock)}, nil
+	return &walletrpc.BlockID{Height: uint64(latestBlock), Hash: latestHash}, nil
 }
 
 // GetTaddressTxids is a streaming RPC that returns transaction IDs that have
@@ -83,26 +85,8 @@ func (s *lwdStreamer) GetTaddressTxids(addressBlockFilter *walletrpc.Transparent
 	if addressBlockFilter.Range.End == nil {
 		return errors.New("Must specify an end block height")
 	}
-	params := make([]json.RawMessage, 1)
-	request := &common.ZcashdRpcRequestGetaddresstxids{
-		Addresses: []string{addressBlockFilter.Address},
-		Start:     addressBlockFilter.Range.Start.Height,
-		End:       addressBlockFilter.Range.End.Height,
-	}
-	param, err := json.Marshal(request)
-	if err != nil {
-		return err
-	}
-	params[0] = param
-	result, rpcErr := common.RawRequest("getaddresstxids", params)
-
-	// For some reason, the error responses are not JSON
-	if rpcErr != nil {
-		return rpcErr
-	}
-
-	var txids []string
-	err = json.Unmarshal(result, &txids)
+	txids, err := s.backend.GetAddressTxids(resp.Context(), []string{addressBlockFilter.Address},
+		addressBlockFilter.Range.Start.Height, addressBlockFilter.Range.End.Height)
 	if err != nil {
 		return err
 	}
@@ -137,7 +121,7 @@ func (s *lwdStreamer) GetBlock(ctx context.Context, id *walletrpc.BlockID) (*wal
 		// TODO: Get block by hash
 		return nil, errors.New("GetBlock by Hash is not yet implemented")
 	}
-	cBlock, err := common.GetBlock(s.cache, int(id.Height))
+	cBlock, err := common.GetBlock(ctx, s.backend, s.cache, int(id.Height))
 
 	if err != nil {
 		return nil, err
@@ -148,15 +132,22 @@ func (s *lwdStreamer) GetBlock(ctx context.Context, id *walletrpc.BlockID) (*wal
 
 // GetBlockRange is a streaming RPC that returns blocks, in compact form,
 // (as also returned by GetBlock) from the block height 'start' to height
-// 'end' inclusively.
+// 'end' inclusively. If the range's joinSplits is set, the blocks also
+// include Sprout JoinSplits.
 func (s *lwdStreamer) GetBlockRange(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetBlockRangeServer) error {
 	blockChan := make(chan *walletrpc.CompactBlock)
 	errChan := make(chan error)
 	if span.Start == nil || span.End == nil {
 		return errors.New("Must specify start and end heights")
 	}
+	if err := checkBlockRange(span); err != nil {
+		return err
+	}
 
-	go common.GetBlockRange(s.cache, blockChan, errChan, int(span.Start.Height), int(span.End.Height))
+	// Stop reading blocks if sending one fails.
+	ctx, cancel := context.WithCancel(resp.Context())
+	defer cancel()
+	go common.GetBlockRange(ctx, s.backend, s.cache, blockChan, errChan, int(span.Start.Height), int(span.End.Height), span.JoinSplits)
 
 	for {
 		select {
@@ -172,6 +163,73 @@ func (s *lwdStreamer) GetBlockRange(span *walletrpc.BlockRange, resp walletrpc.C
 	}
 }
 
+// checkBlockRange returns an error if the range (in either direction) has
+// more blocks than common.MaxBlockRange allows.
+func checkBlockRange(span *walletrpc.BlockRange) error {
+	if common.MaxBlockRange <= 0 || span.Start == nil || span.End == nil {
+		return nil
+	}
+	start, end := span.Start.Height, span.End.Height
+	if end < start {
+		start, end = end, start
+	}
+	if end-start >= uint64(common.MaxBlockRange) {
+		return status.Errorf(codes.InvalidArgument,
+			"block range of %d blocks exceeds the maximum of %d", end-start+1, common.MaxBlockRange)
+	}
+	return nil
+}
+
+// GetBlockHeaders is a streaming RPC that returns the blocks from height
+// 'start' to 'end' inclusively (like GetBlockRange), each with its full
+// serialized header and without transactions, so that clients can check the
+// proof of work and the Sapling root themselves.
+func (s *lwdStreamer) GetBlockHeaders(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetBlockHeadersServer) error {
+	return s.sendBlockHeaders(resp.Context(), span, resp.Send)
+}
+
+// GetHeaderRange is a streaming RPC that returns the headers of the blocks
+// from height 'start' to height 'end' inclusively, as stored by the block
+// ingestor (see GetBlockHeaders).
+func (s *lwdStreamer) GetHeaderRange(span *walletrpc.BlockRange, resp walletrpc.CompactTxStreamer_GetHeaderRangeServer) error {
+	return s.sendBlockHeaders(resp.Context(), span, func(block *walletrpc.CompactBlock) error {
+		return resp.Send(&walletrpc.BlockHeader{
+			Height: block.Height,
+			Hash:   block.Hash,
+			Header: block.Header,
+		})
+	})
+}
+
+// sendBlockHeaders reads the blocks in the range with their headers, for
+// GetBlockHeaders and GetHeaderRange, and passes each to send.
+func (s *lwdStreamer) sendBlockHeaders(ctx context.Context, span *walletrpc.BlockRange, send func(*walletrpc.CompactBlock) error) error {
+	blockChan := make(chan *walletrpc.CompactBlock)
+	errChan := make(chan error)
+	if span.Start == nil || span.End == nil {
+		return errors.New("Must specify start and end heights")
+	}
+	if err := checkBlockRange(span); err != nil {
+		return err
+	}
+
+	// Stop reading headers if sending one fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go common.GetBlockHeaderRange(ctx, s.backend, s.cache, blockChan, errChan, int(span.Start.Height), int(span.End.Height))
+
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case block := <-blockChan:
+			if err := send(block); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // GetTreeState returns the note commitment tree state corresponding to the given block.
 // See section 3.7 of the Zcash protocol specification. It returns several other useful
 // values also (even though they can be obtained using GetBlock).
@@ -180,55 +238,12 @@ func (s *lwdStreamer) GetTreeState(ctx context.Context, id *walletrpc.BlockID) (
 	if id.Height == 0 && id.Hash == nil {
 		return nil, errors.New("request for unspecified identifier")
 	}
-	// The Zcash z_gettreestate rpc accepts either a block height or block hash
-	params := make([]json.RawMessage, 1)
-	var hashJSON []byte
-	if id.Height > 0 {
-		heightJSON, err := json.Marshal(strconv.Itoa(int(id.Height)))
-		if err != nil {
-			return nil, err
-		}
-		params[0] = heightJSON
-	} else {
-		// id.Hash is big-endian, keep in big-endian for the rpc
-		hashJSON, err := json.Marshal(hex.EncodeToString(id.Hash))
-		if err != nil {
-			return nil, err
-		}
-		params[0] = hashJSON
-	}
-	var gettreestateReply common.ZcashdRpcReplyGettreestate
-	for {
-		result, rpcErr := common.RawRequest("z_gettreestate", params)
-		if rpcErr != nil {
-			return nil, rpcErr
-		}
-		err := json.Unmarshal(result, &gettreestateReply)
-		if err != nil {
-			return nil, err
-		}
-		if gettreestateReply.Sapling.Commitments.FinalState != "" {
-			break
-		}
-		if gettreestateReply.Sapling.SkipHash == "" {
-			break
-		}
-		hashJSON, err = json.Marshal(gettreestateReply.Sapling.SkipHash)
-		if err != nil {
-			return nil, err
-		}
-		params[0] = hashJSON
-	}
-	if gettreestateReply.Sapling.Commitments.FinalState == "" {
-		return nil, errors.New("zcashd did not return treestate")
+	treeState, err := s.backend.GetTreeState(ctx, id)
+	if err != nil {
+		return nil, err
 	}
-	return &walletrpc.TreeState{
-		Network: s.chainName,
-		Height:  uint64(gettreestateReply.Height),
-		Hash:    gettreestateReply.Hash,
-		Time:    gettreestateReply.Time,
-		Tree:    gettreestateReply.Sapling.Commitments.FinalState,
-	}, nil
+	treeState.Network = s.chainName
+	return treeState, nil
 }
 
 // GetTransaction returns the raw transaction bytes that are returned
@@ -238,34 +253,7 @@ func (s *lwdStreamer) GetTransaction(ctx context.Context, txf *walletrpc.TxFilte
 		if len(txf.Hash) != 32 {
 			return nil, errors.New("Transaction ID has invalid length")
 		}
-		leHashStringJSON, err := json.Marshal(hex.EncodeToString(parser.Reverse(txf.Hash)))
-		if err != nil {
-			return nil, err
-		}
-		params := []json.RawMessage{
-			leHashStringJSON,
-			json.RawMessage("1"),
-		}
-		result, rpcErr := common.RawRequest("getrawtransaction", params)
-
-		// For some reason, the error responses are not JSON
-		if rpcErr != nil {
-			return nil, rpcErr
-		}
-		// Many other fields are returned, but we need only these two.
-		var txinfo common.ZcashdRpcReplyGetrawtransaction
-		err = json.Unmarshal(result, &txinfo)
-		if err != nil {
-			return nil, err
-		}
-		txBytes, err := hex.DecodeString(txinfo.Hex)
-		if err != nil {
-			return nil, err
-		}
-		return &walletrpc.RawTransaction{
-			Data:   txBytes,
-			Height: uint64(txinfo.Height),
-		}, nil
+		return s.backend.GetRawTransaction(ctx, parser.Reverse(txf.Hash))
 	}
 
 	if txf.Block != nil && txf.Block.Hash != nil {
@@ -277,7 +265,7 @@ func (s *lwdStreamer) GetTransaction(ctx context.Context, txf *walletrpc.TxFilte
 // GetLightdInfo gets the LightWalletD (this server) info, and includes information
 // it gets from its backend zcashd.
 func (s *lwdStreamer) GetLightdInfo(ctx context.Context, in *walletrpc.Empty) (*walletrpc.LightdInfo, error) {
-	return common.GetLightdInfo()
+	return common.GetLightdInfo(ctx, s.backend)
 }
 
 // SendTransaction forwards raw transaction bytes to a zcashd instance over JSON-RPC
@@ -289,14 +277,7 @@ func (s *lwdStreamer) SendTransaction(ctx context.Context, rawtx *walletrpc.RawT
 	// Result:
 	// "hex"             (string) The transaction hash in hex
 
-	// Construct raw JSON-RPC params
-	params := make([]json.RawMessage, 1)
-	txJSON, err := json.Marshal(hex.EncodeToString(rawtx.Data))
-	if err != nil {
-		return &walletrpc.SendResponse{}, err
-	}
-	params[0] = txJSON
-	result, rpcErr := common.RawRequest("sendrawtransaction", params)
+	result, rpcErr := s.backend.SendRawTransaction(ctx, rawtx.Data)
 
 	var errCode int64
 	var errMsg string
@@ -308,6 +289,7 @@ func (s *lwdStreamer) SendTransaction(ctx context.Context, rawtx *walletrpc.RawT
 			return nil, errors.New("SendTransaction couldn't parse error code")
 		}
 		errMsg = strings.TrimSpace(errParts[1])
+		var err error
 		errCode, err = strconv.ParseInt(errParts[0], 10, 32)
 		if err != nil {
 			// This should never happen. We can't panic here, but it's that class of error.
@@ -315,7 +297,7 @@ func (s *lwdStreamer) SendTransaction(ctx context.Context, rawtx *walletrpc.RawT
 			return nil, errors.New("SendTransaction couldn't parse error code")
 		}
 	} else {
-		errMsg = string(result)
+		errMsg = result
 	}
 
 	// TODO these are called Error but they aren't at the moment.
@@ -326,37 +308,22 @@ func (s *lwdStreamer) SendTransaction(ctx context.Context, rawtx *walletrpc.RawT
 	}, nil
 }
 
-func getTaddressBalanceZcashdRpc(addressList []string) (*walletrpc.Balance, error) {
+func (s *lwdStreamer) getTaddressBalance(ctx context.Context, addressList []string) (*walletrpc.Balance, error) {
 	for _, addr := range addressList {
 		if err := checkTaddress(addr); err != nil {
 			return &walletrpc.Balance{}, err
 		}
 	}
-	params := make([]json.RawMessage, 1)
-	addrList := &common.ZcashdRpcRequestGetaddressbalance{
-		Addresses: addressList,
-	}
-	param, err := json.Marshal(addrList)
-	if err != nil {
-		return &walletrpc.Balance{}, err
-	}
-	params[0] = param
-
-	result, rpcErr := common.RawRequest("getaddressbalance", params)
-	if rpcErr != nil {
-		return &walletrpc.Balance{}, rpcErr
-	}
-	var balanceReply common.ZcashdRpcReplyGetaddressbalance
-	err = json.Unmarshal(result, &balanceReply)
+	balance, err := s.backend.GetAddressBalance(ctx, addressList)
 	if err != nil {
 		return &walletrpc.Balance{}, err
 	}
-	return &walletrpc.Balance{ValueZat: balanceReply.Balance}, nil
+	return &walletrpc.Balance{ValueZat: balance}, nil
 }
 
 // GetTaddressBalance returns the total balance for a list of taddrs
 func (s *lwdStreamer) GetTaddressBalance(ctx context.Context, addresses *walletrpc.AddressList) (*walletrpc.Balance, error) {
-	return getTaddressBalanceZcashdRpc(addresses.Addresses)
+	return s.getTaddressBalance(ctx, addresses.Addresses)
 }
 
 // GetTaddressBalanceStream returns the total balance for a list of taddrs
@@ -372,7 +339,7 @@ func (s *lwdStreamer) GetTaddressBalanceStream(addresses walletrpc.CompactTxStre
 		}
 		addressList = append(addressList, addr.Address)
 	}
-	balance, err := getTaddressBalanceZcashdRpc(addressList)
+	balance, err := s.getTaddressBalance(addresses.Context(), addressList)
 	if err != nil {
 		return err
 	}
@@ -390,13 +357,8 @@ var lastMempool time.Time
 func (s *lwdStreamer) GetMempoolTx(exclude *walletrpc.Exclude, resp walletrpc.CompactTxStreamer_GetMempoolTxServer) error {
 	if time.Now().Sub(lastMempool).Seconds() >= 2 {
 		lastMempool = time.Now()
-		// Refresh our copy of the mempool.
-		params := make([]json.RawMessage, 0)
-		result, rpcErr := common.RawRequest("getrawmempool", params)
-		if rpcErr != nil {
-			return rpcErr
-		}
-		err := json.Unmarshal(result, &mempoolList)
+		// Refresh our copy of the mempool; on failure, keep the old one.
+		newmempoolList, err := s.backend.GetMempool(resp.Context())
 		if err != nil {
 			return err
 		}
@@ -404,38 +366,23 @@ func (s *lwdStreamer) GetMempoolTx(exclude *walletrpc.Exclude, resp walletrpc.Co
 		if mempoolMap == nil {
 			mempoolMap = &newmempoolMap
 		}
-		for _, txidstr := range mempoolList {
+		for _, txidstr := range newmempoolList {
 			if ctx, ok := (*mempoolMap)[txidstr]; ok {
 				// This ctx has already been fetched, copy pointer to it.
 				newmempoolMap[txidstr] = ctx
 				continue
 			}
-			txidJSON, err := json.Marshal(txidstr)
+			txid, err := hex.DecodeString(txidstr)
 			if err != nil {
 				return err
 			}
-			// The "0" is because we only need the raw hex, which is returned as
-			// just a hex string, and not even a json string (with quotes).
-			params := []json.RawMessage{txidJSON, json.RawMessage("0")}
-			result, rpcErr := common.RawRequest("getrawtransaction", params)
+			rawtx, rpcErr := s.backend.GetRawTransaction(resp.Context(), txid)
 			if rpcErr != nil {
 				// Not an error; mempool transactions can disappear
 				continue
 			}
-			// strip the quotes
-			var txStr string
-			err = json.Unmarshal(result, &txStr)
-			if err != nil {
-				return err
-			}
-
-			// conver to binary
-			txBytes, err := hex.DecodeString(txStr)
-			if err != nil {
-				return err
-			}
 			tx := parser.NewTransaction()
-			txdata, err := tx.ParseFromSlice(txBytes)
+			txdata, err := tx.ParseFromSlice(rawtx.Data)
 			if len(txdata) > 0 {
 				return errors.New("extra data deserializing transaction")
 			}
@@ -444,15 +391,19 @@ func (s *lwdStreamer) GetMempoolTx(exclude *walletrpc.Exclude, resp walletrpc.Co
 				newmempoolMap[txidstr] = tx.ToCompact( /* height */ 0)
 			}
 		}
+		mempoolList = newmempoolList
 		mempoolMap = &newmempoolMap
+		common.SetMempoolSize(len(mempoolList))
 	}
 	excludeHex := make([]string, len(exclude.Txid))
 	for i := 0; i < len(exclude.Txid); i++ {
 		excludeHex[i] = hex.EncodeToString(parser.Reverse(exclude.Txid[i]))
 	}
 	for _, txid := range MempoolFilter(mempoolList, excludeHex) {
+		// A transaction that left the mempool before it could be fetched
+		// isn't in the map.
 		tx := (*mempoolMap)[txid]
-		if len(tx.Hash) > 0 {
+		if tx != nil && len(tx.Hash) > 0 {
 			err := resp.Send(tx)
 			if err != nil {
 				return err
@@ -508,22 +459,11 @@ func MempoolFilter(items, exclude []string) []string {
 	return tosend
 }
 
-func getAddressUtxos(arg *walletrpc.GetAddressUtxosArg, f func(*walletrpc.GetAddressUtxosReply) error) error {
+func (s *lwdStreamer) getAddressUtxos(ctx context.Context, arg *walletrpc.GetAddressUtxosArg, f func(*walletrpc.GetAddressUtxosReply) error) error {
 	if err := checkTaddress(arg.Address); err != nil {
 		return err
 	}
-	params := make([]json.RawMessage, 1)
-	param, err := json.Marshal(arg.Address)
-	if err != nil {
-		return err
-	}
-	params[0] = param
-	result, rpcErr := common.RawRequest("getaddressutxos", params)
-	if rpcErr != nil {
-		return rpcErr
-	}
-	var utxosReply common.ZcashdRpcReplyGetaddressutxos
-	err = json.Unmarshal(result, &utxosReply)
+	utxosReply, err := s.backend.GetAddressUtxos(ctx, arg.Address)
 	if err != nil {
 		return err
 	}
@@ -560,7 +500,7 @@ func getAddressUtxos(arg *walletrpc.GetAddressUtxosArg, f func(*walletrpc.GetAdd
 
 func (s *lwdStreamer) GetAddressUtxos(ctx context.Context, arg *walletrpc.GetAddressUtxosArg) (*walletrpc.GetAddressUtxosReplyList, error) {
 	addressUtxos := make([]*walletrpc.GetAddressUtxosReply, 0)
-	err := getAddressUtxos(arg, func(utxo *walletrpc.GetAddressUtxosReply) error {
+	err := s.getAddressUtxos(ctx, arg, func(utxo *walletrpc.GetAddressUtxosReply) error {
 		addressUtxos = append(addressUtxos, utxo)
 		return nil
 	})
@@ -571,7 +511,7 @@ func (s *lwdStreamer) GetAddressUtxos(ctx context.Context, arg *walletrpc.GetAdd
 }
 
 func (s *lwdStreamer) GetAddressUtxosStream(arg *walletrpc.GetAddressUtxosArg, resp walletrpc.CompactTxStreamer_GetAddressUtxosStreamServer) error {
-	err := getAddressUtxos(arg, func(utxo *walletrpc.GetAddressUtxosReply) error {
+	err := s.getAddressUtxos(resp.Context(), arg, func(utxo *walletrpc.GetAddressUtxosReply) error {
 		return resp.Send(utxo)
 	})
 	if err != nil {
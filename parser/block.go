@@ -6,6 +6,8 @@
 package parser
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 
 	"github.com/asherda/lightwalletd/parser/internal/bytestring"
@@ -78,7 +80,17 @@ func (b *Block) GetHeight() int {
 	if b.height != -1 {
 		return b.height
 	}
-	coinbaseScript := bytestring.String(b.vtx[0].transparentInputs[0].ScriptSig)
+	if len(b.vtx) == 0 || len(b.vtx[0].transparentInputs) == 0 {
+		return -1
+	}
+	b.height = heightFromCoinbaseScript(b.vtx[0].transparentInputs[0].ScriptSig)
+	return b.height
+}
+
+// heightFromCoinbaseScript returns the block height at the start of a
+// coinbase script, or -1 if there isn't a valid one.
+func heightFromCoinbaseScript(script []byte) int {
+	coinbaseScript := bytestring.String(script)
 	var heightNum int64
 	if !coinbaseScript.ReadScriptInt64(&heightNum) {
 		return -1
@@ -95,8 +107,6 @@ func (b *Block) GetHeight() int {
 	if blockHeight == genesisTargetDifficulty {
 		blockHeight = 0
 	}
-
-	b.height = int(blockHeight)
 	return int(blockHeight)
 }
 
@@ -105,8 +115,90 @@ func (b *Block) GetPrevHash() []byte {
 	return b.hdr.HashPrevBlock
 }
 
+// MarshalBinary returns the block in serialized form, as ParseFromSlice
+// reads it.
+func (b *Block) MarshalBinary() ([]byte, error) {
+	header, err := b.hdr.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(header)
+	WriteCompactLengthPrefixedLen(buf, len(b.vtx))
+	for _, tx := range b.vtx {
+		txBytes, err := tx.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(txBytes)
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalHeader returns the block's serialized header.
+func (b *Block) MarshalHeader() ([]byte, error) {
+	return b.hdr.MarshalBinary()
+}
+
+// MerkleRoot computes the merkle root of the block's transactions (in
+// little-endian wire order), as it should appear in the header.
+func (b *Block) MerkleRoot() []byte {
+	if len(b.vtx) == 0 {
+		return make([]byte, 32)
+	}
+	level := make([][]byte, len(b.vtx))
+	for i, tx := range b.vtx {
+		level[i] = tx.GetEncodableHash()
+	}
+	for len(level) > 1 {
+		// An odd transaction (or hash) out is paired with itself.
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			digest := sha256.Sum256(append(append([]byte{}, level[2*i]...), level[2*i+1]...))
+			digest = sha256.Sum256(digest[:])
+			next[i] = digest[:]
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// CheckMerkleRoot returns an error if the header's merkle root doesn't
+// match the block's transactions.
+func (b *Block) CheckMerkleRoot() error {
+	if !bytes.Equal(b.MerkleRoot(), b.hdr.HashMerkleRoot) {
+		return errors.New("merkle root doesn't match the transactions")
+	}
+	return nil
+}
+
+// IsProofOfStake returns true for a Verus proof-of-stake block (see
+// BlockHeader.IsProofOfStake).
+func (b *Block) IsProofOfStake() bool {
+	return b.hdr.IsProofOfStake()
+}
+
+// CheckProofOfWork returns an error if the block's hash doesn't meet its
+// target (see BlockHeader.CheckProofOfWork).
+func (b *Block) CheckProofOfWork() error {
+	return b.hdr.CheckProofOfWork()
+}
+
 // ToCompact returns the compact representation of the full block.
 func (b *Block) ToCompact() *walletrpc.CompactBlock {
+	return b.toCompact(false)
+}
+
+// ToCompactWithJoinSplits returns the compact representation of the full
+// block, including the Sprout JoinSplits, and the transactions that only
+// have JoinSplits.
+func (b *Block) ToCompactWithJoinSplits() *walletrpc.CompactBlock {
+	return b.toCompact(true)
+}
+
+func (b *Block) toCompact(joinSplits bool) *walletrpc.CompactBlock {
 	compactBlock := &walletrpc.CompactBlock{
 		//TODO ProtoVersion: 1,
 		Height:   uint64(b.GetHeight()),
@@ -115,14 +207,17 @@ func (b *Block) ToCompact() *walletrpc.CompactBlock {
 		Time:     b.hdr.Time,
 	}
 
-	// Only Sapling transactions have a meaningful compact encoding
-	saplingTxns := make([]*walletrpc.CompactTx, 0, len(b.vtx))
+	// Only shielded transactions have a meaningful compact encoding
+	shieldedTxns := make([]*walletrpc.CompactTx, 0, len(b.vtx))
 	for idx, tx := range b.vtx {
-		if tx.HasSaplingElements() {
-			saplingTxns = append(saplingTxns, tx.ToCompact(idx))
+		switch {
+		case joinSplits && (tx.HasShieldedElements() || tx.HasJoinSplits()):
+			shieldedTxns = append(shieldedTxns, tx.ToCompactWithJoinSplits(idx))
+		case tx.HasShieldedElements():
+			shieldedTxns = append(shieldedTxns, tx.ToCompact(idx))
 		}
 	}
-	compactBlock.Vtx = saplingTxns
+	compactBlock.Vtx = shieldedTxns
 	return compactBlock
 }
 
@@ -141,6 +236,9 @@ func (b *Block) ParseFromSlice(data []byte) (rest []byte, err error) {
 	if !s.ReadCompactSize(&txCount) {
 		return nil, errors.New("could not read tx_count")
 	}
+	if tooMany(txCount, minTxSize, s) {
+		return nil, errors.New("too many transactions for the data")
+	}
 	data = []byte(s)
 
 	vtx := make([]*Transaction, 0, txCount)
@@ -19,6 +19,14 @@ const (
 	equihashSizeMainnet             = 1344 // size of a mainnet / testnet Equihash solution in bytes
 )
 
+// The start of a Verus solution is a descriptor: a little-endian uint32
+// version and a byte of flags. From solution version 5 (PBaaS headers), the
+// solutionPoW flag is set only in proof-of-work blocks.
+const (
+	solutionVersionPBaaSHeader = 5
+	solutionPoW                = 0x1
+)
+
 // RawBlockHeader implements the block header as defined in version
 // 2018.0-beta-29 of the Zcash Protocol Spec.
 type RawBlockHeader struct {
@@ -168,14 +176,14 @@ func (hdr *BlockHeader) ParseFromSlice(in []byte) (rest []byte, err error) {
 		return in, errors.New("could not read CompactSize-prefixed Equihash solution")
 	}
 
-	// TODO: interpret the bytes
-	//hdr.targetThreshold = parseNBits(hdr.NBitsBytes)
-
 	return []byte(s), nil
 }
 
 func parseNBits(b []byte) *big.Int {
 	byteLen := int(b[0])
+	if byteLen == 0 {
+		return new(big.Int)
+	}
 
 	targetBytes := make([]byte, byteLen)
 	copy(targetBytes, b[1:])
@@ -232,6 +240,42 @@ func (hdr *BlockHeader) GetEncodableHash() []byte {
 	return vh
 }
 
+// GetTarget returns the target threshold encoded in the header's nBits.
+func (hdr *BlockHeader) GetTarget() *big.Int {
+	// nBits is a little-endian uint32; parseNBits wants it big-endian.
+	return parseNBits(Reverse(hdr.NBitsBytes))
+}
+
+// IsProofOfStake returns true if the header is of a Verus proof-of-stake
+// block, whose hash needn't meet its nBits target. A staked block's nonce
+// holds the stake's target in its first four bytes (which Verus reads with
+// CPOSNonce::GetPOSTarget), and from solution version 5 its solution
+// descriptor lacks the proof-of-work flag; either marks it as staked.
+func (hdr *BlockHeader) IsProofOfStake() bool {
+	if len(hdr.Nonce) >= 4 && binary.LittleEndian.Uint32(hdr.Nonce) != 0 {
+		return true
+	}
+	return len(hdr.Solution) >= 5 &&
+		binary.LittleEndian.Uint32(hdr.Solution) >= solutionVersionPBaaSHeader &&
+		hdr.Solution[4]&solutionPoW == 0
+}
+
+// CheckProofOfWork returns an error if the header's hash is greater than the
+// target threshold encoded in its nBits (or that target isn't valid). It
+// doesn't verify the solution, and shouldn't be used for proof-of-stake
+// blocks (see IsProofOfStake).
+func (hdr *BlockHeader) CheckProofOfWork() error {
+	target := hdr.GetTarget()
+	if target.Sign() <= 0 || target.BitLen() > 256 {
+		return errors.New("invalid nBits target")
+	}
+	hash := new(big.Int).SetBytes(hdr.GetDisplayHash())
+	if hash.Cmp(target) > 0 {
+		return errors.New("block hash is above the nBits target")
+	}
+	return nil
+}
+
 // GetDisplayPrevHash returns the block hash in big-endian order.
 func (hdr *BlockHeader) GetDisplayPrevHash() []byte {
 	return Reverse(hdr.HashPrevBlock)
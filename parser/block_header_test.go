@@ -6,6 +6,7 @@ package parser
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"math/big"
 	"os"
@@ -45,6 +46,10 @@ var nbitsTests = []struct {
 		[]byte{0x04, 0x12, 0x34, 0x56},
 		"12345600",
 	},
+	{
+		[]byte{0x00, 0x92, 0x34, 0x56},
+		"00",
+	},
 }
 
 func TestParseNBits(t *testing.T) {
@@ -257,3 +262,73 @@ func TestWriteCompactLengthPrefixed(t *testing.T) {
 		t.Fatal("TestWriteCompactLengthPrefixed incorrect result")
 	}
 }
+
+func TestCheckProofOfWork(t *testing.T) {
+	hdr := NewBlockHeader()
+	hdr.Version = 4
+	hdr.HashPrevBlock = make([]byte, 32)
+	hdr.HashMerkleRoot = make([]byte, 32)
+	hdr.HashFinalSaplingRoot = make([]byte, 32)
+	hdr.Nonce = make([]byte, 32)
+	hdr.Solution = make([]byte, equihashSizeMainnet)
+
+	// The regtest target (0x207fffff) is met by about half of all hashes.
+	// The nonce's first four bytes stay zero, as in a proof-of-work block.
+	hdr.NBitsBytes = []byte{0xff, 0xff, 0x7f, 0x20}
+	for nonce := 0; ; nonce++ {
+		hdr.Nonce[31] = byte(nonce)
+		hdr.cachedHash = nil
+		if hdr.CheckProofOfWork() == nil {
+			break
+		}
+		if nonce == 255 {
+			t.Fatal("no nonce meets the regtest target")
+		}
+	}
+	if hdr.IsProofOfStake() {
+		t.Fatal("proof-of-work header taken for proof of stake")
+	}
+
+	// Practically no hash meets a target of 1.
+	hdr.NBitsBytes = []byte{0x01, 0x00, 0x00, 0x03}
+	if hdr.CheckProofOfWork() == nil {
+		t.Fatal("hash meets a target of 1")
+	}
+	// Nor a negative one.
+	hdr.NBitsBytes = []byte{0x00, 0x00, 0x80, 0x04}
+	if err := hdr.CheckProofOfWork(); err == nil || err.Error() != "invalid nBits target" {
+		t.Fatal("unexpected error with a negative target", err)
+	}
+}
+
+func TestIsProofOfStake(t *testing.T) {
+	hdr := NewBlockHeader()
+	hdr.Nonce = make([]byte, 32)
+	hdr.Solution = make([]byte, equihashSizeMainnet)
+	if hdr.IsProofOfStake() {
+		t.Fatal("proof-of-work header taken for proof of stake")
+	}
+
+	// A staked block's nonce starts with the stake's target.
+	binary.LittleEndian.PutUint32(hdr.Nonce, 0x1d0fffff)
+	if !hdr.IsProofOfStake() {
+		t.Fatal("proof-of-stake nonce not detected")
+	}
+	binary.LittleEndian.PutUint32(hdr.Nonce, 0)
+
+	// From solution version 5, the descriptor's flag tells them apart.
+	binary.LittleEndian.PutUint32(hdr.Solution, solutionVersionPBaaSHeader)
+	if !hdr.IsProofOfStake() {
+		t.Fatal("proof-of-stake solution not detected")
+	}
+	hdr.Solution[4] = solutionPoW
+	if hdr.IsProofOfStake() {
+		t.Fatal("proof-of-work solution taken for proof of stake")
+	}
+	// Before version 5, the flag isn't there.
+	binary.LittleEndian.PutUint32(hdr.Solution, solutionVersionPBaaSHeader-1)
+	hdr.Solution[4] = 0
+	if hdr.IsProofOfStake() {
+		t.Fatal("early solution taken for proof of stake")
+	}
+}
@@ -112,7 +112,7 @@ func TestBlockParser(t *testing.T) {
 			}
 			// Keep appending the original transactions, which is unrealistic
 			// because the coinbase is being replicated, but it works; first do
-			// some surgery to the transaction count (see DarksideApplyStaged()).
+			// some surgery to the transaction count.
 			for j := 0; j < len(txhashes[blockindex]); j++ {
 				nTxFirstByte := blockData[1487]
 				switch {
@@ -273,3 +273,64 @@ func TestCompactBlocks(t *testing.T) {
 	}
 
 }
+
+func TestBlockMerkleRoot(t *testing.T) {
+	testBlocks, err := os.Open("../testdata/blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testBlocks.Close()
+
+	scan := bufio.NewScanner(testBlocks)
+	for scan.Scan() {
+		blockData, err := hex.DecodeString(scan.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := NewBlock()
+		if _, err := block.ParseFromSlice(blockData); err != nil {
+			t.Fatal(err)
+		}
+		if err := block.CheckMerkleRoot(); err != nil {
+			t.Error("block", block.GetHeight(), err)
+		}
+		// Changing a transaction changes the merkle root.
+		block.vtx[len(block.vtx)-1].rawBytes = append([]byte{0}, block.vtx[len(block.vtx)-1].rawBytes...)
+		if err := block.CheckMerkleRoot(); err == nil {
+			t.Error("block", block.GetHeight(), "has a changed transaction but the merkle root matches")
+		}
+	}
+}
+
+func TestBlockWithoutTransactions(t *testing.T) {
+	blockData, err := ioutil.ReadFile("../testdata/corpus/block0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockData, err = hex.DecodeString(string(bytes.TrimSpace(blockData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := NewBlockHeader()
+	rest, err := hdr.ParseFromSlice(blockData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header, and a transaction count of zero.
+	empty := append(blockData[:len(blockData)-len(rest):len(blockData)-len(rest)], 0)
+	block := NewBlock()
+	if _, err := block.ParseFromSlice(empty); err != nil {
+		t.Fatal(err)
+	}
+	if block.GetHeight() != -1 {
+		t.Error("block without a coinbase has height", block.GetHeight())
+	}
+	if _, _, err := ParseCompactBlock(empty, false); err == nil {
+		t.Error("block without a coinbase was parsed")
+	}
+	// A count of transactions that can't fit in the data
+	tooMany := append(empty[:len(empty)-1:len(empty)-1], 0xfe, 0, 0, 0, 1)
+	if _, err := NewBlock().ParseFromSlice(tooMany); err == nil {
+		t.Error("block with too many transactions was parsed")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package parser
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Header fields of the transactions NewCoinbaseTransaction makes (v4, Sapling).
+const (
+	saplingTxVersion      = 4
+	saplingVersionGroupID = 0x892F2085
+)
+
+// equihashSolutionSize is the size of an Equihash (200, 9) solution.
+const equihashSolutionSize = 1344
+
+// Script opcodes
+const (
+	scriptOp0 = 0x00
+	scriptOp1 = 0x51
+)
+
+// coinbaseScript returns the script of a coinbase input for the given
+// height, which begins with the height (BIP34) as zcashd's miner writes it.
+func coinbaseScript(height int) []byte {
+	var script []byte
+	switch {
+	case height == 0:
+		script = []byte{scriptOp0}
+	case height <= 16:
+		script = []byte{scriptOp1 + byte(height-1)}
+	default:
+		var num []byte
+		for n := height; n > 0; n >>= 8 {
+			num = append(num, byte(n))
+		}
+		// Script numbers are signed, so keep the sign bit clear.
+		if num[len(num)-1]&0x80 != 0 {
+			num = append(num, 0)
+		}
+		script = append([]byte{byte(len(num))}, num...)
+	}
+	return append(script, scriptOp0)
+}
+
+// NewCoinbaseTransaction returns a v4 coinbase transaction for a block at the
+// given height, paying the given value to one transparent output with the
+// given script.
+func NewCoinbaseTransaction(height int, value uint64, script []byte) *Transaction {
+	tx := NewTransaction()
+	tx.fOverwintered = true
+	tx.version = saplingTxVersion
+	tx.nVersionGroupID = saplingVersionGroupID
+	tx.transparentInputs = []*txIn{{
+		PrevTxHash:     make([]byte, 32),
+		PrevTxOutIndex: 0xffffffff,
+		ScriptSig:      coinbaseScript(height),
+		SequenceNumber: 0xffffffff,
+	}}
+	tx.transparentOutputs = []*txOut{{
+		Value:  value,
+		Script: script,
+	}}
+	tx.rawBytes, _ = tx.MarshalBinary()
+	return tx
+}
+
+// BlockBuilder assembles blocks with chosen transactions, to make synthetic
+// chains for testing (genblocks, darksidewalletd). The blocks it builds have
+// the right merkle root, but no valid proof of work.
+type BlockBuilder struct {
+	// Header is the header the block is built with. Build fills in
+	// HashMerkleRoot; the other fields are up to the caller.
+	Header *RawBlockHeader
+	vtx    []*Transaction
+}
+
+// NewBlockBuilder returns a builder for a block at the given height whose
+// only transaction, to begin with, is a coinbase. prevHash is the previous
+// block's hash, in little-endian order, or nil for zeros.
+func NewBlockBuilder(height int, prevHash []byte) *BlockBuilder {
+	hashPrevBlock := make([]byte, 32)
+	copy(hashPrevBlock, prevHash)
+	return &BlockBuilder{
+		Header: &RawBlockHeader{
+			Version:              4,
+			HashPrevBlock:        hashPrevBlock,
+			HashMerkleRoot:       make([]byte, 32),
+			HashFinalSaplingRoot: make([]byte, 32),
+			Time:                 1,
+			NBitsBytes:           make([]byte, 4),
+			Nonce:                make([]byte, 32),
+			Solution:             make([]byte, equihashSolutionSize),
+		},
+		vtx: []*Transaction{NewCoinbaseTransaction(height, 0, nil)},
+	}
+}
+
+// NewBlockBuilderFromBlock returns a builder that starts with the header and
+// transactions of an existing block.
+func NewBlockBuilderFromBlock(block *Block) *BlockBuilder {
+	header := *block.hdr.RawBlockHeader
+	return &BlockBuilder{
+		Header: &header,
+		vtx:    append([]*Transaction{}, block.vtx...),
+	}
+}
+
+// SetNonce sets the header's nonce to the given number (little-endian), which
+// is a simple way to give otherwise identical blocks different hashes.
+func (bb *BlockBuilder) SetNonce(nonce uint64) {
+	bb.Header.Nonce = make([]byte, 32)
+	binary.LittleEndian.PutUint64(bb.Header.Nonce, nonce)
+}
+
+// AddTransaction appends a transaction to the block.
+func (bb *BlockBuilder) AddTransaction(tx *Transaction) {
+	bb.vtx = append(bb.vtx, tx)
+}
+
+// AddRawTransaction parses a serialized transaction and appends it to the
+// block.
+func (bb *BlockBuilder) AddRawTransaction(data []byte) error {
+	tx := NewTransaction()
+	rest, err := tx.ParseFromSlice(data)
+	if err != nil {
+		return errors.Wrap(err, "parsing transaction")
+	}
+	if len(rest) != 0 {
+		return errors.New("transaction is followed by extra data")
+	}
+	bb.AddTransaction(tx)
+	return nil
+}
+
+// Build returns the block, with the merkle root of its transactions in its
+// header. The builder can still be used afterwards; the block doesn't share
+// its header or transaction list.
+func (bb *BlockBuilder) Build() (*Block, error) {
+	header := *bb.Header
+	block := &Block{
+		hdr:    &BlockHeader{RawBlockHeader: &header},
+		vtx:    append([]*Transaction{}, bb.vtx...),
+		height: -1,
+	}
+	if block.GetHeight() < 0 {
+		return nil, errors.New("block must begin with a coinbase transaction giving its height")
+	}
+	header.HashMerkleRoot = block.MerkleRoot()
+	return block, nil
+}
+
+// BuildBinary returns the serialized block (see Build).
+func (bb *BlockBuilder) BuildBinary() ([]byte, error) {
+	block, err := bb.Build()
+	if err != nil {
+		return nil, err
+	}
+	return block.MarshalBinary()
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCoinbaseScript(t *testing.T) {
+	for _, height := range []int{0, 1, 16, 17, 127, 128, 255, 256, 32767, 32768, 797905, 1 << 24, 1<<31 - 1} {
+		script := coinbaseScript(height)
+		if got := heightFromCoinbaseScript(script); got != height {
+			t.Fatalf("height %d: coinbase script %x gives height %d", height, script, got)
+		}
+	}
+}
+
+func TestBlockBuilder(t *testing.T) {
+	txs := readHexLines(t, "../testdata/zip243_raw_tx")
+	txs = append(txs, readHexLines(t, "../testdata/v5_raw_tx")...)
+
+	prevHash := bytes.Repeat([]byte{7}, 32)
+	builder := NewBlockBuilder(1000, prevHash)
+	empty, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range txs {
+		if err := builder.AddRawTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builder.AddRawTransaction(append(txs[0], 0)); err == nil {
+		t.Fatal("transaction with extra data was added")
+	}
+	blockData, err := builder.BuildBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := NewBlock()
+	rest, err := block.ParseFromSlice(blockData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Fatal("block has extra data")
+	}
+	if block.GetHeight() != 1000 {
+		t.Fatal("unexpected height", block.GetHeight())
+	}
+	if !bytes.Equal(block.GetPrevHash(), prevHash) {
+		t.Fatal("unexpected previous block hash")
+	}
+	if block.GetTxCount() != 1+len(txs) {
+		t.Fatal("unexpected transaction count", block.GetTxCount())
+	}
+	for i, tx := range block.Transactions()[1:] {
+		if !bytes.Equal(tx.Bytes(), txs[i]) {
+			t.Fatal("transaction differs", i)
+		}
+	}
+	if err := block.CheckMerkleRoot(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(block.GetEncodableHash(), empty.GetEncodableHash()) {
+		t.Fatal("adding transactions didn't change the block hash")
+	}
+	checkParseCompactBlock(t, blockData)
+
+	// The nonce changes the hash, but not the merkle root.
+	builder.SetNonce(1)
+	other, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.GetEncodableHash(), block.GetEncodableHash()) {
+		t.Fatal("nonce didn't change the block hash")
+	}
+	if err := other.CheckMerkleRoot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilding an existing block with another transaction.
+	builder = NewBlockBuilderFromBlock(block)
+	builder.AddTransaction(block.Transactions()[1])
+	rebuilt, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.GetTxCount() != block.GetTxCount()+1 {
+		t.Fatal("unexpected transaction count", rebuilt.GetTxCount())
+	}
+	if err := rebuilt.CheckMerkleRoot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := block.CheckMerkleRoot(); err != nil {
+		t.Fatal("rebuilding modified the original block:", err)
+	}
+
+	// A block needs a coinbase transaction.
+	builder = &BlockBuilder{Header: builder.Header}
+	if _, err := builder.Build(); err == nil {
+		t.Fatal("block without transactions was built")
+	}
+}
+
+func TestMarshalTransactionParts(t *testing.T) {
+	for _, txData := range readHexLines(t, "../testdata/zip243_raw_tx") {
+		tx := NewTransaction()
+		if _, err := tx.ParseFromSlice(txData); err != nil {
+			t.Fatal(err)
+		}
+		var parts []interface {
+			MarshalBinary() ([]byte, error)
+			ParseFromSlice([]byte) ([]byte, error)
+		}
+		for _, in := range tx.transparentInputs {
+			parts = append(parts, in)
+		}
+		for _, out := range tx.transparentOutputs {
+			parts = append(parts, out)
+		}
+		for _, sp := range tx.shieldedSpends {
+			parts = append(parts, sp)
+		}
+		for _, out := range tx.shieldedOutputs {
+			parts = append(parts, out)
+		}
+		for _, js := range tx.joinSplits {
+			parts = append(parts, js)
+		}
+		for _, part := range parts {
+			data, err := part.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(txData, data) {
+				t.Fatalf("%T serialized as %x, not part of the transaction", part, data)
+			}
+			rest, err := part.ParseFromSlice(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rest) != 0 {
+				t.Fatalf("%T serialized with extra data", part)
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package parser
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/asherda/lightwalletd/parser/internal/bytestring"
+	"github.com/asherda/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+)
+
+// Sizes of the fixed-size parts of a transaction, and the offsets of the
+// fields compact blocks need.
+const (
+	txInSize = 32 + 4 // prevout hash and index, before the script
+
+	// The smallest possible transaction, input and output, with empty
+	// scripts.
+	minTxSize    = 4 + 1 + 1 + 4 // header, no inputs or outputs, nLockTime
+	minTxInSize  = txInSize + 1 + 4
+	minTxOutSize = 8 + 1
+
+	spendSize        = 384 // cv, anchor, nullifier, rk, zkproof, spendAuthSig
+	spendNullifierAt = 64
+
+	outputSize     = 948 // cv, cmu, ephemeralKey, encCiphertext, outCiphertext, zkproof
+	outputCmuAt    = 32
+	outputEpkAt    = 64
+	outputCipherAt = 96
+
+	// The inline parts of Sapling descriptions in v5 transactions, and
+	// Orchard actions.
+	spendSizeV5  = 96
+	outputSizeV5 = 756
+	actionSize   = 820
+
+	joinSplitSizePHGR13  = 1802 // v2 and v3 transactions
+	joinSplitSizeGroth16 = 1698 // v4 transactions
+	joinSplitNullifierAt = 48
+	joinSplitCommitAt    = 112
+	joinSplitEpkAt       = 176
+)
+
+// ParseCompactBlock scans a full block from the given data once and returns
+// its compact form, as Block.ToCompact (or ToCompactWithJoinSplits, if
+// joinSplits is set) would, and the rest of the data. It doesn't build the
+// block's transactions, and only hashes the ones in the compact block, so
+// it's much cheaper than ParseFromSlice followed by ToCompact. The compact
+// block also has the serialized header, and its byte fields share memory
+// with data, which the caller must not modify.
+//
+// Version 5 transactions are parsed in full, since their txid (ZIP 244)
+// depends on all their parts.
+func ParseCompactBlock(data []byte, joinSplits bool) (*walletrpc.CompactBlock, []byte, error) {
+	hdr := NewBlockHeader()
+	rest, err := hdr.ParseFromSlice(data)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing block header")
+	}
+	headerBytes := data[:len(data)-len(rest)]
+
+	s := bytestring.String(rest)
+	var txCount int
+	if !s.ReadCompactSize(&txCount) {
+		return nil, nil, errors.New("could not read tx_count")
+	}
+
+	compact := &walletrpc.CompactBlock{
+		PrevHash: hdr.HashPrevBlock,
+		Hash:     hashHeader(headerBytes),
+		Time:     hdr.Time,
+		Header:   headerBytes,
+	}
+	height := -1
+	var i int
+	for i = 0; i < txCount && len(s) > 0; i++ {
+		var ctx *walletrpc.CompactTx
+		var coinbaseScript []byte
+		s, ctx, coinbaseScript, err = scanTransaction(s, i, joinSplits)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("parsing transaction %d", i))
+		}
+		if i == 0 {
+			height = heightFromCoinbaseScript(coinbaseScript)
+		}
+		if ctx != nil {
+			compact.Vtx = append(compact.Vtx, ctx)
+		}
+	}
+	if i < txCount {
+		return nil, nil, errors.New("parsing block transactions: not enough data")
+	}
+	if height < 0 {
+		return nil, nil, errors.New("could not read the block height from the coinbase transaction")
+	}
+	compact.Height = uint64(height)
+	return compact, []byte(s), nil
+}
+
+// scanTransaction advances s over the transaction at the given index in the
+// block. It returns the transaction's compact form, or nil if it has nothing
+// to put in a compact block, and the script of its first input (the
+// coinbase script, for the first transaction).
+func scanTransaction(s bytestring.String, index int, joinSplits bool) (bytestring.String, *walletrpc.CompactTx, []byte, error) {
+	data := []byte(s)
+
+	var header uint32
+	if !s.ReadUint32(&header) {
+		return nil, nil, nil, errors.New("could not read header")
+	}
+	fOverwintered := (header >> 31) == 1
+	version := header & 0x7FFFFFFF
+
+	if version >= 5 {
+		tx := NewTransaction()
+		rest, err := tx.ParseFromSlice(data)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var firstScript []byte
+		if len(tx.transparentInputs) > 0 {
+			firstScript = tx.transparentInputs[0].ScriptSig
+		}
+		if !tx.HasShieldedElements() {
+			return bytestring.String(rest), nil, firstScript, nil
+		}
+		return bytestring.String(rest), tx.ToCompact(index), firstScript, nil
+	}
+
+	if version >= 3 && !s.Skip(4) {
+		return nil, nil, nil, errors.New("could not read nVersionGroupId")
+	}
+
+	var txInCount int
+	if !s.ReadCompactSize(&txInCount) {
+		return nil, nil, nil, errors.New("could not read tx_in_count")
+	}
+	var firstScript []byte
+	for i := 0; i < txInCount; i++ {
+		var script bytestring.String
+		if !s.Skip(txInSize) || !s.ReadCompactLengthPrefixed(&script) || !s.Skip(4) {
+			return nil, nil, nil, errors.New("while parsing transparent input: could not read input")
+		}
+		if i == 0 {
+			firstScript = script
+		}
+	}
+
+	var txOutCount int
+	if !s.ReadCompactSize(&txOutCount) {
+		return nil, nil, nil, errors.New("could not read tx_out_count")
+	}
+	for i := 0; i < txOutCount; i++ {
+		var script bytestring.String
+		if !s.Skip(8) || !s.ReadCompactLengthPrefixed(&script) {
+			return nil, nil, nil, errors.New("while parsing transparent output: could not read output")
+		}
+	}
+
+	if !s.Skip(4) {
+		return nil, nil, nil, errors.New("could not read nLockTime")
+	}
+	if fOverwintered && !s.Skip(4) {
+		return nil, nil, nil, errors.New("could not read nExpiryHeight")
+	}
+
+	var spends, outputs []byte
+	var spendCount, outputCount int
+	if version >= 4 {
+		if !s.Skip(8) {
+			return nil, nil, nil, errors.New("could not read valueBalance")
+		}
+		if !s.ReadCompactSize(&spendCount) {
+			return nil, nil, nil, errors.New("could not read nShieldedSpend")
+		}
+		if tooMany(spendCount, spendSize, s) || !s.ReadBytes(&spends, spendCount*spendSize) {
+			return nil, nil, nil, errors.New("while parsing shielded Spend: not enough data")
+		}
+		if !s.ReadCompactSize(&outputCount) {
+			return nil, nil, nil, errors.New("could not read nShieldedOutput")
+		}
+		if tooMany(outputCount, outputSize, s) || !s.ReadBytes(&outputs, outputCount*outputSize) {
+			return nil, nil, nil, errors.New("while parsing shielded Output: not enough data")
+		}
+	}
+
+	var jsplits []byte
+	var joinSplitCount, joinSplitSize int
+	if version >= 2 {
+		if !s.ReadCompactSize(&joinSplitCount) {
+			return nil, nil, nil, errors.New("could not read nJoinSplit")
+		}
+		joinSplitSize = joinSplitSizeGroth16
+		if version <= 3 {
+			joinSplitSize = joinSplitSizePHGR13
+		}
+		if joinSplitCount > 0 {
+			if tooMany(joinSplitCount, joinSplitSize, s) || !s.ReadBytes(&jsplits, joinSplitCount*joinSplitSize) {
+				return nil, nil, nil, errors.New("while parsing JoinSplit: not enough data")
+			}
+			// joinSplitPubKey and joinSplitSig
+			if !s.Skip(32 + 64) {
+				return nil, nil, nil, errors.New("could not read joinSplitPubKey and joinSplitSig")
+			}
+		}
+	}
+
+	if version >= 4 && spendCount+outputCount > 0 && !s.Skip(64) {
+		return nil, nil, nil, errors.New("could not read bindingSig")
+	}
+
+	if spendCount+outputCount == 0 && !(joinSplits && joinSplitCount > 0) {
+		return s, nil, firstScript, nil
+	}
+
+	// SHA256d of the transaction's bytes
+	digest := sha256.Sum256(data[:len(data)-len(s)])
+	digest = sha256.Sum256(digest[:])
+	ctx := &walletrpc.CompactTx{
+		Index:   uint64(index),
+		Hash:    digest[:],
+		Spends:  make([]*walletrpc.CompactSpend, spendCount),
+		Outputs: make([]*walletrpc.CompactOutput, outputCount),
+	}
+	// Allocate the messages together rather than one by one.
+	compactSpends := make([]walletrpc.CompactSpend, spendCount)
+	for i := range compactSpends {
+		sp := spends[i*spendSize:]
+		compactSpends[i].Nf = sp[spendNullifierAt : spendNullifierAt+32]
+		ctx.Spends[i] = &compactSpends[i]
+	}
+	compactOutputs := make([]walletrpc.CompactOutput, outputCount)
+	for i := range compactOutputs {
+		out := outputs[i*outputSize:]
+		compactOutputs[i].Cmu = out[outputCmuAt : outputCmuAt+32]
+		compactOutputs[i].Epk = out[outputEpkAt : outputEpkAt+32]
+		compactOutputs[i].Ciphertext = out[outputCipherAt : outputCipherAt+52]
+		ctx.Outputs[i] = &compactOutputs[i]
+	}
+	if joinSplits {
+		ctx.JoinSplits = make([]*walletrpc.CompactJoinSplit, joinSplitCount)
+		compactJoinSplits := make([]walletrpc.CompactJoinSplit, joinSplitCount)
+		for i := range compactJoinSplits {
+			js := jsplits[i*joinSplitSize:]
+			compactJoinSplits[i].Nullifiers = [][]byte{
+				js[joinSplitNullifierAt : joinSplitNullifierAt+32],
+				js[joinSplitNullifierAt+32 : joinSplitNullifierAt+64],
+			}
+			compactJoinSplits[i].Commitments = [][]byte{
+				js[joinSplitCommitAt : joinSplitCommitAt+32],
+				js[joinSplitCommitAt+32 : joinSplitCommitAt+64],
+			}
+			compactJoinSplits[i].EphemeralKey = js[joinSplitEpkAt : joinSplitEpkAt+32]
+			ctx.JoinSplits[i] = &compactJoinSplits[i]
+		}
+	}
+	return s, ctx, firstScript, nil
+}
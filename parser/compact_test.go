@@ -0,0 +1,134 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+// readHexLines returns the hex-encoded lines of a test data file, skipping
+// comments.
+func readHexLines(t testing.TB, name string) [][]byte {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var result [][]byte
+	scan := bufio.NewScanner(f)
+	scan.Buffer(make([]byte, 64*1024), 8*1024*1024)
+	for scan.Scan() {
+		if strings.HasPrefix(scan.Text(), "#") {
+			continue
+		}
+		data, err := hex.DecodeString(scan.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, data)
+	}
+	return result
+}
+
+// checkParseCompactBlock checks that ParseCompactBlock gives the same compact
+// block as parsing the full block.
+func checkParseCompactBlock(t *testing.T, blockData []byte) {
+	block := NewBlock()
+	if _, err := block.ParseFromSlice(blockData); err != nil {
+		t.Fatal(err)
+	}
+	header, err := block.MarshalHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, joinSplits := range []bool{false, true} {
+		compact, rest, err := ParseCompactBlock(blockData, joinSplits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rest) != 0 {
+			t.Fatal("did not consume entire buffer")
+		}
+		if !bytes.Equal(compact.Header, header) {
+			t.Fatal("unexpected header", block.GetHeight())
+		}
+		compact.Header = nil
+		expected := block.ToCompact()
+		if joinSplits {
+			expected = block.ToCompactWithJoinSplits()
+		}
+		if !protobuf.Equal(compact, expected) {
+			t.Fatalf("block %d (joinSplits %v) compact forms differ:\n%v\n%v",
+				block.GetHeight(), joinSplits, compact, expected)
+		}
+	}
+}
+
+func TestParseCompactBlock(t *testing.T) {
+	blocks := readHexLines(t, "../testdata/blocks")
+	for _, blockData := range blocks {
+		checkParseCompactBlock(t, blockData)
+
+		// Truncated blocks fail.
+		for _, n := range []int{0, 100, 1487, len(blockData) / 2, len(blockData) - 1} {
+			if _, _, err := ParseCompactBlock(blockData[:n], false); err == nil {
+				t.Fatal("truncated block was parsed", n)
+			}
+		}
+	}
+
+	// A block with v4 Sapling and Sprout transactions and v5 ones.
+	block := NewBlock()
+	if _, err := block.ParseFromSlice(blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	header, err := block.MarshalHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txs [][]byte
+	for _, tx := range block.Transactions() {
+		txs = append(txs, tx.Bytes())
+	}
+	txs = append(txs, readHexLines(t, "../testdata/zip243_raw_tx")...)
+	txs = append(txs, readHexLines(t, "../testdata/v5_raw_tx")...)
+	var mixed bytes.Buffer
+	mixed.Write(header)
+	WriteCompactLengthPrefixedLen(&mixed, len(txs))
+	for _, tx := range txs {
+		mixed.Write(tx)
+	}
+	checkParseCompactBlock(t, mixed.Bytes())
+}
+
+func BenchmarkParseBlock(b *testing.B) {
+	blocks := readHexLines(b, "../testdata/blocks")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block := NewBlock()
+		if _, err := block.ParseFromSlice(blocks[i%len(blocks)]); err != nil {
+			b.Fatal(err)
+		}
+		block.ToCompact()
+	}
+}
+
+func BenchmarkParseCompactBlock(b *testing.B) {
+	blocks := readHexLines(b, "../testdata/blocks")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseCompactBlock(blocks[i%len(blocks)], false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
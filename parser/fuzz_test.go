@@ -0,0 +1,135 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+//go:build go1.18
+// +build go1.18
+
+package parser
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	protobuf "github.com/golang/protobuf/proto"
+)
+
+// corpusBlocks returns the blocks in testdata/corpus, which seed the fuzzers.
+func corpusBlocks(f *testing.F) []*Block {
+	files, err := filepath.Glob("../testdata/corpus/*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	var blocks []*Block
+	for _, name := range files {
+		for _, blockData := range readHexLines(f, name) {
+			block := NewBlock()
+			if _, err := block.ParseFromSlice(blockData); err != nil {
+				f.Fatal(name, err)
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) == 0 {
+		f.Fatal("no corpus blocks")
+	}
+	return blocks
+}
+
+// checkRoundTrip checks that marshaling what was parsed from data, leaving
+// rest, gives the bytes that were parsed.
+func checkRoundTrip(t *testing.T, data, rest []byte, marshal func() ([]byte, error)) {
+	serialized, err := marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serialized, data[:len(data)-len(rest)]) {
+		t.Fatalf("round trip changed the data:\n%x\n%x", data[:len(data)-len(rest)], serialized)
+	}
+}
+
+func FuzzBlockParser(f *testing.F) {
+	for _, block := range corpusBlocks(f) {
+		blockData, err := block.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(blockData)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block := NewBlock()
+		rest, err := block.ParseFromSlice(data)
+		compact, compactRest, compactErr := ParseCompactBlock(data, true)
+		if err != nil {
+			if compactErr == nil {
+				t.Fatal("ParseCompactBlock accepted a block ParseFromSlice rejected:", err)
+			}
+			return
+		}
+		checkRoundTrip(t, data, rest, block.MarshalBinary)
+		block.CheckMerkleRoot()
+		block.IsProofOfStake()
+		block.CheckProofOfWork()
+		if block.GetHeight() < 0 {
+			return
+		}
+		if compactErr != nil {
+			t.Fatal("ParseCompactBlock rejected a block ParseFromSlice accepted:", compactErr)
+		}
+		if len(compactRest) != len(rest) {
+			t.Fatal("ParseCompactBlock and ParseFromSlice consumed different lengths")
+		}
+		compact.Header = nil
+		if !protobuf.Equal(compact, block.ToCompactWithJoinSplits()) {
+			t.Fatal("ParseCompactBlock and ParseFromSlice give different compact blocks")
+		}
+	})
+}
+
+func FuzzTransactionParser(f *testing.F) {
+	for _, block := range corpusBlocks(f) {
+		for _, tx := range block.Transactions() {
+			f.Add(tx.Bytes())
+		}
+	}
+	for _, name := range []string{"zip143_raw_tx", "zip243_raw_tx", "v5_raw_tx"} {
+		for _, txData := range readHexLines(f, "../testdata/"+name) {
+			f.Add(txData)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tx := NewTransaction()
+		rest, err := tx.ParseFromSlice(data)
+		if err != nil {
+			return
+		}
+		checkRoundTrip(t, data, rest, tx.MarshalBinary)
+		tx.GetDisplayHash()
+		tx.ToCompactWithJoinSplits(0)
+	})
+}
+
+func FuzzBlockHeaderParser(f *testing.F) {
+	for _, block := range corpusBlocks(f) {
+		header, err := block.MarshalHeader()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(header)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hdr := NewBlockHeader()
+		rest, err := hdr.ParseFromSlice(data)
+		if err != nil {
+			if !bytes.Equal(rest, data) {
+				t.Fatal("failed parse advanced over the data")
+			}
+			return
+		}
+		checkRoundTrip(t, data, rest, hdr.MarshalBinary)
+		hdr.GetDisplayHash()
+		hdr.IsProofOfStake()
+		hdr.CheckProofOfWork()
+	})
+}
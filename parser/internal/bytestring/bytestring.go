@@ -24,9 +24,9 @@ const (
 type String []byte
 
 // read advances the string by n bytes and returns them. If fewer than n bytes
-// remain, it returns nil.
+// remain, or n is negative, it returns nil.
 func (s *String) read(n int) []byte {
-	if len(*s) < n {
+	if n < 0 || len(*s) < n {
 		return nil
 	}
 
@@ -59,7 +59,7 @@ func (s *String) Empty() bool {
 
 // Skip advances the string by n bytes and reports whether it was successful.
 func (s *String) Skip(n int) bool {
-	if len(*s) < n {
+	if n < 0 || len(*s) < n {
 		return false
 	}
 	(*s) = (*s)[n:]
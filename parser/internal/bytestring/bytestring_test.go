@@ -17,6 +17,9 @@ func TestString_read(t *testing.T) {
 	if s.Empty() {
 		t.Fatal("string unexpectedly empty")
 	}
+	if s.read(-1) != nil {
+		t.Fatal("unexpected successful negative read()")
+	}
 	r := s.read(2)
 	if len(r) != 2 {
 		t.Fatal("unexpected string length after read()")
@@ -115,6 +118,9 @@ func TestString_Read(t *testing.T) {
 func TestString_Skip(t *testing.T) {
 	s := String{22, 33, 44}
 	b := make([]byte, 10)
+	if s.Skip(-1) {
+		t.Fatal("Skip(-1) unexpectedly succeeded")
+	}
 	if !s.Skip(1) {
 		t.Fatal("Skip() failed")
 	}
@@ -0,0 +1,133 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+//go:build go1.18
+// +build go1.18
+
+package bytestring
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// compactSizeLen returns the length of the canonical CompactSize encoding
+// of n.
+func compactSizeLen(n int) int {
+	switch {
+	case n < 253:
+		return 1
+	case n <= 0xffff:
+		return 3
+	default:
+		return 5
+	}
+}
+
+// FuzzString applies a sequence of reads, chosen by ops, to a String of the
+// fuzzed data, checking that each successful read advances over exactly the
+// bytes it reads, and that no read panics.
+func FuzzString(f *testing.F) {
+	files, err := filepath.Glob("../../../testdata/corpus/*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		scan := bufio.NewScanner(file)
+		scan.Buffer(make([]byte, 64*1024), 8*1024*1024)
+		for scan.Scan() {
+			data, err := hex.DecodeString(scan.Text())
+			if err != nil {
+				f.Fatal(err)
+			}
+			// Roughly a block header, then a transaction.
+			f.Add(data, []byte{0x46, 0x43, 0x43, 0x43, 0x46, 0x43, 0x14, 0x04, 0x04, 0x45, 0x04, 0x45})
+		}
+		file.Close()
+	}
+	f.Add([]byte{253, 0xfd, 0x00, 0x01, 0x02}, []byte{0x04, 0x05, 0x00, 0xf0, 0x11, 0x0b})
+
+	f.Fuzz(func(t *testing.T, data []byte, ops []byte) {
+		s := String(data)
+		for _, op := range ops {
+			// The high nibble is a length, from -4 to 11.
+			n := int(op>>4) - 4
+			before := len(s)
+			var ok bool
+			want := 0 // the number of bytes a successful read advances over
+			switch op & 0x0f {
+			case 0:
+				ok = s.Skip(n)
+				want = n
+			case 1:
+				var out byte
+				ok = s.ReadByte(&out)
+				want = 1
+			case 2, 3:
+				var out []byte
+				ok = s.ReadBytes(&out, n)
+				want = n
+				if ok && len(out) != n {
+					t.Fatal("ReadBytes returned", len(out), "bytes, not", n)
+				}
+			case 4:
+				var size int
+				ok = s.ReadCompactSize(&size)
+				want = compactSizeLen(size)
+				if ok && (size < 0 || uint64(size) > maxCompactSize) {
+					t.Fatal("ReadCompactSize returned", size)
+				}
+			case 5:
+				var out String
+				ok = s.ReadCompactLengthPrefixed(&out)
+				want = compactSizeLen(len(out)) + len(out)
+			case 6:
+				var out int32
+				ok = s.ReadInt32(&out)
+				want = 4
+			case 7:
+				var out int64
+				ok = s.ReadInt64(&out)
+				want = 8
+			case 8:
+				var out uint16
+				ok = s.ReadUint16(&out)
+				want = 2
+			case 9:
+				var out uint32
+				ok = s.ReadUint32(&out)
+				want = 4
+			case 10:
+				var out uint64
+				ok = s.ReadUint64(&out)
+				want = 8
+			case 11:
+				var num int64
+				ok = s.ReadScriptInt64(&num)
+				want = -1 // depends on the encoding
+			default:
+				if n < 0 {
+					n = 0
+				}
+				var read int
+				read, _ = s.Read(make([]byte, n))
+				ok = true
+				want = read
+			}
+			if len(s) > before {
+				t.Fatalf("op %#x grew the string", op)
+			}
+			if ok && want >= 0 && before-len(s) != want {
+				t.Fatalf("op %#x advanced %d bytes, not %d", op, before-len(s), want)
+			}
+		}
+	})
+}
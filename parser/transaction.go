@@ -6,7 +6,9 @@
 package parser
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 
 	"github.com/asherda/lightwalletd/parser/internal/bytestring"
 	"github.com/asherda/lightwalletd/walletrpc"
@@ -17,6 +19,7 @@ type rawTransaction struct {
 	fOverwintered      bool
 	version            uint32
 	nVersionGroupID    uint32
+	consensusBranchID  uint32 // v5 and later
 	transparentInputs  []*txIn
 	transparentOutputs []*txOut
 	nLockTime          uint32
@@ -28,6 +31,26 @@ type rawTransaction struct {
 	joinSplitPubKey    []byte
 	joinSplitSig       []byte
 	bindingSig         []byte
+
+	// Orchard bundle (v5 and later)
+	orchardActions      []*action
+	orchardFlags        byte
+	orchardValueBalance int64
+	orchardAnchor       []byte
+	orchardProof        []byte
+	orchardBindingSig   []byte
+}
+
+// writer is implemented by the parts of a transaction, which serialize
+// themselves as their ParseFromSlice reads them.
+type writer interface {
+	writeTo(buf *bytes.Buffer)
+}
+
+func marshal(w writer) []byte {
+	buf := new(bytes.Buffer)
+	w.writeTo(buf)
+	return buf.Bytes()
 }
 
 // Txin format as described in https://en.bitcoin.it/wiki/Transaction
@@ -67,6 +90,19 @@ func (tx *txIn) ParseFromSlice(data []byte) ([]byte, error) {
 	return []byte(s), nil
 }
 
+// writeTo serializes the input, as ParseFromSlice reads it.
+func (tx *txIn) writeTo(buf *bytes.Buffer) {
+	buf.Write(tx.PrevTxHash)
+	binary.Write(buf, binary.LittleEndian, tx.PrevTxOutIndex)
+	writeCompactLengthPrefixed(buf, tx.ScriptSig)
+	binary.Write(buf, binary.LittleEndian, tx.SequenceNumber)
+}
+
+// MarshalBinary returns the input in serialized form.
+func (tx *txIn) MarshalBinary() ([]byte, error) {
+	return marshal(tx), nil
+}
+
 // Txout format as described in https://en.bitcoin.it/wiki/Transaction
 type txOut struct {
 	// Non-negative int giving the number of zatoshis to be transferred
@@ -90,6 +126,17 @@ func (tx *txOut) ParseFromSlice(data []byte) ([]byte, error) {
 	return []byte(s), nil
 }
 
+// writeTo serializes the output, as ParseFromSlice reads it.
+func (tx *txOut) writeTo(buf *bytes.Buffer) {
+	binary.Write(buf, binary.LittleEndian, tx.Value)
+	writeCompactLengthPrefixed(buf, tx.Script)
+}
+
+// MarshalBinary returns the output in serialized form.
+func (tx *txOut) MarshalBinary() ([]byte, error) {
+	return marshal(tx), nil
+}
+
 // spend is a Sapling Spend Description as described in 7.3 of the Zcash
 // protocol spec.  Total size is 384 bytes.
 type spend struct {
@@ -131,6 +178,50 @@ func (p *spend) ParseFromSlice(data []byte) ([]byte, error) {
 	return []byte(s), nil
 }
 
+// ParseFromSliceV5 deserializes the fields of a Sapling Spend Description
+// that are inline in a v5 transaction (ZIP 225); the anchor, proof and
+// signature come later in the transaction.
+func (p *spend) ParseFromSliceV5(data []byte) ([]byte, error) {
+	s := bytestring.String(data)
+
+	if !s.ReadBytes(&p.cv, 32) {
+		return nil, errors.New("could not read cv")
+	}
+
+	if !s.ReadBytes(&p.nullifier, 32) {
+		return nil, errors.New("could not read nullifier")
+	}
+
+	if !s.ReadBytes(&p.rk, 32) {
+		return nil, errors.New("could not read rk")
+	}
+
+	return []byte(s), nil
+}
+
+// writeTo serializes the spend, as ParseFromSlice reads it.
+func (p *spend) writeTo(buf *bytes.Buffer) {
+	buf.Write(p.cv)
+	buf.Write(p.anchor)
+	buf.Write(p.nullifier)
+	buf.Write(p.rk)
+	buf.Write(p.zkproof)
+	buf.Write(p.spendAuthSig)
+}
+
+// writeToV5 serializes the spend's inline fields, as ParseFromSliceV5 reads
+// them.
+func (p *spend) writeToV5(buf *bytes.Buffer) {
+	buf.Write(p.cv)
+	buf.Write(p.nullifier)
+	buf.Write(p.rk)
+}
+
+// MarshalBinary returns the spend (v4 format) in serialized form.
+func (p *spend) MarshalBinary() ([]byte, error) {
+	return marshal(p), nil
+}
+
 func (p *spend) ToCompact() *walletrpc.CompactSpend {
 	return &walletrpc.CompactSpend{
 		Nf: p.nullifier,
@@ -178,6 +269,56 @@ func (p *output) ParseFromSlice(data []byte) ([]byte, error) {
 	return []byte(s), nil
 }
 
+// ParseFromSliceV5 deserializes the fields of a Sapling Output Description
+// that are inline in a v5 transaction (ZIP 225); the proof comes later in the
+// transaction.
+func (p *output) ParseFromSliceV5(data []byte) ([]byte, error) {
+	s := bytestring.String(data)
+
+	if !s.ReadBytes(&p.cv, 32) {
+		return nil, errors.New("could not read cv")
+	}
+
+	if !s.ReadBytes(&p.cmu, 32) {
+		return nil, errors.New("could not read cmu")
+	}
+
+	if !s.ReadBytes(&p.ephemeralKey, 32) {
+		return nil, errors.New("could not read ephemeralKey")
+	}
+
+	if !s.ReadBytes(&p.encCiphertext, 580) {
+		return nil, errors.New("could not read encCiphertext")
+	}
+
+	if !s.ReadBytes(&p.outCiphertext, 80) {
+		return nil, errors.New("could not read outCiphertext")
+	}
+
+	return []byte(s), nil
+}
+
+// writeTo serializes the output, as ParseFromSlice reads it.
+func (p *output) writeTo(buf *bytes.Buffer) {
+	p.writeToV5(buf)
+	buf.Write(p.zkproof)
+}
+
+// writeToV5 serializes the output's inline fields, as ParseFromSliceV5 reads
+// them.
+func (p *output) writeToV5(buf *bytes.Buffer) {
+	buf.Write(p.cv)
+	buf.Write(p.cmu)
+	buf.Write(p.ephemeralKey)
+	buf.Write(p.encCiphertext)
+	buf.Write(p.outCiphertext)
+}
+
+// MarshalBinary returns the output (v4 format) in serialized form.
+func (p *output) MarshalBinary() ([]byte, error) {
+	return marshal(p), nil
+}
+
 func (p *output) ToCompact() *walletrpc.CompactOutput {
 	return &walletrpc.CompactOutput{
 		Cmu:        p.cmu,
@@ -186,6 +327,79 @@ func (p *output) ToCompact() *walletrpc.CompactOutput {
 	}
 }
 
+// action is an Orchard Action Description as described in section 7.5 of the
+// Zcash protocol spec. Its size in a v5 transaction is 820 bytes, plus the
+// 64-byte spendAuthSig, which comes later in the transaction.
+type action struct {
+	cv            []byte // 32
+	nullifier     []byte // 32
+	rk            []byte // 32
+	cmx           []byte // 32
+	ephemeralKey  []byte // 32
+	encCiphertext []byte // 580
+	outCiphertext []byte // 80
+	spendAuthSig  []byte // 64
+}
+
+func (a *action) ParseFromSlice(data []byte) ([]byte, error) {
+	s := bytestring.String(data)
+
+	if !s.ReadBytes(&a.cv, 32) {
+		return nil, errors.New("could not read action cv")
+	}
+
+	if !s.ReadBytes(&a.nullifier, 32) {
+		return nil, errors.New("could not read action nullifier")
+	}
+
+	if !s.ReadBytes(&a.rk, 32) {
+		return nil, errors.New("could not read action rk")
+	}
+
+	if !s.ReadBytes(&a.cmx, 32) {
+		return nil, errors.New("could not read action cmx")
+	}
+
+	if !s.ReadBytes(&a.ephemeralKey, 32) {
+		return nil, errors.New("could not read action ephemeralKey")
+	}
+
+	if !s.ReadBytes(&a.encCiphertext, 580) {
+		return nil, errors.New("could not read action encCiphertext")
+	}
+
+	if !s.ReadBytes(&a.outCiphertext, 80) {
+		return nil, errors.New("could not read action outCiphertext")
+	}
+
+	return []byte(s), nil
+}
+
+// writeTo serializes the action, as ParseFromSlice reads it.
+func (a *action) writeTo(buf *bytes.Buffer) {
+	buf.Write(a.cv)
+	buf.Write(a.nullifier)
+	buf.Write(a.rk)
+	buf.Write(a.cmx)
+	buf.Write(a.ephemeralKey)
+	buf.Write(a.encCiphertext)
+	buf.Write(a.outCiphertext)
+}
+
+// MarshalBinary returns the action in serialized form.
+func (a *action) MarshalBinary() ([]byte, error) {
+	return marshal(a), nil
+}
+
+func (a *action) ToCompact() *walletrpc.CompactOrchardAction {
+	return &walletrpc.CompactOrchardAction{
+		Nullifier:    a.nullifier,
+		Cmx:          a.cmx,
+		EphemeralKey: a.ephemeralKey,
+		Ciphertext:   a.encCiphertext[:52],
+	}
+}
+
 // joinSplit is a JoinSplit description as described in 7.2 of the Zcash
 // protocol spec. Its exact contents differ by transaction version and network
 // upgrade level.
@@ -268,6 +482,38 @@ func (p *joinSplit) ParseFromSlice(data []byte) ([]byte, error) {
 	return []byte(s), nil
 }
 
+// writeTo serializes the JoinSplit, as ParseFromSlice reads it.
+func (p *joinSplit) writeTo(buf *bytes.Buffer) {
+	binary.Write(buf, binary.LittleEndian, p.vpubOld)
+	binary.Write(buf, binary.LittleEndian, p.vpubNew)
+	buf.Write(p.anchor)
+	buf.Write(p.nullifiers[0])
+	buf.Write(p.nullifiers[1])
+	buf.Write(p.commitments[0])
+	buf.Write(p.commitments[1])
+	buf.Write(p.ephemeralKey)
+	buf.Write(p.randomSeed)
+	buf.Write(p.vmacs[0])
+	buf.Write(p.vmacs[1])
+	buf.Write(p.proofPHGR13)
+	buf.Write(p.proofGroth16)
+	buf.Write(p.encCiphertexts[0])
+	buf.Write(p.encCiphertexts[1])
+}
+
+// MarshalBinary returns the JoinSplit in serialized form.
+func (p *joinSplit) MarshalBinary() ([]byte, error) {
+	return marshal(p), nil
+}
+
+func (p *joinSplit) ToCompact() *walletrpc.CompactJoinSplit {
+	return &walletrpc.CompactJoinSplit{
+		Nullifiers:   [][]byte{p.nullifiers[0], p.nullifiers[1]},
+		Commitments:  [][]byte{p.commitments[0], p.commitments[1]},
+		EphemeralKey: p.ephemeralKey,
+	}
+}
+
 // Transaction encodes a full (zcashd) transaction.
 type Transaction struct {
 	*rawTransaction
@@ -281,16 +527,18 @@ func (tx *Transaction) GetDisplayHash() []byte {
 		return tx.cachedTxID
 	}
 
-	// SHA256d
-	digest := sha256.Sum256(tx.rawBytes)
-	digest = sha256.Sum256(digest[:])
 	// Convert to big-endian
-	tx.cachedTxID = Reverse(digest[:])
+	tx.cachedTxID = Reverse(tx.GetEncodableHash())
 	return tx.cachedTxID
 }
 
 // GetEncodableHash returns the transaction hash in little-endian wire format order.
 func (tx *Transaction) GetEncodableHash() []byte {
+	if tx.version >= 5 {
+		// The txid commits to the transaction's effects only (ZIP 244).
+		return tx.txidDigest()
+	}
+	// SHA256d
 	digest := sha256.Sum256(tx.rawBytes)
 	digest = sha256.Sum256(digest[:])
 	return digest[:]
@@ -307,6 +555,24 @@ func (tx *Transaction) HasSaplingElements() bool {
 	return tx.version >= 4 && (len(tx.shieldedSpends)+len(tx.shieldedOutputs)) > 0
 }
 
+// HasOrchardElements indicates whether a transaction has at least one
+// Orchard action.
+func (tx *Transaction) HasOrchardElements() bool {
+	return len(tx.orchardActions) > 0
+}
+
+// HasShieldedElements indicates whether a transaction has any Sapling or
+// Orchard elements, and so belongs in a compact block.
+func (tx *Transaction) HasShieldedElements() bool {
+	return tx.HasSaplingElements() || tx.HasOrchardElements()
+}
+
+// HasJoinSplits indicates whether a transaction has at least one Sprout
+// JoinSplit.
+func (tx *Transaction) HasJoinSplits() bool {
+	return len(tx.joinSplits) > 0
+}
+
 // ToCompact converts the given (full) transaction to compact format.
 func (tx *Transaction) ToCompact(index int) *walletrpc.CompactTx {
 	ctx := &walletrpc.CompactTx{
@@ -315,6 +581,7 @@ func (tx *Transaction) ToCompact(index int) *walletrpc.CompactTx {
 		//Fee:     0, // TODO: calculate fees
 		Spends:  make([]*walletrpc.CompactSpend, len(tx.shieldedSpends)),
 		Outputs: make([]*walletrpc.CompactOutput, len(tx.shieldedOutputs)),
+		Actions: make([]*walletrpc.CompactOrchardAction, len(tx.orchardActions)),
 	}
 	for i, spend := range tx.shieldedSpends {
 		ctx.Spends[i] = spend.ToCompact()
@@ -322,6 +589,20 @@ func (tx *Transaction) ToCompact(index int) *walletrpc.CompactTx {
 	for i, output := range tx.shieldedOutputs {
 		ctx.Outputs[i] = output.ToCompact()
 	}
+	for i, action := range tx.orchardActions {
+		ctx.Actions[i] = action.ToCompact()
+	}
+	return ctx
+}
+
+// ToCompactWithJoinSplits converts the given (full) transaction to compact
+// format, including its Sprout JoinSplits.
+func (tx *Transaction) ToCompactWithJoinSplits(index int) *walletrpc.CompactTx {
+	ctx := tx.ToCompact(index)
+	ctx.JoinSplits = make([]*walletrpc.CompactJoinSplit, len(tx.joinSplits))
+	for i, js := range tx.joinSplits {
+		ctx.JoinSplits[i] = js.ToCompact()
+	}
 	return ctx
 }
 
@@ -346,10 +627,17 @@ func (tx *Transaction) ParseFromSlice(data []byte) ([]byte, error) {
 		}
 	}
 
+	if tx.version >= 5 {
+		return tx.parseV5(data, s)
+	}
+
 	var txInCount int
 	if !s.ReadCompactSize(&txInCount) {
 		return nil, errors.New("could not read tx_in_count")
 	}
+	if tooMany(txInCount, minTxInSize, s) {
+		return nil, errors.New("too many transparent inputs for the data")
+	}
 
 	// TODO: Duplicate/otherwise-too-many transactions are a possible DoS
 	// TODO: vector. At the moment we're assuming trusted input.
@@ -371,6 +659,9 @@ func (tx *Transaction) ParseFromSlice(data []byte) ([]byte, error) {
 	if !s.ReadCompactSize(&txOutCount) {
 		return nil, errors.New("could not read tx_out_count")
 	}
+	if tooMany(txOutCount, minTxOutSize, s) {
+		return nil, errors.New("too many transparent outputs for the data")
+	}
 
 	if txOutCount > 0 {
 		tx.transparentOutputs = make([]*txOut, txOutCount)
@@ -404,6 +695,9 @@ func (tx *Transaction) ParseFromSlice(data []byte) ([]byte, error) {
 		if !s.ReadCompactSize(&spendCount) {
 			return nil, errors.New("could not read nShieldedSpend")
 		}
+		if tooMany(spendCount, spendSize, s) {
+			return nil, errors.New("too many shielded Spends for the data")
+		}
 
 		if spendCount > 0 {
 			tx.shieldedSpends = make([]*spend, spendCount)
@@ -420,6 +714,9 @@ func (tx *Transaction) ParseFromSlice(data []byte) ([]byte, error) {
 		if !s.ReadCompactSize(&outputCount) {
 			return nil, errors.New("could not read nShieldedOutput")
 		}
+		if tooMany(outputCount, outputSize, s) {
+			return nil, errors.New("too many shielded Outputs for the data")
+		}
 
 		if outputCount > 0 {
 			tx.shieldedOutputs = make([]*output, outputCount)
@@ -439,6 +736,9 @@ func (tx *Transaction) ParseFromSlice(data []byte) ([]byte, error) {
 		if !s.ReadCompactSize(&joinSplitCount) {
 			return nil, errors.New("could not read nJoinSplit")
 		}
+		if tooMany(joinSplitCount, joinSplitSizeGroth16, s) {
+			return nil, errors.New("too many JoinSplits for the data")
+		}
 
 		if joinSplitCount > 0 {
 			tx.joinSplits = make([]*joinSplit, joinSplitCount)
@@ -474,6 +774,305 @@ func (tx *Transaction) ParseFromSlice(data []byte) ([]byte, error) {
 	return []byte(s), nil
 }
 
+// parseV5 deserializes the rest of a v5 transaction (ZIP 225), after the
+// header and nVersionGroupId, from s; data is the whole transaction.
+func (tx *Transaction) parseV5(data []byte, s bytestring.String) ([]byte, error) {
+	var err error
+
+	if tx.version != 5 {
+		return nil, errors.Errorf("unsupported transaction version %d", tx.version)
+	}
+	if !tx.fOverwintered {
+		return nil, errors.New("v5 transaction is not overwintered")
+	}
+	if !s.ReadUint32(&tx.consensusBranchID) {
+		return nil, errors.New("could not read nConsensusBranchId")
+	}
+	if !s.ReadUint32(&tx.nLockTime) {
+		return nil, errors.New("could not read nLockTime")
+	}
+	if !s.ReadUint32(&tx.nExpiryHeight) {
+		return nil, errors.New("could not read nExpiryHeight")
+	}
+
+	var txInCount int
+	if !s.ReadCompactSize(&txInCount) {
+		return nil, errors.New("could not read tx_in_count")
+	}
+	if tooMany(txInCount, minTxInSize, s) {
+		return nil, errors.New("too many transparent inputs for the data")
+	}
+	if txInCount > 0 {
+		tx.transparentInputs = make([]*txIn, txInCount)
+		for i := 0; i < txInCount; i++ {
+			ti := &txIn{}
+			s, err = ti.ParseFromSlice([]byte(s))
+			if err != nil {
+				return nil, errors.Wrap(err, "while parsing transparent input")
+			}
+			tx.transparentInputs[i] = ti
+		}
+	}
+
+	var txOutCount int
+	if !s.ReadCompactSize(&txOutCount) {
+		return nil, errors.New("could not read tx_out_count")
+	}
+	if tooMany(txOutCount, minTxOutSize, s) {
+		return nil, errors.New("too many transparent outputs for the data")
+	}
+	if txOutCount > 0 {
+		tx.transparentOutputs = make([]*txOut, txOutCount)
+		for i := 0; i < txOutCount; i++ {
+			to := &txOut{}
+			s, err = to.ParseFromSlice([]byte(s))
+			if err != nil {
+				return nil, errors.Wrap(err, "while parsing transparent output")
+			}
+			tx.transparentOutputs[i] = to
+		}
+	}
+
+	// Sapling bundle
+	var spendCount, outputCount int
+	if !s.ReadCompactSize(&spendCount) {
+		return nil, errors.New("could not read nSpendsSapling")
+	}
+	if tooMany(spendCount, spendSizeV5, s) {
+		return nil, errors.New("too many shielded Spends for the data")
+	}
+	if spendCount > 0 {
+		tx.shieldedSpends = make([]*spend, spendCount)
+		for i := 0; i < spendCount; i++ {
+			newSpend := &spend{}
+			s, err = newSpend.ParseFromSliceV5([]byte(s))
+			if err != nil {
+				return nil, errors.Wrap(err, "while parsing shielded Spend")
+			}
+			tx.shieldedSpends[i] = newSpend
+		}
+	}
+	if !s.ReadCompactSize(&outputCount) {
+		return nil, errors.New("could not read nOutputsSapling")
+	}
+	if tooMany(outputCount, outputSizeV5, s) {
+		return nil, errors.New("too many shielded Outputs for the data")
+	}
+	if outputCount > 0 {
+		tx.shieldedOutputs = make([]*output, outputCount)
+		for i := 0; i < outputCount; i++ {
+			newOutput := &output{}
+			s, err = newOutput.ParseFromSliceV5([]byte(s))
+			if err != nil {
+				return nil, errors.Wrap(err, "while parsing shielded Output")
+			}
+			tx.shieldedOutputs[i] = newOutput
+		}
+	}
+	if spendCount+outputCount > 0 {
+		if !s.ReadInt64(&tx.valueBalance) {
+			return nil, errors.New("could not read valueBalanceSapling")
+		}
+	}
+	if spendCount > 0 {
+		var anchor []byte
+		if !s.ReadBytes(&anchor, 32) {
+			return nil, errors.New("could not read anchorSapling")
+		}
+		for _, sp := range tx.shieldedSpends {
+			sp.anchor = anchor
+		}
+		for _, sp := range tx.shieldedSpends {
+			if !s.ReadBytes(&sp.zkproof, 192) {
+				return nil, errors.New("could not read spend zkproof")
+			}
+		}
+		for _, sp := range tx.shieldedSpends {
+			if !s.ReadBytes(&sp.spendAuthSig, 64) {
+				return nil, errors.New("could not read spendAuthSig")
+			}
+		}
+	}
+	for _, out := range tx.shieldedOutputs {
+		if !s.ReadBytes(&out.zkproof, 192) {
+			return nil, errors.New("could not read output zkproof")
+		}
+	}
+	if spendCount+outputCount > 0 {
+		if !s.ReadBytes(&tx.bindingSig, 64) {
+			return nil, errors.New("could not read bindingSigSapling")
+		}
+	}
+
+	// Orchard bundle
+	var actionCount int
+	if !s.ReadCompactSize(&actionCount) {
+		return nil, errors.New("could not read nActionsOrchard")
+	}
+	if tooMany(actionCount, actionSize, s) {
+		return nil, errors.New("too many Orchard actions for the data")
+	}
+	if actionCount > 0 {
+		tx.orchardActions = make([]*action, actionCount)
+		for i := 0; i < actionCount; i++ {
+			a := &action{}
+			s, err = a.ParseFromSlice([]byte(s))
+			if err != nil {
+				return nil, errors.Wrap(err, "while parsing Orchard action")
+			}
+			tx.orchardActions[i] = a
+		}
+		if !s.ReadByte(&tx.orchardFlags) {
+			return nil, errors.New("could not read flagsOrchard")
+		}
+		if !s.ReadInt64(&tx.orchardValueBalance) {
+			return nil, errors.New("could not read valueBalanceOrchard")
+		}
+		if !s.ReadBytes(&tx.orchardAnchor, 32) {
+			return nil, errors.New("could not read anchorOrchard")
+		}
+		if !s.ReadCompactLengthPrefixed((*bytestring.String)(&tx.orchardProof)) {
+			return nil, errors.New("could not read proofsOrchard")
+		}
+		for _, a := range tx.orchardActions {
+			if !s.ReadBytes(&a.spendAuthSig, 64) {
+				return nil, errors.New("could not read action spendAuthSig")
+			}
+		}
+		if !s.ReadBytes(&tx.orchardBindingSig, 64) {
+			return nil, errors.New("could not read bindingSigOrchard")
+		}
+	}
+
+	txLen := len(data) - len(s)
+	tx.rawBytes = data[:txLen]
+
+	return []byte(s), nil
+}
+
+// MarshalBinary returns the transaction in serialized form, as
+// ParseFromSlice reads it.
+func (tx *Transaction) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	header := tx.version
+	if tx.fOverwintered {
+		header |= 1 << 31
+	}
+	binary.Write(buf, binary.LittleEndian, header)
+	if tx.version >= 3 {
+		binary.Write(buf, binary.LittleEndian, tx.nVersionGroupID)
+	}
+	if tx.version >= 5 {
+		tx.marshalV5(buf)
+		return buf.Bytes(), nil
+	}
+
+	tx.marshalTransparent(buf)
+	binary.Write(buf, binary.LittleEndian, tx.nLockTime)
+	if tx.fOverwintered {
+		binary.Write(buf, binary.LittleEndian, tx.nExpiryHeight)
+	}
+
+	if tx.version >= 4 {
+		binary.Write(buf, binary.LittleEndian, tx.valueBalance)
+		WriteCompactLengthPrefixedLen(buf, len(tx.shieldedSpends))
+		for _, sp := range tx.shieldedSpends {
+			sp.writeTo(buf)
+		}
+		WriteCompactLengthPrefixedLen(buf, len(tx.shieldedOutputs))
+		for _, out := range tx.shieldedOutputs {
+			out.writeTo(buf)
+		}
+	}
+
+	if tx.version >= 2 {
+		WriteCompactLengthPrefixedLen(buf, len(tx.joinSplits))
+		for _, js := range tx.joinSplits {
+			js.writeTo(buf)
+		}
+		if len(tx.joinSplits) > 0 {
+			buf.Write(tx.joinSplitPubKey)
+			buf.Write(tx.joinSplitSig)
+		}
+	}
+
+	if tx.version >= 4 && len(tx.shieldedSpends)+len(tx.shieldedOutputs) > 0 {
+		buf.Write(tx.bindingSig)
+	}
+	return buf.Bytes(), nil
+}
+
+func (tx *Transaction) marshalTransparent(buf *bytes.Buffer) {
+	WriteCompactLengthPrefixedLen(buf, len(tx.transparentInputs))
+	for _, in := range tx.transparentInputs {
+		in.writeTo(buf)
+	}
+	WriteCompactLengthPrefixedLen(buf, len(tx.transparentOutputs))
+	for _, out := range tx.transparentOutputs {
+		out.writeTo(buf)
+	}
+}
+
+// marshalV5 serializes the rest of a v5 transaction (ZIP 225), after the
+// header and nVersionGroupId, as parseV5 reads it.
+func (tx *Transaction) marshalV5(buf *bytes.Buffer) {
+	binary.Write(buf, binary.LittleEndian, tx.consensusBranchID)
+	binary.Write(buf, binary.LittleEndian, tx.nLockTime)
+	binary.Write(buf, binary.LittleEndian, tx.nExpiryHeight)
+	tx.marshalTransparent(buf)
+
+	// Sapling bundle
+	WriteCompactLengthPrefixedLen(buf, len(tx.shieldedSpends))
+	for _, sp := range tx.shieldedSpends {
+		sp.writeToV5(buf)
+	}
+	WriteCompactLengthPrefixedLen(buf, len(tx.shieldedOutputs))
+	for _, out := range tx.shieldedOutputs {
+		out.writeToV5(buf)
+	}
+	if len(tx.shieldedSpends)+len(tx.shieldedOutputs) > 0 {
+		binary.Write(buf, binary.LittleEndian, tx.valueBalance)
+	}
+	if len(tx.shieldedSpends) > 0 {
+		buf.Write(tx.shieldedSpends[0].anchor)
+		for _, sp := range tx.shieldedSpends {
+			buf.Write(sp.zkproof)
+		}
+		for _, sp := range tx.shieldedSpends {
+			buf.Write(sp.spendAuthSig)
+		}
+	}
+	for _, out := range tx.shieldedOutputs {
+		buf.Write(out.zkproof)
+	}
+	if len(tx.shieldedSpends)+len(tx.shieldedOutputs) > 0 {
+		buf.Write(tx.bindingSig)
+	}
+
+	// Orchard bundle
+	WriteCompactLengthPrefixedLen(buf, len(tx.orchardActions))
+	if len(tx.orchardActions) > 0 {
+		for _, a := range tx.orchardActions {
+			a.writeTo(buf)
+		}
+		buf.WriteByte(tx.orchardFlags)
+		binary.Write(buf, binary.LittleEndian, tx.orchardValueBalance)
+		buf.Write(tx.orchardAnchor)
+		writeCompactLengthPrefixed(buf, tx.orchardProof)
+		for _, a := range tx.orchardActions {
+			buf.Write(a.spendAuthSig)
+		}
+		buf.Write(tx.orchardBindingSig)
+	}
+}
+
+// tooMany reports whether count items, of at least size bytes each, can't
+// fit in what's left of s, so that a corrupt count can't make the parser
+// allocate a huge slice.
+func tooMany(count, size int, s bytestring.String) bool {
+	return count > len(s)/size
+}
+
 // NewTransaction is the constructor for a full transaction.
 func NewTransaction() *Transaction {
 	return &Transaction{
@@ -8,11 +8,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
 
 	"github.com/asherda/lightwalletd/parser/internal/bytestring"
+	"github.com/asherda/lightwalletd/walletrpc"
 )
 
 // "Human-readable" version of joinSplit struct defined in transaction.go.
@@ -224,12 +227,53 @@ func TestSproutTransactionParser(t *testing.T) {
 			t.Errorf("Test %d: jsSig mismatch %x %x", i, testJSSig, tx.joinSplitSig)
 			continue
 		}
+
+		// Compact JoinSplits, only if asked for
+		if tx.HasJoinSplits() != (len(tt.vJoinSplits) > 0) {
+			t.Errorf("Test %d: HasJoinSplits is %v", i, tx.HasJoinSplits())
+			continue
+		}
+		if len(tx.ToCompact(i).JoinSplits) != 0 {
+			t.Errorf("Test %d: compact tx has unrequested JoinSplits", i)
+			continue
+		}
+		if !subTestCompactJoinSplits(tt.vJoinSplits, tx.ToCompactWithJoinSplits(i).JoinSplits, t, i) {
+			continue
+		}
+
 		if hex.EncodeToString(tx.GetDisplayHash()) != tt.txid {
 			t.Errorf("Test %d: incorrect txid", i)
 		}
 	}
 }
 
+func subTestCompactJoinSplits(testJoinSplits []joinSplitTestVector, compactJoinSplits []*walletrpc.CompactJoinSplit, t *testing.T, caseNum int) bool {
+	if len(testJoinSplits) != len(compactJoinSplits) {
+		t.Errorf("Test %d: compact joinSplit vector lengths mismatch", caseNum)
+		return false
+	}
+	for j, tt := range testJoinSplits {
+		js := compactJoinSplits[j]
+		for k, nf := range tt.nullifiers {
+			if hex.EncodeToString(js.Nullifiers[k]) != nf {
+				t.Errorf("Test %d compact jsplit %d: nullifier %d mismatch %s %x", caseNum, j, k, nf, js.Nullifiers[k])
+				return false
+			}
+		}
+		for k, cm := range tt.commitments {
+			if hex.EncodeToString(js.Commitments[k]) != cm {
+				t.Errorf("Test %d compact jsplit %d: commitment %d mismatch %s %x", caseNum, j, k, cm, js.Commitments[k])
+				return false
+			}
+		}
+		if hex.EncodeToString(js.EphemeralKey) != tt.ephemeralKey {
+			t.Errorf("Test %d compact jsplit %d: ephemeralKey mismatch %s %x", caseNum, j, tt.ephemeralKey, js.EphemeralKey)
+			return false
+		}
+	}
+	return true
+}
+
 func subTestCommonBlockMeta(tt *txTestVector, tx *Transaction, t *testing.T, caseNum int) bool {
 	headerBytes, _ := hex.DecodeString(tt.header)
 	header := binary.LittleEndian.Uint32(headerBytes)
@@ -881,3 +925,222 @@ func subTestShieldedOutputs(testOutputs []outputTestVector, txOutputs []*output,
 
 	return success
 }
+
+type v5TestVector struct {
+	lockTime            uint32
+	expiryHeight        uint32
+	vinCount            int
+	voutCount           int
+	spendCount          int
+	outputCount         int
+	actionCount         int
+	valueBalance        int64
+	orchardFlags        byte
+	orchardValueBalance int64
+	firstNullifier      string // hex prefix of the first Sapling or Orchard nullifier
+}
+
+var v5tests = []v5TestVector{
+	{
+		lockTime:     0xf2396945,
+		expiryHeight: 0x6032ac18,
+		vinCount:     1,
+		voutCount:    2,
+	},
+	{
+		lockTime:       0x91a8b521,
+		expiryHeight:   0x21d1d1d3,
+		voutCount:      1,
+		spendCount:     2,
+		outputCount:    1,
+		valueBalance:   295306804590,
+		firstNullifier: "212701c9f3452eae",
+	},
+	{
+		lockTime:            0x5257b2d4,
+		expiryHeight:        0x54a7cefb,
+		actionCount:         2,
+		orchardFlags:        1,
+		orchardValueBalance: -1081765089303,
+		firstNullifier:      "fa2bfac12b63d4c6",
+	},
+	{
+		lockTime:            0x24e12ddc,
+		expiryHeight:        0x36524c2e,
+		vinCount:            1,
+		outputCount:         2,
+		actionCount:         1,
+		valueBalance:        -497627933426,
+		orchardFlags:        2,
+		orchardValueBalance: 430202405053,
+		firstNullifier:      "b2099d62ab37413e",
+	},
+}
+
+func TestV5TransactionParser(t *testing.T) {
+	testData, err := os.Open("../testdata/v5_raw_tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testData.Close()
+
+	rawTxData := [][]byte{}
+	scan := bufio.NewScanner(testData)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		dataLine := scan.Text()
+		// Skip the comments
+		if strings.HasPrefix(dataLine, "#") {
+			continue
+		}
+
+		txData, err := hex.DecodeString(dataLine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawTxData = append(rawTxData, txData)
+	}
+	if len(rawTxData) != len(v5tests) {
+		t.Fatal("unexpected number of test transactions", len(rawTxData))
+	}
+
+	for i, tt := range v5tests {
+		tx := NewTransaction()
+
+		rest, err := tx.ParseFromSlice(rawTxData[i])
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("Test %d: did not consume entire buffer", i)
+			continue
+		}
+
+		// If the transaction is shorter than it should be, parsing
+		// should fail gracefully
+		for j := 0; j < len(rawTxData[i]); j++ {
+			if _, err := NewTransaction().ParseFromSlice(rawTxData[i][0:j]); err == nil {
+				t.Errorf("Test %d: Parsing truncated transaction unexpectedly succeeded", i)
+				break
+			}
+		}
+
+		if tx.version != 5 || !tx.fOverwintered || tx.nVersionGroupID != 0x26A7270A {
+			t.Errorf("Test %d: unexpected header %d %v %x", i, tx.version, tx.fOverwintered, tx.nVersionGroupID)
+			continue
+		}
+		if tx.consensusBranchID != 0xc2d6d0b4 {
+			t.Errorf("Test %d: unexpected consensusBranchID %x", i, tx.consensusBranchID)
+			continue
+		}
+		if tx.nLockTime != tt.lockTime || tx.nExpiryHeight != tt.expiryHeight {
+			t.Errorf("Test %d: lockTime %x expiryHeight %x", i, tx.nLockTime, tx.nExpiryHeight)
+			continue
+		}
+		if len(tx.transparentInputs) != tt.vinCount || len(tx.transparentOutputs) != tt.voutCount {
+			t.Errorf("Test %d: %d transparent inputs, %d outputs", i, len(tx.transparentInputs), len(tx.transparentOutputs))
+			continue
+		}
+		if len(tx.shieldedSpends) != tt.spendCount || len(tx.shieldedOutputs) != tt.outputCount {
+			t.Errorf("Test %d: %d spends, %d outputs", i, len(tx.shieldedSpends), len(tx.shieldedOutputs))
+			continue
+		}
+		if len(tx.orchardActions) != tt.actionCount {
+			t.Errorf("Test %d: %d actions", i, len(tx.orchardActions))
+			continue
+		}
+		if tx.valueBalance != tt.valueBalance {
+			t.Errorf("Test %d: valueBalance mismatch %d %d", i, tt.valueBalance, tx.valueBalance)
+			continue
+		}
+		if tx.orchardFlags != tt.orchardFlags || tx.orchardValueBalance != tt.orchardValueBalance {
+			t.Errorf("Test %d: orchard flags %d valueBalance %d", i, tx.orchardFlags, tx.orchardValueBalance)
+			continue
+		}
+		if tx.HasShieldedElements() != (tt.spendCount+tt.outputCount+tt.actionCount > 0) {
+			t.Errorf("Test %d: HasShieldedElements is %v", i, tx.HasShieldedElements())
+			continue
+		}
+
+		compact := tx.ToCompact(i)
+		if len(compact.Spends) != tt.spendCount || len(compact.Outputs) != tt.outputCount || len(compact.Actions) != tt.actionCount {
+			t.Errorf("Test %d: compact tx has %d spends, %d outputs, %d actions",
+				i, len(compact.Spends), len(compact.Outputs), len(compact.Actions))
+			continue
+		}
+		var nullifier []byte
+		if len(compact.Actions) > 0 {
+			nullifier = compact.Actions[0].Nullifier
+			if len(compact.Actions[0].Ciphertext) != 52 {
+				t.Errorf("Test %d: compact action ciphertext is %d bytes", i, len(compact.Actions[0].Ciphertext))
+				continue
+			}
+		} else if len(compact.Spends) > 0 {
+			nullifier = compact.Spends[0].Nf
+		}
+		if !strings.HasPrefix(hex.EncodeToString(nullifier), tt.firstNullifier) {
+			t.Errorf("Test %d: first nullifier %x", i, nullifier)
+			continue
+		}
+
+		if !bytes.Equal(compact.Hash, Reverse(tx.GetDisplayHash())) {
+			t.Errorf("Test %d: compact tx hash %x", i, compact.Hash)
+		}
+	}
+
+	// Versions after 5 aren't supported.
+	unsupported := append([]byte{}, rawTxData[0]...)
+	unsupported[0] = 6
+	if _, err := NewTransaction().ParseFromSlice(unsupported); err == nil {
+		t.Error("v6 transaction was parsed")
+	}
+}
+
+// TestZip244Vectors checks the txids of the official ZIP 244 test vectors,
+// zcash-test-vectors' test-vectors/zcash/zip_0244.json, copied to testdata.
+// Each row is tx, txid, auth_digest, ...; the first two rows are comments.
+// The txid is the digest in internal byte order.
+func TestZip244Vectors(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/zip_0244.json")
+	if os.IsNotExist(err) {
+		t.Skip("testdata/zip_0244.json (from zcash-test-vectors) not present")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows [][]interface{}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 3 {
+		t.Fatal("no test vectors in zip_0244.json")
+	}
+	for i, row := range rows[2:] {
+		if len(row) < 2 {
+			t.Fatalf("Test %d: short row", i)
+		}
+		txHex, ok1 := row[0].(string)
+		txidHex, ok2 := row[1].(string)
+		if !ok1 || !ok2 {
+			t.Fatalf("Test %d: unexpected row format", i)
+		}
+		rawTx, err := hex.DecodeString(txHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := NewTransaction()
+		rest, err := tx.ParseFromSlice(rawTx)
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("Test %d: %d bytes left over", i, len(rest))
+			continue
+		}
+		if hex.EncodeToString(tx.GetEncodableHash()) != txidHex {
+			t.Errorf("Test %d: incorrect txid %x", i, tx.GetEncodableHash())
+		}
+	}
+}
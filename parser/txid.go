@@ -0,0 +1,146 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/dchest/blake2b"
+)
+
+// The v5 transaction ID is a tree of BLAKE2b-256 digests, each personalized
+// by the part of the transaction it covers, as specified in ZIP 244:
+// https://zips.z.cash/zip-0244
+
+// digest returns the BLAKE2b-256 hash, with the given 16-byte
+// personalization, of the concatenated parts.
+func digest(personalization string, parts ...[]byte) []byte {
+	h, err := blake2b.New(&blake2b.Config{Size: 32, Person: []byte(personalization)})
+	if err != nil {
+		// Only possible with an invalid size or personalization.
+		panic(err)
+	}
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
+
+func int64Bytes(n int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// txidDigest returns the ZIP 244 transaction ID of a v5 transaction, in
+// little-endian wire order.
+func (tx *Transaction) txidDigest() []byte {
+	header := uint32(tx.version)
+	if tx.fOverwintered {
+		header |= 1 << 31
+	}
+	headerDigest := digest("ZTxIdHeadersHash",
+		uint32Bytes(header),
+		uint32Bytes(tx.nVersionGroupID),
+		uint32Bytes(tx.consensusBranchID),
+		uint32Bytes(tx.nLockTime),
+		uint32Bytes(tx.nExpiryHeight))
+	return digest("ZcashTxHash_"+string(uint32Bytes(tx.consensusBranchID)),
+		headerDigest,
+		tx.transparentDigest(),
+		tx.saplingDigest(),
+		tx.orchardDigest())
+}
+
+func (tx *Transaction) transparentDigest() []byte {
+	if len(tx.transparentInputs) == 0 && len(tx.transparentOutputs) == 0 {
+		return digest("ZTxIdTranspaHash")
+	}
+	var prevouts, sequences, outputs bytes.Buffer
+	for _, in := range tx.transparentInputs {
+		prevouts.Write(in.PrevTxHash)
+		prevouts.Write(uint32Bytes(in.PrevTxOutIndex))
+		sequences.Write(uint32Bytes(in.SequenceNumber))
+	}
+	for _, out := range tx.transparentOutputs {
+		outputs.Write(int64Bytes(int64(out.Value)))
+		writeCompactLengthPrefixed(&outputs, out.Script)
+	}
+	return digest("ZTxIdTranspaHash",
+		digest("ZTxIdPrevoutHash", prevouts.Bytes()),
+		digest("ZTxIdSequencHash", sequences.Bytes()),
+		digest("ZTxIdOutputsHash", outputs.Bytes()))
+}
+
+func (tx *Transaction) saplingDigest() []byte {
+	if len(tx.shieldedSpends) == 0 && len(tx.shieldedOutputs) == 0 {
+		return digest("ZTxIdSaplingHash")
+	}
+
+	spendsDigest := digest("ZTxIdSSpendsHash")
+	if len(tx.shieldedSpends) > 0 {
+		var compact, noncompact bytes.Buffer
+		for _, sp := range tx.shieldedSpends {
+			compact.Write(sp.nullifier)
+			noncompact.Write(sp.cv)
+			noncompact.Write(sp.anchor)
+			noncompact.Write(sp.rk)
+		}
+		spendsDigest = digest("ZTxIdSSpendsHash",
+			digest("ZTxIdSSpendCHash", compact.Bytes()),
+			digest("ZTxIdSSpendNHash", noncompact.Bytes()))
+	}
+
+	outputsDigest := digest("ZTxIdSOutputHash")
+	if len(tx.shieldedOutputs) > 0 {
+		var compact, memos, noncompact bytes.Buffer
+		for _, out := range tx.shieldedOutputs {
+			compact.Write(out.cmu)
+			compact.Write(out.ephemeralKey)
+			compact.Write(out.encCiphertext[:52])
+			memos.Write(out.encCiphertext[52:564])
+			noncompact.Write(out.cv)
+			noncompact.Write(out.encCiphertext[564:])
+			noncompact.Write(out.outCiphertext)
+		}
+		outputsDigest = digest("ZTxIdSOutputHash",
+			digest("ZTxIdSOutC__Hash", compact.Bytes()),
+			digest("ZTxIdSOutM__Hash", memos.Bytes()),
+			digest("ZTxIdSOutN__Hash", noncompact.Bytes()))
+	}
+
+	return digest("ZTxIdSaplingHash", spendsDigest, outputsDigest, int64Bytes(tx.valueBalance))
+}
+
+func (tx *Transaction) orchardDigest() []byte {
+	if len(tx.orchardActions) == 0 {
+		return digest("ZTxIdOrchardHash")
+	}
+	var compact, memos, noncompact bytes.Buffer
+	for _, a := range tx.orchardActions {
+		compact.Write(a.nullifier)
+		compact.Write(a.cmx)
+		compact.Write(a.ephemeralKey)
+		compact.Write(a.encCiphertext[:52])
+		memos.Write(a.encCiphertext[52:564])
+		noncompact.Write(a.cv)
+		noncompact.Write(a.rk)
+		noncompact.Write(a.encCiphertext[564:])
+		noncompact.Write(a.outCiphertext)
+	}
+	return digest("ZTxIdOrchardHash",
+		digest("ZTxIdOrcActCHash", compact.Bytes()),
+		digest("ZTxIdOrcActMHash", memos.Bytes()),
+		digest("ZTxIdOrcActNHash", noncompact.Bytes()),
+		[]byte{tx.orchardFlags},
+		int64Bytes(tx.orchardValueBalance),
+		tx.orchardAnchor)
+}
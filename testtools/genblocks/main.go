@@ -6,7 +6,8 @@
 // (one per line, can be empty), and writes to stdout a list of blocks,
 // one per input file, in hex format (same as zcash-cli getblock 12345 0),
 // each on a separate line. Each fake block contains a fake coinbase
-// transaction and all of the transactions in the corresponding file.
+// transaction and all of the transactions in the corresponding file, and
+// has the merkle root of its transactions (but no valid proof of work).
 
 // The default start height is 1000, so the program expects to find
 // files blocks/1000.txt, blocks/1001.txt, ...
@@ -25,14 +26,12 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha256"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"os"
 	"path"
 	"strconv"
-	"strings"
 
 	"github.com/asherda/lightwalletd/parser"
 )
@@ -59,68 +58,34 @@ func main() {
 		}
 		scan := bufio.NewScanner(testBlocks)
 
-		fakeCoinbase := "0400008085202f890100000000000000000000000000000000000000000000000000" +
-			"00000000000000ffffffff2a03d12c0c00043855975e464b8896790758f824ceac97836" +
-			"22c17ed38f1669b8a45ce1da857dbbe7950e2ffffffff02a0ebce1d000000001976a914" +
-			"7ed15946ec14ae0cd8fa8991eb6084452eb3f77c88ac405973070000000017a914e445cf" +
-			"a944b6f2bdacefbda904a81d5fdd26d77f8700000000000000000000000000000000000000"
-
-		// This coinbase transaction was pulled from block 797905, whose
-		// little-endian encoding is 0xD12C0C00. Replace it with the block
-		// number we want.
-		fakeCoinbase = strings.Replace(fakeCoinbase, "d12c0c00",
-			fmt.Sprintf("%02x", curHeight&0xFF)+
-				fmt.Sprintf("%02x", (curHeight>>8)&0xFF)+
-				fmt.Sprintf("%02x", (curHeight>>16)&0xFF)+
-				fmt.Sprintf("%02x", (curHeight>>24)&0xFF), 1)
-
-		var numTransactions uint = 1 // coinbase
-		allTransactionsHex := ""
+		// The header fields other than the merkle root don't need to be
+		// valid for the lightwalletd/wallet stack to work; it relies on
+		// the miners to validate them.
+		builder := parser.NewBlockBuilder(curHeight, prevhash)
 		for scan.Scan() { // each line (hex-encoded transaction)
-			allTransactionsHex += scan.Text()
-			numTransactions++
+			txBytes, err := hex.DecodeString(scan.Text())
+			if err != nil {
+				panic(fmt.Sprint("block ", curHeight, ": ", err))
+			}
+			if err = builder.AddRawTransaction(txBytes); err != nil {
+				panic(fmt.Sprint("block ", curHeight, ": ", err))
+			}
 		}
 		if err = scan.Err(); err != nil {
 			panic("line too long!")
 		}
-		if numTransactions > 65535 {
-			panic(fmt.Sprint("too many transactions ", numTransactions,
-				" maximum 65535"))
-		}
-
-		hashOfTxnsAndHeight := sha256.Sum256([]byte(allTransactionsHex + "#" + string(curHeight)))
-
-		// These fields do not need to be valid for the lightwalletd/wallet stack to work.
-		// The lightwalletd/wallet stack rely on the miners to validate these.
-		// Make the block header depend on height + all transactions (in an incorrect way)
-		blockHeader := &parser.BlockHeader{
-			RawBlockHeader: &parser.RawBlockHeader{
-				Version:              4,
-				HashPrevBlock:        prevhash,
-				HashMerkleRoot:       hashOfTxnsAndHeight[:],
-				HashFinalSaplingRoot: make([]byte, 32),
-				Time:                 1,
-				NBitsBytes:           make([]byte, 4),
-				Nonce:                make([]byte, 32),
-				Solution:             make([]byte, 1344),
-			},
-		}
 
-		headerBytes, err := blockHeader.MarshalBinary()
+		block, err := builder.Build()
 		if err != nil {
-			panic(fmt.Sprint("Cannot marshal block header: ", err))
+			panic(fmt.Sprint("Cannot build block: ", err))
 		}
-		fmt.Print(hex.EncodeToString(headerBytes))
-
-		// After the header, there's a compactsize representation of the number of transactions.
-		if numTransactions < 253 {
-			fmt.Printf("%02x", numTransactions)
-		} else {
-			fmt.Printf("%02x%02x%02x", 253, numTransactions%256, numTransactions/256)
+		blockBytes, err := block.MarshalBinary()
+		if err != nil {
+			panic(fmt.Sprint("Cannot marshal block: ", err))
 		}
-		fmt.Printf("%s%s\n", fakeCoinbase, allTransactionsHex)
+		fmt.Println(hex.EncodeToString(blockBytes))
 
 		curHeight++
-		prevhash = blockHeader.GetEncodableHash()
+		prevhash = block.GetEncodableHash()
 	}
 }
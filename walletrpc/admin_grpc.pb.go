@@ -0,0 +1,297 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package walletrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// Rollback removes the blocks above the given height from the cache;
+	// the block ingestor then downloads them again.
+	Rollback(ctx context.Context, in *AdminHeight, opts ...grpc.CallOption) (*AdminCacheStats, error)
+	// Verify re-checks the checksums of the cached blocks in the given range,
+	// and returns the heights of any that are corrupt.
+	Verify(ctx context.Context, in *AdminHeightRange, opts ...grpc.CallOption) (*AdminVerifyResult, error)
+	// Compact runs a full LevelDB compaction, returning once it's done.
+	Compact(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error)
+	// PauseIngestor stops the block ingestor from adding blocks to the cache
+	// until ResumeIngestor is called.
+	PauseIngestor(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error)
+	ResumeIngestor(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error)
+	// GetCacheStats returns the cache's height range, latest hash, and size.
+	GetCacheStats(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) Rollback(ctx context.Context, in *AdminHeight, opts ...grpc.CallOption) (*AdminCacheStats, error) {
+	out := new(AdminCacheStats)
+	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.Admin/Rollback", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Verify(ctx context.Context, in *AdminHeightRange, opts ...grpc.CallOption) (*AdminVerifyResult, error) {
+	out := new(AdminVerifyResult)
+	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.Admin/Verify", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Compact(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error) {
+	out := new(AdminCacheStats)
+	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.Admin/Compact", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) PauseIngestor(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error) {
+	out := new(AdminCacheStats)
+	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.Admin/PauseIngestor", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ResumeIngestor(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error) {
+	out := new(AdminCacheStats)
+	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.Admin/ResumeIngestor", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetCacheStats(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*AdminCacheStats, error) {
+	out := new(AdminCacheStats)
+	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.Admin/GetCacheStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	// Rollback removes the blocks above the given height from the cache;
+	// the block ingestor then downloads them again.
+	Rollback(context.Context, *AdminHeight) (*AdminCacheStats, error)
+	// Verify re-checks the checksums of the cached blocks in the given range,
+	// and returns the heights of any that are corrupt.
+	Verify(context.Context, *AdminHeightRange) (*AdminVerifyResult, error)
+	// Compact runs a full LevelDB compaction, returning once it's done.
+	Compact(context.Context, *Empty) (*AdminCacheStats, error)
+	// PauseIngestor stops the block ingestor from adding blocks to the cache
+	// until ResumeIngestor is called.
+	PauseIngestor(context.Context, *Empty) (*AdminCacheStats, error)
+	ResumeIngestor(context.Context, *Empty) (*AdminCacheStats, error)
+	// GetCacheStats returns the cache's height range, latest hash, and size.
+	GetCacheStats(context.Context, *Empty) (*AdminCacheStats, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) Rollback(context.Context, *AdminHeight) (*AdminCacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rollback not implemented")
+}
+func (UnimplementedAdminServer) Verify(context.Context, *AdminHeightRange) (*AdminVerifyResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Verify not implemented")
+}
+func (UnimplementedAdminServer) Compact(context.Context, *Empty) (*AdminCacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Compact not implemented")
+}
+func (UnimplementedAdminServer) PauseIngestor(context.Context, *Empty) (*AdminCacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseIngestor not implemented")
+}
+func (UnimplementedAdminServer) ResumeIngestor(context.Context, *Empty) (*AdminCacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeIngestor not implemented")
+}
+func (UnimplementedAdminServer) GetCacheStats(context.Context, *Empty) (*AdminCacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCacheStats not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_Rollback_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AdminHeight)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Rollback(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cash.z.wallet.sdk.rpc.Admin/Rollback",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Rollback(ctx, req.(*AdminHeight))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Verify_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AdminHeightRange)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Verify(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cash.z.wallet.sdk.rpc.Admin/Verify",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Verify(ctx, req.(*AdminHeightRange))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_Compact_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Compact(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cash.z.wallet.sdk.rpc.Admin/Compact",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Compact(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_PauseIngestor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).PauseIngestor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cash.z.wallet.sdk.rpc.Admin/PauseIngestor",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).PauseIngestor(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ResumeIngestor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ResumeIngestor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cash.z.wallet.sdk.rpc.Admin/ResumeIngestor",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ResumeIngestor(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetCacheStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetCacheStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cash.z.wallet.sdk.rpc.Admin/GetCacheStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetCacheStats(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cash.z.wallet.sdk.rpc.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Rollback",
+			Handler:    _Admin_Rollback_Handler,
+		},
+		{
+			MethodName: "Verify",
+			Handler:    _Admin_Verify_Handler,
+		},
+		{
+			MethodName: "Compact",
+			Handler:    _Admin_Compact_Handler,
+		},
+		{
+			MethodName: "PauseIngestor",
+			Handler:    _Admin_PauseIngestor_Handler,
+		},
+		{
+			MethodName: "ResumeIngestor",
+			Handler:    _Admin_ResumeIngestor_Handler,
+		},
+		{
+			MethodName: "GetCacheStats",
+			Handler:    _Admin_GetCacheStats_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
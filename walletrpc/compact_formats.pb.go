@@ -138,9 +138,11 @@ type CompactTx struct {
 	// unset because the calculation requires reference to prior transactions.
 	// in a pure-Sapling context, the fee will be calculable as:
 	//    valueBalance + (sum(vPubNew) - sum(vPubOld) - sum(tOut))
-	Fee     uint32           `protobuf:"varint,3,opt,name=fee,proto3" json:"fee,omitempty"`
-	Spends  []*CompactSpend  `protobuf:"bytes,4,rep,name=spends,proto3" json:"spends,omitempty"`   // inputs
-	Outputs []*CompactOutput `protobuf:"bytes,5,rep,name=outputs,proto3" json:"outputs,omitempty"` // outputs
+	Fee        uint32                  `protobuf:"varint,3,opt,name=fee,proto3" json:"fee,omitempty"`
+	Spends     []*CompactSpend         `protobuf:"bytes,4,rep,name=spends,proto3" json:"spends,omitempty"`   // inputs
+	Outputs    []*CompactOutput        `protobuf:"bytes,5,rep,name=outputs,proto3" json:"outputs,omitempty"` // outputs
+	Actions    []*CompactOrchardAction `protobuf:"bytes,6,rep,name=actions,proto3" json:"actions,omitempty"`
+	JoinSplits []*CompactJoinSplit     `protobuf:"bytes,7,rep,name=joinSplits,proto3" json:"joinSplits,omitempty"` // only if requested, see BlockRange
 }
 
 func (x *CompactTx) Reset() {
@@ -210,6 +212,20 @@ func (x *CompactTx) GetOutputs() []*CompactOutput {
 	return nil
 }
 
+func (x *CompactTx) GetActions() []*CompactOrchardAction {
+	if x != nil {
+		return x.Actions
+	}
+	return nil
+}
+
+func (x *CompactTx) GetJoinSplits() []*CompactJoinSplit {
+	if x != nil {
+		return x.JoinSplits
+	}
+	return nil
+}
+
 // CompactSpend is a Sapling Spend Description as described in 7.3 of the Zcash
 // protocol specification.
 type CompactSpend struct {
@@ -324,6 +340,146 @@ func (x *CompactOutput) GetCiphertext() []byte {
 	return nil
 }
 
+// CompactOrchardAction is an Orchard Action Description as described in
+// section 7.5 of the Zcash protocol spec, with only the fields a wallet
+// needs to detect its notes and spends.
+type CompactOrchardAction struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Nullifier    []byte `protobuf:"bytes,1,opt,name=nullifier,proto3" json:"nullifier,omitempty"`       // [32] The nullifier of the input note
+	Cmx          []byte `protobuf:"bytes,2,opt,name=cmx,proto3" json:"cmx,omitempty"`                   // [32] The x-coordinate of the note commitment for the output note
+	EphemeralKey []byte `protobuf:"bytes,3,opt,name=ephemeralKey,proto3" json:"ephemeralKey,omitempty"` // [32] An encoding of an ephemeral Pallas public key
+	Ciphertext   []byte `protobuf:"bytes,4,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`     // [52] The first 52 bytes of the encCiphertext field
+}
+
+func (x *CompactOrchardAction) Reset() {
+	*x = CompactOrchardAction{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_compact_formats_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CompactOrchardAction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompactOrchardAction) ProtoMessage() {}
+
+func (x *CompactOrchardAction) ProtoReflect() protoreflect.Message {
+	mi := &file_compact_formats_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompactOrchardAction.ProtoReflect.Descriptor instead.
+func (*CompactOrchardAction) Descriptor() ([]byte, []int) {
+	return file_compact_formats_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *CompactOrchardAction) GetNullifier() []byte {
+	if x != nil {
+		return x.Nullifier
+	}
+	return nil
+}
+
+func (x *CompactOrchardAction) GetCmx() []byte {
+	if x != nil {
+		return x.Cmx
+	}
+	return nil
+}
+
+func (x *CompactOrchardAction) GetEphemeralKey() []byte {
+	if x != nil {
+		return x.EphemeralKey
+	}
+	return nil
+}
+
+func (x *CompactOrchardAction) GetCiphertext() []byte {
+	if x != nil {
+		return x.Ciphertext
+	}
+	return nil
+}
+
+// CompactJoinSplit is a Sprout JoinSplit Description as described in section
+// 7.2 of the Zcash protocol spec, with only the fields a wallet needs to
+// detect its notes and spends.
+type CompactJoinSplit struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Nullifiers   [][]byte `protobuf:"bytes,1,rep,name=nullifiers,proto3" json:"nullifiers,omitempty"`     // [2][32] The nullifiers of the input notes
+	Commitments  [][]byte `protobuf:"bytes,2,rep,name=commitments,proto3" json:"commitments,omitempty"`   // [2][32] The commitments of the output notes
+	EphemeralKey []byte   `protobuf:"bytes,3,opt,name=ephemeralKey,proto3" json:"ephemeralKey,omitempty"` // [32] The ephemeral Curve25519 public key
+}
+
+func (x *CompactJoinSplit) Reset() {
+	*x = CompactJoinSplit{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_compact_formats_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CompactJoinSplit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompactJoinSplit) ProtoMessage() {}
+
+func (x *CompactJoinSplit) ProtoReflect() protoreflect.Message {
+	mi := &file_compact_formats_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompactJoinSplit.ProtoReflect.Descriptor instead.
+func (*CompactJoinSplit) Descriptor() ([]byte, []int) {
+	return file_compact_formats_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CompactJoinSplit) GetNullifiers() [][]byte {
+	if x != nil {
+		return x.Nullifiers
+	}
+	return nil
+}
+
+func (x *CompactJoinSplit) GetCommitments() [][]byte {
+	if x != nil {
+		return x.Commitments
+	}
+	return nil
+}
+
+func (x *CompactJoinSplit) GetEphemeralKey() []byte {
+	if x != nil {
+		return x.EphemeralKey
+	}
+	return nil
+}
+
 var File_compact_formats_proto protoreflect.FileDescriptor
 
 var file_compact_formats_proto_rawDesc = []byte{
@@ -343,7 +499,7 @@ var file_compact_formats_proto_rawDesc = []byte{
 	0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x32, 0x0a, 0x03, 0x76, 0x74, 0x78, 0x18, 0x07,
 	0x20, 0x03, 0x28, 0x0b, 0x32, 0x20, 0x2e, 0x63, 0x61, 0x73, 0x68, 0x2e, 0x7a, 0x2e, 0x77, 0x61,
 	0x6c, 0x6c, 0x65, 0x74, 0x2e, 0x73, 0x64, 0x6b, 0x2e, 0x72, 0x70, 0x63, 0x2e, 0x43, 0x6f, 0x6d,
-	0x70, 0x61, 0x63, 0x74, 0x54, 0x78, 0x52, 0x03, 0x76, 0x74, 0x78, 0x22, 0xc4, 0x01, 0x0a, 0x09,
+	0x70, 0x61, 0x63, 0x74, 0x54, 0x78, 0x52, 0x03, 0x76, 0x74, 0x78, 0x22, 0xd4, 0x02, 0x0a, 0x09,
 	0x43, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74, 0x54, 0x78, 0x12, 0x14, 0x0a, 0x05, 0x69, 0x6e, 0x64,
 	0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x12,
 	0x12, 0x0a, 0x04, 0x68, 0x61, 0x73, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x68,
@@ -356,6 +512,15 @@ var file_compact_formats_proto_rawDesc = []byte{
 	0x03, 0x28, 0x0b, 0x32, 0x24, 0x2e, 0x63, 0x61, 0x73, 0x68, 0x2e, 0x7a, 0x2e, 0x77, 0x61, 0x6c,
 	0x6c, 0x65, 0x74, 0x2e, 0x73, 0x64, 0x6b, 0x2e, 0x72, 0x70, 0x63, 0x2e, 0x43, 0x6f, 0x6d, 0x70,
 	0x61, 0x63, 0x74, 0x4f, 0x75, 0x74, 0x70, 0x75, 0x74, 0x52, 0x07, 0x6f, 0x75, 0x74, 0x70, 0x75,
+	0x74, 0x73, 0x12, 0x45, 0x0a, 0x07, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x06, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x2b, 0x2e, 0x63, 0x61, 0x73, 0x68, 0x2e, 0x7a, 0x2e, 0x77, 0x61, 0x6c,
+	0x6c, 0x65, 0x74, 0x2e, 0x73, 0x64, 0x6b, 0x2e, 0x72, 0x70, 0x63, 0x2e, 0x43, 0x6f, 0x6d, 0x70,
+	0x61, 0x63, 0x74, 0x4f, 0x72, 0x63, 0x68, 0x61, 0x72, 0x64, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e,
+	0x52, 0x07, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x47, 0x0a, 0x0a, 0x6a, 0x6f, 0x69,
+	0x6e, 0x53, 0x70, 0x6c, 0x69, 0x74, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x27, 0x2e,
+	0x63, 0x61, 0x73, 0x68, 0x2e, 0x7a, 0x2e, 0x77, 0x61, 0x6c, 0x6c, 0x65, 0x74, 0x2e, 0x73, 0x64,
+	0x6b, 0x2e, 0x72, 0x70, 0x63, 0x2e, 0x43, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74, 0x4a, 0x6f, 0x69,
+	0x6e, 0x53, 0x70, 0x6c, 0x69, 0x74, 0x52, 0x0a, 0x6a, 0x6f, 0x69, 0x6e, 0x53, 0x70, 0x6c, 0x69,
 	0x74, 0x73, 0x22, 0x1e, 0x0a, 0x0c, 0x43, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74, 0x53, 0x70, 0x65,
 	0x6e, 0x64, 0x12, 0x0e, 0x0a, 0x02, 0x6e, 0x66, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x02,
 	0x6e, 0x66, 0x22, 0x53, 0x0a, 0x0d, 0x43, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74, 0x4f, 0x75, 0x74,
@@ -363,9 +528,25 @@ var file_compact_formats_proto_rawDesc = []byte{
 	0x52, 0x03, 0x63, 0x6d, 0x75, 0x12, 0x10, 0x0a, 0x03, 0x65, 0x70, 0x6b, 0x18, 0x02, 0x20, 0x01,
 	0x28, 0x0c, 0x52, 0x03, 0x65, 0x70, 0x6b, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x69, 0x70, 0x68, 0x65,
 	0x72, 0x74, 0x65, 0x78, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x63, 0x69, 0x70,
-	0x68, 0x65, 0x72, 0x74, 0x65, 0x78, 0x74, 0x42, 0x10, 0x5a, 0x0b, 0x2e, 0x2f, 0x77, 0x61, 0x6c,
-	0x6c, 0x65, 0x74, 0x72, 0x70, 0x63, 0xba, 0x02, 0x00, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x33,
+	0x68, 0x65, 0x72, 0x74, 0x65, 0x78, 0x74, 0x22, 0x8a, 0x01, 0x0a, 0x14, 0x43, 0x6f, 0x6d, 0x70,
+	0x61, 0x63, 0x74, 0x4f, 0x72, 0x63, 0x68, 0x61, 0x72, 0x64, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e,
+	0x12, 0x1c, 0x0a, 0x09, 0x6e, 0x75, 0x6c, 0x6c, 0x69, 0x66, 0x69, 0x65, 0x72, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x09, 0x6e, 0x75, 0x6c, 0x6c, 0x69, 0x66, 0x69, 0x65, 0x72, 0x12, 0x10,
+	0x0a, 0x03, 0x63, 0x6d, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x63, 0x6d, 0x78,
+	0x12, 0x22, 0x0a, 0x0c, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x4b, 0x65, 0x79,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61,
+	0x6c, 0x4b, 0x65, 0x79, 0x12, 0x1e, 0x0a, 0x0a, 0x63, 0x69, 0x70, 0x68, 0x65, 0x72, 0x74, 0x65,
+	0x78, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x63, 0x69, 0x70, 0x68, 0x65, 0x72,
+	0x74, 0x65, 0x78, 0x74, 0x22, 0x78, 0x0a, 0x10, 0x43, 0x6f, 0x6d, 0x70, 0x61, 0x63, 0x74, 0x4a,
+	0x6f, 0x69, 0x6e, 0x53, 0x70, 0x6c, 0x69, 0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x6e, 0x75, 0x6c, 0x6c,
+	0x69, 0x66, 0x69, 0x65, 0x72, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x0a, 0x6e, 0x75,
+	0x6c, 0x6c, 0x69, 0x66, 0x69, 0x65, 0x72, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x63, 0x6f, 0x6d, 0x6d,
+	0x69, 0x74, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x0b, 0x63,
+	0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x65, 0x70,
+	0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x4b, 0x65, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x0c, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x4b, 0x65, 0x79, 0x42, 0x10,
+	0x5a, 0x0b, 0x2e, 0x2f, 0x77, 0x61, 0x6c, 0x6c, 0x65, 0x74, 0x72, 0x70, 0x63, 0xba, 0x02, 0x00,
+	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -380,22 +561,26 @@ func file_compact_formats_proto_rawDescGZIP() []byte {
 	return file_compact_formats_proto_rawDescData
 }
 
-var file_compact_formats_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_compact_formats_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_compact_formats_proto_goTypes = []interface{}{
-	(*CompactBlock)(nil),  // 0: cash.z.wallet.sdk.rpc.CompactBlock
-	(*CompactTx)(nil),     // 1: cash.z.wallet.sdk.rpc.CompactTx
-	(*CompactSpend)(nil),  // 2: cash.z.wallet.sdk.rpc.CompactSpend
-	(*CompactOutput)(nil), // 3: cash.z.wallet.sdk.rpc.CompactOutput
+	(*CompactBlock)(nil),         // 0: cash.z.wallet.sdk.rpc.CompactBlock
+	(*CompactTx)(nil),            // 1: cash.z.wallet.sdk.rpc.CompactTx
+	(*CompactSpend)(nil),         // 2: cash.z.wallet.sdk.rpc.CompactSpend
+	(*CompactOutput)(nil),        // 3: cash.z.wallet.sdk.rpc.CompactOutput
+	(*CompactOrchardAction)(nil), // 4: cash.z.wallet.sdk.rpc.CompactOrchardAction
+	(*CompactJoinSplit)(nil),     // 5: cash.z.wallet.sdk.rpc.CompactJoinSplit
 }
 var file_compact_formats_proto_depIdxs = []int32{
 	1, // 0: cash.z.wallet.sdk.rpc.CompactBlock.vtx:type_name -> cash.z.wallet.sdk.rpc.CompactTx
 	2, // 1: cash.z.wallet.sdk.rpc.CompactTx.spends:type_name -> cash.z.wallet.sdk.rpc.CompactSpend
 	3, // 2: cash.z.wallet.sdk.rpc.CompactTx.outputs:type_name -> cash.z.wallet.sdk.rpc.CompactOutput
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	4, // 3: cash.z.wallet.sdk.rpc.CompactTx.actions:type_name -> cash.z.wallet.sdk.rpc.CompactOrchardAction
+	5, // 4: cash.z.wallet.sdk.rpc.CompactTx.joinSplits:type_name -> cash.z.wallet.sdk.rpc.CompactJoinSplit
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_compact_formats_proto_init() }
@@ -452,6 +637,30 @@ func file_compact_formats_proto_init() {
 				return nil
 			}
 		}
+		file_compact_formats_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CompactOrchardAction); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_compact_formats_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CompactJoinSplit); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -459,7 +668,7 @@ func file_compact_formats_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_compact_formats_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
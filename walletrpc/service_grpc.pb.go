@@ -24,6 +24,12 @@ type CompactTxStreamerClient interface {
 	GetBlock(ctx context.Context, in *BlockID, opts ...grpc.CallOption) (*CompactBlock, error)
 	// Return a list of consecutive compact blocks
 	GetBlockRange(ctx context.Context, in *BlockRange, opts ...grpc.CallOption) (CompactTxStreamer_GetBlockRangeClient, error)
+	// Return the blocks in the given range with their full (serialized)
+	// headers in the header field, and without transactions
+	GetBlockHeaders(ctx context.Context, in *BlockRange, opts ...grpc.CallOption) (CompactTxStreamer_GetBlockHeadersClient, error)
+	// Return the headers of the blocks in the given range, for clients that
+	// only need to verify the chain's continuity and proof of work
+	GetHeaderRange(ctx context.Context, in *BlockRange, opts ...grpc.CallOption) (CompactTxStreamer_GetHeaderRangeClient, error)
 	// Return the requested full (not compact) transaction (as from zcashd)
 	GetTransaction(ctx context.Context, in *TxFilter, opts ...grpc.CallOption) (*RawTransaction, error)
 	// Submit the given transaction to the Zcash network
@@ -113,6 +119,70 @@ func (x *compactTxStreamerGetBlockRangeClient) Recv() (*CompactBlock, error) {
 	return m, nil
 }
 
+func (c *compactTxStreamerClient) GetBlockHeaders(ctx context.Context, in *BlockRange, opts ...grpc.CallOption) (CompactTxStreamer_GetBlockHeadersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[1], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetBlockHeaders", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &compactTxStreamerGetBlockHeadersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CompactTxStreamer_GetBlockHeadersClient interface {
+	Recv() (*CompactBlock, error)
+	grpc.ClientStream
+}
+
+type compactTxStreamerGetBlockHeadersClient struct {
+	grpc.ClientStream
+}
+
+func (x *compactTxStreamerGetBlockHeadersClient) Recv() (*CompactBlock, error) {
+	m := new(CompactBlock)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *compactTxStreamerClient) GetHeaderRange(ctx context.Context, in *BlockRange, opts ...grpc.CallOption) (CompactTxStreamer_GetHeaderRangeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[2], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetHeaderRange", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &compactTxStreamerGetHeaderRangeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CompactTxStreamer_GetHeaderRangeClient interface {
+	Recv() (*BlockHeader, error)
+	grpc.ClientStream
+}
+
+type compactTxStreamerGetHeaderRangeClient struct {
+	grpc.ClientStream
+}
+
+func (x *compactTxStreamerGetHeaderRangeClient) Recv() (*BlockHeader, error) {
+	m := new(BlockHeader)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *compactTxStreamerClient) GetTransaction(ctx context.Context, in *TxFilter, opts ...grpc.CallOption) (*RawTransaction, error) {
 	out := new(RawTransaction)
 	err := c.cc.Invoke(ctx, "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetTransaction", in, out, opts...)
@@ -132,7 +202,7 @@ func (c *compactTxStreamerClient) SendTransaction(ctx context.Context, in *RawTr
 }
 
 func (c *compactTxStreamerClient) GetTaddressTxids(ctx context.Context, in *TransparentAddressBlockFilter, opts ...grpc.CallOption) (CompactTxStreamer_GetTaddressTxidsClient, error) {
-	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[1], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetTaddressTxids", opts...)
+	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[3], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetTaddressTxids", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -173,7 +243,7 @@ func (c *compactTxStreamerClient) GetTaddressBalance(ctx context.Context, in *Ad
 }
 
 func (c *compactTxStreamerClient) GetTaddressBalanceStream(ctx context.Context, opts ...grpc.CallOption) (CompactTxStreamer_GetTaddressBalanceStreamClient, error) {
-	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[2], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetTaddressBalanceStream", opts...)
+	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[4], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetTaddressBalanceStream", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -207,7 +277,7 @@ func (x *compactTxStreamerGetTaddressBalanceStreamClient) CloseAndRecv() (*Balan
 }
 
 func (c *compactTxStreamerClient) GetMempoolTx(ctx context.Context, in *Exclude, opts ...grpc.CallOption) (CompactTxStreamer_GetMempoolTxClient, error) {
-	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[3], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetMempoolTx", opts...)
+	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[5], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetMempoolTx", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -257,7 +327,7 @@ func (c *compactTxStreamerClient) GetAddressUtxos(ctx context.Context, in *GetAd
 }
 
 func (c *compactTxStreamerClient) GetAddressUtxosStream(ctx context.Context, in *GetAddressUtxosArg, opts ...grpc.CallOption) (CompactTxStreamer_GetAddressUtxosStreamClient, error) {
-	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[4], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetAddressUtxosStream", opts...)
+	stream, err := c.cc.NewStream(ctx, &CompactTxStreamer_ServiceDesc.Streams[6], "/cash.z.wallet.sdk.rpc.CompactTxStreamer/GetAddressUtxosStream", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -316,6 +386,12 @@ type CompactTxStreamerServer interface {
 	GetBlock(context.Context, *BlockID) (*CompactBlock, error)
 	// Return a list of consecutive compact blocks
 	GetBlockRange(*BlockRange, CompactTxStreamer_GetBlockRangeServer) error
+	// Return the blocks in the given range with their full (serialized)
+	// headers in the header field, and without transactions
+	GetBlockHeaders(*BlockRange, CompactTxStreamer_GetBlockHeadersServer) error
+	// Return the headers of the blocks in the given range, for clients that
+	// only need to verify the chain's continuity and proof of work
+	GetHeaderRange(*BlockRange, CompactTxStreamer_GetHeaderRangeServer) error
 	// Return the requested full (not compact) transaction (as from zcashd)
 	GetTransaction(context.Context, *TxFilter) (*RawTransaction, error)
 	// Submit the given transaction to the Zcash network
@@ -361,6 +437,12 @@ func (UnimplementedCompactTxStreamerServer) GetBlock(context.Context, *BlockID)
 func (UnimplementedCompactTxStreamerServer) GetBlockRange(*BlockRange, CompactTxStreamer_GetBlockRangeServer) error {
 	return status.Errorf(codes.Unimplemented, "method GetBlockRange not implemented")
 }
+func (UnimplementedCompactTxStreamerServer) GetBlockHeaders(*BlockRange, CompactTxStreamer_GetBlockHeadersServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetBlockHeaders not implemented")
+}
+func (UnimplementedCompactTxStreamerServer) GetHeaderRange(*BlockRange, CompactTxStreamer_GetHeaderRangeServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetHeaderRange not implemented")
+}
 func (UnimplementedCompactTxStreamerServer) GetTransaction(context.Context, *TxFilter) (*RawTransaction, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetTransaction not implemented")
 }
@@ -464,6 +546,48 @@ func (x *compactTxStreamerGetBlockRangeServer) Send(m *CompactBlock) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _CompactTxStreamer_GetBlockHeaders_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BlockRange)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CompactTxStreamerServer).GetBlockHeaders(m, &compactTxStreamerGetBlockHeadersServer{stream})
+}
+
+type CompactTxStreamer_GetBlockHeadersServer interface {
+	Send(*CompactBlock) error
+	grpc.ServerStream
+}
+
+type compactTxStreamerGetBlockHeadersServer struct {
+	grpc.ServerStream
+}
+
+func (x *compactTxStreamerGetBlockHeadersServer) Send(m *CompactBlock) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _CompactTxStreamer_GetHeaderRange_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BlockRange)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CompactTxStreamerServer).GetHeaderRange(m, &compactTxStreamerGetHeaderRangeServer{stream})
+}
+
+type CompactTxStreamer_GetHeaderRangeServer interface {
+	Send(*BlockHeader) error
+	grpc.ServerStream
+}
+
+type compactTxStreamerGetHeaderRangeServer struct {
+	grpc.ServerStream
+}
+
+func (x *compactTxStreamerGetHeaderRangeServer) Send(m *BlockHeader) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _CompactTxStreamer_GetTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(TxFilter)
 	if err := dec(in); err != nil {
@@ -729,6 +853,16 @@ var CompactTxStreamer_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _CompactTxStreamer_GetBlockRange_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "GetBlockHeaders",
+			Handler:       _CompactTxStreamer_GetBlockHeaders_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "GetHeaderRange",
+			Handler:       _CompactTxStreamer_GetHeaderRange_Handler,
+			ServerStreams: true,
+		},
 		{
 			StreamName:    "GetTaddressTxids",
 			Handler:       _CompactTxStreamer_GetTaddressTxids_Handler,